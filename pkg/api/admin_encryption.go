@@ -48,3 +48,11 @@ func (hs *HTTPServer) AdminRollbackSecrets(c *models.ReqContext) response.Respon
 
 	return response.Respond(http.StatusOK, "Secrets rolled back successfully")
 }
+
+func (hs *HTTPServer) AdminEncryptionHealthCheck(c *models.ReqContext) response.Response {
+	if err := hs.EncryptionService.HealthCheck(c.Req.Context()); err != nil {
+		return response.Error(http.StatusServiceUnavailable, "Encryption health check failed", err)
+	}
+
+	return response.Success("Encryption is healthy")
+}
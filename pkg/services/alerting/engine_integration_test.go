@@ -26,9 +26,9 @@ func TestIntegrationEngineTimeouts(t *testing.T) {
 
 	usMock := &usagestats.UsageStatsMock{T: t}
 
-	encProvider := encryptionprovider.ProvideEncryptionProvider()
 	cfg := setting.NewCfg()
 	settings := &setting.OSSImpl{Cfg: cfg}
+	encProvider := encryptionprovider.ProvideEncryptionProvider(settings)
 
 	encService, err := encryptionservice.ProvideEncryptionService(encProvider, usMock, settings)
 	require.NoError(t, err)
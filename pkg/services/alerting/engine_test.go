@@ -116,9 +116,9 @@ func (a *AlertStoreMock) PauseAllAlerts(context.Context, *models.PauseAllAlertCo
 func TestEngineProcessJob(t *testing.T) {
 	usMock := &usagestats.UsageStatsMock{T: t}
 
-	encProvider := encryptionprovider.ProvideEncryptionProvider()
 	cfg := setting.NewCfg()
 	settings := &setting.OSSImpl{Cfg: cfg}
+	encProvider := encryptionprovider.ProvideEncryptionProvider(settings)
 
 	encService, err := encryptionservice.ProvideEncryptionService(encProvider, usMock, settings)
 	require.NoError(t, err)
@@ -31,8 +31,8 @@ func TestService(t *testing.T) {
 
 	usMock := &usagestats.UsageStatsMock{T: t}
 
-	encProvider := encryptionprovider.ProvideEncryptionProvider()
 	settings := &setting.OSSImpl{Cfg: setting.NewCfg()}
+	encProvider := encryptionprovider.ProvideEncryptionProvider(settings)
 
 	encService, err := encryptionservice.ProvideEncryptionService(encProvider, usMock, settings)
 	require.NoError(t, err)
@@ -0,0 +1,242 @@
+package encryption
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+)
+
+const (
+	defaultBreakerFailureThreshold = 5
+	defaultBreakerCooldown         = 30 * time.Second
+)
+
+// BreakerState is the state of a CircuitBreakerCipher.
+type BreakerState int
+
+const (
+	// BreakerClosed lets all the operations through.
+	BreakerClosed BreakerState = iota
+
+	// BreakerOpen fails all the operations fast, with ErrCircuitOpen.
+	BreakerOpen
+
+	// BreakerHalfOpen lets a single operation through, as a probe,
+	// while failing the others fast, until the probe completes.
+	BreakerHalfOpen
+)
+
+func (s BreakerState) String() string {
+	switch s {
+	case BreakerClosed:
+		return "closed"
+	case BreakerOpen:
+		return "open"
+	case BreakerHalfOpen:
+		return "half-open"
+	default:
+		return "unknown"
+	}
+}
+
+// BreakerOptions configures a CircuitBreakerCipher.
+// Zero values are replaced by sensible defaults.
+type BreakerOptions struct {
+	// FailureThreshold is the number of consecutive failures
+	// after which the breaker opens. Defaults to 5.
+	FailureThreshold int
+
+	// Cooldown is how long the breaker stays open before
+	// letting a probe through. Defaults to 30s.
+	Cooldown time.Duration
+
+	// OnStateChange, when set, is called on every state change, e.g. to
+	// record it in a metric. It's called with the breaker's lock held,
+	// so it must be fast and must not call back into the breaker.
+	OnStateChange func(from, to BreakerState)
+}
+
+// CircuitBreakerCipher decorates a Cipher and a Decipher, typically backed by
+// an external key management service, so an outage of the service fails the
+// operations right away, instead of having each one of them wait for the
+// network timeout. After FailureThreshold consecutive failures, the breaker
+// opens and fails all the operations with ErrCircuitOpen for the Cooldown,
+// then lets a single operation through: the breaker closes again if it
+// succeeds, or reopens for another cooldown if it fails.
+//
+// Only failures that say the service is unhealthy trip the breaker, i.e. the
+// errors classified as retryable as for RetryingCipher (see IsRetryable), and
+// the expired context deadlines, which are what a stalled service results in.
+// Any other error, e.g. a malformed payload or an unknown key, is local and
+// deterministic, so it says nothing about the health of the service, and
+// neither do the operations cancelled by the callers. ErrAuthenticationFailed
+// means the service did answer, so it counts as a success.
+//
+// When combined with a RetryingCipher, the breaker should wrap it, so only
+// the operations that failed all their attempts count as failures.
+type CircuitBreakerCipher struct {
+	cipher   Cipher
+	decipher Decipher
+	opts     BreakerOptions
+
+	// now is time.Now, unless replaced by tests.
+	now func() time.Time
+
+	mtx      sync.Mutex
+	state    BreakerState
+	failures int
+	openedAt time.Time
+}
+
+// NewCircuitBreakerCipher returns a CircuitBreakerCipher wrapping the given
+// cipher and decipher, which share the same breaker state. Either of them can
+// be nil, as long as the corresponding operation isn't used.
+func NewCircuitBreakerCipher(cipher Cipher, decipher Decipher, opts BreakerOptions) *CircuitBreakerCipher {
+	if opts.FailureThreshold <= 0 {
+		opts.FailureThreshold = defaultBreakerFailureThreshold
+	}
+	if opts.Cooldown <= 0 {
+		opts.Cooldown = defaultBreakerCooldown
+	}
+
+	return &CircuitBreakerCipher{cipher: cipher, decipher: decipher, opts: opts, now: time.Now}
+}
+
+func (b *CircuitBreakerCipher) Encrypt(ctx context.Context, payload []byte, secret string) ([]byte, error) {
+	if b.cipher == nil {
+		return nil, errors.New("circuit breaker cipher has no cipher to encrypt with")
+	}
+
+	return b.do(ctx, func() ([]byte, error) {
+		return b.cipher.Encrypt(ctx, payload, secret)
+	})
+}
+
+func (b *CircuitBreakerCipher) Decrypt(ctx context.Context, payload []byte, secret string) ([]byte, error) {
+	if b.decipher == nil {
+		return nil, errors.New("circuit breaker cipher has no decipher to decrypt with")
+	}
+
+	return b.do(ctx, func() ([]byte, error) {
+		return b.decipher.Decrypt(ctx, payload, secret)
+	})
+}
+
+// State returns the current state of the breaker. An open breaker
+// whose cooldown is over is reported as half-open, as the next
+// operation is going to be let through.
+func (b *CircuitBreakerCipher) State() BreakerState {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+
+	if b.state == BreakerOpen && b.cooledDown() {
+		return BreakerHalfOpen
+	}
+
+	return b.state
+}
+
+// IsRemote returns whether the wrapped cipher or decipher is remote.
+func (b *CircuitBreakerCipher) IsRemote() bool {
+	return IsRemote(b.cipher) || IsRemote(b.decipher)
+}
+
+// Warmup warms up the wrapped cipher and decipher, when they're Warmable.
+func (b *CircuitBreakerCipher) Warmup(ctx context.Context) error {
+	if err := warmup(ctx, b.cipher); err != nil {
+		return err
+	}
+	return warmup(ctx, b.decipher)
+}
+
+func (b *CircuitBreakerCipher) do(ctx context.Context, fn func() ([]byte, error)) ([]byte, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	if !b.allow() {
+		return nil, ErrCircuitOpen
+	}
+
+	out, err := fn()
+	b.record(ctx, err)
+	return out, err
+}
+
+// allow returns whether an operation can be let through,
+// turning an open breaker whose cooldown is over into half-open.
+func (b *CircuitBreakerCipher) allow() bool {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+
+	switch b.state {
+	case BreakerClosed:
+		return true
+	case BreakerOpen:
+		if !b.cooledDown() {
+			return false
+		}
+		b.setState(BreakerHalfOpen)
+		return true
+	default:
+		// The probe is still in progress.
+		return false
+	}
+}
+
+// record updates the breaker with the outcome of an operation.
+func (b *CircuitBreakerCipher) record(ctx context.Context, err error) {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+
+	// The service did answer when the authentication failed.
+	if err == nil || errors.Is(err, ErrAuthenticationFailed) {
+		b.failures = 0
+		b.setState(BreakerClosed)
+		return
+	}
+
+	// Cancelled operations and local errors say nothing either way, so
+	// such a probe lets the next operation probe again.
+	if !isBreakerFailure(ctx, err) {
+		if b.state == BreakerHalfOpen {
+			b.setState(BreakerOpen)
+		}
+		return
+	}
+
+	b.failures++
+	if b.state == BreakerHalfOpen || b.failures >= b.opts.FailureThreshold {
+		b.openedAt = b.now()
+		b.setState(BreakerOpen)
+	}
+}
+
+// isBreakerFailure returns whether the given error of an operation run with
+// the given context tells the service is unhealthy, see CircuitBreakerCipher.
+func isBreakerFailure(ctx context.Context, err error) bool {
+	if errors.Is(err, context.Canceled) && errors.Is(ctx.Err(), context.Canceled) {
+		return false
+	}
+
+	return IsRetryable(err) || errors.Is(err, context.DeadlineExceeded)
+}
+
+func (b *CircuitBreakerCipher) cooledDown() bool {
+	return b.now().Sub(b.openedAt) >= b.opts.Cooldown
+}
+
+// setState changes the state of the breaker, which
+// must be called with the lock held.
+func (b *CircuitBreakerCipher) setState(state BreakerState) {
+	if state == b.state {
+		return
+	}
+
+	from := b.state
+	b.state = state
+	if b.opts.OnStateChange != nil {
+		b.opts.OnStateChange(from, state)
+	}
+}
@@ -0,0 +1,243 @@
+package encryption
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_CircuitBreakerCipher(t *testing.T) {
+	ctx := context.Background()
+	outage := &RetryableError{Err: errors.New("connection refused")}
+
+	// newBreaker returns a breaker on a fake clock,
+	// along with a function to move that clock forward.
+	newBreaker := func(c *flakyCipher, opts BreakerOptions) (*CircuitBreakerCipher, func(time.Duration)) {
+		now := time.Unix(0, 0)
+		b := NewCircuitBreakerCipher(c, c, opts)
+		b.now = func() time.Time { return now }
+		return b, func(d time.Duration) { now = now.Add(d) }
+	}
+
+	t.Run("consecutive failures should trip the breaker", func(t *testing.T) {
+		flaky := &flakyCipher{failures: 100, err: outage}
+		b, _ := newBreaker(flaky, BreakerOptions{FailureThreshold: 3, Cooldown: time.Minute})
+
+		for i := 0; i < 3; i++ {
+			assert.Equal(t, BreakerClosed, b.State())
+			_, err := b.Decrypt(ctx, []byte("grafana"), "1234")
+			require.ErrorIs(t, err, outage)
+		}
+		assert.Equal(t, BreakerOpen, b.State())
+
+		_, err := b.Decrypt(ctx, []byte("grafana"), "1234")
+		require.ErrorIs(t, err, ErrCircuitOpen)
+		_, err = b.Encrypt(ctx, []byte("grafana"), "1234")
+		require.ErrorIs(t, err, ErrCircuitOpen)
+		assert.EqualValues(t, 3, flaky.calls)
+	})
+
+	t.Run("successful probe should reset the breaker", func(t *testing.T) {
+		flaky := &flakyCipher{failures: 2, err: outage}
+		b, wait := newBreaker(flaky, BreakerOptions{FailureThreshold: 2, Cooldown: time.Minute})
+
+		for i := 0; i < 2; i++ {
+			_, _ = b.Encrypt(ctx, []byte("grafana"), "1234")
+		}
+		require.Equal(t, BreakerOpen, b.State())
+
+		wait(time.Minute)
+		assert.Equal(t, BreakerHalfOpen, b.State())
+
+		encrypted, err := b.Encrypt(ctx, []byte("grafana"), "1234")
+		require.NoError(t, err)
+		assert.Equal(t, []byte("grafana"), encrypted)
+		assert.Equal(t, BreakerClosed, b.State())
+	})
+
+	t.Run("failed probe should reopen the breaker", func(t *testing.T) {
+		flaky := &flakyCipher{failures: 3, err: outage}
+		b, wait := newBreaker(flaky, BreakerOptions{FailureThreshold: 2, Cooldown: time.Minute})
+
+		for i := 0; i < 2; i++ {
+			_, _ = b.Decrypt(ctx, []byte("grafana"), "1234")
+		}
+
+		wait(time.Minute)
+		_, err := b.Decrypt(ctx, []byte("grafana"), "1234")
+		require.ErrorIs(t, err, outage)
+		assert.Equal(t, BreakerOpen, b.State())
+
+		wait(time.Minute - time.Second)
+		_, err = b.Decrypt(ctx, []byte("grafana"), "1234")
+		require.ErrorIs(t, err, ErrCircuitOpen)
+
+		wait(time.Second)
+		_, err = b.Decrypt(ctx, []byte("grafana"), "1234")
+		require.NoError(t, err)
+		assert.Equal(t, BreakerClosed, b.State())
+	})
+
+	t.Run("only one probe should be let through at a time", func(t *testing.T) {
+		blocking := &blockingCipher{started: make(chan struct{}), release: make(chan struct{})}
+		now := time.Unix(0, 0)
+		b := NewCircuitBreakerCipher(blocking, blocking, BreakerOptions{FailureThreshold: 1, Cooldown: time.Minute})
+		b.now = func() time.Time { return now }
+
+		b.mtx.Lock()
+		b.state, b.openedAt = BreakerOpen, now.Add(-time.Minute)
+		b.mtx.Unlock()
+
+		done := make(chan error)
+		go func() {
+			_, err := b.Decrypt(ctx, []byte("grafana"), "1234")
+			done <- err
+		}()
+		<-blocking.started
+
+		_, err := b.Decrypt(ctx, []byte("grafana"), "1234")
+		require.ErrorIs(t, err, ErrCircuitOpen)
+
+		close(blocking.release)
+		require.NoError(t, <-done)
+		assert.Equal(t, BreakerClosed, b.State())
+	})
+
+	t.Run("successes should reset the consecutive failures", func(t *testing.T) {
+		flaky := &flakyCipher{failures: 2, err: outage}
+		b, _ := newBreaker(flaky, BreakerOptions{FailureThreshold: 3})
+
+		for i := 0; i < 2; i++ {
+			_, _ = b.Decrypt(ctx, []byte("grafana"), "1234")
+		}
+		_, err := b.Decrypt(ctx, []byte("grafana"), "1234")
+		require.NoError(t, err)
+
+		flaky.calls, flaky.failures = 0, 2
+		for i := 0; i < 2; i++ {
+			_, _ = b.Decrypt(ctx, []byte("grafana"), "1234")
+		}
+		assert.Equal(t, BreakerClosed, b.State())
+	})
+
+	t.Run("authentication failures should not trip the breaker", func(t *testing.T) {
+		flaky := &flakyCipher{failures: 100, err: ErrAuthenticationFailed}
+		b, _ := newBreaker(flaky, BreakerOptions{FailureThreshold: 1})
+
+		for i := 0; i < 3; i++ {
+			_, err := b.Decrypt(ctx, []byte("grafana"), "1234")
+			require.ErrorIs(t, err, ErrAuthenticationFailed)
+		}
+		assert.Equal(t, BreakerClosed, b.State())
+	})
+
+	t.Run("local errors should not trip the breaker", func(t *testing.T) {
+		for _, err := range []error{
+			errors.New("malformed envelope"),
+			fmt.Errorf("invalid wrapped key length: %d", 12),
+			fmt.Errorf("unknown key version 'v2': %w", ErrUnknownAlgorithm),
+		} {
+			flaky := &flakyCipher{failures: 100, err: err}
+			b, _ := newBreaker(flaky, BreakerOptions{FailureThreshold: 1})
+
+			for i := 0; i < 3; i++ {
+				_, decryptErr := b.Decrypt(ctx, []byte("grafana"), "1234")
+				require.ErrorIs(t, decryptErr, err)
+			}
+			assert.Equal(t, BreakerClosed, b.State(), err.Error())
+			assert.EqualValues(t, 3, flaky.calls)
+		}
+	})
+
+	t.Run("local errors should not close nor reopen the breaker", func(t *testing.T) {
+		flaky := &flakyCipher{failures: 2, err: outage}
+		b, wait := newBreaker(flaky, BreakerOptions{FailureThreshold: 1, Cooldown: time.Minute})
+
+		_, _ = b.Decrypt(ctx, []byte("grafana"), "1234")
+		require.Equal(t, BreakerOpen, b.State())
+
+		// The probe fails locally, so the next operation probes again.
+		wait(time.Minute)
+		flaky.err = errors.New("malformed envelope")
+		_, err := b.Decrypt(ctx, []byte("grafana"), "1234")
+		require.ErrorIs(t, err, flaky.err)
+		assert.Equal(t, BreakerHalfOpen, b.State())
+
+		_, err = b.Decrypt(ctx, []byte("grafana"), "1234")
+		require.NoError(t, err)
+		assert.Equal(t, BreakerClosed, b.State())
+	})
+
+	t.Run("expired deadlines should trip the breaker", func(t *testing.T) {
+		flaky := &flakyCipher{failures: 100, err: context.DeadlineExceeded}
+		b, _ := newBreaker(flaky, BreakerOptions{FailureThreshold: 2})
+
+		for i := 0; i < 2; i++ {
+			_, err := b.Decrypt(ctx, []byte("grafana"), "1234")
+			require.ErrorIs(t, err, context.DeadlineExceeded)
+		}
+		assert.Equal(t, BreakerOpen, b.State())
+	})
+
+	t.Run("cancelled operations should not trip the breaker", func(t *testing.T) {
+		cancelledCtx, cancel := context.WithCancel(ctx)
+		cancel()
+
+		flaky := &flakyCipher{failures: 100, err: context.Canceled}
+		b, _ := newBreaker(flaky, BreakerOptions{FailureThreshold: 1})
+
+		_, err := b.Decrypt(cancelledCtx, []byte("grafana"), "1234")
+		require.ErrorIs(t, err, context.Canceled)
+		assert.Equal(t, BreakerClosed, b.State())
+	})
+
+	t.Run("state changes should be reported", func(t *testing.T) {
+		var changes []string
+		flaky := &flakyCipher{failures: 1, err: outage}
+		b, wait := newBreaker(flaky, BreakerOptions{
+			FailureThreshold: 1,
+			Cooldown:         time.Minute,
+			OnStateChange: func(from, to BreakerState) {
+				changes = append(changes, from.String()+" -> "+to.String())
+			},
+		})
+
+		_, _ = b.Decrypt(ctx, []byte("grafana"), "1234")
+		wait(time.Minute)
+		_, _ = b.Decrypt(ctx, []byte("grafana"), "1234")
+
+		assert.Equal(t, []string{"closed -> open", "open -> half-open", "half-open -> closed"}, changes)
+	})
+
+	t.Run("missing cipher or decipher should fail", func(t *testing.T) {
+		b := NewCircuitBreakerCipher(nil, nil, BreakerOptions{})
+
+		_, err := b.Encrypt(ctx, []byte("grafana"), "1234")
+		require.Error(t, err)
+
+		_, err = b.Decrypt(ctx, []byte("grafana"), "1234")
+		require.Error(t, err)
+	})
+}
+
+// blockingCipher signals when an operation starts, and
+// blocks it until released.
+type blockingCipher struct {
+	started chan struct{}
+	release chan struct{}
+}
+
+func (c *blockingCipher) Encrypt(_ context.Context, payload []byte, _ string) ([]byte, error) {
+	close(c.started)
+	<-c.release
+	return payload, nil
+}
+
+func (c *blockingCipher) Decrypt(ctx context.Context, payload []byte, secret string) ([]byte, error) {
+	return c.Encrypt(ctx, payload, secret)
+}
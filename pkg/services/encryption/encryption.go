@@ -3,22 +3,157 @@ package encryption
 import (
 	"context"
 	"crypto/sha256"
+	"errors"
+	"io"
 
 	"golang.org/x/crypto/pbkdf2"
+
+	"github.com/grafana/grafana/pkg/setting"
 )
 
 const (
+	// SaltLength is the length of the random salt that ciphers generate on
+	// every encryption, use to derive the key from the secret, and store at
+	// the beginning of the ciphertext, so two payloads encrypted with the
+	// same secret are never encrypted with the same key.
 	SaltLength = 8
 
 	AesCfb = "aes-cfb"
 	AesGcm = "aes-gcm"
+
+	AesCbcHmac = "aes-cbc-hmac"
+
+	ChaCha20Poly1305 = "chacha20poly1305"
+
+	// XChaCha20Poly1305 is ChaCha20Poly1305 with 192-bit nonces instead of
+	// 96-bit ones, so random nonces can be used for virtually unlimited
+	// encryptions with the same key. It's the algorithm of choice for
+	// very high write volumes.
+	XChaCha20Poly1305 = "xchacha20poly1305"
+
+	// AesSiv is deterministic: the same payload encrypted with the same
+	// secret always results in the same ciphertext, so encrypted values can
+	// be compared (e.g. looked up in the database) without decrypting them.
+	// This comes at the cost of leaking whether two payloads are equal, so
+	// it must only be used when that's actually needed.
+	AesSiv = "aes-siv"
+
+	AwsKms = "aws-kms"
+
+	GcpKms = "gcp-kms"
+
+	AzureKeyVault = "azure-keyvault"
+
+	VaultTransit = "vault-transit"
+
+	// EnvelopeLocal encrypts each payload with AES-GCM and a random data key,
+	// stored within the payload wrapped by a master key derived from the
+	// secret, so moving payloads to a new secret only requires rewrapping
+	// their data key (see Rewrapper), not re-encrypting them.
+	EnvelopeLocal = "envelope-local"
+)
+
+// authenticatedAlgorithms are the built-in algorithms that provide integrity
+// on top of confidentiality. The ones backed by key management services are
+// authenticated too, as their envelopes are sealed with AES-GCM.
+var authenticatedAlgorithms = map[string]bool{
+	AesGcm:            true,
+	AesCbcHmac:        true,
+	ChaCha20Poly1305:  true,
+	XChaCha20Poly1305: true,
+	AesSiv:            true,
+	AwsKms:            true,
+	GcpKms:            true,
+	AzureKeyVault:     true,
+	VaultTransit:      true,
+	EnvelopeLocal:     true,
+}
+
+// IsAuthenticated returns whether the given algorithm provides authenticated
+// encryption, i.e. whether its deciphers detect tampered payloads instead of
+// decrypting them into garbage. Most of them detect wrong secrets as well,
+// see IsSecretBound. Only the built-in algorithms are known, the others (e.g.
+// registered by plugins) are reported as unauthenticated.
+func IsAuthenticated(algorithm string) bool {
+	return authenticatedAlgorithms[algorithm]
+}
+
+// secretIndependentAlgorithms are the authenticated algorithms whose payloads
+// don't depend on the secret at all, as they're encrypted by a key management
+// service with keys it holds, so their deciphers accept any secret.
+var secretIndependentAlgorithms = map[string]bool{
+	VaultTransit: true,
+}
+
+// IsSecretBound returns whether the given algorithm binds its payloads to the
+// secret they're encrypted with, i.e. whether its deciphers fail with another
+// secret, so that a successful decryption tells the secret is the right one.
+// That's the case of the authenticated algorithms (see IsAuthenticated), but
+// VaultTransit, which doesn't use the secret.
+func IsSecretBound(algorithm string) bool {
+	return authenticatedAlgorithms[algorithm] && !secretIndependentAlgorithms[algorithm]
+}
+
+var (
+	// ErrAuthenticationFailed is returned by deciphers of authenticated
+	// algorithms (e.g. AesGcm) when the payload cannot be verified, either
+	// because it has been tampered with or because the secret is wrong.
+	ErrAuthenticationFailed = errors.New("message authentication failed")
+
+	// ErrUnknownAlgorithm is returned when there is no cipher (or decipher)
+	// registered for the requested encryption algorithm.
+	ErrUnknownAlgorithm = errors.New("unknown encryption algorithm")
+
+	// ErrAADNotSupported is returned when associated data is given for an
+	// algorithm that cannot authenticate it (e.g. AesCfb).
+	ErrAADNotSupported = errors.New("encryption algorithm doesn't support associated data")
+
+	// ErrEmptySecret is returned when encrypting or decrypting with an empty
+	// secret, which usually means the secret has never been configured.
+	ErrEmptySecret = errors.New("encryption secret cannot be empty")
+
+	// ErrPayloadTooLarge is returned when encrypting a
+	// payload larger than the configured maximum size.
+	ErrPayloadTooLarge = errors.New("payload exceeds the maximum size allowed for encryption")
+
+	// ErrCircuitOpen is returned by a CircuitBreakerCipher while it fails
+	// fast, after too many consecutive failures of the wrapped cipher.
+	ErrCircuitOpen = errors.New("circuit breaker is open")
+
+	// ErrUnknownKeyVersion is returned when a payload has been encrypted
+	// with a key version that is not (or no longer) configured.
+	ErrUnknownKeyVersion = errors.New("unknown key version")
 )
 
+// RetryableError wraps the errors caused by transient failures, like network
+// errors or throttling when reaching an external key management service, so
+// callers can tell the operation may succeed if retried.
+type RetryableError struct {
+	Err error
+}
+
+func (e *RetryableError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *RetryableError) Unwrap() error {
+	return e.Err
+}
+
+// IsRetryable returns whether the given error, or any error it wraps,
+// is a RetryableError.
+func IsRetryable(err error) bool {
+	var retryable *RetryableError
+	return errors.As(err, &retryable)
+}
+
 // Internal must not be used for general purpose encryption.
 // This service is used as an internal component for envelope encryption
 // and for very specific few use cases that still require legacy encryption.
 //
 // Unless there is any specific reason, you must use secrets.Service instead.
+// Those who need it should depend on this interface rather than on the
+// implementation, so they can be tested with fakes.FakeEncryptionService.
 type Internal interface {
 	Cipher
 	Decipher
@@ -27,21 +162,149 @@ type Internal interface {
 	DecryptJsonData(ctx context.Context, sjd map[string][]byte, secret string) (map[string]string, error)
 
 	GetDecryptedValue(ctx context.Context, sjd map[string][]byte, key string, fallback string, secret string) string
+
+	// HealthCheck verifies that payloads can be encrypted
+	// and decrypted back with the configured algorithm.
+	HealthCheck(ctx context.Context) error
 }
 
+// Cipher implementations must be safe for concurrent use,
+// as the same instance is used for all the encryptions.
 type Cipher interface {
 	Encrypt(ctx context.Context, payload []byte, secret string) ([]byte, error)
 }
 
+// Decipher implementations must be safe for concurrent use,
+// as the same instance is used for all the decryptions.
 type Decipher interface {
 	Decrypt(ctx context.Context, payload []byte, secret string) ([]byte, error)
 }
 
+// AEADCipher is implemented by the ciphers that can authenticate additional
+// data (AAD) along with the payload. That data isn't part of the ciphertext,
+// but the same one must be given for the decryption to succeed, so it binds
+// the ciphertext to its context (e.g. the identifier of its owner).
+type AEADCipher interface {
+	Cipher
+	EncryptWithAAD(ctx context.Context, payload, aad []byte, secret string) ([]byte, error)
+}
+
+// AEADDecipher is implemented by the deciphers of AEADCipher implementations.
+// They return ErrAuthenticationFailed when the associated data doesn't match.
+type AEADDecipher interface {
+	Decipher
+	DecryptWithAAD(ctx context.Context, payload, aad []byte, secret string) ([]byte, error)
+}
+
+// KeySizer is implemented by the ciphers that know the size (in bytes) of the
+// keys they encrypt the payloads with, e.g. 32 for AES-256. Keys used only
+// for authentication, if any, aren't accounted for.
+type KeySizer interface {
+	KeySize() int
+}
+
+// Remote is implemented by the ciphers and deciphers whose operations call an
+// external service, e.g. a key management service, so they can be bounded by
+// a timeout when the caller's context has none. The ciphers wrapping others,
+// like RetryingCipher, report whether any of the wrapped ones is remote.
+type Remote interface {
+	IsRemote() bool
+}
+
+// IsRemote returns whether the given cipher or decipher is a Remote one.
+func IsRemote(c interface{}) bool {
+	remote, ok := c.(Remote)
+	return ok && remote.IsRemote()
+}
+
+// Warmable is implemented by the ciphers and deciphers that can check upfront
+// that they're able to operate, e.g. that the external service they call is
+// reachable and the credentials are authorized, with a cheap operation, so
+// misconfigurations are caught on startup rather than on the first use.
+type Warmable interface {
+	Warmup(ctx context.Context) error
+}
+
+// warmup warms up the given cipher or decipher, if it's a Warmable one.
+func warmup(ctx context.Context, c interface{}) error {
+	if warmable, ok := c.(Warmable); ok {
+		return warmable.Warmup(ctx)
+	}
+	return nil
+}
+
+// KeyedDecipher is implemented by the deciphers whose key only depends on the
+// secret, i.e. that derive it without any per-payload salt (e.g. AesSiv), so
+// the key can be derived once and reused to decrypt several payloads. The
+// key returned by DeriveKey is owned by the caller, which must wipe it.
+type KeyedDecipher interface {
+	Decipher
+	DeriveKey(secret string) ([]byte, error)
+	DecryptWithKey(ctx context.Context, payload, key []byte) ([]byte, error)
+}
+
+// Rewrapper is implemented by the deciphers of the algorithms whose payloads
+// hold their data key wrapped by a key derived from the secret (e.g.
+// EnvelopeLocal), so they can be moved to a new secret by only rewrapping
+// that data key. Rewrap returns the rewrapped payload, leaving the given one
+// untouched, and fails with ErrAuthenticationFailed if the old secret is wrong.
+type Rewrapper interface {
+	Rewrap(ctx context.Context, payload []byte, oldSecret, newSecret string) ([]byte, error)
+}
+
+// Configurable is implemented by the ciphers and deciphers that have settings
+// of their own, e.g. tunables of the algorithm. They're configured with the
+// section named after the encryption section and their algorithm, e.g.
+// [security.encryption.aes-gcm], when they're provided or registered and
+// on every reload. A value that is both a cipher and a decipher of the same
+// algorithm is configured twice with the same section.
+type Configurable interface {
+	Configure(section setting.Section) error
+}
+
+// KeyProvider resolves the secrets the encryption service encrypts and
+// decrypts with on behalf of the callers, e.g. from a file, the environment
+// or a key management service, see Service.EncryptManaged. Keys returns all
+// the secrets payloads may have been encrypted with, the current one first,
+// so the previous ones keep being decrypted while rotating them.
+//
+// Implementations must be safe for concurrent use.
+type KeyProvider interface {
+	Keys(ctx context.Context) ([]string, error)
+}
+
 type Provider interface {
 	ProvideCiphers() map[string]Cipher
 	ProvideDeciphers() map[string]Decipher
 }
 
+// RandSource is the source of the randomness drawn to encrypt, i.e. the salts,
+// nonces and data keys, e.g. an HSM-backed or audited one. It defaults to
+// crypto/rand.Reader. Failing reads fail the operations they're drawn for, so
+// a failing source never results in weaker output.
+//
+// Implementations must be cryptographically secure and safe for concurrent use.
+type RandSource interface {
+	io.Reader
+}
+
+// RandomizedProvider is implemented by the providers whose ciphers and
+// deciphers can draw their randomness from a given RandSource rather than
+// crypto/rand.Reader. WithRandSource returns the provider to provide them.
+type RandomizedProvider interface {
+	Provider
+	WithRandSource(random RandSource) Provider
+}
+
+// Wipe overwrites the given buffer with zeros, so sensitive data like keys
+// or plaintexts doesn't linger in memory longer than needed. Note that it
+// cannot wipe any copy of the data made elsewhere, like string conversions.
+func Wipe(b []byte) {
+	for i := range b {
+		b[i] = 0
+	}
+}
+
 // KeyToBytes key length needs to be 32 bytes
 func KeyToBytes(secret, salt string) ([]byte, error) {
 	return pbkdf2.Key([]byte(secret), []byte(salt), 10000, 32, sha256.New), nil
@@ -1,6 +1,9 @@
 package encryption
 
 import (
+	"context"
+	"errors"
+	"fmt"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -20,3 +23,119 @@ func Test_KeyToBytes(t *testing.T) {
 		assert.Len(t, key, 32)
 	})
 }
+
+func Test_Wipe(t *testing.T) {
+	buf := []byte("grafana")
+	Wipe(buf)
+	assert.Equal(t, make([]byte, len("grafana")), buf)
+
+	assert.NotPanics(t, func() { Wipe(nil) })
+}
+
+func Test_IsRetryable(t *testing.T) {
+	err := errors.New("connection reset")
+
+	assert.False(t, IsRetryable(err))
+	assert.False(t, IsRetryable(nil))
+
+	retryable := fmt.Errorf("failed to generate data key: %w", &RetryableError{Err: err})
+	assert.True(t, IsRetryable(retryable))
+	assert.ErrorIs(t, retryable, err)
+	assert.Equal(t, "failed to generate data key: connection reset", retryable.Error())
+}
+
+func Test_IsAuthenticated(t *testing.T) {
+	expected := map[string]bool{
+		AesCfb:            false,
+		AesGcm:            true,
+		AesCbcHmac:        true,
+		ChaCha20Poly1305:  true,
+		XChaCha20Poly1305: true,
+		AesSiv:            true,
+		AwsKms:            true,
+		GcpKms:            true,
+		AzureKeyVault:     true,
+		VaultTransit:      true,
+		EnvelopeLocal:     true,
+	}
+
+	for _, algorithm := range knownAlgorithms {
+		authenticated, ok := expected[algorithm]
+		require.True(t, ok, "missing expectation for algorithm '%s'", algorithm)
+		assert.Equal(t, authenticated, IsAuthenticated(algorithm), algorithm)
+	}
+
+	assert.False(t, IsAuthenticated("unknown"))
+	assert.False(t, IsAuthenticated(""))
+}
+
+func Test_IsSecretBound(t *testing.T) {
+	for _, algorithm := range knownAlgorithms {
+		expected := IsAuthenticated(algorithm) && algorithm != VaultTransit
+		assert.Equal(t, expected, IsSecretBound(algorithm), algorithm)
+	}
+
+	assert.False(t, IsSecretBound("unknown"))
+	assert.False(t, IsSecretBound(""))
+}
+
+func Test_IsRemote(t *testing.T) {
+	remote := remoteCipher{flakyCipher: &flakyCipher{}}
+	local := &flakyCipher{}
+
+	assert.True(t, IsRemote(remote))
+	assert.False(t, IsRemote(local))
+	assert.False(t, IsRemote(nil))
+
+	t.Run("wrappers should report the wrapped ciphers", func(t *testing.T) {
+		assert.True(t, IsRemote(NewRetryingCipher(remote, nil, RetryOptions{})))
+		assert.True(t, IsRemote(NewCircuitBreakerCipher(nil, remote, BreakerOptions{})))
+		assert.True(t, IsRemote(NewCircuitBreakerCipher(NewRetryingCipher(remote, remote, RetryOptions{}), nil, BreakerOptions{})))
+		assert.False(t, IsRemote(NewRetryingCipher(local, local, RetryOptions{})))
+	})
+}
+
+// remoteCipher is a flakyCipher reported as remote.
+type remoteCipher struct {
+	*flakyCipher
+}
+
+func (remoteCipher) IsRemote() bool {
+	return true
+}
+
+func Test_WrappersWarmup(t *testing.T) {
+	ctx := context.Background()
+	errUnreachable := errors.New("unreachable")
+
+	t.Run("wrappers should warm up the wrapped ciphers", func(t *testing.T) {
+		cipher := &warmableFlakyCipher{flakyCipher: &flakyCipher{}}
+
+		require.NoError(t, NewRetryingCipher(cipher, cipher, RetryOptions{}).Warmup(ctx))
+		require.NoError(t, NewCircuitBreakerCipher(nil, cipher, BreakerOptions{}).Warmup(ctx))
+		assert.Equal(t, 3, cipher.warmups)
+	})
+
+	t.Run("failed warmups should be returned", func(t *testing.T) {
+		cipher := &warmableFlakyCipher{flakyCipher: &flakyCipher{}, err: errUnreachable}
+
+		require.ErrorIs(t, NewCircuitBreakerCipher(NewRetryingCipher(cipher, nil, RetryOptions{}), nil, BreakerOptions{}).Warmup(ctx), errUnreachable)
+	})
+
+	t.Run("ciphers that are not warmable should be skipped", func(t *testing.T) {
+		require.NoError(t, NewRetryingCipher(&flakyCipher{}, &flakyCipher{}, RetryOptions{}).Warmup(ctx))
+	})
+}
+
+// warmableFlakyCipher is a flakyCipher whose warmups
+// are counted, and fail with the given error.
+type warmableFlakyCipher struct {
+	*flakyCipher
+	err     error
+	warmups int
+}
+
+func (c *warmableFlakyCipher) Warmup(context.Context) error {
+	c.warmups++
+	return c.err
+}
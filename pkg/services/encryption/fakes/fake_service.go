@@ -0,0 +1,53 @@
+package fakes
+
+import (
+	"context"
+
+	"github.com/grafana/grafana/pkg/services/encryption"
+)
+
+var _ encryption.Internal = FakeEncryptionService{}
+
+// FakeEncryptionService is an encryption.Internal that doesn't encrypt
+// anything, so services depending on it can be tested without wiring the
+// real ciphers. Payloads are returned as they are, though always copied.
+type FakeEncryptionService struct{}
+
+func NewFakeEncryptionService() FakeEncryptionService {
+	return FakeEncryptionService{}
+}
+
+func (f FakeEncryptionService) Encrypt(_ context.Context, payload []byte, _ string) ([]byte, error) {
+	return append([]byte(nil), payload...), nil
+}
+
+func (f FakeEncryptionService) Decrypt(_ context.Context, payload []byte, _ string) ([]byte, error) {
+	return append([]byte(nil), payload...), nil
+}
+
+func (f FakeEncryptionService) EncryptJsonData(_ context.Context, kv map[string]string, _ string) (map[string][]byte, error) {
+	result := make(map[string][]byte, len(kv))
+	for key, value := range kv {
+		result[key] = []byte(value)
+	}
+	return result, nil
+}
+
+func (f FakeEncryptionService) DecryptJsonData(_ context.Context, sjd map[string][]byte, _ string) (map[string]string, error) {
+	result := make(map[string]string, len(sjd))
+	for key, value := range sjd {
+		result[key] = string(value)
+	}
+	return result, nil
+}
+
+func (f FakeEncryptionService) GetDecryptedValue(_ context.Context, sjd map[string][]byte, key, fallback, _ string) string {
+	if value, ok := sjd[key]; ok {
+		return string(value)
+	}
+	return fallback
+}
+
+func (f FakeEncryptionService) HealthCheck(_ context.Context) error {
+	return nil
+}
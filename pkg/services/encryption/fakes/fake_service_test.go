@@ -0,0 +1,50 @@
+package fakes
+
+import (
+	"context"
+	"testing"
+
+	"github.com/grafana/grafana/pkg/services/encryption"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// passwordStore stands for any service depending on encryption.Internal.
+type passwordStore struct {
+	enc    encryption.Internal
+	stored map[string][]byte
+}
+
+func (s *passwordStore) set(ctx context.Context, password string) error {
+	var err error
+	s.stored, err = s.enc.EncryptJsonData(ctx, map[string]string{"password": password}, "secret")
+	return err
+}
+
+func (s *passwordStore) get(ctx context.Context) string {
+	return s.enc.GetDecryptedValue(ctx, s.stored, "password", "", "secret")
+}
+
+func Test_FakeEncryptionService(t *testing.T) {
+	ctx := context.Background()
+
+	store := &passwordStore{enc: NewFakeEncryptionService()}
+	require.NoError(t, store.set(ctx, "grafana"))
+	assert.Equal(t, "grafana", store.get(ctx))
+
+	fake := NewFakeEncryptionService()
+
+	payload := []byte("grafana")
+	encrypted, err := fake.Encrypt(ctx, payload, "secret")
+	require.NoError(t, err)
+
+	encrypted[0] = 'G'
+	assert.Equal(t, []byte("grafana"), payload)
+
+	decrypted, err := fake.Decrypt(ctx, encrypted, "secret")
+	require.NoError(t, err)
+	assert.Equal(t, []byte("Grafana"), decrypted)
+
+	assert.Equal(t, "fallback", fake.GetDecryptedValue(ctx, nil, "password", "fallback", "secret"))
+	assert.NoError(t, fake.HealthCheck(ctx))
+}
@@ -0,0 +1,61 @@
+package fakes
+
+import (
+	"context"
+	"errors"
+
+	"github.com/grafana/grafana/pkg/services/encryption"
+	"github.com/grafana/grafana/pkg/services/encryption/provider"
+)
+
+// InMemoryAlgorithm is the algorithm of the cipher provided by the
+// InMemoryProvider. It's meant for tests only and offers no security.
+const InMemoryAlgorithm = "in-memory"
+
+var _ encryption.Provider = InMemoryProvider{}
+
+// InMemoryProvider provides the built-in ciphers plus a trivial one, under
+// InMemoryAlgorithm, that XORs the payload with the secret, so tests can set
+// up a real encryption service with a fast and deterministic algorithm, and
+// assert on the exact ciphertext. It must never be used outside of tests.
+type InMemoryProvider struct {
+	encryption.Provider
+}
+
+// NewInMemoryProvider returns an InMemoryProvider on top of the built-in
+// ciphers, without any of the ones backed by key management services.
+func NewInMemoryProvider() InMemoryProvider {
+	return InMemoryProvider{Provider: provider.Provider{}}
+}
+
+func (p InMemoryProvider) ProvideCiphers() map[string]encryption.Cipher {
+	ciphers := p.Provider.ProvideCiphers()
+	ciphers[InMemoryAlgorithm] = xorCipher{}
+	return ciphers
+}
+
+func (p InMemoryProvider) ProvideDeciphers() map[string]encryption.Decipher {
+	deciphers := p.Provider.ProvideDeciphers()
+	deciphers[InMemoryAlgorithm] = xorCipher{}
+	return deciphers
+}
+
+// xorCipher XORs the payload with the secret, repeated as needed,
+// which is its own inverse, so it's both a cipher and a decipher.
+type xorCipher struct{}
+
+func (c xorCipher) Encrypt(_ context.Context, payload []byte, secret string) ([]byte, error) {
+	if secret == "" {
+		return nil, errors.New("in-memory cipher requires a secret")
+	}
+
+	out := make([]byte, len(payload))
+	for i, b := range payload {
+		out[i] = b ^ secret[i%len(secret)]
+	}
+	return out, nil
+}
+
+func (c xorCipher) Decrypt(ctx context.Context, payload []byte, secret string) ([]byte, error) {
+	return c.Encrypt(ctx, payload, secret)
+}
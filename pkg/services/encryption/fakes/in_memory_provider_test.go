@@ -0,0 +1,46 @@
+package fakes
+
+import (
+	"context"
+	"testing"
+
+	"github.com/grafana/grafana/pkg/infra/usagestats"
+	"github.com/grafana/grafana/pkg/services/encryption"
+	"github.com/grafana/grafana/pkg/services/encryption/service"
+	"github.com/grafana/grafana/pkg/setting"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_InMemoryProvider(t *testing.T) {
+	ctx := context.Background()
+
+	settings := &setting.OSSImpl{Cfg: setting.NewCfg()}
+	settings.Cfg.Raw.Section("security.encryption").Key("algorithm").SetValue(InMemoryAlgorithm)
+
+	svc, err := service.ProvideEncryptionService(NewInMemoryProvider(), &usagestats.UsageStatsMock{T: t}, settings)
+	require.NoError(t, err)
+
+	t.Run("payloads should round-trip with the exact ciphertext", func(t *testing.T) {
+		encrypted, err := svc.Encrypt(ctx, []byte("grafana"), "1234")
+		require.NoError(t, err)
+
+		// The header, i.e. the algorithm name encoded, followed
+		// by the payload XORed with the secret.
+		expected := append([]byte("*aW4tbWVtb3J5*"), 'g'^'1', 'r'^'2', 'a'^'3', 'f'^'4', 'a'^'1', 'n'^'2', 'a'^'3')
+		assert.Equal(t, expected, encrypted)
+
+		decrypted, err := svc.Decrypt(ctx, encrypted, "1234")
+		require.NoError(t, err)
+		assert.Equal(t, []byte("grafana"), decrypted)
+	})
+
+	t.Run("built-in algorithms should still be available", func(t *testing.T) {
+		encrypted, err := svc.EncryptWithAlgorithm(ctx, []byte("grafana"), "1234", encryption.AesGcm)
+		require.NoError(t, err)
+
+		decrypted, err := svc.Decrypt(ctx, encrypted, "1234")
+		require.NoError(t, err)
+		assert.Equal(t, []byte("grafana"), decrypted)
+	})
+}
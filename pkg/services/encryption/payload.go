@@ -0,0 +1,283 @@
+package encryption
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+// The payload format is produced and consumed by the encryption service, see
+// its documentation for the details. Only what's needed to validate payloads
+// structurally is replicated here.
+const (
+	payloadAlgorithmDelimiter = '*'
+	payloadVersion1           = 0x01
+	payloadMaxVersion         = 0x20
+
+	maxPayloadAlgorithmLength = 64
+
+	// The flags of the v1 headers, and the lengths of the fields
+	// they signal, in the order the fields follow the flags.
+	payloadFlagCompressed    = 1 << 0
+	payloadFlagKDF           = 1 << 1
+	payloadFlagKeyVersion    = 1 << 2
+	payloadFlagKeyCommitment = 1 << 3
+	payloadFlagPadded        = 1 << 4
+
+	payloadKnownFlags = payloadFlagCompressed | payloadFlagKDF | payloadFlagKeyVersion | payloadFlagKeyCommitment | payloadFlagPadded
+
+	// <id><uint32 time><uint32 memory><threads><salt length><salt>
+	kdfParamsPrefixLen = 11
+
+	maxKeyVersionIDLength = 64
+
+	// <salt><hmac-sha256>
+	keyCommitmentLen = 16 + sha256.Size
+
+	gcmNonceSize = 12
+	gcmTagSize   = 16
+
+	// envelopeLocalPrefixLen is the length of the wrapped data key
+	// of the EnvelopeLocal payloads and of its length, which precede
+	// the nonce: <uint16 length><salt><nonce><sealed 32-byte key>
+	envelopeLocalPrefixLen = 2 + SaltLength + gcmNonceSize + 32 + gcmTagSize
+)
+
+var knownAlgorithms = []string{
+	AesCfb, AesGcm, AesCbcHmac, ChaCha20Poly1305, XChaCha20Poly1305, AesSiv,
+	AwsKms, GcpKms, AzureKeyVault, VaultTransit, EnvelopeLocal,
+}
+
+// ValidatePayload checks that the given payload is structurally valid, without
+// decrypting it, and returns the algorithm it was encrypted with. That is, its
+// header can be parsed and its ciphertext is long enough to have been produced
+// by the algorithm, when known. Otherwise, the ciphertext only needs to be
+// non-empty.
+//
+// It doesn't allocate for payloads of known algorithms, so it's suitable for
+// scanning large amounts of payloads.
+func ValidatePayload(payload []byte) (string, error) {
+	if len(payload) == 0 {
+		return "", errors.New("unable to derive encryption algorithm")
+	}
+
+	algorithm := AesCfb // backwards compatibility
+	if payload[0] == payloadAlgorithmDelimiter {
+		var err error
+		algorithm, payload, err = validatePayloadHeader(payload[1:])
+		if err != nil {
+			return "", err
+		}
+	}
+
+	if len(payload) < minCiphertextLength(algorithm) {
+		return "", fmt.Errorf("ciphertext too short for algorithm '%s'", algorithm)
+	}
+
+	return algorithm, nil
+}
+
+// IsEncrypted returns whether the given payload looks like the output of the
+// encryption service, that is, whether it's a valid payload (see ValidatePayload)
+// with a header identifying one of the built-in algorithms. It doesn't attempt
+// to decrypt the payload nor allocates, so it's cheap enough to call on every
+// value before deciding whether to decrypt it.
+//
+// Legacy AesCfb payloads, which have no header, cannot be told apart from
+// plaintext, so they're always reported as not encrypted. Conversely, nothing
+// prevents a plaintext from looking like an encrypted payload, so this must
+// only be used on values known to be either plaintexts or encrypted payloads,
+// and never to decide whether a value needs to be protected.
+func IsEncrypted(payload []byte) bool {
+	if len(payload) == 0 || payload[0] != payloadAlgorithmDelimiter {
+		return false
+	}
+
+	algorithm, err := ValidatePayload(payload)
+	if err != nil {
+		return false
+	}
+
+	for _, known := range knownAlgorithms {
+		if algorithm == known {
+			return true
+		}
+	}
+	return false
+}
+
+// InvalidPayload is the bucket ClassifyPayloads
+// counts the payloads that aren't valid under.
+const InvalidPayload = "invalid"
+
+// ClassifyPayloads counts the given payloads per the algorithm they were
+// encrypted with, without decrypting them, e.g. to size the migration from
+// one algorithm to another. Payloads without header are counted as AesCfb,
+// as they're decrypted, and those that don't pass ValidatePayload are
+// counted as InvalidPayload.
+func ClassifyPayloads(payloads [][]byte) map[string]int {
+	counts := make(map[string]int)
+	for _, payload := range payloads {
+		algorithm, err := ValidatePayload(payload)
+		if err != nil {
+			algorithm = InvalidPayload
+		}
+		counts[algorithm]++
+	}
+	return counts
+}
+
+// CiphertextLen returns the exact length of the payload Encrypt produces for
+// a plaintext of the given length with the given algorithm, header included,
+// e.g. to size a column before re-encrypting its values. It assumes the
+// payload header has no options, as is the case by default, since neither
+// the length of compressed payloads nor that of the ciphertexts produced by
+// external key management services can be known in advance. It fails with
+// ErrUnknownAlgorithm for any other algorithm.
+func CiphertextLen(algorithm string, plaintextLen int) (int, error) {
+	if plaintextLen < 0 {
+		return 0, fmt.Errorf("invalid plaintext length: %d", plaintextLen)
+	}
+
+	var n int
+	switch algorithm {
+	case AesCfb:
+		n = SaltLength + aes.BlockSize + plaintextLen
+	case AesGcm:
+		n = SaltLength + gcmNonceSize + plaintextLen + gcmTagSize
+	case AesCbcHmac:
+		padded := plaintextLen + aes.BlockSize - plaintextLen%aes.BlockSize
+		n = SaltLength + aes.BlockSize + padded + sha256.Size
+	case ChaCha20Poly1305:
+		n = SaltLength + chacha20poly1305.NonceSize + plaintextLen + chacha20poly1305.Overhead
+	case XChaCha20Poly1305:
+		n = SaltLength + chacha20poly1305.NonceSizeX + plaintextLen + chacha20poly1305.Overhead
+	case AesSiv:
+		n = aes.BlockSize + plaintextLen
+	case EnvelopeLocal:
+		n = envelopeLocalPrefixLen + gcmNonceSize + plaintextLen + gcmTagSize
+	default:
+		return 0, fmt.Errorf("ciphertext length of algorithm '%s' cannot be estimated: %w", algorithm, ErrUnknownAlgorithm)
+	}
+
+	// Algorithm name, encoded and surrounded by delimiters.
+	return n + base64.RawStdEncoding.EncodedLen(len(algorithm)) + 2, nil
+}
+
+func validatePayloadHeader(payload []byte) (string, []byte, error) {
+	version := byte(0)
+	if len(payload) > 0 && payload[0] != 0 && payload[0] < payloadMaxVersion {
+		version, payload = payload[0], payload[1:]
+	}
+
+	if version > payloadVersion1 {
+		return "", nil, fmt.Errorf("unsupported payload version: %d", version)
+	}
+
+	// The delimiter is only looked for where it can be,
+	// so the search doesn't depend on the size of the payload.
+	window := payload
+	if maxLen := base64.RawStdEncoding.EncodedLen(maxPayloadAlgorithmLength) + 1; len(window) > maxLen {
+		window = window[:maxLen]
+	}
+
+	algorithmDelimiterIdx := bytes.IndexByte(window, payloadAlgorithmDelimiter)
+	if algorithmDelimiterIdx == -1 {
+		if len(window) < len(payload) {
+			return "", nil, fmt.Errorf("encryption algorithm name exceeds the maximum length of %d bytes", maxPayloadAlgorithmLength)
+		}
+		return "", nil, errors.New("malformed algorithm header")
+	}
+
+	// Payloads written by other systems may use the URL-safe alphabet.
+	var buf [maxPayloadAlgorithmLength]byte
+	n, err := base64.RawStdEncoding.Decode(buf[:], payload[:algorithmDelimiterIdx])
+	if err != nil {
+		if n, err = base64.RawURLEncoding.Decode(buf[:], payload[:algorithmDelimiterIdx]); err != nil {
+			return "", nil, err
+		}
+	}
+	payload = payload[algorithmDelimiterIdx+1:]
+
+	algorithm := knownAlgorithm(buf[:n])
+
+	if version == payloadVersion1 {
+		if len(payload) < 2 || payload[0] == 0 || len(payload) < int(payload[0])+1 {
+			return "", nil, errors.New("malformed payload header")
+		}
+		if err := validatePayloadFields(payload[1 : int(payload[0])+1]); err != nil {
+			return "", nil, err
+		}
+		payload = payload[int(payload[0])+1:]
+	}
+
+	return algorithm, payload, nil
+}
+
+// validatePayloadFields checks that the fields of a v1 header, starting with
+// the flags, only signal known options, and are long enough to hold them.
+// The values of the options are only checked when decrypting.
+func validatePayloadFields(fields []byte) error {
+	flags := fields[0]
+	if flags&^payloadKnownFlags != 0 {
+		return fmt.Errorf("unsupported payload header flags: %08b", flags)
+	}
+
+	fields = fields[1:]
+	if flags&payloadFlagKDF != 0 {
+		if len(fields) < kdfParamsPrefixLen || len(fields) < kdfParamsPrefixLen+int(fields[kdfParamsPrefixLen-1]) {
+			return errors.New("malformed key derivation parameters")
+		}
+		fields = fields[kdfParamsPrefixLen+int(fields[kdfParamsPrefixLen-1]):]
+	}
+
+	if flags&payloadFlagKeyVersion != 0 {
+		if len(fields) < 1 || fields[0] == 0 || fields[0] > maxKeyVersionIDLength || len(fields) < 1+int(fields[0]) {
+			return errors.New("malformed key version")
+		}
+		fields = fields[1+int(fields[0]):]
+	}
+
+	if flags&payloadFlagKeyCommitment != 0 && len(fields) < keyCommitmentLen {
+		return errors.New("malformed key commitment")
+	}
+
+	return nil
+}
+
+// knownAlgorithm returns the given algorithm name as a string,
+// without allocating when it's one of the known algorithms.
+func knownAlgorithm(name []byte) string {
+	for _, algorithm := range knownAlgorithms {
+		if string(name) == algorithm {
+			return algorithm
+		}
+	}
+	return string(name)
+}
+
+func minCiphertextLength(algorithm string) int {
+	switch algorithm {
+	case AesCfb:
+		return SaltLength + aes.BlockSize
+	case AesGcm:
+		return SaltLength + gcmNonceSize + gcmTagSize
+	case AesCbcHmac:
+		return SaltLength + aes.BlockSize + aes.BlockSize + sha256.Size
+	case ChaCha20Poly1305:
+		return SaltLength + chacha20poly1305.NonceSize + chacha20poly1305.Overhead
+	case XChaCha20Poly1305:
+		return SaltLength + chacha20poly1305.NonceSizeX + chacha20poly1305.Overhead
+	case AesSiv:
+		return aes.BlockSize
+	case EnvelopeLocal:
+		return envelopeLocalPrefixLen + gcmNonceSize + gcmTagSize
+	default:
+		return 1
+	}
+}
@@ -0,0 +1,190 @@
+package encryption
+
+import (
+	"crypto/aes"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_ValidatePayload(t *testing.T) {
+	t.Run("with valid payload should return the algorithm", func(t *testing.T) {
+		// 'grafana' encrypted with '1234' as secret and aes-gcm as algorithm.
+		payload := []byte{42, 89, 87, 86, 122, 76, 87, 100, 106, 98, 81, 42, 48, 99, 55, 50, 51, 48, 83, 66, 20, 99, 47, 238, 61, 44, 129, 125, 14, 37, 162, 230, 47, 31, 104, 70, 144, 223, 26, 51, 180, 17, 76, 52, 36, 93, 17, 203, 99, 158, 219, 102, 74, 173, 74}
+
+		algorithm, err := ValidatePayload(payload)
+		require.NoError(t, err)
+		assert.Equal(t, AesGcm, algorithm)
+
+		allocs := testing.AllocsPerRun(10, func() {
+			_, _ = ValidatePayload(payload)
+		})
+		assert.Zero(t, allocs)
+	})
+
+	t.Run("with legacy payload should return aes-cfb", func(t *testing.T) {
+		// 'grafana' encrypted with '1234' as secret and no algorithm metadata.
+		payload := []byte{73, 71, 50, 57, 121, 110, 90, 109, 115, 23, 237, 13, 130, 188, 151, 118, 98, 103, 80, 209, 79, 143, 22, 122, 44, 40, 102, 41, 136, 16, 27}
+
+		algorithm, err := ValidatePayload(payload)
+		require.NoError(t, err)
+		assert.Equal(t, AesCfb, algorithm)
+	})
+
+	t.Run("with versioned header should skip it", func(t *testing.T) {
+		payload := append([]byte("*\x01YWVzLWdjbQ*\x01\x01"), make([]byte, SaltLength+28)...)
+
+		algorithm, err := ValidatePayload(payload)
+		require.NoError(t, err)
+		assert.Equal(t, AesGcm, algorithm)
+	})
+
+	t.Run("with multi-megabyte prefix should fail within the maximum algorithm length", func(t *testing.T) {
+		payload := make([]byte, 4*1024*1024)
+		for i := range payload {
+			payload[i] = 'A'
+		}
+		payload[0] = payloadAlgorithmDelimiter
+		payload[len(payload)-1] = payloadAlgorithmDelimiter
+
+		_, err := ValidatePayload(payload)
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "exceeds the maximum length")
+	})
+
+	t.Run("with url-safe algorithm should decode it", func(t *testing.T) {
+		for _, prefix := range []string{"*YWNtZS9rbXN+djE*", "*YWNtZS9rbXN-djE*"} {
+			algorithm, err := ValidatePayload([]byte(prefix + "x"))
+			require.NoError(t, err)
+			assert.Equal(t, "acme/kms~v1", algorithm)
+		}
+	})
+
+	t.Run("with unknown algorithm should only require a ciphertext", func(t *testing.T) {
+		algorithm, err := ValidatePayload([]byte("*dW5rbm93bg*x"))
+		require.NoError(t, err)
+		assert.Equal(t, "unknown", algorithm)
+
+		_, err = ValidatePayload([]byte("*dW5rbm93bg*"))
+		require.Error(t, err)
+	})
+
+	testCases := []struct {
+		desc    string
+		payload []byte
+	}{
+		{desc: "empty payload", payload: []byte{}},
+		{desc: "short legacy payload", payload: []byte("grafana")},
+		{desc: "short aes-gcm payload", payload: append([]byte("*YWVzLWdjbQ*"), make([]byte, SaltLength+27)...)},
+		{desc: "short aes-cbc-hmac payload", payload: append([]byte("*YWVzLWNiYy1obWFj*"), make([]byte, SaltLength+63)...)},
+		{desc: "short chacha20poly1305 payload", payload: append([]byte("*Y2hhY2hhMjBwb2x5MTMwNQ*"), make([]byte, SaltLength+27)...)},
+		{desc: "non-base64 algorithm", payload: []byte("*not base64!*grafana")},
+		{desc: "payload without second delimiter", payload: append([]byte("*YWVzLWdjbQ"), make([]byte, SaltLength+aes.BlockSize)...)},
+		{desc: "versioned payload without delimiter", payload: []byte("*\x01YWVzLWdjbQ")},
+		{desc: "versioned payload without header", payload: []byte("*\x01YWVzLWdjbQ*")},
+		{desc: "versioned payload with truncated header", payload: []byte("*\x01YWVzLWdjbQ*\x05\x01")},
+		{desc: "versioned payload with unknown flags", payload: append([]byte("*\x01YWVzLWdjbQ*\x01\x80"), make([]byte, SaltLength+28)...)},
+		{desc: "versioned payload with truncated key derivation parameters", payload: append([]byte("*\x01YWVzLWdjbQ*\x05\x02\x01\x00\x00\x00"), make([]byte, SaltLength+28)...)},
+		{desc: "versioned payload with empty key version", payload: append([]byte("*\x01YWVzLWdjbQ*\x02\x04\x00"), make([]byte, SaltLength+28)...)},
+		{desc: "versioned payload with truncated key commitment", payload: append([]byte("*\x01YWVzLWdjbQ*\x03\x08\x00\x00"), make([]byte, SaltLength+28)...)},
+	}
+
+	for _, tc := range testCases {
+		t.Run("with "+tc.desc+" should fail", func(t *testing.T) {
+			_, err := ValidatePayload(tc.payload)
+			require.Error(t, err)
+		})
+	}
+}
+
+func Test_IsEncrypted(t *testing.T) {
+	t.Run("with prefixed payload should return true", func(t *testing.T) {
+		// 'grafana' encrypted with '1234' as secret and aes-gcm as algorithm.
+		payload := []byte{42, 89, 87, 86, 122, 76, 87, 100, 106, 98, 81, 42, 48, 99, 55, 50, 51, 48, 83, 66, 20, 99, 47, 238, 61, 44, 129, 125, 14, 37, 162, 230, 47, 31, 104, 70, 144, 223, 26, 51, 180, 17, 76, 52, 36, 93, 17, 203, 99, 158, 219, 102, 74, 173, 74}
+		assert.True(t, IsEncrypted(payload))
+
+		allocs := testing.AllocsPerRun(10, func() {
+			_ = IsEncrypted(payload)
+		})
+		assert.Zero(t, allocs)
+
+		assert.True(t, IsEncrypted(append([]byte("*\x01YWVzLWdjbQ*\x01\x01"), make([]byte, SaltLength+28)...)))
+		assert.True(t, IsEncrypted([]byte("*YXdzLWttcw*ciphertext")))
+	})
+
+	t.Run("with legacy payload should return false", func(t *testing.T) {
+		// 'grafana' encrypted with '1234' as secret and no algorithm metadata.
+		payload := []byte{73, 71, 50, 57, 121, 110, 90, 109, 115, 23, 237, 13, 130, 188, 151, 118, 98, 103, 80, 209, 79, 143, 22, 122, 44, 40, 102, 41, 136, 16, 27}
+		assert.False(t, IsEncrypted(payload))
+	})
+
+	t.Run("with plaintext should return false", func(t *testing.T) {
+		for _, payload := range []string{
+			"",
+			"grafana",
+			"*grafana*",
+			"*bold* text",
+			"*dW5rbm93bg*ciphertext",
+			"*YWVzLWdjbQ*short",
+		} {
+			assert.False(t, IsEncrypted([]byte(payload)), payload)
+		}
+	})
+}
+
+func Test_ClassifyPayloads(t *testing.T) {
+	gcm := append([]byte("*YWVzLWdjbQ*"), make([]byte, SaltLength+28)...)
+	legacy := make([]byte, SaltLength+aes.BlockSize)
+	custom := append([]byte("*Y3VzdG9t*"), 'x')
+
+	counts := ClassifyPayloads([][]byte{
+		gcm,
+		gcm,
+		legacy,
+		custom,
+		nil,
+		[]byte("*YWVzLWdjbQ"),
+		gcm[:len(gcm)-1],
+	})
+
+	assert.Equal(t, map[string]int{
+		AesGcm:         2,
+		AesCfb:         1,
+		"custom":       1,
+		InvalidPayload: 3,
+	}, counts)
+
+	assert.Empty(t, ClassifyPayloads(nil))
+}
+
+func Test_CiphertextLen(t *testing.T) {
+	t.Run("aes-gcm should add the header, salt, nonce and tag", func(t *testing.T) {
+		n, err := CiphertextLen(AesGcm, 7)
+		require.NoError(t, err)
+		assert.Equal(t, len("*YWVzLWdjbQ*")+SaltLength+12+7+16, n)
+	})
+
+	t.Run("aes-cbc-hmac should account for the padding", func(t *testing.T) {
+		for plaintextLen, padded := range map[int]int{0: 16, 15: 16, 16: 32} {
+			n, err := CiphertextLen(AesCbcHmac, plaintextLen)
+			require.NoError(t, err)
+
+			withoutPlaintext, err := CiphertextLen(AesCbcHmac, 0)
+			require.NoError(t, err)
+			assert.Equal(t, withoutPlaintext-16+padded, n)
+		}
+	})
+
+	t.Run("unknown or external algorithms should fail", func(t *testing.T) {
+		for _, algorithm := range []string{"unknown", AwsKms, VaultTransit} {
+			_, err := CiphertextLen(algorithm, 7)
+			require.ErrorIs(t, err, ErrUnknownAlgorithm)
+		}
+	})
+
+	t.Run("negative lengths should fail", func(t *testing.T) {
+		_, err := CiphertextLen(AesGcm, -1)
+		require.Error(t, err)
+	})
+}
@@ -0,0 +1,122 @@
+package provider
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"io"
+
+	"golang.org/x/crypto/hkdf"
+
+	"github.com/grafana/grafana/pkg/services/encryption"
+)
+
+// aesCbcHmacCipher implements AES-256-CBC with PKCS#7 padding, followed
+// by an HMAC-SHA256 (encrypt-then-MAC). The ciphertext layout is:
+//
+//	<salt><iv><ciphertext><hmac-sha256(iv + ciphertext)>
+//
+// When there's associated data, it's authenticated as well, together with
+// its length in bits, so the MAC becomes:
+//
+//	hmac-sha256(aad + iv + ciphertext + uint64(len(aad) * 8))
+type aesCbcHmacCipher struct {
+	// random is the source the salts and IVs are read
+	// from, crypto/rand.Reader when nil (see randomSource).
+	random io.Reader
+}
+
+func (c aesCbcHmacCipher) Encrypt(ctx context.Context, payload []byte, secret string) ([]byte, error) {
+	return c.EncryptWithAAD(ctx, payload, nil, secret)
+}
+
+func (c aesCbcHmacCipher) KeySize() int {
+	return keySize
+}
+
+func (c aesCbcHmacCipher) EncryptWithAAD(_ context.Context, payload, aad []byte, secret string) ([]byte, error) {
+	salt, err := randomSalt(c.random)
+	if err != nil {
+		return nil, err
+	}
+
+	iv := make([]byte, aes.BlockSize)
+	if _, err := io.ReadFull(randomSource(c.random), iv); err != nil {
+		return nil, err
+	}
+
+	return sealAesCbcHmac(payload, aad, secret, salt, iv)
+}
+
+func sealAesCbcHmac(payload, aad []byte, secret, salt string, iv []byte) ([]byte, error) {
+	encKey, macKey, err := deriveAesCbcHmacKeys(secret, salt)
+	if err != nil {
+		return nil, err
+	}
+	defer encryption.Wipe(encKey)
+	defer encryption.Wipe(macKey)
+
+	block, err := aes.NewCipher(encKey)
+	if err != nil {
+		return nil, err
+	}
+
+	padding := aes.BlockSize - len(payload)%aes.BlockSize
+	ivOffset := encryption.SaltLength
+	dataOffset := ivOffset + aes.BlockSize
+	macOffset := dataOffset + len(payload) + padding
+
+	ciphertext := make([]byte, macOffset+sha256.Size)
+	copy(ciphertext[:ivOffset], salt)
+	copy(ciphertext[ivOffset:dataOffset], iv)
+	copy(ciphertext[dataOffset:], payload)
+	for i := dataOffset + len(payload); i < macOffset; i++ {
+		ciphertext[i] = byte(padding)
+	}
+
+	mode := cipher.NewCBCEncrypter(block, iv)
+	mode.CryptBlocks(ciphertext[dataOffset:macOffset], ciphertext[dataOffset:macOffset])
+
+	copy(ciphertext[macOffset:], aesCbcHmacMAC(macKey, aad, ciphertext[ivOffset:macOffset]))
+
+	return ciphertext, nil
+}
+
+// aesCbcHmacMAC computes the MAC of the given iv and ciphertext, together
+// with the associated data, if any. Without associated data, the MAC is the
+// same as it's always been, so existing ciphertexts remain valid.
+func aesCbcHmacMAC(macKey, aad, ivAndCiphertext []byte) []byte {
+	mac := hmac.New(sha256.New, macKey)
+	if len(aad) == 0 {
+		mac.Write(ivAndCiphertext)
+		return mac.Sum(nil)
+	}
+
+	aadBits := make([]byte, 8)
+	binary.BigEndian.PutUint64(aadBits, uint64(len(aad))*8)
+
+	mac.Write(aad)
+	mac.Write(ivAndCiphertext)
+	mac.Write(aadBits)
+	return mac.Sum(nil)
+}
+
+// deriveAesCbcHmacKeys derives two independent keys, one for encryption and
+// another one for authentication, from the key derived from the secret.
+func deriveAesCbcHmacKeys(secret, salt string) ([]byte, []byte, error) {
+	key, err := encryption.KeyToBytes(secret, salt)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer encryption.Wipe(key)
+
+	keys := make([]byte, 64)
+	if _, err := io.ReadFull(hkdf.Expand(sha256.New, key, []byte(encryption.AesCbcHmac)), keys); err != nil {
+		return nil, nil, err
+	}
+
+	return keys[:32], keys[32:], nil
+}
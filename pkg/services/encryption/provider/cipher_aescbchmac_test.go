@@ -0,0 +1,201 @@
+package provider
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/sha256"
+	"testing"
+
+	"github.com/grafana/grafana/pkg/services/encryption"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_aesCbcHmacCipher(t *testing.T) {
+	cipher := aesCbcHmacCipher{}
+	decipher := aesCbcHmacDecipher{}
+	ctx := context.Background()
+
+	// Raw slice of bytes that corresponds to the following ciphertext:
+	// - 'grafana' as payload
+	// - '1234' as secret
+	// - 'abcdefgh' as salt
+	// - zeroed IV
+	vector := []byte{97, 98, 99, 100, 101, 102, 103, 104, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 74, 235, 62, 156, 136, 200, 116, 177, 11, 37, 45, 136, 48, 72, 215, 240, 7, 131, 0, 143, 232, 132, 227, 249, 242, 139, 56, 191, 3, 211, 113, 54, 178, 241, 179, 250, 195, 118, 225, 132, 231, 187, 15, 115, 100, 171, 108, 70}
+
+	t.Run("encrypt with fixed salt and iv should match the test vector", func(t *testing.T) {
+		encrypted, err := sealAesCbcHmac([]byte("grafana"), nil, "1234", "abcdefgh", make([]byte, 16))
+		require.NoError(t, err)
+		assert.Equal(t, vector, encrypted)
+	})
+
+	t.Run("decrypt the test vector should work", func(t *testing.T) {
+		decrypted, err := decipher.Decrypt(ctx, vector, "1234")
+		require.NoError(t, err)
+		assert.Equal(t, []byte("grafana"), decrypted)
+	})
+
+	t.Run("encrypt and decrypt should work", func(t *testing.T) {
+		for _, payload := range []string{"", "grafana", "sixteen bytes!!!", "a payload longer than a single block"} {
+			encrypted, err := cipher.Encrypt(ctx, []byte(payload), "1234")
+			require.NoError(t, err)
+
+			decrypted, err := decipher.Decrypt(ctx, encrypted, "1234")
+			require.NoError(t, err)
+			assert.Equal(t, payload, string(decrypted))
+		}
+	})
+
+	t.Run("decrypt tampered ciphertext should fail", func(t *testing.T) {
+		for _, i := range []int{encryption.SaltLength, len(vector) - 40, len(vector) - 1} {
+			tampered := make([]byte, len(vector))
+			copy(tampered, vector)
+			tampered[i] ^= 0x01
+
+			_, err := decipher.Decrypt(ctx, tampered, "1234")
+			require.ErrorIs(t, err, encryption.ErrAuthenticationFailed)
+		}
+	})
+
+	t.Run("decrypt with wrong secret should fail", func(t *testing.T) {
+		_, err := decipher.Decrypt(ctx, vector, "4321")
+		require.ErrorIs(t, err, encryption.ErrAuthenticationFailed)
+	})
+
+	t.Run("decrypt too short payload should fail", func(t *testing.T) {
+		_, err := decipher.Decrypt(ctx, vector[:len(vector)-16], "1234")
+		require.Error(t, err)
+	})
+
+	t.Run("encryption and authentication keys should differ", func(t *testing.T) {
+		encKey, macKey, err := deriveAesCbcHmacKeys("1234", "abcdefgh")
+		require.NoError(t, err)
+		assert.Len(t, encKey, 32)
+		assert.Len(t, macKey, 32)
+		assert.NotEqual(t, encKey, macKey)
+	})
+}
+
+func Test_aesCbcHmacDecipher_PaddingOracle(t *testing.T) {
+	decipher := aesCbcHmacDecipher{}
+	ctx := context.Background()
+
+	badPadding := aesCbcHmacInvalidPadding(t, 0x00)
+	badMAC := aesCbcHmacInvalidMAC(t)
+
+	t.Run("bad padding should only be checked behind a valid MAC", func(t *testing.T) {
+		for _, last := range []byte{0x00, 0x11, 0xff} {
+			payload := aesCbcHmacInvalidPadding(t, last)
+
+			_, macKey, err := deriveAesCbcHmacKeys("1234", "abcdefgh")
+			require.NoError(t, err)
+
+			macOffset := len(payload) - sha256.Size
+			assert.Equal(t, aesCbcHmacMAC(macKey, nil, payload[encryption.SaltLength:macOffset]), payload[macOffset:])
+		}
+	})
+
+	t.Run("bad padding and bad MAC should fail with the same error value", func(t *testing.T) {
+		// Not only the same error, but the very same value, so
+		// nothing wrapped around it could tell the failures apart.
+		for _, last := range []byte{0x00, 0x11, 0xff} {
+			_, err := decipher.Decrypt(ctx, aesCbcHmacInvalidPadding(t, last), "1234")
+			assert.Same(t, encryption.ErrAuthenticationFailed, err)
+		}
+
+		_, err := decipher.Decrypt(ctx, badPadding, "1234")
+		assert.Same(t, encryption.ErrAuthenticationFailed, err)
+
+		_, err = decipher.Decrypt(ctx, badMAC, "1234")
+		assert.Same(t, encryption.ErrAuthenticationFailed, err)
+	})
+}
+
+// Benchmark_aesCbcHmacDecipher_PaddingOracle compares the time it takes to
+// reject a bad padding and a bad MAC, which should be about the same.
+func Benchmark_aesCbcHmacDecipher_PaddingOracle(b *testing.B) {
+	decipher := aesCbcHmacDecipher{}
+	ctx := context.Background()
+
+	benchmarks := []struct {
+		name    string
+		payload []byte
+	}{
+		{name: "bad padding", payload: aesCbcHmacInvalidPadding(b, 0x00)},
+		{name: "bad MAC", payload: aesCbcHmacInvalidMAC(b)},
+	}
+
+	for _, bm := range benchmarks {
+		payload := bm.payload
+		b.Run(bm.name, func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				if _, err := decipher.Decrypt(ctx, payload, "1234"); err == nil {
+					b.Fatal("expected an error")
+				}
+			}
+		})
+	}
+}
+
+// aesCbcHmacInvalidPadding returns a payload with a valid MAC over a single
+// block, whose last byte is the given one, so the padding is invalid unless
+// the byte happens to be a valid padding on its own.
+func aesCbcHmacInvalidPadding(tb testing.TB, last byte) []byte {
+	tb.Helper()
+
+	block := []byte("fifteen bytes!!?")
+	block[aes.BlockSize-1] = last
+
+	// The trailing block of full padding is dropped,
+	// and the MAC computed again over what's left.
+	sealed, err := sealAesCbcHmac(block, nil, "1234", "abcdefgh", make([]byte, aes.BlockSize))
+	require.NoError(tb, err)
+	payload := sealed[:encryption.SaltLength+2*aes.BlockSize]
+
+	_, macKey, err := deriveAesCbcHmacKeys("1234", "abcdefgh")
+	require.NoError(tb, err)
+	return append(payload, aesCbcHmacMAC(macKey, nil, payload[encryption.SaltLength:])...)
+}
+
+// aesCbcHmacInvalidMAC returns a payload with a valid padding but a bad MAC.
+func aesCbcHmacInvalidMAC(tb testing.TB) []byte {
+	tb.Helper()
+
+	payload, err := sealAesCbcHmac([]byte("grafana"), nil, "1234", "abcdefgh", make([]byte, aes.BlockSize))
+	require.NoError(tb, err)
+	payload[len(payload)-1] ^= 0x01
+	return payload
+}
+
+func Test_unpadPKCS7(t *testing.T) {
+	block := func(last ...byte) []byte {
+		b := make([]byte, aes.BlockSize)
+		copy(b[aes.BlockSize-len(last):], last)
+		return b
+	}
+
+	testCases := []struct {
+		desc     string
+		data     []byte
+		expected int
+		ok       bool
+	}{
+		{desc: "single byte of padding", data: block(0x01), expected: 15, ok: true},
+		{desc: "several bytes of padding", data: block(0x03, 0x03, 0x03), expected: 13, ok: true},
+		{desc: "full block of padding", data: bytes.Repeat([]byte{0x10}, aes.BlockSize), expected: 0, ok: true},
+		{desc: "zero padding", data: block(0x00)},
+		{desc: "padding longer than a block", data: block(0x11)},
+		{desc: "inconsistent padding", data: block(0x02, 0x03, 0x03)},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			unpadded, ok := unpadPKCS7(tc.data)
+			require.Equal(t, tc.ok, ok)
+			if tc.ok {
+				assert.Len(t, unpadded, tc.expected)
+			}
+		})
+	}
+}
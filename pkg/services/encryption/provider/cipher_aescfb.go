@@ -4,17 +4,19 @@ import (
 	"context"
 	"crypto/aes"
 	"crypto/cipher"
-	"crypto/rand"
 	"io"
 
 	"github.com/grafana/grafana/pkg/services/encryption"
-	"github.com/grafana/grafana/pkg/util"
 )
 
-type aesCfbCipher struct{}
+type aesCfbCipher struct {
+	// random is the source the salts and IVs are read
+	// from, crypto/rand.Reader when nil (see randomSource).
+	random io.Reader
+}
 
 func (c aesCfbCipher) Encrypt(_ context.Context, payload []byte, secret string) ([]byte, error) {
-	salt, err := util.GetRandomString(encryption.SaltLength)
+	salt, err := randomSalt(c.random)
 	if err != nil {
 		return nil, err
 	}
@@ -23,6 +25,7 @@ func (c aesCfbCipher) Encrypt(_ context.Context, payload []byte, secret string)
 	if err != nil {
 		return nil, err
 	}
+	defer encryption.Wipe(key)
 
 	block, err := aes.NewCipher(key)
 	if err != nil {
@@ -34,7 +37,7 @@ func (c aesCfbCipher) Encrypt(_ context.Context, payload []byte, secret string)
 	ciphertext := make([]byte, encryption.SaltLength+aes.BlockSize+len(payload))
 	copy(ciphertext[:encryption.SaltLength], salt)
 	iv := ciphertext[encryption.SaltLength : encryption.SaltLength+aes.BlockSize]
-	if _, err := io.ReadFull(rand.Reader, iv); err != nil {
+	if _, err := io.ReadFull(randomSource(c.random), iv); err != nil {
 		return nil, err
 	}
 
@@ -43,3 +46,7 @@ func (c aesCfbCipher) Encrypt(_ context.Context, payload []byte, secret string)
 
 	return ciphertext, nil
 }
+
+func (c aesCfbCipher) KeySize() int {
+	return keySize
+}
@@ -0,0 +1,51 @@
+package provider
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"io"
+
+	"github.com/grafana/grafana/pkg/services/encryption"
+)
+
+type aesGcmCipher struct {
+	// random is the source the salts and nonces are read
+	// from, crypto/rand.Reader when nil (see randomSource).
+	random io.Reader
+}
+
+func (c aesGcmCipher) Encrypt(ctx context.Context, payload []byte, secret string) ([]byte, error) {
+	return c.EncryptWithAAD(ctx, payload, nil, secret)
+}
+
+func (c aesGcmCipher) KeySize() int {
+	return keySize
+}
+
+func (c aesGcmCipher) EncryptWithAAD(_ context.Context, payload, aad []byte, secret string) ([]byte, error) {
+	salt, err := randomSalt(c.random)
+	if err != nil {
+		return nil, err
+	}
+
+	key, err := encryption.KeyToBytes(secret, salt)
+	if err != nil {
+		return nil, err
+	}
+	defer encryption.Wipe(key)
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+
+	// The nonce must be unique for each encryption with the same key,
+	// so a fresh random one is generated and stored next to the salt.
+	return sealWithRandomNonce(gcm, c.random, salt, payload, aad)
+}
@@ -0,0 +1,102 @@
+package provider
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"encoding/hex"
+	"testing"
+
+	"github.com/grafana/grafana/pkg/services/encryption"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_aesGcmCipher(t *testing.T) {
+	cipher := aesGcmCipher{}
+	decipher := aesDecipher{algorithm: encryption.AesGcm}
+	ctx := context.Background()
+
+	t.Run("encrypt and decrypt should work", func(t *testing.T) {
+		encrypted, err := cipher.Encrypt(ctx, []byte("grafana"), "1234")
+		require.NoError(t, err)
+		assert.NotEmpty(t, encrypted)
+
+		decrypted, err := decipher.Decrypt(ctx, encrypted, "1234")
+		require.NoError(t, err)
+		assert.Equal(t, []byte("grafana"), decrypted)
+	})
+
+	t.Run("decrypt tampered ciphertext should fail", func(t *testing.T) {
+		encrypted, err := cipher.Encrypt(ctx, []byte("grafana"), "1234")
+		require.NoError(t, err)
+
+		encrypted[len(encrypted)-1] ^= 0x01
+
+		_, err = decipher.Decrypt(ctx, encrypted, "1234")
+		require.ErrorIs(t, err, encryption.ErrAuthenticationFailed)
+	})
+
+	t.Run("decrypt with wrong secret should fail", func(t *testing.T) {
+		encrypted, err := cipher.Encrypt(ctx, []byte("grafana"), "1234")
+		require.NoError(t, err)
+
+		_, err = decipher.Decrypt(ctx, encrypted, "4321")
+		require.ErrorIs(t, err, encryption.ErrAuthenticationFailed)
+	})
+}
+
+func Test_aesGcmCipher_InjectedRandomness(t *testing.T) {
+	ctx := context.Background()
+
+	unhex := func(s string) []byte {
+		b, err := hex.DecodeString(s)
+		require.NoError(t, err)
+		return b
+	}
+
+	t.Run("known answer with the injected nonce", func(t *testing.T) {
+		// Test Case 16 of "The Galois/Counter Mode of Operation (GCM)",
+		// as validated by NIST: 256-bit key, 96-bit nonce and AAD.
+		key := unhex("feffe9928665731c6d6a8f9467308308feffe9928665731c6d6a8f9467308308")
+		nonce := unhex("cafebabefacedbaddecaf888")
+		plaintext := unhex("d9313225f88406e5a55909c5aff5269a86a7a9531534f7da2e4c303d8a318a72" +
+			"1c3c0c95956809532fcf0e2449a6b525b16aedf5aa0de657ba637b39")
+		aad := unhex("feedfacedeadbeeffeedfacedeadbeefabaddad2")
+		expected := unhex("522dc1f099567d07f47f37a32a84427d643a8cdcbfe5c0c97598a2bd2555d1aa" +
+			"8cb08e48590dbb3da7b08b1056828838c5f61e6393ba7a0abcc9f662" +
+			"76fc6ece0f4e1768cddf8853bb2d551b")
+
+		block, err := aes.NewCipher(key)
+		require.NoError(t, err)
+		gcm, err := cipher.NewGCM(block)
+		require.NoError(t, err)
+
+		sealed, err := sealWithRandomNonce(gcm, bytes.NewReader(nonce), "12345678", plaintext, aad)
+		require.NoError(t, err)
+
+		assert.Equal(t, []byte("12345678"), sealed[:encryption.SaltLength])
+		assert.Equal(t, nonce, sealed[encryption.SaltLength:encryption.SaltLength+gcm.NonceSize()])
+		assert.Equal(t, expected, sealed[encryption.SaltLength+gcm.NonceSize():])
+	})
+
+	t.Run("same randomness should produce the same ciphertext", func(t *testing.T) {
+		random := bytes.Repeat([]byte{0x2a}, encryption.SaltLength+12)
+
+		first, err := aesGcmCipher{random: bytes.NewReader(random)}.Encrypt(ctx, []byte("grafana"), "1234")
+		require.NoError(t, err)
+		second, err := aesGcmCipher{random: bytes.NewReader(random)}.Encrypt(ctx, []byte("grafana"), "1234")
+		require.NoError(t, err)
+		assert.Equal(t, first, second)
+
+		decrypted, err := aesDecipher{algorithm: encryption.AesGcm}.Decrypt(ctx, first, "1234")
+		require.NoError(t, err)
+		assert.Equal(t, []byte("grafana"), decrypted)
+	})
+
+	t.Run("exhausted randomness should fail", func(t *testing.T) {
+		_, err := aesGcmCipher{random: bytes.NewReader(make([]byte, encryption.SaltLength))}.Encrypt(ctx, []byte("grafana"), "1234")
+		require.Error(t, err)
+	})
+}
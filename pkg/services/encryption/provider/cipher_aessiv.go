@@ -0,0 +1,70 @@
+package provider
+
+import (
+	"context"
+	"crypto/sha256"
+	"io"
+
+	"golang.org/x/crypto/hkdf"
+
+	"github.com/grafana/grafana/pkg/services/encryption"
+)
+
+// aesSivCipher implements AES-256-SIV (RFC 5297), a deterministic
+// authenticated encryption mode. The ciphertext layout is:
+//
+//	<synthetic iv><ciphertext>
+//
+// Unlike the other ciphers, neither a random salt nor a random nonce is
+// used, so encrypting the same payload with the same secret always results
+// in the same ciphertext. That's what makes it possible to look encrypted
+// values up without decrypting them, but it also means anyone with access
+// to the ciphertexts can tell which ones hold the same payload. It must
+// therefore never be the default algorithm, and must only be used for
+// values that need to be searchable.
+type aesSivCipher struct{}
+
+func (c aesSivCipher) Encrypt(ctx context.Context, payload []byte, secret string) ([]byte, error) {
+	return c.EncryptWithAAD(ctx, payload, nil, secret)
+}
+
+func (c aesSivCipher) KeySize() int {
+	return keySize
+}
+
+func (c aesSivCipher) EncryptWithAAD(_ context.Context, payload, aad []byte, secret string) ([]byte, error) {
+	key, err := deriveAesSivKey(secret)
+	if err != nil {
+		return nil, err
+	}
+	defer encryption.Wipe(key)
+
+	return sivSeal(key, payload, sivAD(aad)...)
+}
+
+// sivAD returns the associated data components for the given associated
+// data, so empty associated data results in the same ciphertexts as none.
+func sivAD(aad []byte) [][]byte {
+	if len(aad) == 0 {
+		return nil
+	}
+	return [][]byte{aad}
+}
+
+// deriveAesSivKey derives the 64 bytes key needed by AES-256-SIV from the
+// secret. A fixed salt is used in place of a random one, so the resulting
+// key (and thus the ciphertexts) only depend on the secret.
+func deriveAesSivKey(secret string) ([]byte, error) {
+	key, err := encryption.KeyToBytes(secret, encryption.AesSiv)
+	if err != nil {
+		return nil, err
+	}
+	defer encryption.Wipe(key)
+
+	sivKey := make([]byte, 64)
+	if _, err := io.ReadFull(hkdf.Expand(sha256.New, key, []byte(encryption.AesSiv)), sivKey); err != nil {
+		return nil, err
+	}
+
+	return sivKey, nil
+}
@@ -0,0 +1,100 @@
+package provider
+
+import (
+	"context"
+	"testing"
+
+	"github.com/grafana/grafana/pkg/services/encryption"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_aesSivCipher(t *testing.T) {
+	cipher := aesSivCipher{}
+	decipher := aesSivDecipher{}
+	ctx := context.Background()
+
+	t.Run("encrypt and decrypt should work", func(t *testing.T) {
+		encrypted, err := cipher.Encrypt(ctx, []byte("grafana"), "1234")
+		require.NoError(t, err)
+		assert.Len(t, encrypted, sivSize+len("grafana"))
+
+		decrypted, err := decipher.Decrypt(ctx, encrypted, "1234")
+		require.NoError(t, err)
+		assert.Equal(t, []byte("grafana"), decrypted)
+	})
+
+	t.Run("encrypt should be deterministic", func(t *testing.T) {
+		first, err := cipher.Encrypt(ctx, []byte("grafana"), "1234")
+		require.NoError(t, err)
+
+		second, err := cipher.Encrypt(ctx, []byte("grafana"), "1234")
+		require.NoError(t, err)
+
+		assert.Equal(t, first, second)
+
+		other, err := cipher.Encrypt(ctx, []byte("grafanA"), "1234")
+		require.NoError(t, err)
+
+		assert.NotEqual(t, first, other)
+	})
+
+	t.Run("encrypt with different secrets should differ", func(t *testing.T) {
+		first, err := cipher.Encrypt(ctx, []byte("grafana"), "1234")
+		require.NoError(t, err)
+
+		second, err := cipher.Encrypt(ctx, []byte("grafana"), "4321")
+		require.NoError(t, err)
+
+		assert.NotEqual(t, first, second)
+	})
+
+	t.Run("decrypt tampered ciphertext should fail", func(t *testing.T) {
+		encrypted, err := cipher.Encrypt(ctx, []byte("grafana"), "1234")
+		require.NoError(t, err)
+
+		for _, i := range []int{0, sivSize, len(encrypted) - 1} {
+			tampered := append([]byte{}, encrypted...)
+			tampered[i] ^= 0x01
+
+			_, err = decipher.Decrypt(ctx, tampered, "1234")
+			require.ErrorIs(t, err, encryption.ErrAuthenticationFailed)
+		}
+	})
+
+	t.Run("decrypt with wrong secret should fail", func(t *testing.T) {
+		encrypted, err := cipher.Encrypt(ctx, []byte("grafana"), "1234")
+		require.NoError(t, err)
+
+		_, err = decipher.Decrypt(ctx, encrypted, "4321")
+		require.ErrorIs(t, err, encryption.ErrAuthenticationFailed)
+	})
+
+	t.Run("decrypt short payload should fail", func(t *testing.T) {
+		_, err := decipher.Decrypt(ctx, make([]byte, sivSize-1), "1234")
+		require.Error(t, err)
+	})
+
+	t.Run("decrypt with derived key should work", func(t *testing.T) {
+		key, err := decipher.DeriveKey("1234")
+		require.NoError(t, err)
+
+		for _, payload := range []string{"grafana", "loki"} {
+			encrypted, err := cipher.Encrypt(ctx, []byte(payload), "1234")
+			require.NoError(t, err)
+
+			decrypted, err := decipher.DecryptWithKey(ctx, encrypted, key)
+			require.NoError(t, err)
+			assert.Equal(t, []byte(payload), decrypted)
+		}
+
+		wrongKey, err := decipher.DeriveKey("4321")
+		require.NoError(t, err)
+
+		encrypted, err := cipher.Encrypt(ctx, []byte("grafana"), "1234")
+		require.NoError(t, err)
+
+		_, err = decipher.DecryptWithKey(ctx, encrypted, wrongKey)
+		require.ErrorIs(t, err, encryption.ErrAuthenticationFailed)
+	})
+}
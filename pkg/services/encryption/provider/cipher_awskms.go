@@ -0,0 +1,138 @@
+package provider
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/kms"
+	"github.com/aws/aws-sdk-go/service/kms/kmsiface"
+
+	"github.com/grafana/grafana/pkg/services/encryption"
+	"github.com/grafana/grafana/pkg/setting"
+)
+
+const (
+	awsKmsKeyIDKey    = "aws_kms_key_id"
+	awsKmsRegionKey   = "aws_kms_region"
+	awsKmsEndpointKey = "aws_kms_endpoint"
+)
+
+// awsKms holds the AWS KMS client shared by the cipher and the decipher,
+// which is only created when first used, with the default credentials chain.
+type awsKms struct {
+	keyID    string
+	region   string
+	endpoint string
+
+	once   sync.Once
+	client kmsiface.KMSAPI
+	err    error
+}
+
+func newAwsKms(section setting.Section) *awsKms {
+	keyID := section.KeyValue(awsKmsKeyIDKey).MustString("")
+	if keyID == "" {
+		return nil
+	}
+
+	return &awsKms{
+		keyID:    keyID,
+		region:   section.KeyValue(awsKmsRegionKey).MustString(""),
+		endpoint: section.KeyValue(awsKmsEndpointKey).MustString(""),
+	}
+}
+
+func (k *awsKms) getClient() (kmsiface.KMSAPI, error) {
+	k.once.Do(func() {
+		if k.client != nil {
+			return
+		}
+
+		cfg := aws.NewConfig()
+		if k.region != "" {
+			cfg = cfg.WithRegion(k.region)
+		}
+		if k.endpoint != "" {
+			cfg = cfg.WithEndpoint(k.endpoint)
+		}
+
+		var sess *session.Session
+		sess, k.err = session.NewSession(cfg)
+		if k.err != nil {
+			return
+		}
+
+		k.client = kms.New(sess)
+	})
+
+	return k.client, k.err
+}
+
+type awsKmsCipher struct {
+	kms *awsKms
+
+	// random is the source the nonces are drawn from, as the data
+	// keys come from the key management service, crypto/rand.Reader
+	// when nil (see randomSource).
+	random io.Reader
+}
+
+func (c awsKmsCipher) Encrypt(ctx context.Context, payload []byte, secret string) ([]byte, error) {
+	client, err := c.kms.getClient()
+	if err != nil {
+		return nil, err
+	}
+
+	out, err := client.GenerateDataKeyWithContext(ctx, &kms.GenerateDataKeyInput{
+		KeyId:   aws.String(c.kms.keyID),
+		KeySpec: aws.String(kms.DataKeySpecAes256),
+	})
+	if err != nil {
+		return nil, awsKmsError("failed to generate data key", err)
+	}
+	defer encryption.Wipe(out.Plaintext)
+
+	return sealEnvelope(c.random, payload, out.Plaintext, out.CiphertextBlob, []byte(secret))
+}
+
+// IsRemote reports the cipher as remote, as it calls the key management service.
+func (c awsKmsCipher) IsRemote() bool {
+	return true
+}
+
+// Warmup checks that the key management service can be reached, see warmupCipher.
+func (c awsKmsCipher) Warmup(ctx context.Context) error {
+	return warmupCipher(ctx, c)
+}
+
+// KeySize returns the size of the data keys.
+func (c awsKmsCipher) KeySize() int {
+	return envelopeDataKeyLength
+}
+
+// awsKmsError wraps the given error, marking it as retryable when
+// it's caused by a transient failure, like a network error or throttling.
+func awsKmsError(msg string, err error) error {
+	wrapped := fmt.Errorf("%s: %w", msg, err)
+
+	if request.IsErrorRetryable(err) || request.IsErrorThrottle(err) {
+		return &encryption.RetryableError{Err: wrapped}
+	}
+
+	var awsErr awserr.Error
+	if errors.As(err, &awsErr) {
+		switch awsErr.Code() {
+		case kms.ErrCodeInternalException, kms.ErrCodeDependencyTimeoutException, kms.ErrCodeKeyUnavailableException:
+			return &encryption.RetryableError{Err: wrapped}
+		}
+	}
+
+	return wrapped
+}
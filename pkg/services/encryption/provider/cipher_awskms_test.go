@@ -0,0 +1,156 @@
+package provider
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"errors"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/kms"
+	"github.com/aws/aws-sdk-go/service/kms/kmsiface"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/grafana/grafana/pkg/services/encryption"
+	"github.com/grafana/grafana/pkg/setting"
+)
+
+// fakeAwsKms wraps data keys by prefixing them with the key id.
+type fakeAwsKms struct {
+	kmsiface.KMSAPI
+
+	err error
+}
+
+func (f *fakeAwsKms) GenerateDataKeyWithContext(_ aws.Context, input *kms.GenerateDataKeyInput, _ ...request.Option) (*kms.GenerateDataKeyOutput, error) {
+	if f.err != nil {
+		return nil, f.err
+	}
+
+	plaintext := make([]byte, 32)
+	if _, err := rand.Read(plaintext); err != nil {
+		return nil, err
+	}
+
+	return &kms.GenerateDataKeyOutput{
+		KeyId:          input.KeyId,
+		Plaintext:      append([]byte{}, plaintext...),
+		CiphertextBlob: append([]byte(*input.KeyId), plaintext...),
+	}, nil
+}
+
+func (f *fakeAwsKms) DecryptWithContext(_ aws.Context, input *kms.DecryptInput, _ ...request.Option) (*kms.DecryptOutput, error) {
+	if f.err != nil {
+		return nil, f.err
+	}
+
+	if !bytes.HasPrefix(input.CiphertextBlob, []byte("key-id")) {
+		return nil, awserr.New(kms.ErrCodeInvalidCiphertextException, "invalid ciphertext", nil)
+	}
+
+	return &kms.DecryptOutput{Plaintext: append([]byte{}, input.CiphertextBlob[len("key-id"):]...)}, nil
+}
+
+func Test_awsKmsCipher(t *testing.T) {
+	ctx := context.Background()
+
+	client := &fakeAwsKms{}
+	k := &awsKms{keyID: "key-id", client: client}
+
+	cipher := awsKmsCipher{kms: k}
+	decipher := awsKmsDecipher{kms: k}
+
+	t.Run("encrypt and decrypt should work", func(t *testing.T) {
+		encrypted, err := cipher.Encrypt(ctx, []byte("grafana"), "1234")
+		require.NoError(t, err)
+
+		wrappedKey, _, err := splitEnvelope(encrypted)
+		require.NoError(t, err)
+		assert.True(t, bytes.HasPrefix(wrappedKey, []byte("key-id")))
+
+		decrypted, err := decipher.Decrypt(ctx, encrypted, "1234")
+		require.NoError(t, err)
+		assert.Equal(t, []byte("grafana"), decrypted)
+	})
+
+	t.Run("decrypt with wrong secret should fail", func(t *testing.T) {
+		encrypted, err := cipher.Encrypt(ctx, []byte("grafana"), "1234")
+		require.NoError(t, err)
+
+		_, err = decipher.Decrypt(ctx, encrypted, "4321")
+		require.ErrorIs(t, err, encryption.ErrAuthenticationFailed)
+	})
+
+	t.Run("decrypt malformed payload should fail", func(t *testing.T) {
+		for _, payload := range [][]byte{{}, {0}, {0, 0, 1}, {0, 10, 1, 2, 3}} {
+			_, err := decipher.Decrypt(ctx, payload, "1234")
+			require.Error(t, err)
+		}
+	})
+
+	t.Run("decrypt with invalid wrapped key should not be retryable", func(t *testing.T) {
+		encrypted, err := cipher.Encrypt(ctx, []byte("grafana"), "1234")
+		require.NoError(t, err)
+		encrypted[2] ^= 0xff
+
+		_, err = decipher.Decrypt(ctx, encrypted, "1234")
+		require.Error(t, err)
+		assert.False(t, encryption.IsRetryable(err))
+	})
+
+	testCases := []struct {
+		desc      string
+		err       error
+		retryable bool
+	}{
+		{desc: "network error", err: awserr.New(request.ErrCodeRequestError, "connection reset", errors.New("connection reset by peer")), retryable: true},
+		{desc: "throttling", err: awserr.New("ThrottlingException", "rate exceeded", nil), retryable: true},
+		{desc: "kms internal error", err: awserr.New(kms.ErrCodeInternalException, "internal error", nil), retryable: true},
+		{desc: "access denied", err: awserr.New("AccessDeniedException", "access denied", nil), retryable: false},
+		{desc: "cancellation", err: awserr.New(request.CanceledErrorCode, "canceled", context.Canceled), retryable: false},
+	}
+
+	for _, tc := range testCases {
+		t.Run("with "+tc.desc+" should mark the error accordingly", func(t *testing.T) {
+			encrypted, err := cipher.Encrypt(ctx, []byte("grafana"), "1234")
+			require.NoError(t, err)
+
+			client.err = tc.err
+			defer func() { client.err = nil }()
+
+			_, err = cipher.Encrypt(ctx, []byte("grafana"), "1234")
+			require.ErrorIs(t, err, tc.err)
+			assert.Equal(t, tc.retryable, encryption.IsRetryable(err))
+
+			_, err = decipher.Decrypt(ctx, encrypted, "1234")
+			require.ErrorIs(t, err, tc.err)
+			assert.Equal(t, tc.retryable, encryption.IsRetryable(err))
+		})
+	}
+}
+
+func Test_Provider_AwsKms(t *testing.T) {
+	t.Run("without key id should not provide aws-kms", func(t *testing.T) {
+		p := ProvideEncryptionProvider(&setting.OSSImpl{Cfg: setting.NewCfg()})
+
+		assert.NotContains(t, p.ProvideCiphers(), encryption.AwsKms)
+		assert.NotContains(t, p.ProvideDeciphers(), encryption.AwsKms)
+	})
+
+	t.Run("with key id should provide aws-kms", func(t *testing.T) {
+		cfg := setting.NewCfg()
+		cfg.Raw.Section(securitySection).Key(awsKmsKeyIDKey).SetValue("key-id")
+		cfg.Raw.Section(securitySection).Key(awsKmsRegionKey).SetValue("eu-west-1")
+
+		p := ProvideEncryptionProvider(&setting.OSSImpl{Cfg: cfg})
+
+		assert.Contains(t, p.ProvideCiphers(), encryption.AwsKms)
+		assert.Contains(t, p.ProvideDeciphers(), encryption.AwsKms)
+		assert.Equal(t, "key-id", p.awsKms.keyID)
+		assert.Equal(t, "eu-west-1", p.awsKms.region)
+	})
+}
@@ -0,0 +1,256 @@
+package provider
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore"
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/policy"
+	"github.com/Azure/azure-sdk-for-go/sdk/azidentity"
+
+	"github.com/grafana/grafana/pkg/services/encryption"
+	"github.com/grafana/grafana/pkg/setting"
+)
+
+const (
+	azureKeyVaultURLKey           = "azure_keyvault_url"
+	azureKeyVaultKeyNameKey       = "azure_keyvault_key_name"
+	azureKeyVaultKeyVersionKey    = "azure_keyvault_key_version"
+	azureKeyVaultWrapAlgorithmKey = "azure_keyvault_wrap_algorithm"
+
+	defaultAzureKeyVaultWrapAlgorithm = "RSA-OAEP-256"
+
+	azureKeyVaultAPIVersion = "7.3"
+	azureKeyVaultScope      = "https://vault.azure.net/.default"
+
+	azureKeyVaultTimeout = 30 * time.Second
+
+	// azureKeyVaultTokenExpiryMargin is how long before its expiration
+	// an access token is considered expired, and so refreshed.
+	azureKeyVaultTokenExpiryMargin = 5 * time.Minute
+
+	// azureKeyVaultMaxResponseSize bounds the size of the responses
+	// read from Key Vault, which are small JSON documents.
+	azureKeyVaultMaxResponseSize = 1 << 20
+)
+
+// azureKeyVault is a client of the key operations of Azure Key Vault, shared
+// by the cipher and the decipher, used to wrap the data keys of envelopes.
+// It authenticates with the default Azure credential chain (environment,
+// managed identity, Azure CLI...), which is only set up when first used.
+//
+// Data keys are wrapped with the configured key version, or the latest one if
+// none is configured, and the version used is stored with the wrapped key:
+//
+//	<uint8 length><key version><wrapped data key>
+//
+// So payloads remain decryptable after rotating the key in Key Vault.
+type azureKeyVault struct {
+	vaultURL   string
+	keyName    string
+	keyVersion string
+	algorithm  string
+
+	client *http.Client
+
+	once       sync.Once
+	credential azcore.TokenCredential
+	err        error
+
+	mtx   sync.Mutex
+	token *azcore.AccessToken
+}
+
+func newAzureKeyVault(section setting.Section) *azureKeyVault {
+	vaultURL := section.KeyValue(azureKeyVaultURLKey).MustString("")
+	keyName := section.KeyValue(azureKeyVaultKeyNameKey).MustString("")
+	if vaultURL == "" || keyName == "" {
+		return nil
+	}
+
+	return &azureKeyVault{
+		vaultURL:   strings.TrimSuffix(vaultURL, "/"),
+		keyName:    keyName,
+		keyVersion: section.KeyValue(azureKeyVaultKeyVersionKey).MustString(""),
+		algorithm:  section.KeyValue(azureKeyVaultWrapAlgorithmKey).MustString(defaultAzureKeyVaultWrapAlgorithm),
+		client:     &http.Client{Timeout: azureKeyVaultTimeout},
+	}
+}
+
+// getToken returns an access token for Key Vault,
+// reusing the last one obtained until it's about to expire.
+func (k *azureKeyVault) getToken(ctx context.Context) (string, error) {
+	k.once.Do(func() {
+		if k.credential != nil {
+			return
+		}
+
+		var credential *azidentity.DefaultAzureCredential
+		credential, k.err = azidentity.NewDefaultAzureCredential(nil)
+		if k.err != nil {
+			return
+		}
+
+		k.credential = credential
+	})
+
+	if k.err != nil {
+		return "", k.err
+	}
+
+	k.mtx.Lock()
+	defer k.mtx.Unlock()
+
+	if k.token != nil && time.Until(k.token.ExpiresOn) > azureKeyVaultTokenExpiryMargin {
+		return k.token.Token, nil
+	}
+
+	token, err := k.credential.GetToken(ctx, policy.TokenRequestOptions{Scopes: []string{azureKeyVaultScope}})
+	if err != nil {
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			return "", ctxErr
+		}
+		return "", &encryption.RetryableError{Err: fmt.Errorf("azure key vault authentication failed: %w", err)}
+	}
+
+	k.token = token
+	return token.Token, nil
+}
+
+type azureKeyVaultRequest struct {
+	Algorithm string `json:"alg"`
+	Value     string `json:"value"`
+}
+
+type azureKeyVaultResponse struct {
+	KeyID string `json:"kid"`
+	Value string `json:"value"`
+	Error *struct {
+		Code    string `json:"code"`
+		Message string `json:"message"`
+	} `json:"error"`
+}
+
+// do sends the given value to the given key operation, either wrapkey or
+// unwrapkey, of the given key version, and returns the resulting value
+// together with the version of the key that processed it.
+func (k *azureKeyVault) do(ctx context.Context, operation, version string, value []byte) ([]byte, string, error) {
+	token, err := k.getToken(ctx)
+	if err != nil {
+		return nil, "", err
+	}
+
+	reqBody, err := json.Marshal(azureKeyVaultRequest{
+		Algorithm: k.algorithm,
+		Value:     base64.RawURLEncoding.EncodeToString(value),
+	})
+	if err != nil {
+		return nil, "", err
+	}
+
+	endpoint := fmt.Sprintf("%s/keys/%s/%s/%s?api-version=%s", k.vaultURL, url.PathEscape(k.keyName), url.PathEscape(version), operation, azureKeyVaultAPIVersion)
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, bytes.NewReader(reqBody))
+	if err != nil {
+		return nil, "", err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+token)
+
+	resp, err := k.client.Do(req)
+	if err != nil {
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			return nil, "", ctxErr
+		}
+		return nil, "", &encryption.RetryableError{Err: fmt.Errorf("azure key vault %s failed: %w", operation, err)}
+	}
+	defer func() { _ = resp.Body.Close() }()
+
+	var decoded azureKeyVaultResponse
+	decodeErr := json.NewDecoder(io.LimitReader(resp.Body, azureKeyVaultMaxResponseSize)).Decode(&decoded)
+
+	if resp.StatusCode != http.StatusOK {
+		msg := http.StatusText(resp.StatusCode)
+		if decoded.Error != nil {
+			msg = fmt.Sprintf("%s: %s", decoded.Error.Code, decoded.Error.Message)
+		}
+		err := fmt.Errorf("azure key vault %s failed with status %d: %s", operation, resp.StatusCode, msg)
+
+		// Throttling or any other server-side failure may be transient.
+		if resp.StatusCode == http.StatusTooManyRequests || (resp.StatusCode >= 500 && resp.StatusCode != http.StatusNotImplemented) {
+			return nil, "", &encryption.RetryableError{Err: err}
+		}
+
+		return nil, "", err
+	}
+
+	if decodeErr != nil {
+		return nil, "", fmt.Errorf("azure key vault %s failed: invalid response: %w", operation, decodeErr)
+	}
+
+	result, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(decoded.Value, "="))
+	if err != nil {
+		return nil, "", fmt.Errorf("azure key vault %s failed: invalid value: %w", operation, err)
+	}
+
+	// The key id is the URL of the key version: <vault>/keys/<name>/<version>
+	return result, path.Base(decoded.KeyID), nil
+}
+
+type azureKeyVaultCipher struct {
+	kv *azureKeyVault
+
+	// random is the source the data keys and nonces are drawn
+	// from, crypto/rand.Reader when nil (see randomSource).
+	random io.Reader
+}
+
+func (c azureKeyVaultCipher) Encrypt(ctx context.Context, payload []byte, secret string) ([]byte, error) {
+	dataKey := make([]byte, envelopeDataKeyLength)
+	if _, err := io.ReadFull(randomSource(c.random), dataKey); err != nil {
+		return nil, err
+	}
+	defer encryption.Wipe(dataKey)
+
+	wrapped, version, err := c.kv.do(ctx, "wrapkey", c.kv.keyVersion, dataKey)
+	if err != nil {
+		return nil, err
+	}
+
+	if version == "" || len(version) > 0xff {
+		return nil, errors.New("azure key vault wrapkey failed: invalid key version")
+	}
+
+	wrappedKey := make([]byte, 0, 1+len(version)+len(wrapped))
+	wrappedKey = append(wrappedKey, byte(len(version)))
+	wrappedKey = append(wrappedKey, version...)
+	wrappedKey = append(wrappedKey, wrapped...)
+
+	return sealEnvelope(c.random, payload, dataKey, wrappedKey, []byte(secret))
+}
+
+// IsRemote reports the cipher as remote, as it calls the key management service.
+func (c azureKeyVaultCipher) IsRemote() bool {
+	return true
+}
+
+// Warmup checks that the key management service can be reached, see warmupCipher.
+func (c azureKeyVaultCipher) Warmup(ctx context.Context) error {
+	return warmupCipher(ctx, c)
+}
+
+// KeySize returns the size of the data keys.
+func (c azureKeyVaultCipher) KeySize() int {
+	return envelopeDataKeyLength
+}
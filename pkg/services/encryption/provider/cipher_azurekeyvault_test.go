@@ -0,0 +1,238 @@
+package provider
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore"
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/policy"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/grafana/grafana/pkg/services/encryption"
+	"github.com/grafana/grafana/pkg/setting"
+)
+
+// newFakeAzureKeyVault starts a server that mimics the key operations of
+// Key Vault, "wrapping" keys by prefixing them with the key version.
+func newFakeAzureKeyVault(t *testing.T, status *int32) *httptest.Server {
+	t.Helper()
+
+	var server *httptest.Server
+	server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if code := atomic.LoadInt32(status); code != http.StatusOK {
+			w.WriteHeader(int(code))
+			_, _ = w.Write([]byte(`{"error":{"code":"Fake","message":"fake failure"}}`))
+			return
+		}
+
+		if r.Header.Get("Authorization") != "Bearer token" || r.URL.Query().Get("api-version") != azureKeyVaultAPIVersion {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		var body azureKeyVaultRequest
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&body))
+		require.Equal(t, defaultAzureKeyVaultWrapAlgorithm, body.Algorithm)
+
+		value, err := base64.RawURLEncoding.DecodeString(body.Value)
+		require.NoError(t, err)
+
+		parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/keys/"), "/")
+		if len(parts) != 3 || parts[0] != "grafana" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+
+		version, operation := parts[1], parts[2]
+		if version == "" {
+			version = "v2"
+		}
+
+		switch operation {
+		case "wrapkey":
+			value = append([]byte(version+":"), value...)
+		case "unwrapkey":
+			if !strings.HasPrefix(string(value), version+":") {
+				w.WriteHeader(http.StatusBadRequest)
+				_, _ = w.Write([]byte(`{"error":{"code":"BadParameter","message":"invalid ciphertext"}}`))
+				return
+			}
+			value = value[len(version)+1:]
+		default:
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+
+		_ = json.NewEncoder(w).Encode(map[string]string{
+			"kid":   server.URL + "/keys/grafana/" + version,
+			"value": base64.RawURLEncoding.EncodeToString(value),
+		})
+	}))
+	t.Cleanup(server.Close)
+
+	return server
+}
+
+// fakeAzureCredential counts the tokens requested.
+type fakeAzureCredential struct {
+	requested int32
+	err       error
+}
+
+func (c *fakeAzureCredential) GetToken(_ context.Context, opts policy.TokenRequestOptions) (*azcore.AccessToken, error) {
+	if c.err != nil {
+		return nil, c.err
+	}
+
+	if len(opts.Scopes) != 1 || opts.Scopes[0] != azureKeyVaultScope {
+		return nil, errors.New("unexpected scopes")
+	}
+
+	atomic.AddInt32(&c.requested, 1)
+	return &azcore.AccessToken{Token: "token", ExpiresOn: time.Now().Add(time.Hour)}, nil
+}
+
+func Test_azureKeyVaultCipher(t *testing.T) {
+	ctx := context.Background()
+
+	status := int32(http.StatusOK)
+	server := newFakeAzureKeyVault(t, &status)
+
+	cfg := setting.NewCfg()
+	cfg.Raw.Section(securitySection).Key(azureKeyVaultURLKey).SetValue(server.URL + "/")
+	cfg.Raw.Section(securitySection).Key(azureKeyVaultKeyNameKey).SetValue("grafana")
+
+	p := ProvideEncryptionProvider(&setting.OSSImpl{Cfg: cfg})
+
+	credential := &fakeAzureCredential{}
+	p.azureKeyVault.credential = credential
+
+	cipher := p.ProvideCiphers()[encryption.AzureKeyVault]
+	decipher := p.ProvideDeciphers()[encryption.AzureKeyVault]
+	require.NotNil(t, cipher)
+	require.NotNil(t, decipher)
+
+	t.Run("encrypt and decrypt should work", func(t *testing.T) {
+		encrypted, err := cipher.Encrypt(ctx, []byte("grafana"), "1234")
+		require.NoError(t, err)
+
+		wrappedKey, _, err := splitEnvelope(encrypted)
+		require.NoError(t, err)
+		assert.Equal(t, []byte("\x02v2v2:"), wrappedKey[:6])
+
+		decrypted, err := decipher.Decrypt(ctx, encrypted, "1234")
+		require.NoError(t, err)
+		assert.Equal(t, []byte("grafana"), decrypted)
+	})
+
+	t.Run("decrypt should use the key version that wrapped the data key", func(t *testing.T) {
+		p.azureKeyVault.keyVersion = "v1"
+		encrypted, err := cipher.Encrypt(ctx, []byte("grafana"), "1234")
+		p.azureKeyVault.keyVersion = ""
+		require.NoError(t, err)
+
+		decrypted, err := decipher.Decrypt(ctx, encrypted, "1234")
+		require.NoError(t, err)
+		assert.Equal(t, []byte("grafana"), decrypted)
+	})
+
+	t.Run("access token should be reused", func(t *testing.T) {
+		assert.Equal(t, int32(1), atomic.LoadInt32(&credential.requested))
+	})
+
+	t.Run("decrypt with wrong secret should fail", func(t *testing.T) {
+		encrypted, err := cipher.Encrypt(ctx, []byte("grafana"), "1234")
+		require.NoError(t, err)
+
+		_, err = decipher.Decrypt(ctx, encrypted, "4321")
+		require.ErrorIs(t, err, encryption.ErrAuthenticationFailed)
+	})
+
+	t.Run("decrypt malformed payload should fail", func(t *testing.T) {
+		for _, payload := range [][]byte{{}, {0}, {0, 0, 1}, {0, 1, 0}, {0, 2, 5, 'v'}, {0, 10, 1, 2, 3}} {
+			_, err := decipher.Decrypt(ctx, payload, "1234")
+			require.Error(t, err)
+		}
+	})
+
+	t.Run("decrypt with invalid wrapped key should not be retryable", func(t *testing.T) {
+		encrypted, err := cipher.Encrypt(ctx, []byte("grafana"), "1234")
+		require.NoError(t, err)
+		encrypted[5] ^= 0xff
+
+		_, err = decipher.Decrypt(ctx, encrypted, "1234")
+		require.Error(t, err)
+		assert.False(t, encryption.IsRetryable(err))
+	})
+
+	testCases := []struct {
+		status    int32
+		retryable bool
+	}{
+		{status: http.StatusTooManyRequests, retryable: true},
+		{status: http.StatusServiceUnavailable, retryable: true},
+		{status: http.StatusForbidden, retryable: false},
+		{status: http.StatusNotImplemented, retryable: false},
+	}
+
+	for _, tc := range testCases {
+		t.Run("with status "+http.StatusText(int(tc.status))+" should mark the error accordingly", func(t *testing.T) {
+			encrypted, err := cipher.Encrypt(ctx, []byte("grafana"), "1234")
+			require.NoError(t, err)
+
+			atomic.StoreInt32(&status, tc.status)
+			defer atomic.StoreInt32(&status, http.StatusOK)
+
+			_, err = cipher.Encrypt(ctx, []byte("grafana"), "1234")
+			require.Error(t, err)
+			assert.Equal(t, tc.retryable, encryption.IsRetryable(err))
+
+			_, err = decipher.Decrypt(ctx, encrypted, "1234")
+			require.Error(t, err)
+			assert.Equal(t, tc.retryable, encryption.IsRetryable(err))
+		})
+	}
+
+	t.Run("authentication failure should be retryable", func(t *testing.T) {
+		k := &azureKeyVault{vaultURL: server.URL, keyName: "grafana", algorithm: defaultAzureKeyVaultWrapAlgorithm, client: server.Client()}
+		k.credential = &fakeAzureCredential{err: errors.New("no credentials")}
+
+		_, err := azureKeyVaultCipher{kv: k}.Encrypt(ctx, []byte("grafana"), "1234")
+		require.Error(t, err)
+		assert.True(t, encryption.IsRetryable(err))
+	})
+}
+
+func Test_Provider_AzureKeyVault(t *testing.T) {
+	t.Run("without vault url or key name should not provide azure-keyvault", func(t *testing.T) {
+		cfg := setting.NewCfg()
+		cfg.Raw.Section(securitySection).Key(azureKeyVaultURLKey).SetValue("https://grafana.vault.azure.net")
+
+		p := ProvideEncryptionProvider(&setting.OSSImpl{Cfg: cfg})
+
+		assert.NotContains(t, p.ProvideCiphers(), encryption.AzureKeyVault)
+		assert.NotContains(t, p.ProvideDeciphers(), encryption.AzureKeyVault)
+	})
+
+	t.Run("with vault url and key name should provide azure-keyvault", func(t *testing.T) {
+		cfg := setting.NewCfg()
+		cfg.Raw.Section(securitySection).Key(azureKeyVaultURLKey).SetValue("https://grafana.vault.azure.net/")
+		cfg.Raw.Section(securitySection).Key(azureKeyVaultKeyNameKey).SetValue("grafana")
+
+		p := ProvideEncryptionProvider(&setting.OSSImpl{Cfg: cfg})
+
+		assert.Contains(t, p.ProvideCiphers(), encryption.AzureKeyVault)
+		assert.Contains(t, p.ProvideDeciphers(), encryption.AzureKeyVault)
+		assert.Equal(t, "https://grafana.vault.azure.net", p.azureKeyVault.vaultURL)
+		assert.Equal(t, defaultAzureKeyVaultWrapAlgorithm, p.azureKeyVault.algorithm)
+	})
+}
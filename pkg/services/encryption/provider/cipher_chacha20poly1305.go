@@ -0,0 +1,60 @@
+package provider
+
+import (
+	"context"
+	"crypto/cipher"
+	"io"
+
+	"golang.org/x/crypto/chacha20poly1305"
+
+	"github.com/grafana/grafana/pkg/services/encryption"
+)
+
+// chaCha20Poly1305Cipher encrypts with ChaCha20-Poly1305,
+// or with XChaCha20-Poly1305 when extended.
+type chaCha20Poly1305Cipher struct {
+	extended bool
+
+	// random is the source the salts and nonces are read
+	// from, crypto/rand.Reader when nil (see randomSource).
+	random io.Reader
+}
+
+func (c chaCha20Poly1305Cipher) Encrypt(ctx context.Context, payload []byte, secret string) ([]byte, error) {
+	return c.EncryptWithAAD(ctx, payload, nil, secret)
+}
+
+func (c chaCha20Poly1305Cipher) KeySize() int {
+	return keySize
+}
+
+func (c chaCha20Poly1305Cipher) EncryptWithAAD(_ context.Context, payload, aad []byte, secret string) ([]byte, error) {
+	salt, err := randomSalt(c.random)
+	if err != nil {
+		return nil, err
+	}
+
+	key, err := encryption.KeyToBytes(secret, salt)
+	if err != nil {
+		return nil, err
+	}
+	defer encryption.Wipe(key)
+
+	aead, err := newChaCha20Poly1305(key, c.extended)
+	if err != nil {
+		return nil, err
+	}
+
+	// A fresh random nonce is generated for every call and stored
+	// right after the salt, same as for AES-GCM.
+	return sealWithRandomNonce(aead, c.random, salt, payload, aad)
+}
+
+// newChaCha20Poly1305 returns the ChaCha20-Poly1305 AEAD with the given
+// key, or the XChaCha20-Poly1305 one, with 192-bit nonces, if extended.
+func newChaCha20Poly1305(key []byte, extended bool) (cipher.AEAD, error) {
+	if extended {
+		return chacha20poly1305.NewX(key)
+	}
+	return chacha20poly1305.New(key)
+}
@@ -0,0 +1,112 @@
+package provider
+
+import (
+	"context"
+	"crypto/rand"
+	"testing"
+
+	"github.com/grafana/grafana/pkg/services/encryption"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_chaCha20Poly1305Cipher(t *testing.T) {
+	cipher := chaCha20Poly1305Cipher{}
+	decipher := chaCha20Poly1305Decipher{}
+	ctx := context.Background()
+
+	t.Run("encrypt and decrypt should work", func(t *testing.T) {
+		encrypted, err := cipher.Encrypt(ctx, []byte("grafana"), "1234")
+		require.NoError(t, err)
+		assert.NotEmpty(t, encrypted)
+
+		decrypted, err := decipher.Decrypt(ctx, encrypted, "1234")
+		require.NoError(t, err)
+		assert.Equal(t, []byte("grafana"), decrypted)
+	})
+
+	t.Run("decrypt with fixed ciphertext should work", func(t *testing.T) {
+		// Raw slice of bytes that corresponds to the following ciphertext:
+		// - 'grafana' as payload
+		// - '1234' as secret
+		ciphertext := []byte{108, 69, 50, 68, 118, 112, 86, 48, 134, 73, 126, 153, 252, 45, 155, 4, 135, 72, 142, 189, 75, 18, 141, 60, 156, 95, 242, 33, 6, 19, 214, 66, 142, 128, 25, 39, 136, 23, 114, 174, 47, 40, 53}
+
+		decrypted, err := decipher.Decrypt(ctx, ciphertext, "1234")
+		require.NoError(t, err)
+		assert.Equal(t, []byte("grafana"), decrypted)
+	})
+
+	t.Run("decrypt tampered ciphertext should fail", func(t *testing.T) {
+		encrypted, err := cipher.Encrypt(ctx, []byte("grafana"), "1234")
+		require.NoError(t, err)
+
+		encrypted[len(encrypted)-1] ^= 0x01
+
+		_, err = decipher.Decrypt(ctx, encrypted, "1234")
+		require.ErrorIs(t, err, encryption.ErrAuthenticationFailed)
+	})
+
+	t.Run("decrypt too short payload should fail", func(t *testing.T) {
+		_, err := decipher.Decrypt(ctx, []byte("grafana"), "1234")
+		require.Error(t, err)
+	})
+}
+
+func Test_xChaCha20Poly1305Cipher(t *testing.T) {
+	cipher := chaCha20Poly1305Cipher{extended: true}
+	decipher := chaCha20Poly1305Decipher{extended: true}
+	ctx := context.Background()
+
+	t.Run("encrypt and decrypt should work", func(t *testing.T) {
+		encrypted, err := cipher.Encrypt(ctx, []byte("grafana"), "1234")
+		require.NoError(t, err)
+		assert.Len(t, encrypted, encryption.SaltLength+24+len("grafana")+16)
+
+		decrypted, err := decipher.Decrypt(ctx, encrypted, "1234")
+		require.NoError(t, err)
+		assert.Equal(t, []byte("grafana"), decrypted)
+	})
+
+	t.Run("decrypt with the other nonce size should fail", func(t *testing.T) {
+		encrypted, err := cipher.Encrypt(ctx, []byte("grafana"), "1234")
+		require.NoError(t, err)
+
+		_, err = chaCha20Poly1305Decipher{}.Decrypt(ctx, encrypted, "1234")
+		require.ErrorIs(t, err, encryption.ErrAuthenticationFailed)
+
+		encrypted, err = chaCha20Poly1305Cipher{}.Encrypt(ctx, []byte("grafana"), "1234")
+		require.NoError(t, err)
+
+		_, err = decipher.Decrypt(ctx, encrypted, "1234")
+		require.Error(t, err)
+	})
+
+	t.Run("decrypt tampered ciphertext should fail", func(t *testing.T) {
+		encrypted, err := cipher.EncryptWithAAD(ctx, []byte("grafana"), []byte("aad"), "1234")
+		require.NoError(t, err)
+
+		_, err = decipher.DecryptWithAAD(ctx, encrypted, []byte("other"), "1234")
+		require.ErrorIs(t, err, encryption.ErrAuthenticationFailed)
+	})
+}
+
+func Benchmark_Ciphers(b *testing.B) {
+	ctx := context.Background()
+
+	payload := make([]byte, 1<<20)
+	_, err := rand.Read(payload)
+	require.NoError(b, err)
+
+	ciphers := Provider{}.ProvideCiphers()
+	for _, algorithm := range []string{encryption.AesCfb, encryption.AesGcm, encryption.ChaCha20Poly1305} {
+		cipher := ciphers[algorithm]
+		b.Run(algorithm, func(b *testing.B) {
+			b.SetBytes(int64(len(payload)))
+			for i := 0; i < b.N; i++ {
+				if _, err := cipher.Encrypt(ctx, payload, "1234"); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
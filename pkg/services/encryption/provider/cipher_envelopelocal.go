@@ -0,0 +1,111 @@
+package provider
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"errors"
+	"io"
+
+	"github.com/grafana/grafana/pkg/services/encryption"
+)
+
+// The envelope-local ciphers wrap the data keys themselves, with AES-GCM and a
+// master key derived from the secret, same as the AesGcm cipher does with the
+// payloads. The wrapped data key, stored in the envelope (see sealEnvelope),
+// is made of the salt the master key is derived with, the nonce and the
+// sealed data key:
+//
+//	<salt><nonce><ciphertext>
+//
+// Unlike with the other envelope ciphers, the payload is sealed with the
+// associated data given by the caller, if any, rather than the secret, which
+// the data key is already bound to, so rewrapping the data key with a new
+// secret (see envelopeLocalDecipher.Rewrap) leaves the rest untouched.
+const envelopeLocalWrappedKeyLength = encryption.SaltLength + 12 + envelopeDataKeyLength + 16
+
+// envelopeLocalLabel is the associated data of the wrapped data keys, so they
+// cannot be mistaken for AesGcm payloads encrypted with the same secret.
+var envelopeLocalLabel = []byte("grafana envelope-local data key")
+
+type envelopeLocalCipher struct {
+	// random is the source the data keys, salts and nonces are
+	// drawn from, crypto/rand.Reader when nil (see randomSource).
+	random io.Reader
+}
+
+func (c envelopeLocalCipher) Encrypt(ctx context.Context, payload []byte, secret string) ([]byte, error) {
+	return c.EncryptWithAAD(ctx, payload, nil, secret)
+}
+
+// KeySize returns the size of the data keys.
+func (c envelopeLocalCipher) KeySize() int {
+	return envelopeDataKeyLength
+}
+
+func (c envelopeLocalCipher) EncryptWithAAD(_ context.Context, payload, aad []byte, secret string) ([]byte, error) {
+	dataKey := make([]byte, envelopeDataKeyLength)
+	if _, err := io.ReadFull(randomSource(c.random), dataKey); err != nil {
+		return nil, err
+	}
+	defer encryption.Wipe(dataKey)
+
+	wrappedKey, err := wrapLocalDataKey(c.random, dataKey, secret)
+	if err != nil {
+		return nil, err
+	}
+
+	return sealEnvelope(c.random, payload, dataKey, wrappedKey, aad)
+}
+
+// wrapLocalDataKey wraps the given data key with the master key derived from
+// the given secret and a random salt, read from the given source of randomness.
+func wrapLocalDataKey(random io.Reader, dataKey []byte, secret string) ([]byte, error) {
+	salt, err := randomSalt(random)
+	if err != nil {
+		return nil, err
+	}
+
+	gcm, err := newLocalMasterKeyAEAD(secret, salt)
+	if err != nil {
+		return nil, err
+	}
+
+	return sealWithRandomNonce(gcm, random, salt, dataKey, envelopeLocalLabel)
+}
+
+// unwrapLocalDataKey unwraps the given data key, as wrapped by wrapLocalDataKey,
+// and fails with encryption.ErrAuthenticationFailed if the secret is wrong.
+func unwrapLocalDataKey(wrappedKey []byte, secret string) ([]byte, error) {
+	if len(wrappedKey) != envelopeLocalWrappedKeyLength {
+		return nil, errors.New("malformed wrapped data key")
+	}
+
+	gcm, err := newLocalMasterKeyAEAD(secret, string(wrappedKey[:encryption.SaltLength]))
+	if err != nil {
+		return nil, err
+	}
+
+	nonce := wrappedKey[encryption.SaltLength : encryption.SaltLength+gcm.NonceSize()]
+	dataKey, err := gcm.Open(nil, nonce, wrappedKey[encryption.SaltLength+gcm.NonceSize():], envelopeLocalLabel)
+	if err != nil {
+		return nil, encryption.ErrAuthenticationFailed
+	}
+
+	return dataKey, nil
+}
+
+func newLocalMasterKeyAEAD(secret, salt string) (cipher.AEAD, error) {
+	key, err := encryption.KeyToBytes(secret, salt)
+	if err != nil {
+		return nil, err
+	}
+	defer encryption.Wipe(key)
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return cipher.NewGCM(block)
+}
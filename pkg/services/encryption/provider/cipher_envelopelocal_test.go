@@ -0,0 +1,93 @@
+package provider
+
+import (
+	"context"
+	"encoding/base64"
+	"testing"
+
+	"github.com/grafana/grafana/pkg/services/encryption"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_envelopeLocalCipher(t *testing.T) {
+	cipher := envelopeLocalCipher{}
+	decipher := envelopeLocalDecipher{}
+	ctx := context.Background()
+
+	t.Run("encrypt and decrypt should work", func(t *testing.T) {
+		encrypted, err := cipher.Encrypt(ctx, []byte("grafana"), "1234")
+		require.NoError(t, err)
+
+		n, err := encryption.CiphertextLen(encryption.EnvelopeLocal, len("grafana"))
+		require.NoError(t, err)
+		assert.Equal(t, n, base64.RawStdEncoding.EncodedLen(len(encryption.EnvelopeLocal))+2+len(encrypted))
+
+		decrypted, err := decipher.Decrypt(ctx, encrypted, "1234")
+		require.NoError(t, err)
+		assert.Equal(t, []byte("grafana"), decrypted)
+	})
+
+	t.Run("encrypt and decrypt with aad should work", func(t *testing.T) {
+		encrypted, err := cipher.EncryptWithAAD(ctx, []byte("grafana"), []byte("password"), "1234")
+		require.NoError(t, err)
+
+		decrypted, err := decipher.DecryptWithAAD(ctx, encrypted, []byte("password"), "1234")
+		require.NoError(t, err)
+		assert.Equal(t, []byte("grafana"), decrypted)
+
+		_, err = decipher.DecryptWithAAD(ctx, encrypted, []byte("token"), "1234")
+		require.ErrorIs(t, err, encryption.ErrAuthenticationFailed)
+	})
+
+	t.Run("decrypt with wrong secret should fail", func(t *testing.T) {
+		encrypted, err := cipher.Encrypt(ctx, []byte("grafana"), "1234")
+		require.NoError(t, err)
+
+		_, err = decipher.Decrypt(ctx, encrypted, "4321")
+		require.ErrorIs(t, err, encryption.ErrAuthenticationFailed)
+	})
+
+	t.Run("decrypt tampered ciphertext should fail", func(t *testing.T) {
+		encrypted, err := cipher.Encrypt(ctx, []byte("grafana"), "1234")
+		require.NoError(t, err)
+
+		for _, i := range []int{envelopeLengthSize + 1, len(encrypted) - 1} {
+			tampered := append([]byte{}, encrypted...)
+			tampered[i] ^= 0x01
+
+			_, err = decipher.Decrypt(ctx, tampered, "1234")
+			require.ErrorIs(t, err, encryption.ErrAuthenticationFailed)
+		}
+	})
+
+	t.Run("rewrap should only replace the wrapped data key", func(t *testing.T) {
+		encrypted, err := cipher.EncryptWithAAD(ctx, []byte("grafana"), []byte("password"), "1234")
+		require.NoError(t, err)
+		original := append([]byte{}, encrypted...)
+
+		rewrapped, err := decipher.Rewrap(ctx, encrypted, "1234", "4321")
+		require.NoError(t, err)
+		assert.Equal(t, original, encrypted)
+		assert.Len(t, rewrapped, len(encrypted))
+
+		prefixLen := envelopeLengthSize + envelopeLocalWrappedKeyLength
+		assert.Equal(t, encrypted[prefixLen:], rewrapped[prefixLen:])
+		assert.NotEqual(t, encrypted[:prefixLen], rewrapped[:prefixLen])
+
+		decrypted, err := decipher.DecryptWithAAD(ctx, rewrapped, []byte("password"), "4321")
+		require.NoError(t, err)
+		assert.Equal(t, []byte("grafana"), decrypted)
+
+		_, err = decipher.DecryptWithAAD(ctx, rewrapped, []byte("password"), "1234")
+		require.ErrorIs(t, err, encryption.ErrAuthenticationFailed)
+	})
+
+	t.Run("rewrap with wrong secret should fail", func(t *testing.T) {
+		encrypted, err := cipher.Encrypt(ctx, []byte("grafana"), "1234")
+		require.NoError(t, err)
+
+		_, err = decipher.Rewrap(ctx, encrypted, "4321", "5678")
+		require.ErrorIs(t, err, encryption.ErrAuthenticationFailed)
+	})
+}
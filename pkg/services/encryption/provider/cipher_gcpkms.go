@@ -0,0 +1,168 @@
+package provider
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"sync"
+
+	kms "cloud.google.com/go/kms/apiv1"
+	"github.com/googleapis/gax-go/v2"
+	"google.golang.org/api/option"
+	kmspb "google.golang.org/genproto/googleapis/cloud/kms/v1"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/wrapperspb"
+
+	"github.com/grafana/grafana/pkg/services/encryption"
+	"github.com/grafana/grafana/pkg/setting"
+)
+
+const (
+	gcpKmsKeyNameKey         = "gcp_kms_key_name"
+	gcpKmsEndpointKey        = "gcp_kms_endpoint"
+	gcpKmsCredentialsFileKey = "gcp_kms_credentials_file"
+)
+
+// gcpKmsClient is the subset of the Cloud KMS
+// client used by the cipher and the decipher.
+type gcpKmsClient interface {
+	Encrypt(ctx context.Context, req *kmspb.EncryptRequest, opts ...gax.CallOption) (*kmspb.EncryptResponse, error)
+	Decrypt(ctx context.Context, req *kmspb.DecryptRequest, opts ...gax.CallOption) (*kmspb.DecryptResponse, error)
+}
+
+// gcpKms holds the Cloud KMS client shared by the cipher and the decipher,
+// which is only created when first used, with the application default
+// credentials unless a credentials file is configured.
+//
+// Unlike AWS KMS, Cloud KMS cannot generate data keys, so they're generated
+// locally and then wrapped with the configured key, whose resource name is
+// projects/<project>/locations/<location>/keyRings/<key ring>/cryptoKeys/<key>.
+type gcpKms struct {
+	keyName         string
+	endpoint        string
+	credentialsFile string
+
+	once   sync.Once
+	client gcpKmsClient
+	err    error
+}
+
+func newGcpKms(section setting.Section) *gcpKms {
+	keyName := section.KeyValue(gcpKmsKeyNameKey).MustString("")
+	if keyName == "" {
+		return nil
+	}
+
+	return &gcpKms{
+		keyName:         keyName,
+		endpoint:        section.KeyValue(gcpKmsEndpointKey).MustString(""),
+		credentialsFile: section.KeyValue(gcpKmsCredentialsFileKey).MustString(""),
+	}
+}
+
+func (k *gcpKms) getClient() (gcpKmsClient, error) {
+	k.once.Do(func() {
+		if k.client != nil {
+			return
+		}
+
+		var opts []option.ClientOption
+		if k.endpoint != "" {
+			opts = append(opts, option.WithEndpoint(k.endpoint))
+		}
+		if k.credentialsFile != "" {
+			opts = append(opts, option.WithCredentialsFile(k.credentialsFile))
+		}
+
+		// The context used to create the client is also used to refresh its
+		// credentials, so it must not be bound to any particular request.
+		var client *kms.KeyManagementClient
+		client, k.err = kms.NewKeyManagementClient(context.Background(), opts...)
+		if k.err != nil {
+			return
+		}
+
+		k.client = client
+	})
+
+	return k.client, k.err
+}
+
+type gcpKmsCipher struct {
+	kms *gcpKms
+
+	// random is the source the data keys and nonces are drawn
+	// from, crypto/rand.Reader when nil (see randomSource).
+	random io.Reader
+}
+
+func (c gcpKmsCipher) Encrypt(ctx context.Context, payload []byte, secret string) ([]byte, error) {
+	client, err := c.kms.getClient()
+	if err != nil {
+		return nil, err
+	}
+
+	dataKey := make([]byte, envelopeDataKeyLength)
+	if _, err := io.ReadFull(randomSource(c.random), dataKey); err != nil {
+		return nil, err
+	}
+	defer encryption.Wipe(dataKey)
+
+	resp, err := client.Encrypt(ctx, &kmspb.EncryptRequest{
+		Name:            c.kms.keyName,
+		Plaintext:       dataKey,
+		PlaintextCrc32C: wrapperspb.Int64(gcpKmsChecksum(dataKey)),
+	})
+	if err != nil {
+		return nil, gcpKmsError("failed to wrap data key", err)
+	}
+
+	// Checksums protect against corruption
+	// in transit, so they're worth a retry.
+	if !resp.VerifiedPlaintextCrc32C || resp.CiphertextCrc32C == nil || resp.CiphertextCrc32C.Value != gcpKmsChecksum(resp.Ciphertext) {
+		return nil, &encryption.RetryableError{Err: errors.New("failed to wrap data key: checksum mismatch")}
+	}
+
+	return sealEnvelope(c.random, payload, dataKey, resp.Ciphertext, []byte(secret))
+}
+
+// IsRemote reports the cipher as remote, as it calls the key management service.
+func (c gcpKmsCipher) IsRemote() bool {
+	return true
+}
+
+// Warmup checks that the key management service can be reached, see warmupCipher.
+func (c gcpKmsCipher) Warmup(ctx context.Context) error {
+	return warmupCipher(ctx, c)
+}
+
+// KeySize returns the size of the data keys.
+func (c gcpKmsCipher) KeySize() int {
+	return envelopeDataKeyLength
+}
+
+var gcpKmsCrc32cTable = crc32.MakeTable(crc32.Castagnoli)
+
+// gcpKmsChecksum returns the CRC32C checksum
+// Cloud KMS uses to verify requests and responses.
+func gcpKmsChecksum(b []byte) int64 {
+	return int64(crc32.Checksum(b, gcpKmsCrc32cTable))
+}
+
+// gcpKmsError wraps the given error, marking it as retryable when
+// it's caused by a transient failure, like unavailability or throttling.
+// Note the client already retries some of those by itself, so they're only
+// returned once its own retries are exhausted.
+func gcpKmsError(msg string, err error) error {
+	wrapped := fmt.Errorf("%s: %w", msg, err)
+
+	switch status.Code(err) {
+	case codes.Unavailable, codes.ResourceExhausted, codes.Internal, codes.Aborted, codes.DeadlineExceeded:
+		return &encryption.RetryableError{Err: wrapped}
+	}
+
+	return wrapped
+}
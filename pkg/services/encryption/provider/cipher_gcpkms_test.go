@@ -0,0 +1,216 @@
+package provider
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net"
+	"sync/atomic"
+	"testing"
+
+	kms "cloud.google.com/go/kms/apiv1"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/api/option"
+	kmspb "google.golang.org/genproto/googleapis/cloud/kms/v1"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/wrapperspb"
+
+	"github.com/grafana/grafana/pkg/services/encryption"
+	"github.com/grafana/grafana/pkg/setting"
+)
+
+const fakeGcpKmsKeyName = "projects/grafana/locations/global/keyRings/grafana/cryptoKeys/secrets"
+
+// fakeGcpKms mimics Cloud KMS, wrapping data keys by prefixing them with
+// the key name. When code is set, requests fail with that status code.
+type fakeGcpKms struct {
+	kmspb.UnimplementedKeyManagementServiceServer
+
+	code int32
+}
+
+func (f *fakeGcpKms) Encrypt(_ context.Context, req *kmspb.EncryptRequest) (*kmspb.EncryptResponse, error) {
+	if code := codes.Code(atomic.LoadInt32(&f.code)); code != codes.OK {
+		return nil, status.Error(code, "fake failure")
+	}
+
+	if req.Name != fakeGcpKmsKeyName {
+		return nil, status.Error(codes.NotFound, "key not found")
+	}
+
+	if req.PlaintextCrc32C == nil || req.PlaintextCrc32C.Value != gcpKmsChecksum(req.Plaintext) {
+		return nil, status.Error(codes.InvalidArgument, "checksum mismatch")
+	}
+
+	ciphertext := append([]byte(req.Name), req.Plaintext...)
+	return &kmspb.EncryptResponse{
+		Name:                    req.Name + "/cryptoKeyVersions/1",
+		Ciphertext:              ciphertext,
+		CiphertextCrc32C:        wrapperspb.Int64(gcpKmsChecksum(ciphertext)),
+		VerifiedPlaintextCrc32C: true,
+	}, nil
+}
+
+func (f *fakeGcpKms) Decrypt(_ context.Context, req *kmspb.DecryptRequest) (*kmspb.DecryptResponse, error) {
+	if code := codes.Code(atomic.LoadInt32(&f.code)); code != codes.OK {
+		return nil, status.Error(code, "fake failure")
+	}
+
+	if req.CiphertextCrc32C == nil || req.CiphertextCrc32C.Value != gcpKmsChecksum(req.Ciphertext) {
+		return nil, status.Error(codes.InvalidArgument, "checksum mismatch")
+	}
+
+	if !bytes.HasPrefix(req.Ciphertext, []byte(req.Name)) {
+		return nil, status.Error(codes.InvalidArgument, "invalid ciphertext")
+	}
+
+	plaintext := req.Ciphertext[len(req.Name):]
+	return &kmspb.DecryptResponse{
+		Plaintext:       plaintext,
+		PlaintextCrc32C: wrapperspb.Int64(gcpKmsChecksum(plaintext)),
+	}, nil
+}
+
+// newFakeGcpKmsClient starts a gRPC server backed by the given fake
+// and returns a Cloud KMS client connected to it.
+func newFakeGcpKmsClient(t *testing.T, fake *fakeGcpKms) *kms.KeyManagementClient {
+	t.Helper()
+
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	server := grpc.NewServer()
+	kmspb.RegisterKeyManagementServiceServer(server, fake)
+	go func() { _ = server.Serve(lis) }()
+	t.Cleanup(server.Stop)
+
+	client, err := kms.NewKeyManagementClient(context.Background(),
+		option.WithEndpoint(lis.Addr().String()),
+		option.WithoutAuthentication(),
+		option.WithGRPCDialOption(grpc.WithTransportCredentials(insecure.NewCredentials())),
+	)
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = client.Close() })
+
+	// The client retries some failures by itself, with backoff,
+	// which would only slow down the tests of those failures.
+	client.CallOptions.Encrypt = nil
+	client.CallOptions.Decrypt = nil
+
+	return client
+}
+
+// grpcCode returns the status code of the gRPC error wrapped by the given one.
+func grpcCode(err error) codes.Code {
+	var grpcErr interface{ GRPCStatus() *status.Status }
+	if errors.As(err, &grpcErr) {
+		return grpcErr.GRPCStatus().Code()
+	}
+	return codes.Unknown
+}
+
+func Test_gcpKmsCipher(t *testing.T) {
+	ctx := context.Background()
+
+	fake := &fakeGcpKms{}
+	k := &gcpKms{keyName: fakeGcpKmsKeyName, client: newFakeGcpKmsClient(t, fake)}
+
+	cipher := gcpKmsCipher{kms: k}
+	decipher := gcpKmsDecipher{kms: k}
+
+	t.Run("encrypt and decrypt should work", func(t *testing.T) {
+		encrypted, err := cipher.Encrypt(ctx, []byte("grafana"), "1234")
+		require.NoError(t, err)
+
+		wrappedKey, _, err := splitEnvelope(encrypted)
+		require.NoError(t, err)
+		assert.True(t, bytes.HasPrefix(wrappedKey, []byte(fakeGcpKmsKeyName)))
+
+		decrypted, err := decipher.Decrypt(ctx, encrypted, "1234")
+		require.NoError(t, err)
+		assert.Equal(t, []byte("grafana"), decrypted)
+	})
+
+	t.Run("decrypt with wrong secret should fail", func(t *testing.T) {
+		encrypted, err := cipher.Encrypt(ctx, []byte("grafana"), "1234")
+		require.NoError(t, err)
+
+		_, err = decipher.Decrypt(ctx, encrypted, "4321")
+		require.ErrorIs(t, err, encryption.ErrAuthenticationFailed)
+	})
+
+	t.Run("decrypt malformed payload should fail", func(t *testing.T) {
+		for _, payload := range [][]byte{{}, {0}, {0, 0, 1}, {0, 10, 1, 2, 3}} {
+			_, err := decipher.Decrypt(ctx, payload, "1234")
+			require.Error(t, err)
+		}
+	})
+
+	t.Run("decrypt with invalid wrapped key should not be retryable", func(t *testing.T) {
+		encrypted, err := cipher.Encrypt(ctx, []byte("grafana"), "1234")
+		require.NoError(t, err)
+		encrypted[2] ^= 0xff
+
+		_, err = decipher.Decrypt(ctx, encrypted, "1234")
+		require.Error(t, err)
+		assert.Equal(t, codes.InvalidArgument, grpcCode(err))
+		assert.False(t, encryption.IsRetryable(err))
+	})
+
+	testCases := []struct {
+		code      codes.Code
+		retryable bool
+	}{
+		{code: codes.Unavailable, retryable: true},
+		{code: codes.ResourceExhausted, retryable: true},
+		{code: codes.Internal, retryable: true},
+		{code: codes.PermissionDenied, retryable: false},
+		{code: codes.FailedPrecondition, retryable: false},
+	}
+
+	for _, tc := range testCases {
+		t.Run("with "+tc.code.String()+" should mark the error accordingly", func(t *testing.T) {
+			encrypted, err := cipher.Encrypt(ctx, []byte("grafana"), "1234")
+			require.NoError(t, err)
+
+			atomic.StoreInt32(&fake.code, int32(tc.code))
+			defer atomic.StoreInt32(&fake.code, int32(codes.OK))
+
+			_, err = cipher.Encrypt(ctx, []byte("grafana"), "1234")
+			require.Error(t, err)
+			assert.Equal(t, tc.code, grpcCode(err))
+			assert.Equal(t, tc.retryable, encryption.IsRetryable(err))
+
+			_, err = decipher.Decrypt(ctx, encrypted, "1234")
+			require.Error(t, err)
+			assert.Equal(t, tc.code, grpcCode(err))
+			assert.Equal(t, tc.retryable, encryption.IsRetryable(err))
+		})
+	}
+}
+
+func Test_Provider_GcpKms(t *testing.T) {
+	t.Run("without key name should not provide gcp-kms", func(t *testing.T) {
+		p := ProvideEncryptionProvider(&setting.OSSImpl{Cfg: setting.NewCfg()})
+
+		assert.NotContains(t, p.ProvideCiphers(), encryption.GcpKms)
+		assert.NotContains(t, p.ProvideDeciphers(), encryption.GcpKms)
+	})
+
+	t.Run("with key name should provide gcp-kms", func(t *testing.T) {
+		cfg := setting.NewCfg()
+		cfg.Raw.Section(securitySection).Key(gcpKmsKeyNameKey).SetValue(fakeGcpKmsKeyName)
+		cfg.Raw.Section(securitySection).Key(gcpKmsEndpointKey).SetValue("kms.example.com:443")
+
+		p := ProvideEncryptionProvider(&setting.OSSImpl{Cfg: cfg})
+
+		assert.Contains(t, p.ProvideCiphers(), encryption.GcpKms)
+		assert.Contains(t, p.ProvideDeciphers(), encryption.GcpKms)
+		assert.Equal(t, fakeGcpKmsKeyName, p.gcpKms.keyName)
+		assert.Equal(t, "kms.example.com:443", p.gcpKms.endpoint)
+	})
+}
@@ -0,0 +1,150 @@
+package provider
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/grafana/grafana/pkg/services/encryption"
+	"github.com/grafana/grafana/pkg/setting"
+)
+
+const (
+	vaultTransitAddressKey = "vault_transit_address"
+	vaultTransitTokenKey   = "vault_transit_token"
+	vaultTransitMountKey   = "vault_transit_mount"
+	vaultTransitKeyNameKey = "vault_transit_key"
+
+	defaultVaultTransitMount = "transit"
+
+	vaultTransitTimeout = 30 * time.Second
+
+	// vaultTransitMaxResponseSize bounds the size of the responses read from
+	// Vault, which are small JSON documents wrapping the (de)ciphertexts.
+	vaultTransitMaxResponseSize = 64 << 20
+)
+
+// vaultTransit is a client of the transit secrets engine of HashiCorp Vault,
+// shared by the cipher and the decipher. The payloads are encrypted by Vault
+// itself, so no key material is ever held by Grafana, and the ciphertexts are
+// stored as returned by Vault (i.e. vault:v<version>:<ciphertext>), so keys
+// can be rotated in Vault transparently. As a consequence, the secret passed
+// to Encrypt and Decrypt is not used, so the payloads aren't bound to it and
+// decrypt with any secret, see encryption.IsSecretBound.
+type vaultTransit struct {
+	address string
+	token   string
+	mount   string
+	keyName string
+
+	client *http.Client
+}
+
+func newVaultTransit(section setting.Section) *vaultTransit {
+	address := section.KeyValue(vaultTransitAddressKey).MustString("")
+	keyName := section.KeyValue(vaultTransitKeyNameKey).MustString("")
+	if address == "" || keyName == "" {
+		return nil
+	}
+
+	return &vaultTransit{
+		address: strings.TrimSuffix(address, "/"),
+		token:   section.KeyValue(vaultTransitTokenKey).MustString(""),
+		mount:   strings.Trim(section.KeyValue(vaultTransitMountKey).MustString(defaultVaultTransitMount), "/"),
+		keyName: keyName,
+		client:  &http.Client{Timeout: vaultTransitTimeout},
+	}
+}
+
+type vaultTransitResponse struct {
+	Data struct {
+		Ciphertext string `json:"ciphertext"`
+		Plaintext  string `json:"plaintext"`
+	} `json:"data"`
+	Errors []string `json:"errors"`
+}
+
+// do sends the given request body to the given transit operation,
+// either encrypt or decrypt, and returns the decoded response.
+func (v *vaultTransit) do(ctx context.Context, operation string, body map[string]string) (*vaultTransitResponse, error) {
+	reqBody, err := json.Marshal(body)
+	if err != nil {
+		return nil, err
+	}
+
+	endpoint := fmt.Sprintf("%s/v1/%s/%s/%s", v.address, v.mount, operation, url.PathEscape(v.keyName))
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, bytes.NewReader(reqBody))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Vault-Token", v.token)
+
+	resp, err := v.client.Do(req)
+	if err != nil {
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			return nil, ctxErr
+		}
+		return nil, &encryption.RetryableError{Err: fmt.Errorf("vault transit %s failed: %w", operation, err)}
+	}
+	defer func() { _ = resp.Body.Close() }()
+
+	var decoded vaultTransitResponse
+	decodeErr := json.NewDecoder(io.LimitReader(resp.Body, vaultTransitMaxResponseSize)).Decode(&decoded)
+
+	if resp.StatusCode != http.StatusOK {
+		err := fmt.Errorf("vault transit %s failed with status %d: %s", operation, resp.StatusCode, strings.Join(decoded.Errors, "; "))
+
+		// Throttling, unavailability (e.g. a sealed Vault) or
+		// any other server-side failure may be transient.
+		if resp.StatusCode == http.StatusTooManyRequests || (resp.StatusCode >= 500 && resp.StatusCode != http.StatusNotImplemented) {
+			return nil, &encryption.RetryableError{Err: err}
+		}
+
+		return nil, err
+	}
+
+	if decodeErr != nil {
+		return nil, fmt.Errorf("vault transit %s failed: invalid response: %w", operation, decodeErr)
+	}
+
+	return &decoded, nil
+}
+
+type vaultTransitCipher struct {
+	vault *vaultTransit
+}
+
+func (c vaultTransitCipher) Encrypt(ctx context.Context, payload []byte, _ string) ([]byte, error) {
+	resp, err := c.vault.do(ctx, "encrypt", map[string]string{
+		"plaintext": base64.StdEncoding.EncodeToString(payload),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if !strings.HasPrefix(resp.Data.Ciphertext, "vault:") {
+		return nil, errors.New("vault transit encrypt failed: unexpected ciphertext format")
+	}
+
+	return []byte(resp.Data.Ciphertext), nil
+}
+
+// IsRemote reports the cipher as remote, as it calls the key management service.
+func (c vaultTransitCipher) IsRemote() bool {
+	return true
+}
+
+// Warmup checks that the key management service can be reached, see warmupCipher.
+func (c vaultTransitCipher) Warmup(ctx context.Context) error {
+	return warmupCipher(ctx, c)
+}
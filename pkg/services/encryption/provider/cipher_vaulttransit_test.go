@@ -0,0 +1,145 @@
+package provider
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/grafana/grafana/pkg/services/encryption"
+	"github.com/grafana/grafana/pkg/setting"
+)
+
+// newFakeVaultTransit starts a server that mimics the transit secrets engine,
+// "encrypting" plaintexts by prefixing them with the current key version.
+func newFakeVaultTransit(t *testing.T, status *int32) *httptest.Server {
+	t.Helper()
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if code := atomic.LoadInt32(status); code != http.StatusOK {
+			w.WriteHeader(int(code))
+			_, _ = w.Write([]byte(`{"errors":["fake failure"]}`))
+			return
+		}
+
+		if r.Header.Get("X-Vault-Token") != "token" {
+			w.WriteHeader(http.StatusForbidden)
+			_, _ = w.Write([]byte(`{"errors":["permission denied"]}`))
+			return
+		}
+
+		var body map[string]string
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&body))
+
+		switch r.URL.Path {
+		case "/v1/transit/encrypt/grafana":
+			_, _ = w.Write([]byte(`{"data":{"ciphertext":"vault:v1:` + body["plaintext"] + `"}}`))
+		case "/v1/transit/decrypt/grafana":
+			if !strings.HasPrefix(body["ciphertext"], "vault:v1:") {
+				w.WriteHeader(http.StatusBadRequest)
+				_, _ = w.Write([]byte(`{"errors":["invalid ciphertext"]}`))
+				return
+			}
+			_, _ = w.Write([]byte(`{"data":{"plaintext":"` + strings.TrimPrefix(body["ciphertext"], "vault:v1:") + `"}}`))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	t.Cleanup(server.Close)
+
+	return server
+}
+
+func Test_vaultTransitCipher(t *testing.T) {
+	ctx := context.Background()
+
+	status := int32(http.StatusOK)
+	server := newFakeVaultTransit(t, &status)
+
+	cfg := setting.NewCfg()
+	section := cfg.Raw.Section(securitySection)
+	section.Key(vaultTransitAddressKey).SetValue(server.URL + "/")
+	section.Key(vaultTransitTokenKey).SetValue("token")
+	section.Key(vaultTransitKeyNameKey).SetValue("grafana")
+
+	p := ProvideEncryptionProvider(&setting.OSSImpl{Cfg: cfg})
+	require.NotNil(t, p.vaultTransit)
+
+	cipher := p.ProvideCiphers()[encryption.VaultTransit]
+	decipher := p.ProvideDeciphers()[encryption.VaultTransit]
+
+	t.Run("encrypt should return the vault ciphertext", func(t *testing.T) {
+		encrypted, err := cipher.Encrypt(ctx, []byte("grafana"), "1234")
+		require.NoError(t, err)
+		assert.Equal(t, "vault:v1:"+base64.StdEncoding.EncodeToString([]byte("grafana")), string(encrypted))
+
+		decrypted, err := decipher.Decrypt(ctx, encrypted, "1234")
+		require.NoError(t, err)
+		assert.Equal(t, []byte("grafana"), decrypted)
+	})
+
+	t.Run("decrypt should not depend on the secret", func(t *testing.T) {
+		encrypted, err := cipher.Encrypt(ctx, []byte("grafana"), "1234")
+		require.NoError(t, err)
+
+		decrypted, err := decipher.Decrypt(ctx, encrypted, "4321")
+		require.NoError(t, err)
+		assert.Equal(t, []byte("grafana"), decrypted)
+		assert.False(t, encryption.IsSecretBound(encryption.VaultTransit))
+	})
+
+	t.Run("decrypt non-vault ciphertext should fail", func(t *testing.T) {
+		_, err := decipher.Decrypt(ctx, []byte("grafana"), "1234")
+		require.Error(t, err)
+	})
+
+	t.Run("with wrong token should fail without being retryable", func(t *testing.T) {
+		p.vaultTransit.token = "wrong"
+		defer func() { p.vaultTransit.token = "token" }()
+
+		_, err := cipher.Encrypt(ctx, []byte("grafana"), "1234")
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "permission denied")
+		assert.False(t, encryption.IsRetryable(err))
+	})
+
+	for _, code := range []int32{http.StatusTooManyRequests, http.StatusServiceUnavailable} {
+		t.Run("with transient failure should return a retryable error", func(t *testing.T) {
+			atomic.StoreInt32(&status, code)
+			defer atomic.StoreInt32(&status, http.StatusOK)
+
+			_, err := cipher.Encrypt(ctx, []byte("grafana"), "1234")
+			require.Error(t, err)
+			assert.True(t, encryption.IsRetryable(err))
+
+			_, err = decipher.Decrypt(ctx, []byte("vault:v1:Z3JhZmFuYQ=="), "1234")
+			require.Error(t, err)
+			assert.True(t, encryption.IsRetryable(err))
+		})
+	}
+
+	t.Run("with unreachable vault should return a retryable error", func(t *testing.T) {
+		unreachable := *p.vaultTransit
+		unreachable.address = "http://127.0.0.1:1"
+
+		_, err := vaultTransitCipher{vault: &unreachable}.Encrypt(ctx, []byte("grafana"), "1234")
+		require.Error(t, err)
+		assert.True(t, encryption.IsRetryable(err))
+	})
+
+	t.Run("with cancelled context should return the context error", func(t *testing.T) {
+		cancelled, cancel := context.WithCancel(ctx)
+		cancel()
+
+		_, err := cipher.Encrypt(cancelled, []byte("grafana"), "1234")
+		require.ErrorIs(t, err, context.Canceled)
+		assert.False(t, encryption.IsRetryable(err))
+	})
+}
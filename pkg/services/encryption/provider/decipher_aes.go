@@ -14,6 +14,20 @@ type aesDecipher struct {
 }
 
 func (d aesDecipher) Decrypt(_ context.Context, payload []byte, secret string) ([]byte, error) {
+	return d.decrypt(payload, nil, secret)
+}
+
+// DecryptWithAAD is only supported for AesGcm, as AesCfb
+// cannot authenticate any associated data.
+func (d aesDecipher) DecryptWithAAD(_ context.Context, payload, aad []byte, secret string) ([]byte, error) {
+	if d.algorithm != encryption.AesGcm {
+		return nil, encryption.ErrAADNotSupported
+	}
+
+	return d.decrypt(payload, aad, secret)
+}
+
+func (d aesDecipher) decrypt(payload, aad []byte, secret string) ([]byte, error) {
 	if len(payload) < encryption.SaltLength {
 		return nil, errors.New("unable to compute salt")
 	}
@@ -23,6 +37,7 @@ func (d aesDecipher) Decrypt(_ context.Context, payload []byte, secret string) (
 	if err != nil {
 		return nil, err
 	}
+	defer encryption.Wipe(key)
 
 	block, err := aes.NewCipher(key)
 	if err != nil {
@@ -31,27 +46,37 @@ func (d aesDecipher) Decrypt(_ context.Context, payload []byte, secret string) (
 
 	switch d.algorithm {
 	case encryption.AesGcm:
-		return decryptGCM(block, payload)
+		return decryptGCM(block, payload, aad)
 	default:
 		return decryptCFB(block, payload)
 	}
 }
 
-func decryptGCM(block cipher.Block, payload []byte) ([]byte, error) {
+func decryptGCM(block cipher.Block, payload, aad []byte) ([]byte, error) {
 	gcm, err := cipher.NewGCM(block)
 	if err != nil {
 		return nil, err
 	}
 
+	if len(payload) < encryption.SaltLength+gcm.NonceSize()+gcm.Overhead() {
+		return nil, errors.New("payload too short")
+	}
+
 	nonce := payload[encryption.SaltLength : encryption.SaltLength+gcm.NonceSize()]
 	ciphertext := payload[encryption.SaltLength+gcm.NonceSize():]
-	return gcm.Open(nil, nonce, ciphertext, nil)
+
+	decrypted, err := gcm.Open(nil, nonce, ciphertext, aad)
+	if err != nil {
+		return nil, encryption.ErrAuthenticationFailed
+	}
+
+	return decrypted, nil
 }
 
 func decryptCFB(block cipher.Block, payload []byte) ([]byte, error) {
 	// The IV needs to be unique, but not secure. Therefore, it's common to
 	// include it at the beginning of the ciphertext.
-	if len(payload) < aes.BlockSize {
+	if len(payload) < encryption.SaltLength+aes.BlockSize {
 		return nil, errors.New("payload too short")
 	}
 
@@ -19,6 +19,10 @@ func Test_aesDecipher(t *testing.T) {
 		decrypted, err := cipher.Decrypt(ctx, cfbEncryptedCiphertext, "1234")
 		require.NoError(t, err)
 		assert.Equal(t, []byte("grafana"), decrypted)
+
+		// Shorter than the salt and the IV, but not than the IV alone.
+		_, err = cipher.Decrypt(ctx, cfbEncryptedCiphertext[:encryption.SaltLength+8], "1234")
+		require.Error(t, err)
 	})
 
 	t.Run("aes-gcm", func(t *testing.T) {
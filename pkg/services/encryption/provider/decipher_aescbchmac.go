@@ -0,0 +1,88 @@
+package provider
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"errors"
+
+	"github.com/grafana/grafana/pkg/services/encryption"
+)
+
+// aesCbcHmacDecipher decrypts the ciphertexts of aesCbcHmacCipher. To not
+// act as a padding oracle, it must never tell apart an invalid MAC from an
+// invalid padding: the MAC is verified before the ciphertext is decrypted,
+// so tampered ciphertexts are never unpadded, then the padding is checked
+// in constant time, and any failure results in the same error, that is,
+// encryption.ErrAuthenticationFailed. Only the length of the payload, which
+// isn't secret, is checked upfront.
+type aesCbcHmacDecipher struct{}
+
+func (d aesCbcHmacDecipher) Decrypt(ctx context.Context, payload []byte, secret string) ([]byte, error) {
+	return d.DecryptWithAAD(ctx, payload, nil, secret)
+}
+
+func (d aesCbcHmacDecipher) DecryptWithAAD(_ context.Context, payload, aad []byte, secret string) ([]byte, error) {
+	ivOffset := encryption.SaltLength
+	dataOffset := ivOffset + aes.BlockSize
+	macOffset := len(payload) - sha256.Size
+
+	if macOffset-dataOffset < aes.BlockSize || (macOffset-dataOffset)%aes.BlockSize != 0 {
+		return nil, errors.New("payload too short")
+	}
+
+	encKey, macKey, err := deriveAesCbcHmacKeys(secret, string(payload[:ivOffset]))
+	if err != nil {
+		return nil, err
+	}
+	defer encryption.Wipe(encKey)
+	defer encryption.Wipe(macKey)
+
+	// The MAC is verified before touching the ciphertext.
+	if !hmac.Equal(aesCbcHmacMAC(macKey, aad, payload[ivOffset:macOffset]), payload[macOffset:]) {
+		return nil, encryption.ErrAuthenticationFailed
+	}
+
+	block, err := aes.NewCipher(encKey)
+	if err != nil {
+		return nil, err
+	}
+
+	decrypted := make([]byte, macOffset-dataOffset)
+	mode := cipher.NewCBCDecrypter(block, payload[ivOffset:dataOffset])
+	mode.CryptBlocks(decrypted, payload[dataOffset:macOffset])
+
+	unpadded, ok := unpadPKCS7(decrypted)
+	if !ok {
+		encryption.Wipe(decrypted)
+		return nil, encryption.ErrAuthenticationFailed
+	}
+
+	return unpadded, nil
+}
+
+// unpadPKCS7 removes the PKCS#7 padding of the given data, whose length must
+// be a positive multiple of the block size. It runs in constant time with
+// respect to the content of the last block, so the time it takes doesn't
+// depend on whether, or where, the padding is invalid.
+func unpadPKCS7(data []byte) ([]byte, bool) {
+	lastBlock := data[len(data)-aes.BlockSize:]
+	padding := int(lastBlock[aes.BlockSize-1])
+
+	good := subtle.ConstantTimeLessOrEq(1, padding) & subtle.ConstantTimeLessOrEq(padding, aes.BlockSize)
+	for i := 0; i < aes.BlockSize; i++ {
+		// Only the last padding bytes of the block must match.
+		inPadding := subtle.ConstantTimeLessOrEq(aes.BlockSize-i, padding)
+		matches := subtle.ConstantTimeByteEq(lastBlock[i], byte(padding))
+		good &= subtle.ConstantTimeSelect(inPadding, matches, 1)
+	}
+
+	if good != 1 {
+		return nil, false
+	}
+
+	return data[:len(data)-padding], true
+}
@@ -0,0 +1,51 @@
+package provider
+
+import (
+	"context"
+	"errors"
+
+	"github.com/grafana/grafana/pkg/services/encryption"
+)
+
+type aesSivDecipher struct{}
+
+func (d aesSivDecipher) Decrypt(ctx context.Context, payload []byte, secret string) ([]byte, error) {
+	return d.DecryptWithAAD(ctx, payload, nil, secret)
+}
+
+func (d aesSivDecipher) DecryptWithAAD(_ context.Context, payload, aad []byte, secret string) ([]byte, error) {
+	if len(payload) < sivSize {
+		return nil, errors.New("payload too short")
+	}
+
+	key, err := deriveAesSivKey(secret)
+	if err != nil {
+		return nil, err
+	}
+	defer encryption.Wipe(key)
+
+	return openAesSiv(key, payload, aad)
+}
+
+// DeriveKey returns the key the payloads encrypted with the given
+// secret are decrypted with, as the same one is used for all of them.
+func (d aesSivDecipher) DeriveKey(secret string) ([]byte, error) {
+	return deriveAesSivKey(secret)
+}
+
+func (d aesSivDecipher) DecryptWithKey(_ context.Context, payload, key []byte) ([]byte, error) {
+	if len(payload) < sivSize {
+		return nil, errors.New("payload too short")
+	}
+
+	return openAesSiv(key, payload, nil)
+}
+
+func openAesSiv(key, payload, aad []byte) ([]byte, error) {
+	plaintext, err := sivOpen(key, payload, sivAD(aad)...)
+	if err != nil {
+		return nil, encryption.ErrAuthenticationFailed
+	}
+
+	return plaintext, nil
+}
@@ -0,0 +1,42 @@
+package provider
+
+import (
+	"context"
+
+	"github.com/aws/aws-sdk-go/service/kms"
+
+	"github.com/grafana/grafana/pkg/services/encryption"
+)
+
+type awsKmsDecipher struct {
+	kms *awsKms
+}
+
+func (d awsKmsDecipher) Decrypt(ctx context.Context, payload []byte, secret string) ([]byte, error) {
+	wrappedKey, sealed, err := splitEnvelope(payload)
+	if err != nil {
+		return nil, err
+	}
+
+	client, err := d.kms.getClient()
+	if err != nil {
+		return nil, err
+	}
+
+	// The wrapped data key identifies the KMS key that wrapped it, so
+	// payloads remain decryptable after changing the configured key.
+	out, err := client.DecryptWithContext(ctx, &kms.DecryptInput{
+		CiphertextBlob: wrappedKey,
+	})
+	if err != nil {
+		return nil, awsKmsError("failed to decrypt data key", err)
+	}
+	defer encryption.Wipe(out.Plaintext)
+
+	return openEnvelope(sealed, out.Plaintext, []byte(secret))
+}
+
+// IsRemote reports the decipher as remote, as it calls the key management service.
+func (d awsKmsDecipher) IsRemote() bool {
+	return true
+}
@@ -0,0 +1,39 @@
+package provider
+
+import (
+	"context"
+	"errors"
+
+	"github.com/grafana/grafana/pkg/services/encryption"
+)
+
+type azureKeyVaultDecipher struct {
+	kv *azureKeyVault
+}
+
+func (d azureKeyVaultDecipher) Decrypt(ctx context.Context, payload []byte, secret string) ([]byte, error) {
+	wrappedKey, sealed, err := splitEnvelope(payload)
+	if err != nil {
+		return nil, err
+	}
+
+	versionLen := int(wrappedKey[0])
+	if versionLen == 0 || len(wrappedKey) <= 1+versionLen {
+		return nil, errors.New("malformed wrapped data key")
+	}
+
+	version, wrapped := string(wrappedKey[1:1+versionLen]), wrappedKey[1+versionLen:]
+
+	dataKey, _, err := d.kv.do(ctx, "unwrapkey", version, wrapped)
+	if err != nil {
+		return nil, err
+	}
+	defer encryption.Wipe(dataKey)
+
+	return openEnvelope(sealed, dataKey, []byte(secret))
+}
+
+// IsRemote reports the decipher as remote, as it calls the key management service.
+func (d azureKeyVaultDecipher) IsRemote() bool {
+	return true
+}
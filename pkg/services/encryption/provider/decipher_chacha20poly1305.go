@@ -0,0 +1,53 @@
+package provider
+
+import (
+	"context"
+	"errors"
+
+	"golang.org/x/crypto/chacha20poly1305"
+
+	"github.com/grafana/grafana/pkg/services/encryption"
+)
+
+// chaCha20Poly1305Decipher decrypts with ChaCha20-Poly1305,
+// or with XChaCha20-Poly1305 when extended.
+type chaCha20Poly1305Decipher struct {
+	extended bool
+}
+
+func (d chaCha20Poly1305Decipher) Decrypt(ctx context.Context, payload []byte, secret string) ([]byte, error) {
+	return d.DecryptWithAAD(ctx, payload, nil, secret)
+}
+
+func (d chaCha20Poly1305Decipher) DecryptWithAAD(_ context.Context, payload, aad []byte, secret string) ([]byte, error) {
+	nonceSize := chacha20poly1305.NonceSize
+	if d.extended {
+		nonceSize = chacha20poly1305.NonceSizeX
+	}
+
+	if len(payload) < encryption.SaltLength+nonceSize+chacha20poly1305.Overhead {
+		return nil, errors.New("payload too short")
+	}
+
+	salt := payload[:encryption.SaltLength]
+	key, err := encryption.KeyToBytes(secret, string(salt))
+	if err != nil {
+		return nil, err
+	}
+	defer encryption.Wipe(key)
+
+	aead, err := newChaCha20Poly1305(key, d.extended)
+	if err != nil {
+		return nil, err
+	}
+
+	nonce := payload[encryption.SaltLength : encryption.SaltLength+nonceSize]
+	ciphertext := payload[encryption.SaltLength+nonceSize:]
+
+	decrypted, err := aead.Open(nil, nonce, ciphertext, aad)
+	if err != nil {
+		return nil, encryption.ErrAuthenticationFailed
+	}
+
+	return decrypted, nil
+}
@@ -0,0 +1,59 @@
+package provider
+
+import (
+	"context"
+	"encoding/binary"
+	"io"
+
+	"github.com/grafana/grafana/pkg/services/encryption"
+)
+
+type envelopeLocalDecipher struct {
+	// random is the source the rewrapped data keys are drawn
+	// from, crypto/rand.Reader when nil (see randomSource).
+	random io.Reader
+}
+
+func (d envelopeLocalDecipher) Decrypt(ctx context.Context, payload []byte, secret string) ([]byte, error) {
+	return d.DecryptWithAAD(ctx, payload, nil, secret)
+}
+
+func (d envelopeLocalDecipher) DecryptWithAAD(_ context.Context, payload, aad []byte, secret string) ([]byte, error) {
+	wrappedKey, sealed, err := splitEnvelope(payload)
+	if err != nil {
+		return nil, err
+	}
+
+	dataKey, err := unwrapLocalDataKey(wrappedKey, secret)
+	if err != nil {
+		return nil, err
+	}
+	defer encryption.Wipe(dataKey)
+
+	return openEnvelope(sealed, dataKey, aad)
+}
+
+// Rewrap replaces the wrapped data key of the given payload by the same data
+// key, wrapped with the new secret, leaving the sealed payload as it is.
+func (d envelopeLocalDecipher) Rewrap(_ context.Context, payload []byte, oldSecret, newSecret string) ([]byte, error) {
+	wrappedKey, sealed, err := splitEnvelope(payload)
+	if err != nil {
+		return nil, err
+	}
+
+	dataKey, err := unwrapLocalDataKey(wrappedKey, oldSecret)
+	if err != nil {
+		return nil, err
+	}
+	defer encryption.Wipe(dataKey)
+
+	rewrappedKey, err := wrapLocalDataKey(d.random, dataKey, newSecret)
+	if err != nil {
+		return nil, err
+	}
+
+	rewrapped := make([]byte, envelopeLengthSize, envelopeLengthSize+len(rewrappedKey)+len(sealed))
+	binary.BigEndian.PutUint16(rewrapped, uint16(len(rewrappedKey)))
+	rewrapped = append(rewrapped, rewrappedKey...)
+	return append(rewrapped, sealed...), nil
+}
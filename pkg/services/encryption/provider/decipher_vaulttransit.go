@@ -0,0 +1,38 @@
+package provider
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+)
+
+type vaultTransitDecipher struct {
+	vault *vaultTransit
+}
+
+func (d vaultTransitDecipher) Decrypt(ctx context.Context, payload []byte, _ string) ([]byte, error) {
+	if !bytes.HasPrefix(payload, []byte("vault:")) {
+		return nil, errors.New("malformed vault transit ciphertext")
+	}
+
+	resp, err := d.vault.do(ctx, "decrypt", map[string]string{
+		"ciphertext": string(payload),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	plaintext, err := base64.StdEncoding.DecodeString(resp.Data.Plaintext)
+	if err != nil {
+		return nil, fmt.Errorf("vault transit decrypt failed: invalid plaintext: %w", err)
+	}
+
+	return plaintext, nil
+}
+
+// IsRemote reports the decipher as remote, as it calls the key management service.
+func (d vaultTransitDecipher) IsRemote() bool {
+	return true
+}
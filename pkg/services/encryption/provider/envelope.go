@@ -0,0 +1,100 @@
+package provider
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"encoding/binary"
+	"errors"
+	"io"
+
+	"github.com/grafana/grafana/pkg/services/encryption"
+)
+
+// Envelope ciphers encrypt each payload locally, with AES-GCM and a random
+// data key generated for it, and store that data key, wrapped by an external
+// key management service, in front of the ciphertext:
+//
+//	<uint16 length><wrapped data key><nonce><ciphertext>
+//
+// The payload is sealed with the given additional authenticated data: the
+// secret for the ciphers whose data keys are wrapped by an external service,
+// so it's still needed to decrypt the payload, as with any other cipher.
+const (
+	envelopeDataKeyLength = 32
+
+	envelopeLengthSize = 2
+)
+
+// sealEnvelope seals the given payload with the given data key, under a nonce
+// read from the given source of randomness (see randomSource), and stores the
+// wrapped data key in front of it.
+func sealEnvelope(random io.Reader, payload, dataKey, wrappedKey, aad []byte) ([]byte, error) {
+	if len(wrappedKey) > 0xffff {
+		return nil, errors.New("wrapped data key too long")
+	}
+
+	gcm, err := newEnvelopeAEAD(dataKey)
+	if err != nil {
+		return nil, err
+	}
+
+	prefixLen := envelopeLengthSize + len(wrappedKey) + gcm.NonceSize()
+	ciphertext := make([]byte, prefixLen, prefixLen+len(payload)+gcm.Overhead())
+	binary.BigEndian.PutUint16(ciphertext, uint16(len(wrappedKey)))
+	copy(ciphertext[envelopeLengthSize:], wrappedKey)
+
+	nonce := ciphertext[envelopeLengthSize+len(wrappedKey) : prefixLen]
+	if _, err := io.ReadFull(randomSource(random), nonce); err != nil {
+		return nil, err
+	}
+
+	return gcm.Seal(ciphertext, nonce, payload, aad), nil
+}
+
+// splitEnvelope returns the wrapped data key of the given
+// payload, as well as the remaining nonce and ciphertext.
+func splitEnvelope(payload []byte) ([]byte, []byte, error) {
+	if len(payload) < envelopeLengthSize {
+		return nil, nil, errors.New("payload too short")
+	}
+
+	keyLen := int(binary.BigEndian.Uint16(payload))
+	if keyLen == 0 || len(payload) < envelopeLengthSize+keyLen {
+		return nil, nil, errors.New("malformed wrapped data key")
+	}
+
+	return payload[envelopeLengthSize : envelopeLengthSize+keyLen], payload[envelopeLengthSize+keyLen:], nil
+}
+
+func openEnvelope(sealed, dataKey, aad []byte) ([]byte, error) {
+	gcm, err := newEnvelopeAEAD(dataKey)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(sealed) < gcm.NonceSize()+gcm.Overhead() {
+		return nil, encryption.ErrAuthenticationFailed
+	}
+
+	nonce, ciphertext := sealed[:gcm.NonceSize()], sealed[gcm.NonceSize():]
+
+	plaintext, err := gcm.Open(nil, nonce, ciphertext, aad)
+	if err != nil {
+		return nil, encryption.ErrAuthenticationFailed
+	}
+
+	return plaintext, nil
+}
+
+func newEnvelopeAEAD(dataKey []byte) (cipher.AEAD, error) {
+	if len(dataKey) != envelopeDataKeyLength {
+		return nil, errors.New("invalid data key length")
+	}
+
+	block, err := aes.NewCipher(dataKey)
+	if err != nil {
+		return nil, err
+	}
+
+	return cipher.NewGCM(block)
+}
@@ -0,0 +1,70 @@
+package provider
+
+import (
+	"crypto/cipher"
+	"crypto/rand"
+	"io"
+
+	"github.com/grafana/grafana/pkg/services/encryption"
+)
+
+// sealWithRandomNonce seals the given payload with the given AEAD, under a
+// fresh random nonce, and returns the salt the key was derived with, followed
+// by the nonce and the sealed payload (i.e. ciphertext and tag).
+//
+// Nonces are random rather than counter-based: a counter would have to be
+// persisted and shared by every Grafana instance encrypting with the same
+// secret, or it would repeat after a restart or across a cluster, which is far
+// worse than the risk it removes. A nonce must never repeat under the same
+// key, but the key is derived from the secret and the random salt of every
+// payload (see encryption.SaltLength), so two payloads only share a key when
+// they share a salt too. With 96-bit nonces (AES-GCM, ChaCha20-Poly1305),
+// that puts the birthday bound on the pair of salt and nonce at around 2^71
+// encryptions with the same secret. Still, the usual guidance for 96-bit
+// random nonces is to stay under 2^32 encryptions per key, so deployments
+// writing at very high volume, or deriving keys without salt, should prefer
+// XChaCha20-Poly1305, whose 192-bit nonces make collisions negligible (2^96
+// encryptions per key for a 50% chance) regardless of the salt.
+//
+// The nonce is read from the given source of randomness, or from
+// crypto/rand.Reader when nil, see randomSource.
+func sealWithRandomNonce(aead cipher.AEAD, random io.Reader, salt string, payload, aad []byte) ([]byte, error) {
+	prefixLen := encryption.SaltLength + aead.NonceSize()
+	ciphertext := make([]byte, prefixLen, prefixLen+len(payload)+aead.Overhead())
+	copy(ciphertext[:encryption.SaltLength], salt)
+	nonce := ciphertext[encryption.SaltLength:prefixLen]
+	if _, err := io.ReadFull(randomSource(random), nonce); err != nil {
+		return nil, err
+	}
+
+	// The authentication tag is appended to the ciphertext by Seal.
+	return aead.Seal(ciphertext, nonce, payload, aad), nil
+}
+
+// saltAlphabet is the alphabet of the salts, same as util.GetRandomString's.
+const saltAlphabet = "0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz"
+
+// randomSource returns the given source of randomness, or crypto/rand.Reader
+// when nil. The ciphers only draw their randomness through it, so it can be
+// routed to an audited source (see encryption.RandSource), and tests can inject
+// a deterministic one and reproduce exact ciphertexts.
+func randomSource(random io.Reader) io.Reader {
+	if random == nil {
+		return rand.Reader
+	}
+	return random
+}
+
+// randomSalt returns a fresh alphanumeric salt of encryption.SaltLength bytes,
+// read from the given source of randomness, as util.GetRandomString would.
+func randomSalt(random io.Reader) (string, error) {
+	salt := make([]byte, encryption.SaltLength)
+	if _, err := io.ReadFull(randomSource(random), salt); err != nil {
+		return "", err
+	}
+
+	for i, b := range salt {
+		salt[i] = saltAlphabet[b%byte(len(saltAlphabet))]
+	}
+	return string(salt), nil
+}
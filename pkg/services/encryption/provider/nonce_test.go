@@ -0,0 +1,51 @@
+package provider
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"testing"
+
+	"github.com/grafana/grafana/pkg/services/encryption"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_sealWithRandomNonce(t *testing.T) {
+	const batchSize = 100000
+
+	key, err := encryption.KeyToBytes("1234", "12345678")
+	require.NoError(t, err)
+
+	aeads := map[string]func() (cipher.AEAD, error){
+		encryption.AesGcm: func() (cipher.AEAD, error) {
+			block, err := aes.NewCipher(key)
+			if err != nil {
+				return nil, err
+			}
+			return cipher.NewGCM(block)
+		},
+		encryption.ChaCha20Poly1305: func() (cipher.AEAD, error) {
+			return newChaCha20Poly1305(key, false)
+		},
+		encryption.XChaCha20Poly1305: func() (cipher.AEAD, error) {
+			return newChaCha20Poly1305(key, true)
+		},
+	}
+
+	for algorithm, newAEAD := range aeads {
+		t.Run(algorithm+" nonces should not repeat with the same key", func(t *testing.T) {
+			aead, err := newAEAD()
+			require.NoError(t, err)
+
+			nonces := make(map[string]struct{}, batchSize)
+			for i := 0; i < batchSize; i++ {
+				sealed, err := sealWithRandomNonce(aead, nil, "12345678", []byte("grafana"), nil)
+				require.NoError(t, err)
+
+				nonce := string(sealed[encryption.SaltLength : encryption.SaltLength+aead.NonceSize()])
+				_, repeated := nonces[nonce]
+				require.False(t, repeated, "nonce repeated after %d encryptions", i)
+				nonces[nonce] = struct{}{}
+			}
+		})
+	}
+}
@@ -1,24 +1,116 @@
 package provider
 
 import (
+	"io"
+
 	"github.com/grafana/grafana/pkg/services/encryption"
+	"github.com/grafana/grafana/pkg/setting"
 )
 
-type Provider struct{}
+const securitySection = "security.encryption"
+
+// keySize is the size of the encryption keys used by all the built-in
+// ciphers, as derived by encryption.KeyToBytes, which means AES-256.
+const keySize = 32
+
+// Provider provides the built-in ciphers. Those backed by external key
+// management services are only provided when configured, so they're never
+// provided by the zero value.
+type Provider struct {
+	awsKms        *awsKms
+	gcpKms        *gcpKms
+	azureKeyVault *azureKeyVault
+	vaultTransit  *vaultTransit
+
+	// random is the source the ciphers draw their randomness
+	// from, crypto/rand.Reader when nil (see randomSource).
+	random io.Reader
+}
+
+var _ encryption.RandomizedProvider = Provider{}
+
+func ProvideEncryptionProvider(settingsProvider setting.Provider) Provider {
+	section := settingsProvider.Section(securitySection)
+
+	return Provider{
+		awsKms:        newAwsKms(section),
+		gcpKms:        newGcpKms(section),
+		azureKeyVault: newAzureKeyVault(section),
+		vaultTransit:  newVaultTransit(section),
+	}
+}
 
-func ProvideEncryptionProvider() Provider {
-	return Provider{}
+// WithRandSource returns a copy of the provider, whose
+// ciphers draw their randomness from the given source.
+func (p Provider) WithRandSource(random encryption.RandSource) encryption.Provider {
+	p.random = random
+	return p
 }
 
 func (p Provider) ProvideCiphers() map[string]encryption.Cipher {
-	return map[string]encryption.Cipher{
-		encryption.AesCfb: aesCfbCipher{},
+	ciphers := map[string]encryption.Cipher{
+		encryption.AesCfb: aesCfbCipher{random: p.random},
+		encryption.AesGcm: aesGcmCipher{random: p.random},
+
+		encryption.AesCbcHmac: aesCbcHmacCipher{random: p.random},
+
+		encryption.ChaCha20Poly1305:  chaCha20Poly1305Cipher{random: p.random},
+		encryption.XChaCha20Poly1305: chaCha20Poly1305Cipher{extended: true, random: p.random},
+
+		encryption.AesSiv: aesSivCipher{},
+
+		encryption.EnvelopeLocal: envelopeLocalCipher{random: p.random},
+	}
+
+	if p.awsKms != nil {
+		ciphers[encryption.AwsKms] = awsKmsCipher{kms: p.awsKms, random: p.random}
+	}
+
+	if p.gcpKms != nil {
+		ciphers[encryption.GcpKms] = gcpKmsCipher{kms: p.gcpKms, random: p.random}
 	}
+
+	if p.azureKeyVault != nil {
+		ciphers[encryption.AzureKeyVault] = azureKeyVaultCipher{kv: p.azureKeyVault, random: p.random}
+	}
+
+	if p.vaultTransit != nil {
+		ciphers[encryption.VaultTransit] = vaultTransitCipher{vault: p.vaultTransit}
+	}
+
+	return ciphers
 }
 
 func (p Provider) ProvideDeciphers() map[string]encryption.Decipher {
-	return map[string]encryption.Decipher{
+	deciphers := map[string]encryption.Decipher{
 		encryption.AesCfb: aesDecipher{algorithm: encryption.AesCfb},
 		encryption.AesGcm: aesDecipher{algorithm: encryption.AesGcm},
+
+		encryption.AesCbcHmac: aesCbcHmacDecipher{},
+
+		encryption.ChaCha20Poly1305:  chaCha20Poly1305Decipher{},
+		encryption.XChaCha20Poly1305: chaCha20Poly1305Decipher{extended: true},
+
+		encryption.AesSiv: aesSivDecipher{},
+
+		encryption.EnvelopeLocal: envelopeLocalDecipher{random: p.random},
 	}
+
+	if p.awsKms != nil {
+		deciphers[encryption.AwsKms] = awsKmsDecipher{kms: p.awsKms}
+	}
+
+	if p.gcpKms != nil {
+		deciphers[encryption.GcpKms] = gcpKmsDecipher{kms: p.gcpKms}
+	}
+
+	if p.azureKeyVault != nil {
+		deciphers[encryption.AzureKeyVault] = azureKeyVaultDecipher{kv: p.azureKeyVault}
+	}
+
+	if p.vaultTransit != nil {
+		deciphers[encryption.VaultTransit] = vaultTransitDecipher{vault: p.vaultTransit}
+	}
+
+	return deciphers
 }
@@ -0,0 +1,85 @@
+package provider
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/grafana/grafana/pkg/services/encryption"
+)
+
+func Test_Provider_AEAD(t *testing.T) {
+	ciphers := Provider{}.ProvideCiphers()
+	deciphers := Provider{}.ProvideDeciphers()
+
+	for _, algorithm := range []string{encryption.AesGcm, encryption.AesCbcHmac, encryption.ChaCha20Poly1305, encryption.XChaCha20Poly1305, encryption.AesSiv} {
+		assert.Implements(t, (*encryption.AEADCipher)(nil), ciphers[algorithm], algorithm)
+		assert.Implements(t, (*encryption.AEADDecipher)(nil), deciphers[algorithm], algorithm)
+	}
+
+	_, ok := ciphers[encryption.AesCfb].(encryption.AEADCipher)
+	assert.False(t, ok)
+}
+
+func Test_Provider_KeySize(t *testing.T) {
+	ciphers := Provider{}.ProvideCiphers()
+
+	for algorithm, cipher := range ciphers {
+		assert.Implements(t, (*encryption.KeySizer)(nil), cipher, algorithm)
+	}
+
+	t.Run("aes-gcm should report the size of aes-256 keys", func(t *testing.T) {
+		sizer, ok := ciphers[encryption.AesGcm].(encryption.KeySizer)
+		require.True(t, ok)
+		assert.Equal(t, 32, sizer.KeySize())
+
+		key, err := encryption.KeyToBytes("1234", "salt")
+		require.NoError(t, err)
+		assert.Len(t, key, sizer.KeySize())
+	})
+
+	t.Run("envelope ciphers should report the size of the data keys", func(t *testing.T) {
+		for _, cipher := range []encryption.Cipher{awsKmsCipher{}, gcpKmsCipher{}, azureKeyVaultCipher{}} {
+			assert.Equal(t, envelopeDataKeyLength, cipher.(encryption.KeySizer).KeySize())
+		}
+	})
+}
+
+func Test_Provider_WithRandSource(t *testing.T) {
+	ctx := context.Background()
+	errRandom := errors.New("entropy source unavailable")
+
+	p := Provider{}.WithRandSource(failingReader{err: errRandom})
+
+	for algorithm, cipher := range p.ProvideCiphers() {
+		// AES-SIV is deterministic, so it doesn't draw any randomness.
+		if algorithm == encryption.AesSiv {
+			continue
+		}
+
+		encrypted, err := cipher.Encrypt(ctx, []byte("grafana"), "1234")
+		require.ErrorIs(t, err, errRandom, algorithm)
+		assert.Nil(t, encrypted, algorithm)
+	}
+
+	t.Run("rewrapped data keys should use the source too", func(t *testing.T) {
+		encrypted, err := envelopeLocalCipher{}.Encrypt(ctx, []byte("grafana"), "1234")
+		require.NoError(t, err)
+
+		rewrapper := p.ProvideDeciphers()[encryption.EnvelopeLocal].(encryption.Rewrapper)
+		_, err = rewrapper.Rewrap(ctx, encrypted, "1234", "4321")
+		require.ErrorIs(t, err, errRandom)
+	})
+}
+
+// failingReader is a source of randomness that always fails with the given error.
+type failingReader struct {
+	err error
+}
+
+func (r failingReader) Read([]byte) (int, error) {
+	return 0, r.err
+}
@@ -0,0 +1,164 @@
+package provider
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/subtle"
+	"errors"
+)
+
+// The AES-SIV construction (RFC 5297) isn't available in the standard
+// library nor in golang.org/x/crypto, so it's implemented here. The key is
+// split in two halves, the first one for S2V and the second one for CTR,
+// hence it must be 32, 48 or 64 bytes long (the aes-siv cipher uses 64).
+
+const sivSize = aes.BlockSize
+
+var errSivKeyLength = errors.New("aes-siv key must be 32, 48 or 64 bytes long")
+
+// sivSeal encrypts the given plaintext, returning the synthetic IV
+// followed by the ciphertext.
+func sivSeal(key, plaintext []byte, ad ...[]byte) ([]byte, error) {
+	macBlock, ctrBlock, err := newSivBlocks(key)
+	if err != nil {
+		return nil, err
+	}
+
+	out := make([]byte, sivSize+len(plaintext))
+	v := s2v(macBlock, plaintext, ad)
+	copy(out, v)
+
+	cipher.NewCTR(ctrBlock, sivCounter(v)).XORKeyStream(out[sivSize:], plaintext)
+
+	return out, nil
+}
+
+// sivOpen decrypts and verifies the given synthetic IV and ciphertext.
+func sivOpen(key, sealed []byte, ad ...[]byte) ([]byte, error) {
+	if len(sealed) < sivSize {
+		return nil, errors.New("payload too short")
+	}
+
+	macBlock, ctrBlock, err := newSivBlocks(key)
+	if err != nil {
+		return nil, err
+	}
+
+	v, ciphertext := sealed[:sivSize], sealed[sivSize:]
+
+	plaintext := make([]byte, len(ciphertext))
+	cipher.NewCTR(ctrBlock, sivCounter(v)).XORKeyStream(plaintext, ciphertext)
+
+	if subtle.ConstantTimeCompare(s2v(macBlock, plaintext, ad), v) != 1 {
+		for i := range plaintext {
+			plaintext[i] = 0
+		}
+		return nil, errors.New("aes-siv authentication failed")
+	}
+
+	return plaintext, nil
+}
+
+func newSivBlocks(key []byte) (cipher.Block, cipher.Block, error) {
+	if len(key) != 32 && len(key) != 48 && len(key) != 64 {
+		return nil, nil, errSivKeyLength
+	}
+
+	macBlock, err := aes.NewCipher(key[:len(key)/2])
+	if err != nil {
+		return nil, nil, err
+	}
+
+	ctrBlock, err := aes.NewCipher(key[len(key)/2:])
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return macBlock, ctrBlock, nil
+}
+
+// sivCounter returns the initial counter for the CTR mode,
+// which is the synthetic IV with the 31st and 63rd bits cleared.
+func sivCounter(v []byte) []byte {
+	q := make([]byte, sivSize)
+	copy(q, v)
+	q[8] &= 0x7f
+	q[12] &= 0x7f
+	return q
+}
+
+// s2v is the pseudorandom function that turns the associated data and the
+// plaintext into the synthetic IV, as defined in section 2.4 of RFC 5297.
+func s2v(block cipher.Block, plaintext []byte, ad [][]byte) []byte {
+	d := cmac(block, make([]byte, sivSize))
+
+	for _, s := range ad {
+		sivDouble(d)
+		xorBytes(d, cmac(block, s))
+	}
+
+	var t []byte
+	if len(plaintext) >= sivSize {
+		t = make([]byte, len(plaintext))
+		copy(t, plaintext)
+		xorBytes(t[len(t)-sivSize:], d)
+	} else {
+		t = make([]byte, sivSize)
+		copy(t, plaintext)
+		t[len(plaintext)] = 0x80
+		sivDouble(d)
+		xorBytes(t, d)
+	}
+
+	return cmac(block, t)
+}
+
+// cmac computes the AES-CMAC (RFC 4493) of the given message.
+func cmac(block cipher.Block, msg []byte) []byte {
+	k1 := make([]byte, sivSize)
+	block.Encrypt(k1, k1)
+	sivDouble(k1)
+
+	n := (len(msg) + sivSize - 1) / sivSize
+	last := make([]byte, sivSize)
+	if n > 0 && len(msg)%sivSize == 0 {
+		copy(last, msg[(n-1)*sivSize:])
+		xorBytes(last, k1)
+	} else {
+		if n == 0 {
+			n = 1
+		}
+		rest := msg[(n-1)*sivSize:]
+		copy(last, rest)
+		last[len(rest)] = 0x80
+
+		k2 := k1
+		sivDouble(k2)
+		xorBytes(last, k2)
+	}
+
+	x := make([]byte, sivSize)
+	for i := 0; i < n-1; i++ {
+		xorBytes(x, msg[i*sivSize:(i+1)*sivSize])
+		block.Encrypt(x, x)
+	}
+	xorBytes(x, last)
+	block.Encrypt(x, x)
+
+	return x
+}
+
+// sivDouble multiplies the given block by x in GF(2^128), in place.
+func sivDouble(b []byte) {
+	carry := b[0] >> 7
+	for i := 0; i < len(b)-1; i++ {
+		b[i] = b[i]<<1 | b[i+1]>>7
+	}
+	b[len(b)-1] = b[len(b)-1]<<1 ^ 0x87*carry
+}
+
+func xorBytes(dst, src []byte) {
+	for i := range src {
+		dst[i] ^= src[i]
+	}
+}
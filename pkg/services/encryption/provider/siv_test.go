@@ -0,0 +1,87 @@
+package provider
+
+import (
+	"encoding/hex"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_siv(t *testing.T) {
+	unhex := func(s string) []byte {
+		b, err := hex.DecodeString(strings.ReplaceAll(s, " ", ""))
+		require.NoError(t, err)
+		return b
+	}
+
+	// Test vectors from RFC 5297, appendix A.
+	testCases := []struct {
+		desc       string
+		key        []byte
+		ad         [][]byte
+		plaintext  []byte
+		ciphertext []byte
+	}{
+		{
+			desc: "deterministic authenticated encryption",
+			key:  unhex("fffefdfc fbfaf9f8 f7f6f5f4 f3f2f1f0 f0f1f2f3 f4f5f6f7 f8f9fafb fcfdfeff"),
+			ad: [][]byte{
+				unhex("10111213 14151617 18191a1b 1c1d1e1f 20212223 24252627"),
+			},
+			plaintext:  unhex("11223344 55667788 99aabbcc ddee"),
+			ciphertext: unhex("85632d07 c6e8f37f 950acd32 0a2ecc93 40c02b96 90c4dc04 daef7f6a fe5c"),
+		},
+		{
+			desc: "nonce-based authenticated encryption",
+			key:  unhex("7f7e7d7c 7b7a7978 77767574 73727170 40414243 44454647 48494a4b 4c4d4e4f"),
+			ad: [][]byte{
+				unhex("00112233 44556677 8899aabb ccddeeff deaddada deaddada ffeeddcc bbaa9988 77665544 33221100"),
+				unhex("10203040 50607080 90a0"),
+				unhex("09f91102 9d74e35b d84156c5 635688c0"),
+			},
+			plaintext:  unhex("74686973 20697320 736f6d65 20706c61 696e7465 78742074 6f20656e 63727970 74207573 696e6720 5349562d 414553"),
+			ciphertext: unhex("7bdb6e3b 432667eb 06f4d14b ff2fbd0f cb900f2f ddbe4043 26601965 c889bf17 dba77ceb 094fa663 b7a3f748 ba8af829 ea64ad54 4a272e9c 485b62a3 fd5c0d"),
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			sealed, err := sivSeal(tc.key, tc.plaintext, tc.ad...)
+			require.NoError(t, err)
+			assert.Equal(t, tc.ciphertext, sealed)
+
+			opened, err := sivOpen(tc.key, tc.ciphertext, tc.ad...)
+			require.NoError(t, err)
+			assert.Equal(t, tc.plaintext, opened)
+
+			tampered := append([]byte{}, tc.ciphertext...)
+			tampered[len(tampered)-1] ^= 1
+			_, err = sivOpen(tc.key, tampered, tc.ad...)
+			require.Error(t, err)
+
+			_, err = sivOpen(tc.key, tc.ciphertext)
+			require.Error(t, err)
+		})
+	}
+
+	t.Run("with invalid key length should fail", func(t *testing.T) {
+		_, err := sivSeal(make([]byte, 16), []byte("grafana"))
+		require.ErrorIs(t, err, errSivKeyLength)
+	})
+
+	t.Run("with any plaintext length should round-trip", func(t *testing.T) {
+		key := make([]byte, 64)
+		for i := 0; i <= 3*sivSize; i++ {
+			plaintext := []byte(strings.Repeat("g", i))
+
+			sealed, err := sivSeal(key, plaintext)
+			require.NoError(t, err)
+
+			opened, err := sivOpen(key, sealed)
+			require.NoError(t, err)
+			assert.Equal(t, plaintext, opened)
+		}
+	})
+}
@@ -0,0 +1,18 @@
+package provider
+
+import (
+	"context"
+
+	"github.com/grafana/grafana/pkg/services/encryption"
+)
+
+// warmupPayload is the tiny payload the remote ciphers encrypt on warmup.
+var warmupPayload = []byte("grafana encryption warmup")
+
+// warmupCipher warms up the given remote cipher by encrypting warmupPayload,
+// which fails unless the external service is reachable and the credentials
+// are authorized to encrypt. The payload produced is discarded.
+func warmupCipher(ctx context.Context, cipher encryption.Cipher) error {
+	_, err := cipher.Encrypt(ctx, warmupPayload, "warmup")
+	return err
+}
@@ -0,0 +1,154 @@
+package encryption
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"time"
+)
+
+const (
+	defaultRetryMaxAttempts    = 3
+	defaultRetryInitialBackoff = 100 * time.Millisecond
+	defaultRetryMaxBackoff     = 5 * time.Second
+)
+
+// RetryOptions configures a RetryingCipher. Zero values are replaced by
+// sensible defaults, except for MaxConcurrency, which is unbounded when zero.
+type RetryOptions struct {
+	// MaxAttempts is the maximum number of attempts per operation,
+	// including the first one. Defaults to 3.
+	MaxAttempts int
+
+	// InitialBackoff is the wait before the first retry, doubled on
+	// every subsequent retry up to MaxBackoff. Defaults to 100ms.
+	InitialBackoff time.Duration
+
+	// MaxBackoff bounds the wait between two attempts. Defaults to 5s.
+	MaxBackoff time.Duration
+
+	// MaxConcurrency bounds the number of attempts in progress at the same
+	// time, so a burst of operations doesn't hammer the external service.
+	MaxConcurrency int
+}
+
+// RetryingCipher decorates a Cipher and a Decipher, typically backed by an
+// external key management service, retrying the operations that fail with
+// a RetryableError with an exponential backoff, and bounding the number of
+// concurrent operations. Errors that aren't retryable are returned as they
+// are, and so is the last one once the attempts are exhausted.
+//
+// Retries stop as soon as the context is cancelled, and aren't attempted
+// when the context deadline would expire during the backoff.
+type RetryingCipher struct {
+	cipher   Cipher
+	decipher Decipher
+	opts     RetryOptions
+
+	// sem is nil when the concurrency is unbounded.
+	sem chan struct{}
+}
+
+// NewRetryingCipher returns a RetryingCipher wrapping the given cipher and
+// decipher. Either of them can be nil, as long as the corresponding operation
+// isn't used.
+func NewRetryingCipher(cipher Cipher, decipher Decipher, opts RetryOptions) *RetryingCipher {
+	if opts.MaxAttempts <= 0 {
+		opts.MaxAttempts = defaultRetryMaxAttempts
+	}
+	if opts.InitialBackoff <= 0 {
+		opts.InitialBackoff = defaultRetryInitialBackoff
+	}
+	if opts.MaxBackoff <= 0 {
+		opts.MaxBackoff = defaultRetryMaxBackoff
+	}
+
+	r := &RetryingCipher{cipher: cipher, decipher: decipher, opts: opts}
+	if opts.MaxConcurrency > 0 {
+		r.sem = make(chan struct{}, opts.MaxConcurrency)
+	}
+
+	return r
+}
+
+func (r *RetryingCipher) Encrypt(ctx context.Context, payload []byte, secret string) ([]byte, error) {
+	if r.cipher == nil {
+		return nil, errors.New("retrying cipher has no cipher to encrypt with")
+	}
+
+	return r.do(ctx, func() ([]byte, error) {
+		return r.cipher.Encrypt(ctx, payload, secret)
+	})
+}
+
+func (r *RetryingCipher) Decrypt(ctx context.Context, payload []byte, secret string) ([]byte, error) {
+	if r.decipher == nil {
+		return nil, errors.New("retrying cipher has no decipher to decrypt with")
+	}
+
+	return r.do(ctx, func() ([]byte, error) {
+		return r.decipher.Decrypt(ctx, payload, secret)
+	})
+}
+
+// IsRemote returns whether the wrapped cipher or decipher is remote.
+func (r *RetryingCipher) IsRemote() bool {
+	return IsRemote(r.cipher) || IsRemote(r.decipher)
+}
+
+// Warmup warms up the wrapped cipher and decipher, when they're Warmable.
+func (r *RetryingCipher) Warmup(ctx context.Context) error {
+	if err := warmup(ctx, r.cipher); err != nil {
+		return err
+	}
+	return warmup(ctx, r.decipher)
+}
+
+func (r *RetryingCipher) do(ctx context.Context, fn func() ([]byte, error)) ([]byte, error) {
+	backoff := r.opts.InitialBackoff
+
+	for attempt := 1; ; attempt++ {
+		out, err := r.attempt(ctx, fn)
+		if err == nil || !IsRetryable(err) || attempt >= r.opts.MaxAttempts {
+			return out, err
+		}
+
+		// Half of the backoff is randomized, so the operations
+		// that failed together aren't retried all at once.
+		wait := backoff/2 + time.Duration(rand.Int63n(int64(backoff/2)+1))
+		if deadline, ok := ctx.Deadline(); ok && time.Until(deadline) < wait {
+			return nil, err
+		}
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return nil, ctx.Err()
+		case <-timer.C:
+		}
+
+		if backoff *= 2; backoff > r.opts.MaxBackoff {
+			backoff = r.opts.MaxBackoff
+		}
+	}
+}
+
+// attempt runs the given operation once, holding the semaphore, if any,
+// only while it's in progress, so it's not held during the backoff.
+func (r *RetryingCipher) attempt(ctx context.Context, fn func() ([]byte, error)) ([]byte, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	if r.sem != nil {
+		select {
+		case r.sem <- struct{}{}:
+			defer func() { <-r.sem }()
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+
+	return fn()
+}
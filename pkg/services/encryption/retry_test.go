@@ -0,0 +1,150 @@
+package encryption
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_RetryingCipher(t *testing.T) {
+	ctx := context.Background()
+	opts := RetryOptions{InitialBackoff: time.Millisecond, MaxBackoff: 2 * time.Millisecond}
+
+	t.Run("flaky operations should be retried until they succeed", func(t *testing.T) {
+		flaky := &flakyCipher{failures: 2, err: &RetryableError{Err: errors.New("throttled")}}
+		r := NewRetryingCipher(flaky, flaky, opts)
+
+		encrypted, err := r.Encrypt(ctx, []byte("grafana"), "1234")
+		require.NoError(t, err)
+		assert.Equal(t, []byte("grafana"), encrypted)
+		assert.EqualValues(t, 3, flaky.calls)
+
+		flaky.calls = 0
+		decrypted, err := r.Decrypt(ctx, encrypted, "1234")
+		require.NoError(t, err)
+		assert.Equal(t, []byte("grafana"), decrypted)
+		assert.EqualValues(t, 3, flaky.calls)
+	})
+
+	t.Run("attempts should be bounded", func(t *testing.T) {
+		flaky := &flakyCipher{failures: 5, err: &RetryableError{Err: errors.New("throttled")}}
+		r := NewRetryingCipher(flaky, flaky, RetryOptions{MaxAttempts: 2, InitialBackoff: time.Millisecond})
+
+		_, err := r.Encrypt(ctx, []byte("grafana"), "1234")
+		require.Error(t, err)
+		assert.True(t, IsRetryable(err))
+		assert.EqualValues(t, 2, flaky.calls)
+	})
+
+	t.Run("non-retryable errors should be returned right away", func(t *testing.T) {
+		flaky := &flakyCipher{failures: 2, err: ErrAuthenticationFailed}
+		r := NewRetryingCipher(flaky, flaky, opts)
+
+		_, err := r.Decrypt(ctx, []byte("grafana"), "1234")
+		require.ErrorIs(t, err, ErrAuthenticationFailed)
+		assert.EqualValues(t, 1, flaky.calls)
+	})
+
+	t.Run("retries should stop when the context is cancelled", func(t *testing.T) {
+		flaky := &flakyCipher{failures: 5, err: &RetryableError{Err: errors.New("throttled")}}
+		r := NewRetryingCipher(flaky, flaky, RetryOptions{MaxAttempts: 5, InitialBackoff: time.Hour})
+
+		cancelledCtx, cancel := context.WithCancel(ctx)
+		time.AfterFunc(10*time.Millisecond, cancel)
+
+		_, err := r.Encrypt(cancelledCtx, []byte("grafana"), "1234")
+		require.ErrorIs(t, err, context.Canceled)
+		assert.EqualValues(t, 1, flaky.calls)
+	})
+
+	t.Run("retries should not be attempted past the context deadline", func(t *testing.T) {
+		flaky := &flakyCipher{failures: 5, err: &RetryableError{Err: errors.New("throttled")}}
+		r := NewRetryingCipher(flaky, flaky, RetryOptions{MaxAttempts: 5, InitialBackoff: time.Hour})
+
+		deadlineCtx, cancel := context.WithTimeout(ctx, time.Minute)
+		defer cancel()
+
+		_, err := r.Encrypt(deadlineCtx, []byte("grafana"), "1234")
+		require.Error(t, err)
+		assert.True(t, IsRetryable(err))
+		assert.EqualValues(t, 1, flaky.calls)
+	})
+
+	t.Run("concurrency should be bounded", func(t *testing.T) {
+		slow := &slowCipher{}
+		r := NewRetryingCipher(slow, slow, RetryOptions{MaxConcurrency: 2})
+
+		var wg sync.WaitGroup
+		for i := 0; i < 10; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				_, err := r.Encrypt(ctx, []byte("grafana"), "1234")
+				assert.NoError(t, err)
+			}()
+		}
+		wg.Wait()
+
+		assert.EqualValues(t, 2, slow.maxInFlight)
+	})
+
+	t.Run("missing cipher or decipher should fail", func(t *testing.T) {
+		r := NewRetryingCipher(nil, nil, opts)
+
+		_, err := r.Encrypt(ctx, []byte("grafana"), "1234")
+		require.Error(t, err)
+
+		_, err = r.Decrypt(ctx, []byte("grafana"), "1234")
+		require.Error(t, err)
+	})
+}
+
+// flakyCipher fails with the given error the given number
+// of times, then returns the payload as it is.
+type flakyCipher struct {
+	failures int32
+	err      error
+	calls    int32
+}
+
+func (c *flakyCipher) Encrypt(_ context.Context, payload []byte, _ string) ([]byte, error) {
+	if atomic.AddInt32(&c.calls, 1) <= c.failures {
+		return nil, c.err
+	}
+	return payload, nil
+}
+
+func (c *flakyCipher) Decrypt(ctx context.Context, payload []byte, secret string) ([]byte, error) {
+	return c.Encrypt(ctx, payload, secret)
+}
+
+// slowCipher records the maximum number of concurrent operations.
+type slowCipher struct {
+	inFlight    int32
+	maxInFlight int32
+}
+
+func (c *slowCipher) Encrypt(_ context.Context, payload []byte, _ string) ([]byte, error) {
+	n := atomic.AddInt32(&c.inFlight, 1)
+	defer atomic.AddInt32(&c.inFlight, -1)
+
+	for {
+		max := atomic.LoadInt32(&c.maxInFlight)
+		if n <= max || atomic.CompareAndSwapInt32(&c.maxInFlight, max, n) {
+			break
+		}
+	}
+
+	time.Sleep(10 * time.Millisecond)
+	return payload, nil
+}
+
+func (c *slowCipher) Decrypt(ctx context.Context, payload []byte, secret string) ([]byte, error) {
+	return c.Encrypt(ctx, payload, secret)
+}
@@ -0,0 +1,99 @@
+package service
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/grafana/grafana/pkg/services/encryption"
+)
+
+// algorithmAliases are the alternative names of the built-in algorithms the
+// configuration accepts, e.g. as commonly mistyped, keyed by lowercase name.
+// The canonical name is the one written into the payloads' prefix.
+var algorithmAliases = map[string]string{
+	"aescfb": encryption.AesCfb,
+
+	"aesgcm":      encryption.AesGcm,
+	"aes256gcm":   encryption.AesGcm,
+	"aes-256-gcm": encryption.AesGcm,
+
+	"aescbchmac": encryption.AesCbcHmac,
+
+	"chacha20-poly1305":  encryption.ChaCha20Poly1305,
+	"xchacha20-poly1305": encryption.XChaCha20Poly1305,
+
+	"aessiv": encryption.AesSiv,
+
+	"awskms":          encryption.AwsKms,
+	"gcpkms":          encryption.GcpKms,
+	"azurekeyvault":   encryption.AzureKeyVault,
+	"azure-key-vault": encryption.AzureKeyVault,
+	"vaulttransit":    encryption.VaultTransit,
+
+	"envelopelocal": encryption.EnvelopeLocal,
+}
+
+// RegisterAlias registers the given alias of the given algorithm, e.g. for the
+// algorithms registered with RegisterCipher, so it can be configured under
+// that name too. Aliases are case-insensitive, and take precedence over the
+// built-in ones, but not over the names of the registered algorithms.
+func (s *Service) RegisterAlias(alias, algorithm string) error {
+	if alias == "" || algorithm == "" {
+		return errors.New("encryption algorithm alias and name cannot be empty")
+	}
+
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	alias = strings.ToLower(alias)
+	if _, ok := s.aliases[alias]; ok {
+		return fmt.Errorf("encryption algorithm alias '%s' already registered", alias)
+	}
+
+	if s.aliases == nil {
+		s.aliases = make(map[string]string)
+	}
+
+	s.aliases[alias] = algorithm
+
+	return nil
+}
+
+// resolveAlgorithm returns the canonical name of the given configured
+// algorithm: the name itself when registered, otherwise the algorithm it's
+// an alias of, or the registered one it only differs from by case. That one
+// is unique, as RegisterCipher rejects the names only differing by case, but
+// the first one in order is picked otherwise (e.g. as given by a provider),
+// so the resolution never depends on the order of the map. Unknown names are
+// returned as they are, so they fail as usual.
+func (s *Service) resolveAlgorithm(algorithm string) string {
+	s.mtx.RLock()
+	defer s.mtx.RUnlock()
+
+	if _, ok := s.ciphers[algorithm]; ok {
+		return algorithm
+	}
+
+	lower := strings.ToLower(algorithm)
+	if resolved, ok := s.aliases[lower]; ok {
+		return resolved
+	}
+
+	if resolved, ok := algorithmAliases[lower]; ok {
+		return resolved
+	}
+
+	var resolved string
+	for registered := range s.ciphers {
+		if strings.EqualFold(registered, algorithm) && (resolved == "" || registered < resolved) {
+			resolved = registered
+		}
+	}
+
+	if resolved != "" {
+		return resolved
+	}
+
+	return algorithm
+}
@@ -0,0 +1,87 @@
+package service
+
+import (
+	"context"
+	"testing"
+
+	"github.com/grafana/grafana/pkg/services/encryption"
+	"github.com/grafana/grafana/pkg/setting"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_Service_AlgorithmAliases(t *testing.T) {
+	ctx := context.Background()
+
+	svc := SetupTestService(t)
+	settings := svc.settingsProvider.(*setting.OSSImpl)
+	section := settings.Cfg.Raw.Section(securitySection)
+
+	for configured, algorithm := range map[string]string{
+		"aes-gcm":            encryption.AesGcm,
+		"aesgcm":             encryption.AesGcm,
+		"AES-GCM":            encryption.AesGcm,
+		"AesGcm":             encryption.AesGcm,
+		"aes-256-gcm":        encryption.AesGcm,
+		"ChaCha20-Poly1305":  encryption.ChaCha20Poly1305,
+		"XCHACHA20POLY1305":  encryption.XChaCha20Poly1305,
+		"Aes-Cbc-Hmac":       encryption.AesCbcHmac,
+		"aessiv":             encryption.AesSiv,
+		"xchacha20-poly1305": encryption.XChaCha20Poly1305,
+	} {
+		t.Run(configured+" should resolve to "+algorithm, func(t *testing.T) {
+			setAlgorithm(t, svc, configured)
+
+			require.NoError(t, svc.Validate(settings.Section(securitySection)))
+			assert.Equal(t, algorithm, svc.CurrentAlgorithm())
+
+			encrypted, err := svc.Encrypt(ctx, []byte("grafana"), "1234")
+			require.NoError(t, err)
+
+			// The canonical name is the one written into the prefix.
+			header, _, err := decodePayloadHeader(encrypted)
+			require.NoError(t, err)
+			assert.Equal(t, algorithm, header.algorithm)
+
+			decrypted, err := svc.Decrypt(ctx, encrypted, "1234")
+			require.NoError(t, err)
+			assert.Equal(t, []byte("grafana"), decrypted)
+		})
+	}
+
+	t.Run("registered aliases should resolve", func(t *testing.T) {
+		require.NoError(t, svc.RegisterCipher("acme/kms", fakeCipher{}, fakeDecipher{}))
+		require.NoError(t, svc.RegisterAlias("acme", "acme/kms"))
+		require.EqualError(t, svc.RegisterAlias("ACME", "acme/kms"), "encryption algorithm alias 'acme' already registered")
+
+		setAlgorithm(t, svc, "Acme")
+
+		require.NoError(t, svc.Validate(settings.Section(securitySection)))
+		assert.Equal(t, "acme/kms", svc.CurrentAlgorithm())
+	})
+
+	t.Run("names only differing by case should be rejected", func(t *testing.T) {
+		err := svc.RegisterCipher("ACME/KMS", fakeCipher{}, fakeDecipher{})
+		require.EqualError(t, err, "encryption algorithm 'ACME/KMS' conflicts with the registered 'acme/kms'")
+	})
+
+	t.Run("provided names only differing by case should resolve in order", func(t *testing.T) {
+		svc := SetupTestService(t)
+		svc.ciphers["Acme/KMS"], svc.ciphers["acme/KMS"] = fakeCipher{}, fakeCipher{}
+		svc.deciphers["Acme/KMS"], svc.deciphers["acme/KMS"] = fakeDecipher{}, fakeDecipher{}
+
+		for i := 0; i < 10; i++ {
+			assert.Equal(t, "Acme/KMS", svc.resolveAlgorithm("ACME/kms"))
+		}
+	})
+
+	t.Run("unknown algorithms should still fail", func(t *testing.T) {
+		for _, configured := range []string{"aes-gcm2", "aes", "gcm", "aes gcm"} {
+			section.Key(encryptionAlgorithmKey).SetValue(configured)
+			t.Cleanup(func() { section.DeleteKey(encryptionAlgorithmKey) })
+
+			err := svc.Validate(settings.Section(securitySection))
+			require.EqualError(t, err, "no cipher registered for encryption algorithm configured '"+configured+"'")
+		}
+	})
+}
@@ -0,0 +1,58 @@
+package service
+
+import (
+	"context"
+
+	"github.com/grafana/grafana/pkg/services/encryption"
+)
+
+// AuditPayloads checks the integrity of the given payloads, e.g. from a
+// scheduled job looking for silent database corruption, and returns one
+// error per payload, in the same order, which is nil for the sound ones.
+//
+// The payloads of authenticated algorithms (see encryption.IsAuthenticated)
+// are decrypted with the given secret, and the plaintexts discarded, so any
+// tampering or corruption of the ciphertext is detected, as well as those
+// encrypted under another secret, unless the algorithm isn't bound to the
+// secret (see encryption.IsSecretBound). Only structural checks are possible
+// for the others (i.e. AesCfb), as they decrypt corrupted ciphertexts into
+// garbage, so they're validated (see encryption.ValidatePayload) without
+// being decrypted. Once the context is done, the remaining payloads fail
+// with its error.
+func (s *Service) AuditPayloads(ctx context.Context, payloads [][]byte, secret string) []error {
+	errs := make([]error, len(payloads))
+	deciphers := make(map[string]encryption.Decipher)
+
+	var failed int
+	for i, payload := range payloads {
+		if errs[i] = s.auditPayload(ctx, deciphers, payload, secret); errs[i] != nil {
+			failed++
+		}
+	}
+
+	if failed > 0 {
+		s.log.Warn("Payload audit found payloads failing the integrity checks", logContext(ctx, "failed", failed, "total", len(payloads))...)
+	}
+
+	return errs
+}
+
+func (s *Service) auditPayload(ctx context.Context, deciphers map[string]encryption.Decipher, payload []byte, secret string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	header, _, err := s.decodePayloadHeader(payload)
+	if err != nil {
+		return err
+	}
+
+	if !encryption.IsAuthenticated(header.algorithm) {
+		_, err := encryption.ValidatePayload(payload)
+		return err
+	}
+
+	decrypted, err := s.decryptValue(ctx, deciphers, payload, secret)
+	encryption.Wipe(decrypted)
+	return err
+}
@@ -0,0 +1,72 @@
+package service
+
+import (
+	"context"
+	"testing"
+
+	"github.com/grafana/grafana/pkg/services/encryption"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_Service_AuditPayloads(t *testing.T) {
+	ctx := context.Background()
+
+	svc := SetupTestService(t)
+
+	encrypt := func(t *testing.T, algorithm, secret string) []byte {
+		t.Helper()
+
+		encrypted, err := svc.EncryptWithAlgorithm(ctx, []byte("grafana"), secret, algorithm)
+		require.NoError(t, err)
+		return encrypted
+	}
+
+	tamper := func(payload []byte) []byte {
+		tampered := append([]byte{}, payload...)
+		tampered[len(tampered)-1] ^= 0x01
+		return tampered
+	}
+
+	t.Run("only the failing payloads should be reported", func(t *testing.T) {
+		payloads := [][]byte{
+			encrypt(t, encryption.AesGcm, "1234"),
+			tamper(encrypt(t, encryption.AesGcm, "1234")),
+			encrypt(t, encryption.ChaCha20Poly1305, "1234"),
+			encrypt(t, encryption.AesGcm, "4321"),
+			tamper(encrypt(t, encryption.ChaCha20Poly1305, "1234")),
+			[]byte("*unknown*"),
+		}
+
+		errs := svc.AuditPayloads(ctx, payloads, "1234")
+		require.Len(t, errs, len(payloads))
+
+		assert.NoError(t, errs[0])
+		assert.ErrorIs(t, errs[1], encryption.ErrAuthenticationFailed)
+		assert.NoError(t, errs[2])
+		assert.ErrorIs(t, errs[3], encryption.ErrAuthenticationFailed)
+		assert.ErrorIs(t, errs[4], encryption.ErrAuthenticationFailed)
+		assert.Error(t, errs[5])
+	})
+
+	t.Run("unauthenticated payloads should only be checked structurally", func(t *testing.T) {
+		valid := encrypt(t, encryption.AesCfb, "1234")
+
+		errs := svc.AuditPayloads(ctx, [][]byte{tamper(valid), valid[:len(valid)-8]}, "1234")
+		assert.NoError(t, errs[0])
+		assert.Error(t, errs[1])
+	})
+
+	t.Run("empty secret should fail the authenticated payloads", func(t *testing.T) {
+		errs := svc.AuditPayloads(ctx, [][]byte{encrypt(t, encryption.AesGcm, "1234")}, "")
+		assert.ErrorIs(t, errs[0], encryption.ErrEmptySecret)
+	})
+
+	t.Run("remaining payloads should fail once the context is done", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(ctx)
+		cancel()
+
+		errs := svc.AuditPayloads(ctx, [][]byte{encrypt(t, encryption.AesGcm, "1234")}, "1234")
+		assert.ErrorIs(t, errs[0], context.Canceled)
+	})
+}
@@ -0,0 +1,178 @@
+package service
+
+import (
+	"context"
+	"crypto/rand"
+	"fmt"
+	"testing"
+
+	"github.com/grafana/grafana/pkg/infra/usagestats"
+	"github.com/grafana/grafana/pkg/services/encryption"
+	"github.com/grafana/grafana/pkg/services/encryption/provider"
+	"github.com/grafana/grafana/pkg/setting"
+	"github.com/stretchr/testify/require"
+)
+
+// benchmarkPayloadSizes are the plaintext sizes the benchmarks are run with,
+// from a typical secret (e.g. a password) to a large document.
+var benchmarkPayloadSizes = []int{64, 4 << 10, 1 << 20}
+
+// runBenchmarks runs the given benchmark for each registered
+// algorithm and each payload size, with a random payload.
+func runBenchmarks(b *testing.B, fn func(b *testing.B, svc *Service, payload []byte)) {
+	svc := SetupTestService(b)
+
+	for _, algorithm := range svc.SupportedAlgorithms() {
+		for _, size := range benchmarkPayloadSizes {
+			payload := make([]byte, size)
+			_, err := rand.Read(payload)
+			require.NoError(b, err)
+
+			b.Run(fmt.Sprintf("%s/%dB", algorithm, size), func(b *testing.B) {
+				setAlgorithm(b, svc, algorithm)
+
+				b.ReportAllocs()
+				b.SetBytes(int64(size))
+				fn(b, svc, payload)
+			})
+		}
+	}
+}
+
+func BenchmarkEncrypt(b *testing.B) {
+	ctx := context.Background()
+
+	runBenchmarks(b, func(b *testing.B, svc *Service, payload []byte) {
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			if _, err := svc.Encrypt(ctx, payload, "1234"); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+func BenchmarkEncryptTo(b *testing.B) {
+	ctx := context.Background()
+
+	runBenchmarks(b, func(b *testing.B, svc *Service, payload []byte) {
+		var (
+			buf []byte
+			err error
+		)
+
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			if buf, err = svc.EncryptTo(ctx, buf[:0], payload, "1234"); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+func BenchmarkDecrypt(b *testing.B) {
+	ctx := context.Background()
+
+	runBenchmarks(b, func(b *testing.B, svc *Service, payload []byte) {
+		encrypted, err := svc.Encrypt(ctx, payload, "1234")
+		require.NoError(b, err)
+
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			if _, err := svc.Decrypt(ctx, encrypted, "1234"); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+func BenchmarkEncryptJsonData(b *testing.B) {
+	ctx := context.Background()
+
+	runBenchmarks(b, func(b *testing.B, svc *Service, payload []byte) {
+		kv := make(map[string]string, 10)
+		for i := 0; i < 10; i++ {
+			kv[fmt.Sprintf("field%d", i)] = string(payload)
+		}
+
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			if _, err := svc.EncryptJsonData(ctx, kv, "1234"); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+func BenchmarkDecryptJsonData(b *testing.B) {
+	ctx := context.Background()
+
+	svc := SetupTestService(b)
+
+	kv := make(map[string]string, 20)
+	for i := 0; i < 20; i++ {
+		kv[fmt.Sprintf("field%d", i)] = "grafana"
+	}
+
+	// Unlike the others, the aes-siv keys don't depend on a per-payload
+	// salt, so the key is derived (with PBKDF2) only once for the map.
+	for _, algorithm := range []string{encryption.AesGcm, encryption.AesSiv} {
+		sjd, err := svc.EncryptJsonDataWithAlgorithm(ctx, kv, "1234", algorithm)
+		require.NoError(b, err)
+
+		b.Run(algorithm+"/shared key", func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				if _, err := svc.DecryptJsonData(ctx, sjd, "1234"); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+
+		b.Run(algorithm+"/per value", func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				for _, data := range sjd {
+					if _, err := svc.Decrypt(ctx, data, "1234"); err != nil {
+						b.Fatal(err)
+					}
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkDecryptKDFCache(b *testing.B) {
+	ctx := context.Background()
+
+	for _, size := range []int{0, 10} {
+		b.Run(fmt.Sprintf("cache size %d", size), func(b *testing.B) {
+			settings := &setting.OSSImpl{Cfg: setting.NewCfg()}
+			section := settings.Cfg.Raw.Section(securitySection)
+			section.Key(encryptionAlgorithmKey).SetValue(encryption.AesGcm)
+			section.Key(kdfKey).SetValue(kdfArgon2id)
+			section.Key(kdfCacheSizeKey).SetValue(fmt.Sprint(size))
+
+			svc, err := ProvideEncryptionService(provider.ProvideEncryptionProvider(settings), &usagestats.UsageStatsMock{T: b}, settings)
+			require.NoError(b, err)
+
+			encrypted, err := svc.Encrypt(ctx, []byte("grafana"), "1234")
+			require.NoError(b, err)
+
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if _, err := svc.Decrypt(ctx, encrypted, "1234"); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkEncodePayloadHeader(b *testing.B) {
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		_ = encodePayloadHeader(payloadHeader{algorithm: encryption.AesGcm})
+	}
+}
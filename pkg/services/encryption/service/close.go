@@ -0,0 +1,73 @@
+package service
+
+import (
+	"context"
+	"sync"
+
+	"github.com/grafana/grafana/pkg/setting"
+)
+
+// registration is registered for settings reloads and usage stats on behalf
+// of a Service. Neither registry supports removals, so it's what allows Close
+// to detach the service from them: once closed, the registration forgets the
+// service, which can then be released, and does nothing from then on. Only
+// the registration itself, which is tiny, remains registered.
+type registration struct {
+	mtx sync.RWMutex
+	s   *Service
+}
+
+func (r *registration) service() *Service {
+	r.mtx.RLock()
+	defer r.mtx.RUnlock()
+	return r.s
+}
+
+func (r *registration) detach() {
+	r.mtx.Lock()
+	r.s = nil
+	r.mtx.Unlock()
+}
+
+func (r *registration) Validate(section setting.Section) error {
+	if s := r.service(); s != nil {
+		return s.Validate(section)
+	}
+	return nil
+}
+
+func (r *registration) Reload(section setting.Section) error {
+	if s := r.service(); s != nil {
+		return s.Reload(section)
+	}
+	return nil
+}
+
+func (r *registration) usageStats(ctx context.Context) (map[string]interface{}, error) {
+	if s := r.service(); s != nil {
+		return s.usageStats(ctx)
+	}
+	return nil, nil
+}
+
+func (r *registration) resetUsageStats() {
+	if s := r.service(); s != nil {
+		s.resetUsageStats()
+	}
+}
+
+// Close detaches the service from the settings reloads and the usage stats,
+// so it can be released when it's no longer used, and wipes the cached keys
+// and decrypted values, if any. The service can still be used afterwards, but
+// it no longer follows configuration reloads nor reports usage stats. It's
+// safe to call it twice.
+func (s *Service) Close() error {
+	if s.registration != nil {
+		s.registration.detach()
+	}
+
+	s.keyCache.clear()
+	s.decryptCache.clear()
+
+	return nil
+}
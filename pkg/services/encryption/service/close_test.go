@@ -0,0 +1,81 @@
+package service
+
+import (
+	"context"
+	"crypto/rand"
+	"runtime"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/grafana/grafana/pkg/infra/usagestats"
+	"github.com/grafana/grafana/pkg/services/encryption"
+	"github.com/grafana/grafana/pkg/services/encryption/provider"
+	"github.com/grafana/grafana/pkg/setting"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_Service_Close(t *testing.T) {
+	ctx := context.Background()
+
+	t.Run("closed services should be detached and released", func(t *testing.T) {
+		usageStats := &usagestats.UsageStatsMock{T: t}
+		settings := &setting.OSSImpl{Cfg: setting.NewCfg()}
+		settings.Cfg.Raw.Section(securitySection).Key(skipSelfTestKey).SetValue("true")
+		encProvider := provider.ProvideEncryptionProvider(settings)
+
+		const services = 100
+		var released int32
+		for i := 0; i < services; i++ {
+			svc, err := ProvideEncryptionService(encProvider, usageStats, settings)
+			require.NoError(t, err)
+
+			_, err = svc.Decrypt(ctx, svc.MustEncrypt(ctx, []byte("grafana"), "1234"), "1234")
+			require.NoError(t, err)
+
+			runtime.SetFinalizer(svc, func(*Service) { atomic.AddInt32(&released, 1) })
+			require.NoError(t, svc.Close())
+			require.NoError(t, svc.Close())
+		}
+
+		report, err := usageStats.GetUsageReport(ctx)
+		require.NoError(t, err)
+		assert.Empty(t, report.Metrics)
+
+		assert.Eventually(t, func() bool {
+			runtime.GC()
+			return atomic.LoadInt32(&released) == services
+		}, 5*time.Second, 10*time.Millisecond)
+	})
+
+	t.Run("closed service should ignore reloads but keep working", func(t *testing.T) {
+		svc := SetupTestService(t)
+		require.NoError(t, svc.Close())
+
+		cfg := setting.NewCfg()
+		cfg.Raw.Section(securitySection).Key(encryptionAlgorithmKey).SetValue(encryption.AesGcm)
+		require.NoError(t, svc.registration.Reload((&setting.OSSImpl{Cfg: cfg}).Section(securitySection)))
+		assert.Equal(t, encryption.AesCfb, svc.CurrentAlgorithm())
+
+		decrypted, err := svc.Decrypt(ctx, svc.MustEncrypt(ctx, []byte("grafana"), "1234"), "1234")
+		require.NoError(t, err)
+		assert.Equal(t, []byte("grafana"), decrypted)
+	})
+
+	t.Run("close should wipe the cached keys", func(t *testing.T) {
+		svc := SetupTestService(t)
+
+		var err error
+		svc.keyCache, err = newKeyCache(10, rand.Reader)
+		require.NoError(t, err)
+
+		p := &kdfParams{id: kdfIDArgon2id, time: 1, memory: 1024, threads: 1, salt: []byte("salt")}
+		svc.keyCache.derive(p, "1234")
+		key := svc.keyCache.entries[svc.keyCache.id(p, "1234")].Value.(*keyCacheEntry).key
+
+		require.NoError(t, svc.Close())
+		assert.Zero(t, svc.keyCache.lru.Len())
+		assert.Equal(t, make([]byte, kdfKeyLength), key)
+	})
+}
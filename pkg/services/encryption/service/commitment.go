@@ -0,0 +1,143 @@
+package service
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/grafana/grafana/pkg/services/encryption"
+)
+
+// AEADs like AES-GCM aren't key-committing: a ciphertext can be crafted to
+// decrypt successfully, into different plaintexts, under different keys. So
+// trying several secrets, as DecryptWithSecrets does, could end up with the
+// wrong plaintext instead of an error. When enabled, the ciphertexts of the
+// AEAD ciphers are committed to the secret they're encrypted with: a value
+// derived from the secret is recorded in the payload header, and checked
+// before decrypting, so a payload only decrypts under the secret it was
+// encrypted with. The commitment is encoded into the payload header as:
+//
+//	<salt><hmac-sha256(pbkdf2(secret, salt), label)>
+//
+// The commitment is derived with the same KDF as the keys (see
+// encryption.KeyToBytes), so it doesn't give a shortcut to guess the secret,
+// but it costs one more key derivation per encryption and decryption, plus
+// keyCommitmentLen bytes (and the v1 header, if there's none already).
+//
+// AesSiv payloads are never committed, as the random salt of the commitment
+// would defeat their determinism, which is what the algorithm is used for.
+const (
+	// keyCommitmentKey enables the key commitment of
+	// the payloads encrypted with AEAD ciphers.
+	keyCommitmentKey = "key_commitment"
+
+	keyCommitmentSaltLen = 16
+	keyCommitmentLen     = keyCommitmentSaltLen + sha256.Size
+)
+
+var keyCommitmentLabel = []byte("grafana encryption key commitment")
+
+type keyCommitment struct {
+	salt  []byte
+	value []byte
+}
+
+// newKeyCommitment returns the commitment to the given secret,
+// under a salt freshly read from the given source of randomness.
+func newKeyCommitment(random io.Reader, secret string) (*keyCommitment, error) {
+	salt := make([]byte, keyCommitmentSaltLen)
+	if _, err := io.ReadFull(random, salt); err != nil {
+		return nil, err
+	}
+
+	value, err := commitToKey(secret, salt)
+	if err != nil {
+		return nil, err
+	}
+
+	return &keyCommitment{salt: salt, value: value}, nil
+}
+
+// verify checks that the commitment is to the given secret, and fails
+// with encryption.ErrAuthenticationFailed otherwise.
+func (c *keyCommitment) verify(secret string) error {
+	value, err := commitToKey(secret, c.salt)
+	if err != nil {
+		return err
+	}
+
+	if !hmac.Equal(value, c.value) {
+		return fmt.Errorf("key commitment mismatch: %w", encryption.ErrAuthenticationFailed)
+	}
+
+	return nil
+}
+
+func (c *keyCommitment) appendTo(b []byte) []byte {
+	b = append(b, c.salt...)
+	return append(b, c.value...)
+}
+
+func commitToKey(secret string, salt []byte) ([]byte, error) {
+	key, err := encryption.KeyToBytes(secret, string(salt))
+	if err != nil {
+		return nil, err
+	}
+	defer encryption.Wipe(key)
+
+	mac := hmac.New(sha256.New, key)
+	_, _ = mac.Write(keyCommitmentLabel)
+	return mac.Sum(nil), nil
+}
+
+// decodeKeyCommitment decodes the commitment at the start
+// of the given header fields, and returns the remaining fields.
+func decodeKeyCommitment(fields []byte) (*keyCommitment, []byte, error) {
+	if len(fields) < keyCommitmentLen {
+		return nil, nil, errors.New("malformed key commitment")
+	}
+
+	c := &keyCommitment{
+		salt:  fields[:keyCommitmentSaltLen],
+		value: fields[keyCommitmentSaltLen:keyCommitmentLen],
+	}
+
+	return c, fields[keyCommitmentLen:], nil
+}
+
+// verifyKeyCommitment checks the commitment of the payload with the given
+// header, if any, to the given secret. The flag of the commitment isn't
+// authenticated, so once key commitment is enabled, a payload that would be
+// committed (see committed) without one is rejected: otherwise stripping the
+// commitment would be enough to get around it. Note that it means the AEAD
+// payloads encrypted before enabling key commitment must be re-encrypted
+// beforehand.
+func (s *Service) verifyKeyCommitment(header payloadHeader, secret string) error {
+	if header.commitment != nil {
+		return header.commitment.verify(secret)
+	}
+
+	// As in newPayloadHeader, the cipher tells whether the payload would be committed:
+	// some deciphers, e.g. the AES one, handle both AEAD and other algorithms.
+	cipher, _ := s.cipher(header.algorithm)
+	if committed(cipher, header.algorithm) && s.keyCommitmentEnabled() {
+		return fmt.Errorf("missing key commitment: %w", encryption.ErrAuthenticationFailed)
+	}
+
+	return nil
+}
+
+// committed returns whether the payloads the given cipher encrypts with
+// the given algorithm are committed when key commitment is enabled.
+func committed(cipher encryption.Cipher, algorithm string) bool {
+	_, ok := cipher.(encryption.AEADCipher)
+	return ok && algorithm != encryption.AesSiv
+}
+
+func (s *Service) keyCommitmentEnabled() bool {
+	return s.securitySettings().
+		KeyValue(keyCommitmentKey).
+		MustBool(false)
+}
@@ -0,0 +1,172 @@
+package service
+
+import (
+	"context"
+	"testing"
+
+	"github.com/grafana/grafana/pkg/services/encryption"
+	"github.com/grafana/grafana/pkg/setting"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_Service_KeyCommitment(t *testing.T) {
+	ctx := context.Background()
+
+	svc := SetupTestService(t)
+	section := svc.settingsProvider.(*setting.OSSImpl).Cfg.Raw.Section(securitySection)
+	setAlgorithm(t, svc, encryption.AesGcm)
+
+	// xorAEADCipher isn't committing at all: any
+	// secret decrypts its ciphertexts successfully.
+	require.NoError(t, svc.RegisterCipher("fake-aead", xorAEADCipher{}, xorAEADCipher{}))
+
+	t.Run("payloads should not be committed by default", func(t *testing.T) {
+		encrypted, err := svc.Encrypt(ctx, []byte("grafana"), "1234")
+		require.NoError(t, err)
+
+		header, _, err := decodePayloadHeader(encrypted)
+		require.NoError(t, err)
+		assert.Nil(t, header.commitment)
+	})
+
+	t.Run("wrong secrets should produce alternate plaintexts without commitment", func(t *testing.T) {
+		encrypted, err := svc.EncryptWithAlgorithm(ctx, []byte("grafana"), "1234", "fake-aead")
+		require.NoError(t, err)
+
+		decrypted, err := svc.DecryptWithSecrets(ctx, encrypted, []string{"4321", "1234"})
+		require.NoError(t, err)
+		assert.NotEqual(t, []byte("grafana"), decrypted)
+	})
+
+	section.Key(keyCommitmentKey).SetValue("true")
+
+	t.Run("committed payloads should be decrypted", func(t *testing.T) {
+		for _, algorithm := range []string{encryption.AesGcm, encryption.ChaCha20Poly1305, "fake-aead"} {
+			encrypted, err := svc.EncryptWithAlgorithm(ctx, []byte("grafana"), "1234", algorithm)
+			require.NoError(t, err)
+
+			header, _, err := decodePayloadHeader(encrypted)
+			require.NoError(t, err)
+			require.NotNil(t, header.commitment, algorithm)
+
+			decrypted, err := svc.Decrypt(ctx, encrypted, "1234")
+			require.NoError(t, err)
+			assert.Equal(t, []byte("grafana"), decrypted)
+		}
+	})
+
+	t.Run("wrong secrets should be rejected by the commitment", func(t *testing.T) {
+		encrypted, err := svc.EncryptWithAlgorithm(ctx, []byte("grafana"), "1234", "fake-aead")
+		require.NoError(t, err)
+
+		_, err = svc.Decrypt(ctx, encrypted, "4321")
+		require.ErrorIs(t, err, encryption.ErrAuthenticationFailed)
+		assert.Contains(t, err.Error(), "key commitment mismatch")
+
+		decrypted, err := svc.DecryptWithSecrets(ctx, encrypted, []string{"4321", "1234"})
+		require.NoError(t, err)
+		assert.Equal(t, []byte("grafana"), decrypted)
+	})
+
+	t.Run("payloads with a stripped commitment should be rejected", func(t *testing.T) {
+		encrypted, err := svc.EncryptWithAlgorithm(ctx, []byte("grafana"), "1234", "fake-aead")
+		require.NoError(t, err)
+
+		header, toDecrypt, err := decodePayloadHeader(encrypted)
+		require.NoError(t, err)
+		require.NotNil(t, header.commitment)
+
+		header.commitment = nil
+		stripped := append(appendPayloadHeader(nil, header), toDecrypt...)
+
+		_, err = svc.Decrypt(ctx, stripped, "4321")
+		require.ErrorIs(t, err, encryption.ErrAuthenticationFailed)
+		assert.Contains(t, err.Error(), "missing key commitment")
+
+		_, err = svc.DecryptWithSecrets(ctx, stripped, []string{"4321", "1234"})
+		require.ErrorIs(t, err, encryption.ErrAuthenticationFailed)
+	})
+
+	t.Run("uncommitted unauthenticated payloads should still be decrypted", func(t *testing.T) {
+		encrypted, err := svc.EncryptWithAlgorithm(ctx, []byte("grafana"), "1234", encryption.AesCfb)
+		require.NoError(t, err)
+
+		decrypted, err := svc.Decrypt(ctx, encrypted, "1234")
+		require.NoError(t, err)
+		assert.Equal(t, []byte("grafana"), decrypted)
+	})
+
+	t.Run("commitments should stay valid with key versions", func(t *testing.T) {
+		section.Key(keyVersionsKey).SetValue("v1")
+		section.Key(keyVersionKeyPrefix + "v1").SetValue("key")
+		section.Key(currentKeyVersionKey).SetValue("v1")
+		t.Cleanup(func() {
+			section.DeleteKey(keyVersionsKey)
+			section.DeleteKey(keyVersionKeyPrefix + "v1")
+			section.DeleteKey(currentKeyVersionKey)
+		})
+
+		encrypted, err := svc.Encrypt(ctx, []byte("grafana"), "1234")
+		require.NoError(t, err)
+
+		decrypted, err := svc.Decrypt(ctx, encrypted, "1234")
+		require.NoError(t, err)
+		assert.Equal(t, []byte("grafana"), decrypted)
+	})
+
+	t.Run("aes-siv payloads should stay deterministic", func(t *testing.T) {
+		first, err := svc.EncryptWithAlgorithm(ctx, []byte("grafana"), "1234", encryption.AesSiv)
+		require.NoError(t, err)
+
+		second, err := svc.EncryptWithAlgorithm(ctx, []byte("grafana"), "1234", encryption.AesSiv)
+		require.NoError(t, err)
+		assert.Equal(t, first, second)
+
+		header, _, err := decodePayloadHeader(first)
+		require.NoError(t, err)
+		assert.Nil(t, header.commitment)
+
+		decrypted, err := svc.Decrypt(ctx, first, "1234")
+		require.NoError(t, err)
+		assert.Equal(t, []byte("grafana"), decrypted)
+	})
+
+	t.Run("unauthenticated algorithms should not be committed", func(t *testing.T) {
+		encrypted, err := svc.EncryptWithAlgorithm(ctx, []byte("grafana"), "1234", encryption.AesCfb)
+		require.NoError(t, err)
+
+		header, _, err := decodePayloadHeader(encrypted)
+		require.NoError(t, err)
+		assert.Nil(t, header.commitment)
+	})
+
+	t.Run("truncated commitments should fail", func(t *testing.T) {
+		_, _, err := decodeKeyCommitment(make([]byte, keyCommitmentLen-1))
+		require.Error(t, err)
+	})
+}
+
+// xorAEADCipher XORs the payload with the secret, ignoring
+// the associated data, so it decrypts under any secret.
+type xorAEADCipher struct{}
+
+func (c xorAEADCipher) Encrypt(ctx context.Context, payload []byte, secret string) ([]byte, error) {
+	return c.EncryptWithAAD(ctx, payload, nil, secret)
+}
+
+func (c xorAEADCipher) EncryptWithAAD(_ context.Context, payload, _ []byte, secret string) ([]byte, error) {
+	out := make([]byte, len(payload))
+	for i, b := range payload {
+		out[i] = b ^ secret[i%len(secret)]
+	}
+	return out, nil
+}
+
+func (c xorAEADCipher) Decrypt(ctx context.Context, payload []byte, secret string) ([]byte, error) {
+	return c.EncryptWithAAD(ctx, payload, nil, secret)
+}
+
+func (c xorAEADCipher) DecryptWithAAD(ctx context.Context, payload, aad []byte, secret string) ([]byte, error) {
+	return c.EncryptWithAAD(ctx, payload, aad, secret)
+}
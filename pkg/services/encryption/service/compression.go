@@ -0,0 +1,33 @@
+package service
+
+import (
+	"bytes"
+	"compress/flate"
+	"io"
+)
+
+func compress(payload []byte) ([]byte, error) {
+	var buf bytes.Buffer
+
+	w, err := flate.NewWriter(&buf, flate.BestCompression)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := w.Write(payload); err != nil {
+		return nil, err
+	}
+
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+func decompress(payload []byte) ([]byte, error) {
+	r := flate.NewReader(bytes.NewReader(payload))
+	defer func() { _ = r.Close() }()
+
+	return io.ReadAll(r)
+}
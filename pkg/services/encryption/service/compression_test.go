@@ -0,0 +1,65 @@
+package service
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"strings"
+	"testing"
+
+	"github.com/grafana/grafana/pkg/services/encryption"
+	"github.com/grafana/grafana/pkg/setting"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_Service_Compression(t *testing.T) {
+	ctx := context.Background()
+
+	svc := SetupTestService(t)
+	settings := svc.settingsProvider.(*setting.OSSImpl)
+	setAlgorithm(t, svc, encryption.AesGcm)
+
+	compressible := []byte(strings.Repeat(`{"url":"http://localhost:3000","user":"admin"},`, 100))
+
+	incompressible := make([]byte, 1024)
+	_, err := rand.Read(incompressible)
+	require.NoError(t, err)
+
+	t.Run("with compression disabled should not compress", func(t *testing.T) {
+		settings.Cfg.Raw.Section(securitySection).Key(compressPayloadsKey).SetValue("false")
+
+		encrypted, err := svc.Encrypt(ctx, compressible, "1234")
+		require.NoError(t, err)
+		assert.True(t, bytes.HasPrefix(encrypted, encodeEncryptionAlgorithm(encryption.AesGcm)))
+		assert.Greater(t, len(encrypted), len(compressible))
+	})
+
+	t.Run("with compression enabled should compress compressible payloads", func(t *testing.T) {
+		settings.Cfg.Raw.Section(securitySection).Key(compressPayloadsKey).SetValue("true")
+
+		encrypted, err := svc.Encrypt(ctx, compressible, "1234")
+		require.NoError(t, err)
+		assert.Less(t, len(encrypted), len(compressible))
+
+		header, _, err := decodePayloadHeader(encrypted)
+		require.NoError(t, err)
+		assert.True(t, header.compressed)
+
+		decrypted, err := svc.Decrypt(ctx, encrypted, "1234")
+		require.NoError(t, err)
+		assert.Equal(t, compressible, decrypted)
+	})
+
+	t.Run("with compression enabled should not compress incompressible payloads", func(t *testing.T) {
+		settings.Cfg.Raw.Section(securitySection).Key(compressPayloadsKey).SetValue("true")
+
+		encrypted, err := svc.Encrypt(ctx, incompressible, "1234")
+		require.NoError(t, err)
+		assert.True(t, bytes.HasPrefix(encrypted, encodeEncryptionAlgorithm(encryption.AesGcm)))
+
+		decrypted, err := svc.Decrypt(ctx, encrypted, "1234")
+		require.NoError(t, err)
+		assert.Equal(t, incompressible, decrypted)
+	})
+}
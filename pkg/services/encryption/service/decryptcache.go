@@ -0,0 +1,176 @@
+package service
+
+import (
+	"container/list"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/grafana/grafana/pkg/services/encryption"
+)
+
+// Keeping plaintexts in memory makes them easier to leak (e.g. through a core
+// dump), so the cache of decrypted values is disabled (zero) by default, and
+// must only be enabled when decrypting the same payloads over and over is an
+// actual bottleneck. Both settings are only read on startup.
+const (
+	// decryptCacheSizeKey sets the max amount of decrypted values kept in
+	// memory, so decrypting the same payloads repeatedly (e.g. datasource
+	// credentials while rendering dashboards) doesn't run the cipher again.
+	decryptCacheSizeKey = "decrypt_cache_size"
+
+	// decryptCacheTTLKey sets how long the decrypted values are kept.
+	decryptCacheTTLKey = "decrypt_cache_ttl"
+
+	defaultDecryptCacheTTL = time.Minute
+)
+
+// decryptCache is an LRU cache of decrypted values, which expire after the
+// TTL. Entries are identified by an HMAC of the payload, its associated data
+// and the secret, under a random key generated per cache, as for keyCache, so
+// the secret is never kept. Evicted and expired plaintexts are wiped.
+//
+// A nil *decryptCache is valid and caches nothing.
+type decryptCache struct {
+	size    int
+	ttl     time.Duration
+	hmacKey []byte
+
+	// now is time.Now, unless replaced by tests.
+	now func() time.Time
+
+	mtx     sync.Mutex
+	entries map[[sha256.Size]byte]*list.Element
+	lru     *list.List
+}
+
+type decryptCacheEntry struct {
+	id        [sha256.Size]byte
+	algorithm string
+	plaintext []byte
+	expires   time.Time
+}
+
+// newDecryptCache returns a cache of up to the given amount of values,
+// kept for the given TTL, or nil when the size or the TTL isn't positive.
+func newDecryptCache(size int, ttl time.Duration) (*decryptCache, error) {
+	if size <= 0 || ttl <= 0 {
+		return nil, nil
+	}
+
+	c := &decryptCache{
+		size:    size,
+		ttl:     ttl,
+		hmacKey: make([]byte, sha256.Size),
+		now:     time.Now,
+		entries: make(map[[sha256.Size]byte]*list.Element, size),
+		lru:     list.New(),
+	}
+
+	if _, err := io.ReadFull(rand.Reader, c.hmacKey); err != nil {
+		return nil, err
+	}
+
+	return c, nil
+}
+
+// get returns a copy of the plaintext cached for the given payload, associated
+// data and secret, if any and not expired, together with its algorithm.
+func (c *decryptCache) get(payload, aad []byte, secret string) ([]byte, string, bool) {
+	if c == nil {
+		return nil, "", false
+	}
+
+	id := c.id(payload, aad, secret)
+
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	elem, ok := c.entries[id]
+	if !ok {
+		return nil, "", false
+	}
+
+	entry := elem.Value.(*decryptCacheEntry)
+	if !c.now().Before(entry.expires) {
+		c.evict(elem)
+		return nil, "", false
+	}
+
+	c.lru.MoveToFront(elem)
+	return append([]byte{}, entry.plaintext...), entry.algorithm, true
+}
+
+// put caches a copy of the given plaintext, decrypted from the
+// given payload and associated data with the given secret.
+func (c *decryptCache) put(payload, aad []byte, secret, algorithm string, plaintext []byte) {
+	if c == nil {
+		return
+	}
+
+	id := c.id(payload, aad, secret)
+
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	if elem, ok := c.entries[id]; ok {
+		c.evict(elem)
+	}
+
+	c.entries[id] = c.lru.PushFront(&decryptCacheEntry{
+		id:        id,
+		algorithm: algorithm,
+		plaintext: append([]byte{}, plaintext...),
+		expires:   c.now().Add(c.ttl),
+	})
+	for c.lru.Len() > c.size {
+		c.evict(c.lru.Back())
+	}
+}
+
+// clear evicts all the cached values.
+func (c *decryptCache) clear() {
+	if c == nil {
+		return
+	}
+
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	for c.lru.Len() > 0 {
+		c.evict(c.lru.Back())
+	}
+}
+
+// evict removes the given element from the cache and wipes its
+// plaintext. It must be called with the lock held.
+func (c *decryptCache) evict(elem *list.Element) {
+	entry := c.lru.Remove(elem).(*decryptCacheEntry)
+	delete(c.entries, entry.id)
+	encryption.Wipe(entry.plaintext)
+}
+
+func (c *decryptCache) id(payload, aad []byte, secret string) [sha256.Size]byte {
+	// The lengths keep the boundaries between the fields unambiguous,
+	// and tell apart the payloads without associated data from the
+	// payloads with empty associated data.
+	var lengths [16]byte
+	binary.BigEndian.PutUint64(lengths[:8], uint64(len(secret)))
+	if aad != nil {
+		binary.BigEndian.PutUint64(lengths[8:], uint64(len(aad))+1)
+	}
+
+	mac := hmac.New(sha256.New, c.hmacKey)
+	mac.Write(lengths[:])
+	mac.Write([]byte(secret))
+	mac.Write(aad)
+	mac.Write(payload)
+
+	var id [sha256.Size]byte
+	mac.Sum(id[:0])
+	return id
+}
@@ -0,0 +1,186 @@
+package service
+
+import (
+	"bytes"
+	"context"
+	"testing"
+	"time"
+
+	"github.com/grafana/grafana/pkg/infra/usagestats"
+	"github.com/grafana/grafana/pkg/services/encryption"
+	"github.com/grafana/grafana/pkg/services/encryption/provider"
+	"github.com/grafana/grafana/pkg/setting"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_decryptCache(t *testing.T) {
+	t.Run("nil cache should cache nothing", func(t *testing.T) {
+		var c *decryptCache
+		c.put([]byte("payload"), nil, "1234", encryption.AesGcm, []byte("grafana"))
+
+		_, _, ok := c.get([]byte("payload"), nil, "1234")
+		assert.False(t, ok)
+	})
+
+	t.Run("non-positive size or TTL should disable the cache", func(t *testing.T) {
+		for _, c := range []struct {
+			size int
+			ttl  time.Duration
+		}{{0, time.Minute}, {10, 0}} {
+			cache, err := newDecryptCache(c.size, c.ttl)
+			require.NoError(t, err)
+			assert.Nil(t, cache)
+		}
+	})
+
+	t.Run("cached values should be returned as copies", func(t *testing.T) {
+		c, err := newDecryptCache(10, time.Minute)
+		require.NoError(t, err)
+
+		plaintext := []byte("grafana")
+		c.put([]byte("payload"), nil, "1234", encryption.AesGcm, plaintext)
+		encryption.Wipe(plaintext)
+
+		for i := 0; i < 2; i++ {
+			cached, algorithm, ok := c.get([]byte("payload"), nil, "1234")
+			require.True(t, ok)
+			assert.Equal(t, []byte("grafana"), cached)
+			assert.Equal(t, encryption.AesGcm, algorithm)
+			encryption.Wipe(cached)
+		}
+	})
+
+	t.Run("any change to the payload, associated data or secret should miss", func(t *testing.T) {
+		c, err := newDecryptCache(10, time.Minute)
+		require.NoError(t, err)
+
+		c.put([]byte("payload"), nil, "1234", encryption.AesGcm, []byte("grafana"))
+
+		for _, k := range []struct {
+			payload, aad []byte
+			secret       string
+		}{
+			{[]byte("other"), nil, "1234"},
+			{[]byte("payload"), nil, "4321"},
+			{[]byte("payload"), []byte{}, "1234"},
+			{[]byte("payload"), []byte("aad"), "1234"},
+			{[]byte("4payload"), nil, "123"},
+		} {
+			_, _, ok := c.get(k.payload, k.aad, k.secret)
+			assert.False(t, ok)
+		}
+	})
+
+	t.Run("expired values should be evicted and wiped", func(t *testing.T) {
+		c, err := newDecryptCache(10, time.Minute)
+		require.NoError(t, err)
+
+		now := time.Unix(0, 0)
+		c.now = func() time.Time { return now }
+
+		c.put([]byte("payload"), nil, "1234", encryption.AesGcm, []byte("grafana"))
+		cached := c.entries[c.id([]byte("payload"), nil, "1234")].Value.(*decryptCacheEntry).plaintext
+
+		now = now.Add(time.Minute - time.Second)
+		_, _, ok := c.get([]byte("payload"), nil, "1234")
+		assert.True(t, ok)
+
+		now = now.Add(time.Second)
+		_, _, ok = c.get([]byte("payload"), nil, "1234")
+		assert.False(t, ok)
+		assert.Zero(t, c.lru.Len())
+		assert.Equal(t, make([]byte, len("grafana")), cached)
+	})
+
+	t.Run("least recently used values should be evicted and wiped", func(t *testing.T) {
+		c, err := newDecryptCache(2, time.Minute)
+		require.NoError(t, err)
+
+		c.put([]byte("first"), nil, "1234", encryption.AesGcm, []byte("grafana"))
+		c.put([]byte("second"), nil, "1234", encryption.AesGcm, []byte("grafana"))
+		second := c.entries[c.id([]byte("second"), nil, "1234")].Value.(*decryptCacheEntry).plaintext
+
+		_, _, ok := c.get([]byte("first"), nil, "1234")
+		require.True(t, ok)
+
+		c.put([]byte("third"), nil, "1234", encryption.AesGcm, []byte("grafana"))
+
+		assert.Equal(t, 2, c.lru.Len())
+		_, _, ok = c.get([]byte("second"), nil, "1234")
+		assert.False(t, ok)
+		assert.Equal(t, make([]byte, len("grafana")), second)
+	})
+
+	t.Run("secrets should never be kept", func(t *testing.T) {
+		c, err := newDecryptCache(10, time.Minute)
+		require.NoError(t, err)
+
+		secret := "super secret value"
+		c.put([]byte("payload"), nil, secret, encryption.AesGcm, []byte("grafana"))
+
+		for id, elem := range c.entries {
+			assert.False(t, bytes.Contains(id[:], []byte(secret)))
+
+			entry := elem.Value.(*decryptCacheEntry)
+			assert.NotContains(t, string(entry.plaintext), secret)
+			assert.NotContains(t, entry.algorithm, secret)
+		}
+	})
+}
+
+func Test_Service_DecryptCache(t *testing.T) {
+	ctx := context.Background()
+
+	settings := &setting.OSSImpl{Cfg: setting.NewCfg()}
+	section := settings.Cfg.Raw.Section(securitySection)
+	section.Key(skipSelfTestKey).SetValue("true")
+	section.Key(encryptionAlgorithmKey).SetValue(encryption.AesGcm)
+	section.Key(decryptCacheSizeKey).SetValue("10")
+	section.Key(decryptCacheTTLKey).SetValue("1h")
+
+	svc, err := ProvideEncryptionService(provider.ProvideEncryptionProvider(settings), &usagestats.UsageStatsMock{T: t}, settings)
+	require.NoError(t, err)
+	require.NotNil(t, svc.decryptCache)
+	assert.Equal(t, time.Hour, svc.decryptCache.ttl)
+
+	encrypted, err := svc.Encrypt(ctx, []byte("grafana"), "1234")
+	require.NoError(t, err)
+
+	t.Run("repeated decryptions should hit the cache", func(t *testing.T) {
+		decrypted, err := svc.Decrypt(ctx, encrypted, "1234")
+		require.NoError(t, err)
+		assert.Equal(t, []byte("grafana"), decrypted)
+		assert.Equal(t, 1, svc.decryptCache.lru.Len())
+
+		// Wiping the returned plaintext must not wipe the cached one.
+		encryption.Wipe(decrypted)
+
+		decryptions := svc.decryptionsCounter.snapshot()[encryption.AesGcm]
+		decrypted, err = svc.Decrypt(ctx, encrypted, "1234")
+		require.NoError(t, err)
+		assert.Equal(t, []byte("grafana"), decrypted)
+		assert.Equal(t, 1, svc.decryptCache.lru.Len())
+
+		// Hits are counted as any other decryption.
+		assert.Equal(t, decryptions+1, svc.decryptionsCounter.snapshot()[encryption.AesGcm])
+	})
+
+	t.Run("failures should not be cached", func(t *testing.T) {
+		_, err := svc.Decrypt(ctx, encrypted, "4321")
+		require.ErrorIs(t, err, encryption.ErrAuthenticationFailed)
+		assert.Equal(t, 1, svc.decryptCache.lru.Len())
+	})
+
+	t.Run("cache should be wiped on reload and close", func(t *testing.T) {
+		require.NoError(t, svc.Reload(settings.Section(securitySection)))
+		assert.Zero(t, svc.decryptCache.lru.Len())
+
+		_, err := svc.Decrypt(ctx, encrypted, "1234")
+		require.NoError(t, err)
+		require.Equal(t, 1, svc.decryptCache.lru.Len())
+
+		require.NoError(t, svc.Close())
+		assert.Zero(t, svc.decryptCache.lru.Len())
+	})
+}
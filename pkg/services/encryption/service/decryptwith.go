@@ -0,0 +1,86 @@
+package service
+
+import (
+	"context"
+	"crypto/rand"
+	"errors"
+	"sort"
+
+	"github.com/grafana/grafana/pkg/infra/log"
+	"github.com/grafana/grafana/pkg/infra/usagestats"
+	"github.com/grafana/grafana/pkg/services/encryption"
+	"github.com/grafana/grafana/pkg/setting"
+)
+
+var errDecryptOnly = errors.New("encryption not supported by a decrypt-only service")
+
+// DecryptWith decrypts the given payload, as Decrypt does, with the given
+// deciphers (e.g. those of provider.Provider) and the default configuration,
+// so tooling can decrypt values without wiring a whole Service. Payloads
+// encrypted with key versions cannot be decrypted this way, as their keys
+// are only known to the configuration.
+func DecryptWith(ctx context.Context, deciphers map[string]encryption.Decipher, payload []byte, secret string) ([]byte, error) {
+	settings := &setting.OSSImpl{Cfg: setting.NewCfg()}
+	section := settings.Cfg.Raw.Section(securitySection)
+
+	// There's nothing to encrypt, so neither the self-test nor the
+	// configured algorithm matter, as long as the construction accepts it.
+	section.Key(skipSelfTestKey).SetValue("true")
+	if _, ok := deciphers[defaultEncryptionAlgorithm]; !ok {
+		algorithms := make([]string, 0, len(deciphers))
+		for algorithm := range deciphers {
+			algorithms = append(algorithms, algorithm)
+		}
+		sort.Strings(algorithms)
+
+		if len(algorithms) > 0 {
+			section.Key(encryptionAlgorithmKey).SetValue(algorithms[0])
+		}
+	}
+
+	s, err := provideEncryptionService(decryptOnlyProvider{deciphers: deciphers}, noUsageStats{}, settings, log.New("encryption"), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = s.Close() }()
+
+	return s.Decrypt(ctx, payload, secret)
+}
+
+// decryptOnlyProvider provides the given deciphers along with
+// ciphers that refuse to encrypt, as a Service needs both.
+type decryptOnlyProvider struct {
+	deciphers map[string]encryption.Decipher
+}
+
+func (p decryptOnlyProvider) ProvideCiphers() map[string]encryption.Cipher {
+	ciphers := make(map[string]encryption.Cipher, len(p.deciphers))
+	for algorithm := range p.deciphers {
+		ciphers[algorithm] = decryptOnlyCipher{}
+	}
+	return ciphers
+}
+
+func (p decryptOnlyProvider) ProvideDeciphers() map[string]encryption.Decipher {
+	return p.deciphers
+}
+
+type decryptOnlyCipher struct{}
+
+func (decryptOnlyCipher) Encrypt(context.Context, []byte, string) ([]byte, error) {
+	return nil, errDecryptOnly
+}
+
+// noUsageStats discards the usage stats of the services
+// built by DecryptWith, as they're not reported anywhere.
+type noUsageStats struct{}
+
+func (noUsageStats) GetUsageReport(context.Context) (usagestats.Report, error) {
+	return usagestats.Report{}, nil
+}
+
+func (noUsageStats) RegisterMetricsFunc(usagestats.MetricsFunc) {}
+
+func (noUsageStats) RegisterSendReportCallback(usagestats.SendReportCallbackFunc) {}
+
+func (noUsageStats) ShouldBeReported(context.Context, string) bool { return false }
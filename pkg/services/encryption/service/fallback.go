@@ -0,0 +1,42 @@
+package service
+
+import (
+	"github.com/grafana/grafana/pkg/services/encryption"
+)
+
+// SetFallbackDeciphers sets the deciphers to try when decrypting a payload
+// with the registered decipher of its algorithm fails, e.g. to decrypt a
+// database restored from a backup, encrypted under another key set, without
+// reconfiguring the whole service. It replaces any fallback deciphers set
+// before, and a nil or empty map removes them.
+//
+// Failures aren't always detected: only the authenticated algorithms reliably
+// fail when decrypting with the wrong key, while the others (i.e. AesCfb)
+// usually succeed with a garbled plaintext, so the fallback isn't tried.
+// Failures due to the context being done don't fall back either. Payloads
+// of algorithms without a registered decipher aren't decrypted with the
+// fallback deciphers, which aren't a way to register algorithms.
+//
+// In FIPS mode, the deciphers of algorithms that aren't approved are ignored.
+func (s *Service) SetFallbackDeciphers(deciphers map[string]encryption.Decipher) {
+	fallback := make(map[string]encryption.Decipher, len(deciphers))
+	for algorithm, d := range deciphers {
+		if d == nil || (s.fipsMode && !fipsApprovedAlgorithms[algorithm]) {
+			continue
+		}
+		fallback[algorithm] = d
+	}
+
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	s.fallbackDeciphers = fallback
+}
+
+func (s *Service) fallbackDecipher(algorithm string) (encryption.Decipher, bool) {
+	s.mtx.RLock()
+	defer s.mtx.RUnlock()
+
+	d, ok := s.fallbackDeciphers[algorithm]
+	return d, ok
+}
@@ -0,0 +1,107 @@
+package service
+
+import (
+	"context"
+	"testing"
+
+	"github.com/grafana/grafana/pkg/services/encryption"
+	"github.com/grafana/grafana/pkg/services/encryption/provider"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_Service_FallbackDeciphers(t *testing.T) {
+	ctx := context.Background()
+
+	svc := SetupTestService(t)
+	setAlgorithm(t, svc, encryption.AesGcm)
+
+	// The restored payloads are encrypted under the backup secret,
+	// which only the fallback decipher knows about.
+	restored, err := svc.Encrypt(ctx, []byte("grafana"), "backup")
+	require.NoError(t, err)
+
+	restoredWithAAD, err := svc.EncryptWithAAD(ctx, []byte("grafana"), []byte("aad"), "backup")
+	require.NoError(t, err)
+
+	aesGcm := provider.Provider{}.ProvideDeciphers()[encryption.AesGcm].(encryption.AEADDecipher)
+
+	t.Run("without fallback only the primary should be tried", func(t *testing.T) {
+		_, err := svc.Decrypt(ctx, restored, "1234")
+		require.ErrorIs(t, err, encryption.ErrAuthenticationFailed)
+	})
+
+	t.Run("payloads only the fallback can decrypt should be decrypted", func(t *testing.T) {
+		svc.SetFallbackDeciphers(map[string]encryption.Decipher{
+			encryption.AesGcm: fixedSecretDecipher{AEADDecipher: aesGcm, secret: "backup"},
+		})
+		t.Cleanup(func() { svc.SetFallbackDeciphers(nil) })
+
+		decrypted, err := svc.Decrypt(ctx, restored, "1234")
+		require.NoError(t, err)
+		assert.Equal(t, []byte("grafana"), decrypted)
+
+		decrypted, err = svc.DecryptWithAAD(ctx, restoredWithAAD, []byte("aad"), "1234")
+		require.NoError(t, err)
+		assert.Equal(t, []byte("grafana"), decrypted)
+
+		values, err := svc.DecryptJsonData(ctx, map[string][]byte{"password": restored}, "1234")
+		require.NoError(t, err)
+		assert.Equal(t, map[string]string{"password": "grafana"}, values)
+
+		current, err := svc.Encrypt(ctx, []byte("grafana"), "1234")
+		require.NoError(t, err)
+
+		decrypted, err = svc.Decrypt(ctx, current, "1234")
+		require.NoError(t, err)
+		assert.Equal(t, []byte("grafana"), decrypted)
+	})
+
+	t.Run("failing fallback should return the primary error", func(t *testing.T) {
+		svc.SetFallbackDeciphers(map[string]encryption.Decipher{
+			encryption.AesGcm: fixedSecretDecipher{AEADDecipher: aesGcm, secret: "other"},
+		})
+		t.Cleanup(func() { svc.SetFallbackDeciphers(nil) })
+
+		_, err := svc.Decrypt(ctx, restored, "1234")
+		require.ErrorIs(t, err, encryption.ErrAuthenticationFailed)
+
+		_, err = svc.DecryptWithAAD(ctx, restoredWithAAD, []byte("other"), "1234")
+		require.ErrorIs(t, err, encryption.ErrAuthenticationFailed)
+	})
+
+	t.Run("fallback of other algorithms should not be tried", func(t *testing.T) {
+		svc.SetFallbackDeciphers(map[string]encryption.Decipher{
+			encryption.ChaCha20Poly1305: fixedSecretDecipher{AEADDecipher: aesGcm, secret: "backup"},
+		})
+		t.Cleanup(func() { svc.SetFallbackDeciphers(nil) })
+
+		_, err := svc.Decrypt(ctx, restored, "1234")
+		require.ErrorIs(t, err, encryption.ErrAuthenticationFailed)
+	})
+
+	t.Run("removed fallback should not be tried", func(t *testing.T) {
+		svc.SetFallbackDeciphers(map[string]encryption.Decipher{
+			encryption.AesGcm: fixedSecretDecipher{AEADDecipher: aesGcm, secret: "backup"},
+		})
+		svc.SetFallbackDeciphers(nil)
+
+		_, err := svc.Decrypt(ctx, restored, "1234")
+		require.ErrorIs(t, err, encryption.ErrAuthenticationFailed)
+	})
+}
+
+// fixedSecretDecipher decrypts with the given secret,
+// regardless of the one it's called with.
+type fixedSecretDecipher struct {
+	encryption.AEADDecipher
+	secret string
+}
+
+func (d fixedSecretDecipher) Decrypt(ctx context.Context, payload []byte, _ string) ([]byte, error) {
+	return d.AEADDecipher.Decrypt(ctx, payload, d.secret)
+}
+
+func (d fixedSecretDecipher) DecryptWithAAD(ctx context.Context, payload, aad []byte, _ string) ([]byte, error) {
+	return d.AEADDecipher.DecryptWithAAD(ctx, payload, aad, d.secret)
+}
@@ -0,0 +1,38 @@
+package service
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+
+	"github.com/grafana/grafana/pkg/services/encryption"
+)
+
+// fingerprintSalt is the fixed salt the fingerprint key is derived with, so
+// it's the same for all the payloads, but different from any encryption key.
+const fingerprintSalt = "grafana encryption fingerprint"
+
+// Fingerprint decrypts the given payload and returns an HMAC-SHA256 of its
+// plaintext, under a key derived from the secret for that sole purpose. The
+// same plaintext always has the same fingerprint under the same secret,
+// however it was encrypted, so fingerprints can be stored and compared to
+// detect duplicated or changed values (e.g. API keys) without decrypting
+// them. Without the secret, they reveal nothing about the plaintexts, but
+// anyone with the secret can check whether a guess matches a fingerprint.
+func (s *Service) Fingerprint(ctx context.Context, payload []byte, secret string) ([]byte, error) {
+	decrypted, err := s.Decrypt(ctx, payload, secret)
+	if err != nil {
+		return nil, err
+	}
+	defer encryption.Wipe(decrypted)
+
+	key, err := encryption.KeyToBytes(secret, fingerprintSalt)
+	if err != nil {
+		return nil, err
+	}
+	defer encryption.Wipe(key)
+
+	mac := hmac.New(sha256.New, key)
+	_, _ = mac.Write(decrypted)
+	return mac.Sum(nil), nil
+}
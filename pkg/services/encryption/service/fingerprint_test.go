@@ -0,0 +1,69 @@
+package service
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"testing"
+
+	"github.com/grafana/grafana/pkg/services/encryption"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_Service_Fingerprint(t *testing.T) {
+	ctx := context.Background()
+
+	svc := SetupTestService(t)
+
+	fingerprint := func(t *testing.T, plaintext, secret, algorithm string) []byte {
+		t.Helper()
+
+		encrypted, err := svc.EncryptWithAlgorithm(ctx, []byte(plaintext), secret, algorithm)
+		require.NoError(t, err)
+
+		fp, err := svc.Fingerprint(ctx, encrypted, secret)
+		require.NoError(t, err)
+		require.Len(t, fp, sha256.Size)
+		return fp
+	}
+
+	t.Run("same plaintext should have the same fingerprint", func(t *testing.T) {
+		expected := fingerprint(t, "grafana", "1234", encryption.AesGcm)
+
+		// Different ciphertexts, or even algorithms, don't matter.
+		for _, algorithm := range []string{encryption.AesGcm, encryption.AesCfb, encryption.ChaCha20Poly1305} {
+			assert.Equal(t, expected, fingerprint(t, "grafana", "1234", algorithm), algorithm)
+		}
+	})
+
+	t.Run("different plaintexts should have different fingerprints", func(t *testing.T) {
+		assert.NotEqual(t, fingerprint(t, "grafana", "1234", encryption.AesGcm), fingerprint(t, "grafanb", "1234", encryption.AesGcm))
+		assert.NotEqual(t, fingerprint(t, "grafana", "1234", encryption.AesGcm), fingerprint(t, "", "1234", encryption.AesGcm))
+	})
+
+	t.Run("different secrets should have different fingerprints", func(t *testing.T) {
+		assert.NotEqual(t, fingerprint(t, "grafana", "1234", encryption.AesGcm), fingerprint(t, "grafana", "4321", encryption.AesGcm))
+	})
+
+	t.Run("fingerprint should not be a plain hash of the plaintext", func(t *testing.T) {
+		fp := fingerprint(t, "grafana", "1234", encryption.AesGcm)
+
+		hash := sha256.Sum256([]byte("grafana"))
+		assert.NotEqual(t, hash[:], fp)
+
+		// Nor an HMAC under the encryption secret itself.
+		mac := hmac.New(sha256.New, []byte("1234"))
+		mac.Write([]byte("grafana"))
+		assert.NotEqual(t, mac.Sum(nil), fp)
+	})
+
+	t.Run("undecryptable payload should fail", func(t *testing.T) {
+		encrypted, err := svc.EncryptWithAlgorithm(ctx, []byte("grafana"), "1234", encryption.AesGcm)
+		require.NoError(t, err)
+
+		fp, err := svc.Fingerprint(ctx, encrypted, "4321")
+		require.ErrorIs(t, err, encryption.ErrAuthenticationFailed)
+		assert.Nil(t, fp)
+	})
+}
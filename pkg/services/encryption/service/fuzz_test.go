@@ -0,0 +1,70 @@
+//go:build go1.18
+// +build go1.18
+
+package service
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/grafana/grafana/pkg/services/encryption"
+	"github.com/grafana/grafana/pkg/setting"
+)
+
+// FuzzDecrypt checks that Decrypt never panics, whatever the payload.
+// Run it with: go test -run '^$' -fuzz FuzzDecrypt ./pkg/services/encryption/service
+func FuzzDecrypt(f *testing.F) {
+	ctx := context.Background()
+
+	svc := SetupTestService(f)
+	settings := svc.settingsProvider.(*setting.OSSImpl)
+	section := settings.Cfg.Raw.Section(securitySection)
+
+	for _, algorithm := range svc.SupportedAlgorithms() {
+		for _, compress := range []string{"false", "true"} {
+			setAlgorithm(f, svc, algorithm)
+			section.Key(compressPayloadsKey).SetValue(compress)
+
+			encrypted, err := svc.Encrypt(ctx, []byte(strings.Repeat("grafana", 10)), "1234")
+			if err != nil {
+				f.Fatal(err)
+			}
+			f.Add(encrypted)
+		}
+	}
+	section.Key(compressPayloadsKey).SetValue("false")
+
+	for _, payload := range []string{
+		"",
+		"*",
+		"**",
+		"*YWVzLWdjbQ",
+		"*YWVzLWdjbQ*",
+		"*not base64!*grafana",
+		"*" + strings.Repeat("YWFh", 1024) + "*grafana",
+		"*\x01YWVzLWdjbQ*",
+		"*\x01YWVzLWdjbQ*\xff\x01",
+		"*\x01YWVzLWdjbQ*\x01\x80grafana",
+		"*\x01YWVzLWdjbQ*\x0c\x02\x01\x00\x00\x00\x01\x00\x00\x04\x00\x01\x00",
+		"*\x1fYWVzLWdjbQ*grafana",
+		"0123456789abcdef",
+		"0123456789abcdef0123",
+	} {
+		f.Add([]byte(payload))
+	}
+
+	// The secret isn't fuzzed, as it's only fed to the KDFs. None of the
+	// seeds were encrypted with it, so only unauthenticated algorithms,
+	// which decrypt anything into garbage, are expected to succeed.
+	f.Fuzz(func(t *testing.T, payload []byte) {
+		decrypted, err := svc.Decrypt(ctx, payload, "4321")
+		if err != nil {
+			return
+		}
+
+		if algorithm, _, _ := deriveEncryptionAlgorithm(payload); algorithm != encryption.AesCfb {
+			t.Fatalf("decrypted %s payload with wrong secret: %q", algorithm, decrypted)
+		}
+	})
+}
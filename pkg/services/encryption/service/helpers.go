@@ -1,6 +1,8 @@
 package service
 
 import (
+	"context"
+	"fmt"
 	"testing"
 
 	"github.com/grafana/grafana/pkg/infra/usagestats"
@@ -13,11 +15,38 @@ func SetupTestService(tb testing.TB) *Service {
 	tb.Helper()
 
 	usMock := &usagestats.UsageStatsMock{T: tb}
-	provider := encryptionprovider.ProvideEncryptionProvider()
 	settings := &setting.OSSImpl{Cfg: setting.NewCfg()}
+	// The self-test has its own tests, and would otherwise
+	// slow down every test setting up the service.
+	settings.Cfg.Raw.Section(securitySection).Key(skipSelfTestKey).SetValue("true")
+	provider := encryptionprovider.ProvideEncryptionProvider(settings)
 
 	service, err := ProvideEncryptionService(provider, usMock, settings)
 	require.NoError(tb, err)
 
 	return service
 }
+
+// MustEncrypt works like Encrypt, but it panics on failure.
+// It's meant for tests and tooling only, where there's no way to recover
+// from a failed encryption, and must not be used in production code.
+func (s *Service) MustEncrypt(ctx context.Context, payload []byte, secret string) []byte {
+	encrypted, err := s.Encrypt(ctx, payload, secret)
+	if err != nil {
+		panic(fmt.Errorf("encryption failed: %w", err))
+	}
+
+	return encrypted
+}
+
+// MustDecrypt works like Decrypt, but it panics on failure.
+// It's meant for tests and tooling only, where there's no way to recover
+// from a failed decryption, and must not be used in production code.
+func (s *Service) MustDecrypt(ctx context.Context, payload []byte, secret string) []byte {
+	decrypted, err := s.Decrypt(ctx, payload, secret)
+	if err != nil {
+		panic(fmt.Errorf("decryption failed: %w", err))
+	}
+
+	return decrypted
+}
@@ -0,0 +1,156 @@
+package service
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+
+	"golang.org/x/crypto/argon2"
+
+	"github.com/grafana/grafana/pkg/services/encryption"
+	"github.com/grafana/grafana/pkg/setting"
+)
+
+// By default, the secret is handed over to the ciphers as it is, and they
+// derive the key from it with encryption.KeyToBytes (PBKDF2). When a slow KDF
+// is configured, the secret is stretched with it first, using a random salt,
+// and the result is what the ciphers receive. The parameters used are recorded
+// in the payload header, so decryption doesn't depend on the configuration.
+const (
+	kdfKey                = "kdf"
+	kdfArgon2idTimeKey    = "argon2id_time"
+	kdfArgon2idMemoryKey  = "argon2id_memory"
+	kdfArgon2idThreadsKey = "argon2id_threads"
+
+	kdfPBKDF2   = "pbkdf2"
+	kdfArgon2id = "argon2id"
+
+	defaultKDF = kdfPBKDF2
+
+	// Defaults recommended by RFC 9106 for memory-constrained environments.
+	defaultArgon2idTime    = 3
+	defaultArgon2idMemory  = 64 * 1024 // KiB
+	defaultArgon2idThreads = 4
+
+	// Upper bounds for the parameters, both configured and read from
+	// payloads, so a crafted header cannot make a single decryption use
+	// more than 1 GiB of memory for 10 passes, which is already well
+	// above what any sensible configuration needs.
+	maxArgon2idTime   = 10
+	maxArgon2idMemory = 1024 * 1024 // KiB
+
+	kdfSaltLength = 16
+	kdfKeyLength  = 32
+)
+
+const (
+	kdfIDArgon2id byte = 1
+)
+
+// kdfParams are the parameters needed to reproduce the derivation of a secret.
+// They are encoded into the payload header as:
+//
+//	<id><uint32 time><uint32 memory><uint8 threads><uint8 salt length><salt>
+type kdfParams struct {
+	id      byte
+	time    uint32
+	memory  uint32
+	threads uint8
+	salt    []byte
+}
+
+func (p kdfParams) derive(secret string) string {
+	key := p.deriveKey(secret)
+	defer encryption.Wipe(key)
+	return string(key)
+}
+
+func (p kdfParams) deriveKey(secret string) []byte {
+	return argon2.IDKey([]byte(secret), p.salt, p.time, p.memory, p.threads, kdfKeyLength)
+}
+
+func (p kdfParams) encodedLen() int {
+	return 11 + len(p.salt)
+}
+
+// appendTo appends the encoded parameters to the given buffer.
+func (p kdfParams) appendTo(b []byte) []byte {
+	off := len(b)
+	b = append(b, make([]byte, 11)...)
+	b[off] = p.id
+	binary.BigEndian.PutUint32(b[off+1:off+5], p.time)
+	binary.BigEndian.PutUint32(b[off+5:off+9], p.memory)
+	b[off+9] = p.threads
+	b[off+10] = byte(len(p.salt))
+	return append(b, p.salt...)
+}
+
+// decodeKDFParams decodes the KDF parameters at the start of
+// the given header fields, and returns the remaining fields.
+func decodeKDFParams(fields []byte) (kdfParams, []byte, error) {
+	if len(fields) < 11 || len(fields) < 11+int(fields[10]) {
+		return kdfParams{}, nil, errors.New("malformed key derivation parameters")
+	}
+
+	p := kdfParams{
+		id:      fields[0],
+		time:    binary.BigEndian.Uint32(fields[1:5]),
+		memory:  binary.BigEndian.Uint32(fields[5:9]),
+		threads: fields[9],
+		salt:    fields[11 : 11+int(fields[10])],
+	}
+
+	if p.id != kdfIDArgon2id {
+		return kdfParams{}, nil, fmt.Errorf("unsupported key derivation function: %d", p.id)
+	}
+
+	if p.time < 1 || p.time > maxArgon2idTime || p.memory < 1 || p.memory > maxArgon2idMemory || p.threads < 1 {
+		return kdfParams{}, nil, errors.New("key derivation parameters out of bounds")
+	}
+
+	return p, fields[11+int(fields[10]):], nil
+}
+
+// newKDFParams returns the parameters for a new derivation according to the
+// given section, with the salt read from the given source of randomness, or
+// nil when no other KDF than the default one is configured.
+func newKDFParams(section setting.Section, random io.Reader) (*kdfParams, error) {
+	kdf := section.KeyValue(kdfKey).MustString(defaultKDF)
+
+	switch kdf {
+	case kdfPBKDF2:
+		return nil, nil
+	case kdfArgon2id:
+		p := &kdfParams{
+			id:   kdfIDArgon2id,
+			salt: make([]byte, kdfSaltLength),
+		}
+
+		time := section.KeyValue(kdfArgon2idTimeKey).MustInt(defaultArgon2idTime)
+		memory := section.KeyValue(kdfArgon2idMemoryKey).MustInt(defaultArgon2idMemory)
+		threads := section.KeyValue(kdfArgon2idThreadsKey).MustInt(defaultArgon2idThreads)
+
+		if time < 1 || time > maxArgon2idTime {
+			return nil, fmt.Errorf("%s must be between 1 and %d", kdfArgon2idTimeKey, maxArgon2idTime)
+		}
+
+		if memory < 1 || memory > maxArgon2idMemory {
+			return nil, fmt.Errorf("%s must be between 1 and %d", kdfArgon2idMemoryKey, maxArgon2idMemory)
+		}
+
+		if threads < 1 || threads > 255 {
+			return nil, fmt.Errorf("%s must be between 1 and 255", kdfArgon2idThreadsKey)
+		}
+
+		p.time, p.memory, p.threads = uint32(time), uint32(memory), uint8(threads)
+
+		if _, err := io.ReadFull(random, p.salt); err != nil {
+			return nil, err
+		}
+
+		return p, nil
+	default:
+		return nil, fmt.Errorf("unsupported key derivation function '%s'", kdf)
+	}
+}
@@ -0,0 +1,133 @@
+package service
+
+import (
+	"context"
+	"testing"
+
+	"github.com/grafana/grafana/pkg/services/encryption"
+	"github.com/grafana/grafana/pkg/setting"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_Service_KDF(t *testing.T) {
+	ctx := context.Background()
+
+	svc := SetupTestService(t)
+	settings := svc.settingsProvider.(*setting.OSSImpl)
+
+	section := settings.Cfg.Raw.Section(securitySection)
+	setAlgorithm(t, svc, encryption.AesGcm)
+	section.Key(kdfArgon2idTimeKey).SetValue("1")
+	section.Key(kdfArgon2idMemoryKey).SetValue("1024")
+	section.Key(kdfArgon2idThreadsKey).SetValue("1")
+
+	t.Run("with default kdf should not record kdf parameters", func(t *testing.T) {
+		section.Key(kdfKey).SetValue(kdfPBKDF2)
+
+		encrypted, err := svc.Encrypt(ctx, []byte("grafana"), "1234")
+		require.NoError(t, err)
+
+		header, _, err := decodePayloadHeader(encrypted)
+		require.NoError(t, err)
+		assert.Nil(t, header.kdf)
+	})
+
+	t.Run("with argon2id should record kdf parameters", func(t *testing.T) {
+		section.Key(kdfKey).SetValue(kdfArgon2id)
+
+		encrypted, err := svc.Encrypt(ctx, []byte("grafana"), "1234")
+		require.NoError(t, err)
+
+		header, _, err := decodePayloadHeader(encrypted)
+		require.NoError(t, err)
+		require.NotNil(t, header.kdf)
+		assert.Equal(t, kdfIDArgon2id, header.kdf.id)
+		assert.Equal(t, uint32(1), header.kdf.time)
+		assert.Equal(t, uint32(1024), header.kdf.memory)
+		assert.Equal(t, uint8(1), header.kdf.threads)
+		assert.Len(t, header.kdf.salt, kdfSaltLength)
+
+		// Decryption relies on the recorded parameters,
+		// not on the ones currently configured.
+		section.Key(kdfKey).SetValue(kdfPBKDF2)
+
+		decrypted, err := svc.Decrypt(ctx, encrypted, "1234")
+		require.NoError(t, err)
+		assert.Equal(t, []byte("grafana"), decrypted)
+
+		_, err = svc.Decrypt(ctx, encrypted, "4321")
+		require.ErrorIs(t, err, encryption.ErrAuthenticationFailed)
+	})
+
+	t.Run("with argon2id and aes-siv should remain deterministic", func(t *testing.T) {
+		section.Key(kdfKey).SetValue(kdfArgon2id)
+		setAlgorithm(t, svc, encryption.AesSiv)
+
+		first, err := svc.Encrypt(ctx, []byte("grafana"), "1234")
+		require.NoError(t, err)
+
+		second, err := svc.Encrypt(ctx, []byte("grafana"), "1234")
+		require.NoError(t, err)
+
+		assert.Equal(t, first, second)
+	})
+
+	t.Run("with unknown kdf should fail", func(t *testing.T) {
+		section.Key(kdfKey).SetValue("unknown")
+
+		_, err := svc.Encrypt(ctx, []byte("grafana"), "1234")
+		require.Error(t, err)
+
+		require.Error(t, svc.Validate(settings.Section(securitySection)))
+	})
+
+	t.Run("with out of bounds parameters should fail", func(t *testing.T) {
+		section.Key(kdfKey).SetValue(kdfArgon2id)
+		section.Key(kdfArgon2idMemoryKey).SetValue("0")
+		defer section.Key(kdfArgon2idMemoryKey).SetValue("1024")
+
+		_, err := svc.Encrypt(ctx, []byte("grafana"), "1234")
+		require.Error(t, err)
+	})
+}
+
+func Test_decodeKDFParams(t *testing.T) {
+	params := kdfParams{id: kdfIDArgon2id, time: 1, memory: 1024, threads: 1, salt: []byte("0123456789abcdef")}
+
+	t.Run("encoded parameters should round-trip", func(t *testing.T) {
+		decoded, rest, err := decodeKDFParams(append(params.appendTo(nil), 'x'))
+		require.NoError(t, err)
+		assert.Equal(t, params, decoded)
+		assert.Equal(t, []byte("x"), rest)
+	})
+
+	t.Run("truncated parameters should fail", func(t *testing.T) {
+		encoded := params.appendTo(nil)
+		for i := 0; i < len(encoded); i++ {
+			_, _, err := decodeKDFParams(encoded[:i])
+			require.Error(t, err)
+		}
+	})
+
+	t.Run("unknown kdf should fail", func(t *testing.T) {
+		unknown := params
+		unknown.id = 0xff
+
+		_, _, err := decodeKDFParams(unknown.appendTo(nil))
+		require.Error(t, err)
+	})
+
+	t.Run("out of bounds parameters should fail", func(t *testing.T) {
+		for _, p := range []kdfParams{
+			{id: kdfIDArgon2id, time: maxArgon2idTime + 1, memory: 1024, threads: 1},
+			{id: kdfIDArgon2id, time: 1, memory: maxArgon2idMemory + 1, threads: 1},
+			{id: kdfIDArgon2id, time: 1, memory: 1024, threads: 0},
+			// The former bounds, which allowed 4 GiB for 64 passes.
+			{id: kdfIDArgon2id, time: 64, memory: 4 * 1024 * 1024, threads: 1},
+		} {
+			_, _, err := decodeKDFParams(p.appendTo(nil))
+			require.Error(t, err)
+		}
+	})
+}
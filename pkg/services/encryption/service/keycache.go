@@ -0,0 +1,164 @@
+package service
+
+import (
+	"bytes"
+	"container/list"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"io"
+	"sync"
+
+	"github.com/grafana/grafana/pkg/services/encryption"
+)
+
+// kdfCacheSizeKey sets the max amount of keys derived with a slow KDF
+// (see kdfKey) kept in memory, so encrypting and decrypting don't pay for
+// the derivation every time. It's disabled (zero) by default, and only
+// read on startup.
+const kdfCacheSizeKey = "kdf_cache_size"
+
+// keyCache is an LRU cache of the keys derived with a slow KDF. Entries are
+// identified by an HMAC of the secret and the KDF parameters (salt included),
+// under a random key generated per cache, so neither the secret nor anything
+// that would help guess it offline is ever kept. Evicted keys are wiped.
+//
+// A fresh KDF salt per payload would never be derived twice, so while the
+// cache is enabled, the payloads encrypted by the process share the salt
+// drawn on startup instead, see saltSource. That's no weaker, as the ciphers
+// still salt each payload on their own, and the stretched secret is the same
+// for all the payloads anyway. The payloads of an instance are then derived
+// once per restart rather than once per payload, whether on encryption or
+// decryption.
+//
+// A nil *keyCache is valid and derives every key.
+type keyCache struct {
+	size    int
+	hmacKey []byte
+	salt    []byte
+
+	mtx     sync.Mutex
+	entries map[[sha256.Size]byte]*list.Element
+	lru     *list.List
+}
+
+type keyCacheEntry struct {
+	id  [sha256.Size]byte
+	key []byte
+}
+
+// newKeyCache returns a cache of up to the given amount of keys, with its
+// KDF salt read from the given source of randomness, or nil when the size
+// isn't positive.
+func newKeyCache(size int, random io.Reader) (*keyCache, error) {
+	if size <= 0 {
+		return nil, nil
+	}
+
+	c := &keyCache{
+		size:    size,
+		hmacKey: make([]byte, sha256.Size),
+		salt:    make([]byte, kdfSaltLength),
+		entries: make(map[[sha256.Size]byte]*list.Element, size),
+		lru:     list.New(),
+	}
+
+	if _, err := io.ReadFull(rand.Reader, c.hmacKey); err != nil {
+		return nil, err
+	}
+
+	if _, err := io.ReadFull(random, c.salt); err != nil {
+		return nil, err
+	}
+
+	return c, nil
+}
+
+// saltSource returns the source the KDF salts of new payloads must be read
+// from, i.e. the salt of the cache, or the given source when it's disabled.
+func (c *keyCache) saltSource(random io.Reader) io.Reader {
+	if c == nil {
+		return random
+	}
+	return bytes.NewReader(c.salt)
+}
+
+// derive returns the key derived from the given secret with the given
+// parameters, as p.derive does, reusing the cached one when available.
+func (c *keyCache) derive(p *kdfParams, secret string) string {
+	if c == nil {
+		return p.derive(secret)
+	}
+
+	id := c.id(p, secret)
+
+	c.mtx.Lock()
+	if elem, ok := c.entries[id]; ok {
+		c.lru.MoveToFront(elem)
+		key := string(elem.Value.(*keyCacheEntry).key)
+		c.mtx.Unlock()
+		return key
+	}
+	c.mtx.Unlock()
+
+	// The derivation is slow, so it's done without holding the lock,
+	// at the cost of concurrent misses deriving the same key twice.
+	key := p.deriveKey(secret)
+
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	if elem, ok := c.entries[id]; ok {
+		c.lru.MoveToFront(elem)
+		defer encryption.Wipe(key)
+		return string(key)
+	}
+
+	c.entries[id] = c.lru.PushFront(&keyCacheEntry{id: id, key: key})
+	for c.lru.Len() > c.size {
+		c.evict(c.lru.Back())
+	}
+
+	return string(key)
+}
+
+// clear evicts all the cached keys.
+func (c *keyCache) clear() {
+	if c == nil {
+		return
+	}
+
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	for c.lru.Len() > 0 {
+		c.evict(c.lru.Back())
+	}
+}
+
+// evict removes the given element from the cache and wipes its key.
+// It must be called with the lock held.
+func (c *keyCache) evict(elem *list.Element) {
+	entry := c.lru.Remove(elem).(*keyCacheEntry)
+	delete(c.entries, entry.id)
+	encryption.Wipe(entry.key)
+}
+
+func (c *keyCache) id(p *kdfParams, secret string) [sha256.Size]byte {
+	var params [10]byte
+	params[0] = p.id
+	binary.BigEndian.PutUint32(params[1:5], p.time)
+	binary.BigEndian.PutUint32(params[5:9], p.memory)
+	params[9] = p.threads
+
+	mac := hmac.New(sha256.New, c.hmacKey)
+	mac.Write(params[:])
+	mac.Write([]byte{byte(len(p.salt))})
+	mac.Write(p.salt)
+	mac.Write([]byte(secret))
+
+	var id [sha256.Size]byte
+	mac.Sum(id[:0])
+	return id
+}
@@ -0,0 +1,144 @@
+package service
+
+import (
+	"context"
+	"crypto/rand"
+	"testing"
+
+	"github.com/grafana/grafana/pkg/infra/usagestats"
+	"github.com/grafana/grafana/pkg/services/encryption"
+	"github.com/grafana/grafana/pkg/services/encryption/provider"
+	"github.com/grafana/grafana/pkg/setting"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_keyCache(t *testing.T) {
+	params := func(salt string) *kdfParams {
+		return &kdfParams{id: kdfIDArgon2id, time: 1, memory: 1024, threads: 1, salt: []byte(salt)}
+	}
+
+	t.Run("nil cache should derive every key", func(t *testing.T) {
+		var c *keyCache
+		assert.Equal(t, params("salt").derive("1234"), c.derive(params("salt"), "1234"))
+	})
+
+	t.Run("non-positive size should disable the cache", func(t *testing.T) {
+		c, err := newKeyCache(0, rand.Reader)
+		require.NoError(t, err)
+		assert.Nil(t, c)
+	})
+
+	t.Run("cached keys should match the derived ones", func(t *testing.T) {
+		c, err := newKeyCache(10, rand.Reader)
+		require.NoError(t, err)
+
+		for i := 0; i < 2; i++ {
+			assert.Equal(t, params("salt").derive("1234"), c.derive(params("salt"), "1234"))
+		}
+		assert.Equal(t, 1, c.lru.Len())
+
+		// Any change to the secret or the parameters is a different key.
+		assert.Equal(t, params("salt").derive("4321"), c.derive(params("salt"), "4321"))
+		assert.Equal(t, params("pepper").derive("1234"), c.derive(params("pepper"), "1234"))
+		assert.Equal(t, 3, c.lru.Len())
+	})
+
+	t.Run("least recently used keys should be evicted and wiped", func(t *testing.T) {
+		c, err := newKeyCache(2, rand.Reader)
+		require.NoError(t, err)
+
+		c.derive(params("first"), "1234")
+		first := c.entries[c.id(params("first"), "1234")].Value.(*keyCacheEntry).key
+
+		c.derive(params("second"), "1234")
+		c.derive(params("first"), "1234")
+		second := c.entries[c.id(params("second"), "1234")].Value.(*keyCacheEntry).key
+
+		c.derive(params("third"), "1234")
+
+		assert.Equal(t, 2, c.lru.Len())
+		assert.NotContains(t, c.entries, c.id(params("second"), "1234"))
+		assert.Equal(t, make([]byte, kdfKeyLength), second)
+		assert.NotEqual(t, make([]byte, kdfKeyLength), first)
+	})
+}
+
+func Test_Service_KeyCache(t *testing.T) {
+	ctx := context.Background()
+
+	settings := &setting.OSSImpl{Cfg: setting.NewCfg()}
+	section := settings.Cfg.Raw.Section(securitySection)
+	section.Key(encryptionAlgorithmKey).SetValue(encryption.AesGcm)
+	section.Key(kdfKey).SetValue(kdfArgon2id)
+	section.Key(kdfArgon2idTimeKey).SetValue("1")
+	section.Key(kdfArgon2idMemoryKey).SetValue("1024")
+	section.Key(kdfArgon2idThreadsKey).SetValue("1")
+	section.Key(kdfCacheSizeKey).SetValue("10")
+
+	svc, err := ProvideEncryptionService(provider.ProvideEncryptionProvider(settings), &usagestats.UsageStatsMock{T: t}, settings)
+	require.NoError(t, err)
+	require.NotNil(t, svc.keyCache)
+
+	// Distinct payloads share the KDF salt of the cache,
+	// so they're all encrypted and decrypted with one key.
+	var payloads [][]byte
+	for i := 0; i < 3; i++ {
+		encrypted, err := svc.Encrypt(ctx, []byte("grafana"), "1234")
+		require.NoError(t, err)
+		payloads = append(payloads, encrypted)
+
+		header, _, err := decodePayloadHeader(encrypted)
+		require.NoError(t, err)
+		require.NotNil(t, header.kdf)
+		assert.Equal(t, svc.keyCache.salt, header.kdf.salt)
+	}
+	assert.NotEqual(t, payloads[0], payloads[1])
+
+	for _, encrypted := range payloads {
+		decrypted, err := svc.Decrypt(ctx, encrypted, "1234")
+		require.NoError(t, err)
+		assert.Equal(t, []byte("grafana"), decrypted)
+	}
+	assert.Equal(t, 1, svc.keyCache.lru.Len())
+
+	_, err = svc.Decrypt(ctx, payloads[0], "4321")
+	require.ErrorIs(t, err, encryption.ErrAuthenticationFailed)
+
+	t.Run("payloads of another instance should be derived once", func(t *testing.T) {
+		other, err := ProvideEncryptionService(provider.ProvideEncryptionProvider(settings), &usagestats.UsageStatsMock{T: t}, settings)
+		require.NoError(t, err)
+		require.NotEqual(t, svc.keyCache.salt, other.keyCache.salt)
+
+		svc.keyCache.clear()
+		for i := 0; i < 3; i++ {
+			encrypted, err := other.Encrypt(ctx, []byte("grafana"), "1234")
+			require.NoError(t, err)
+
+			decrypted, err := svc.Decrypt(ctx, encrypted, "1234")
+			require.NoError(t, err)
+			assert.Equal(t, []byte("grafana"), decrypted)
+		}
+		assert.Equal(t, 1, svc.keyCache.lru.Len())
+	})
+
+	t.Run("payloads should have their own salt without cache", func(t *testing.T) {
+		section.Key(kdfCacheSizeKey).SetValue("0")
+		t.Cleanup(func() { section.Key(kdfCacheSizeKey).SetValue("10") })
+
+		uncached, err := ProvideEncryptionService(provider.ProvideEncryptionProvider(settings), &usagestats.UsageStatsMock{T: t}, settings)
+		require.NoError(t, err)
+		require.Nil(t, uncached.keyCache)
+
+		var salts [][]byte
+		for i := 0; i < 2; i++ {
+			encrypted, err := uncached.Encrypt(ctx, []byte("grafana"), "1234")
+			require.NoError(t, err)
+
+			header, _, err := decodePayloadHeader(encrypted)
+			require.NoError(t, err)
+			salts = append(salts, header.kdf.salt)
+		}
+		assert.NotEqual(t, salts[0], salts[1])
+	})
+}
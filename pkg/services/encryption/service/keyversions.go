@@ -0,0 +1,120 @@
+package service
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+
+	"github.com/grafana/grafana/pkg/services/encryption"
+	"github.com/grafana/grafana/pkg/setting"
+	"github.com/grafana/grafana/pkg/util"
+)
+
+// Key versions allow rotating the keys used for encryption without having
+// to re-encrypt all the existing payloads at once. They're configured as:
+//
+//	key_versions = 2021, 2022
+//	key_version_2021 = <key>
+//	key_version_2022 = <key>
+//	current_key_version = 2022
+//
+// When configured, the key of the current version is mixed with the secret
+// given to Encrypt (see keyRegistry.secret) and the version id is recorded in
+// the payload header, so Decrypt can look up the same key later on, as long
+// as the version is still configured. Payloads without a version keep being
+// decrypted with the given secret alone.
+const (
+	keyVersionsKey       = "key_versions"
+	keyVersionKeyPrefix  = "key_version_"
+	currentKeyVersionKey = "current_key_version"
+
+	// maxKeyVersionIDLength bounds the length of the
+	// version ids, which are stored in the payload header.
+	maxKeyVersionIDLength = 64
+)
+
+type keyRegistry struct {
+	current string
+	keys    map[string]string
+}
+
+// newKeyRegistry returns the key versions configured in the given
+// section, or nil when no key versions are configured.
+func newKeyRegistry(section setting.Section) (*keyRegistry, error) {
+	ids := util.SplitString(section.KeyValue(keyVersionsKey).MustString(""))
+	current := section.KeyValue(currentKeyVersionKey).MustString("")
+
+	if len(ids) == 0 {
+		if current != "" {
+			return nil, fmt.Errorf("%s is set but no %s are configured", currentKeyVersionKey, keyVersionsKey)
+		}
+		return nil, nil
+	}
+
+	r := &keyRegistry{current: current, keys: make(map[string]string, len(ids))}
+	for _, id := range ids {
+		if len(id) > maxKeyVersionIDLength {
+			return nil, fmt.Errorf("key version id '%s' exceeds the maximum length of %d bytes", id, maxKeyVersionIDLength)
+		}
+
+		if _, ok := r.keys[id]; ok {
+			return nil, fmt.Errorf("key version '%s' is configured more than once", id)
+		}
+
+		key := section.KeyValue(keyVersionKeyPrefix + id).MustString("")
+		if key == "" {
+			return nil, fmt.Errorf("no key configured for key version '%s'", id)
+		}
+
+		r.keys[id] = key
+	}
+
+	if current == "" {
+		return nil, fmt.Errorf("%s must be set when %s are configured", currentKeyVersionKey, keyVersionsKey)
+	}
+
+	if _, ok := r.keys[current]; !ok {
+		return nil, fmt.Errorf("current key version '%s' is not one of the configured %s", current, keyVersionsKey)
+	}
+
+	return r, nil
+}
+
+// secret returns the secret resulting from mixing the given one with the key
+// of the given version, so both are needed to decrypt the payloads encrypted
+// with it. It fails with encryption.ErrUnknownKeyVersion when the version is
+// not configured (e.g. it has been removed after a rotation).
+func (r *keyRegistry) secret(id, secret string) (string, error) {
+	var key string
+	if r != nil {
+		key = r.keys[id]
+	}
+
+	if key == "" {
+		return "", fmt.Errorf("no key available for key version '%s': %w", id, encryption.ErrUnknownKeyVersion)
+	}
+
+	mac := hmac.New(sha256.New, []byte(key))
+	_, _ = mac.Write([]byte(secret))
+	return string(mac.Sum(nil)), nil
+}
+
+// appendKeyVersion appends the given version id to the given buffer, as it's
+// encoded into the payload header:
+//
+//	<uint8 length><id>
+func appendKeyVersion(b []byte, id string) []byte {
+	b = append(b, byte(len(id)))
+	return append(b, id...)
+}
+
+// decodeKeyVersion decodes the version id at the start
+// of the given header fields, and returns the remaining fields.
+func decodeKeyVersion(fields []byte) (string, []byte, error) {
+	if len(fields) < 1 || fields[0] == 0 || fields[0] > maxKeyVersionIDLength || len(fields) < 1+int(fields[0]) {
+		return "", nil, errors.New("malformed key version")
+	}
+
+	return string(fields[1 : 1+int(fields[0])]), fields[1+int(fields[0]):], nil
+}
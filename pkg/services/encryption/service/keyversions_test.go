@@ -0,0 +1,159 @@
+package service
+
+import (
+	"context"
+	"testing"
+
+	"github.com/grafana/grafana/pkg/services/encryption"
+	"github.com/grafana/grafana/pkg/setting"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_Service_KeyVersions(t *testing.T) {
+	ctx := context.Background()
+
+	svc := SetupTestService(t)
+	settings := svc.settingsProvider.(*setting.OSSImpl)
+
+	section := settings.Cfg.Raw.Section(securitySection)
+	setAlgorithm(t, svc, encryption.AesGcm)
+
+	unversioned, err := svc.Encrypt(ctx, []byte("unversioned"), "1234")
+	require.NoError(t, err)
+
+	section.Key(keyVersionsKey).SetValue("v1")
+	section.Key(keyVersionKeyPrefix + "v1").SetValue("first key")
+	section.Key(currentKeyVersionKey).SetValue("v1")
+
+	v1, err := svc.Encrypt(ctx, []byte("v1"), "1234")
+	require.NoError(t, err)
+
+	// Rotation: a new version is added and made current,
+	// while the previous one is kept for decryption.
+	section.Key(keyVersionsKey).SetValue("v1, v2")
+	section.Key(keyVersionKeyPrefix + "v2").SetValue("second key")
+	section.Key(currentKeyVersionKey).SetValue("v2")
+
+	v2, err := svc.Encrypt(ctx, []byte("v2"), "1234")
+	require.NoError(t, err)
+
+	t.Run("encrypt should record the current key version", func(t *testing.T) {
+		for expected, payload := range map[string][]byte{"": unversioned, "v1": v1, "v2": v2} {
+			header, _, err := decodePayloadHeader(payload)
+			require.NoError(t, err)
+			assert.Equal(t, expected, header.keyVersion)
+		}
+	})
+
+	t.Run("decrypt should use the recorded key version", func(t *testing.T) {
+		for expected, payload := range map[string][]byte{"unversioned": unversioned, "v1": v1, "v2": v2} {
+			decrypted, err := svc.Decrypt(ctx, payload, "1234")
+			require.NoError(t, err)
+			assert.Equal(t, []byte(expected), decrypted)
+		}
+	})
+
+	t.Run("decrypt should still require the secret", func(t *testing.T) {
+		_, err := svc.Decrypt(ctx, v2, "4321")
+		require.ErrorIs(t, err, encryption.ErrAuthenticationFailed)
+	})
+
+	t.Run("decrypt with a changed key should fail", func(t *testing.T) {
+		section.Key(keyVersionKeyPrefix + "v1").SetValue("changed key")
+		defer section.Key(keyVersionKeyPrefix + "v1").SetValue("first key")
+
+		_, err := svc.Decrypt(ctx, v1, "1234")
+		require.ErrorIs(t, err, encryption.ErrAuthenticationFailed)
+	})
+
+	t.Run("decrypt with an unknown key version should fail", func(t *testing.T) {
+		section.Key(keyVersionsKey).SetValue("v2")
+		defer section.Key(keyVersionsKey).SetValue("v1, v2")
+
+		_, err := svc.Decrypt(ctx, v1, "1234")
+		require.ErrorIs(t, err, encryption.ErrUnknownKeyVersion)
+
+		decrypted, err := svc.Decrypt(ctx, v2, "1234")
+		require.NoError(t, err)
+		assert.Equal(t, []byte("v2"), decrypted)
+	})
+
+	t.Run("key version should be combined with other header fields", func(t *testing.T) {
+		section.Key(kdfKey).SetValue(kdfArgon2id)
+		section.Key(kdfArgon2idMemoryKey).SetValue("1024")
+		section.Key(compressPayloadsKey).SetValue("true")
+		defer func() {
+			section.Key(kdfKey).SetValue(kdfPBKDF2)
+			section.Key(compressPayloadsKey).SetValue("false")
+		}()
+
+		plaintext := []byte("grafana grafana grafana grafana grafana")
+		encrypted, err := svc.Encrypt(ctx, plaintext, "1234")
+		require.NoError(t, err)
+
+		header, _, err := decodePayloadHeader(encrypted)
+		require.NoError(t, err)
+		assert.True(t, header.compressed)
+		assert.NotNil(t, header.kdf)
+		assert.Equal(t, "v2", header.keyVersion)
+
+		decrypted, err := svc.Decrypt(ctx, encrypted, "1234")
+		require.NoError(t, err)
+		assert.Equal(t, plaintext, decrypted)
+	})
+}
+
+func Test_newKeyRegistry(t *testing.T) {
+	testCases := []struct {
+		desc     string
+		settings map[string]string
+		valid    bool
+	}{
+		{desc: "no key versions", settings: map[string]string{}, valid: true},
+		{desc: "valid key versions", settings: map[string]string{keyVersionsKey: "a, b", "key_version_a": "1", "key_version_b": "2", currentKeyVersionKey: "b"}, valid: true},
+		{desc: "current version without key versions", settings: map[string]string{currentKeyVersionKey: "a"}},
+		{desc: "key versions without current version", settings: map[string]string{keyVersionsKey: "a", "key_version_a": "1"}},
+		{desc: "current version not configured", settings: map[string]string{keyVersionsKey: "a", "key_version_a": "1", currentKeyVersionKey: "b"}},
+		{desc: "missing key", settings: map[string]string{keyVersionsKey: "a, b", "key_version_a": "1", currentKeyVersionKey: "a"}},
+		{desc: "duplicated version", settings: map[string]string{keyVersionsKey: "a, a", "key_version_a": "1", currentKeyVersionKey: "a"}},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			cfg := setting.NewCfg()
+			for k, v := range tc.settings {
+				cfg.Raw.Section(securitySection).Key(k).SetValue(v)
+			}
+
+			_, err := newKeyRegistry((&setting.OSSImpl{Cfg: cfg}).Section(securitySection))
+			if tc.valid {
+				require.NoError(t, err)
+			} else {
+				require.Error(t, err)
+			}
+		})
+	}
+
+	t.Run("invalid key versions should be rejected on validation", func(t *testing.T) {
+		svc := SetupTestService(t)
+
+		cfg := setting.NewCfg()
+		cfg.Raw.Section(securitySection).Key(keyVersionsKey).SetValue("a")
+
+		err := svc.Validate((&setting.OSSImpl{Cfg: cfg}).Section(securitySection))
+		require.Error(t, err)
+	})
+}
+
+func Test_decodeKeyVersion(t *testing.T) {
+	for _, fields := range [][]byte{{}, {0}, {3, 'a', 'b'}, {maxKeyVersionIDLength + 1}} {
+		_, _, err := decodeKeyVersion(fields)
+		require.Error(t, err, fields)
+	}
+
+	id, rest, err := decodeKeyVersion([]byte{2, 'v', '1', 'x'})
+	require.NoError(t, err)
+	assert.Equal(t, "v1", id)
+	assert.Equal(t, []byte("x"), rest)
+}
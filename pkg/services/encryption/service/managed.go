@@ -0,0 +1,71 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/grafana/grafana/pkg/services/encryption"
+)
+
+// errNoKeyProvider is returned by the managed
+// operations when no key provider has been set.
+var errNoKeyProvider = errors.New("no key provider set for managed encryption")
+
+// SetKeyProvider sets the provider the secrets of EncryptManaged and
+// DecryptManaged are resolved from, replacing any provider set before.
+// A nil provider disables the managed operations, while the ones taking
+// the secret explicitly keep working regardless.
+func (s *Service) SetKeyProvider(p encryption.KeyProvider) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	s.keyProvider = p
+}
+
+// EncryptManaged encrypts the given payload, as Encrypt does, with the
+// current secret of the key provider (see SetKeyProvider), i.e. the first
+// one it returns.
+func (s *Service) EncryptManaged(ctx context.Context, payload []byte) ([]byte, error) {
+	keys, err := s.managedKeys(ctx)
+	if err != nil {
+		s.log.Error("Encryption failed", logContext(ctx, "error", err)...)
+		return nil, err
+	}
+
+	return s.Encrypt(ctx, payload, keys[0])
+}
+
+// DecryptManaged decrypts the given payload, as DecryptWithSecrets does, with
+// the secrets of the key provider (see SetKeyProvider), so the payloads
+// encrypted with the previous secrets are decrypted too while rotating them.
+func (s *Service) DecryptManaged(ctx context.Context, payload []byte) ([]byte, error) {
+	keys, err := s.managedKeys(ctx)
+	if err != nil {
+		s.log.Error("Decryption failed", logContext(ctx, "error", err)...)
+		return nil, err
+	}
+
+	return s.DecryptWithSecrets(ctx, payload, keys)
+}
+
+func (s *Service) managedKeys(ctx context.Context) ([]string, error) {
+	s.mtx.RLock()
+	p := s.keyProvider
+	s.mtx.RUnlock()
+
+	if p == nil {
+		return nil, errNoKeyProvider
+	}
+
+	keys, err := p.Keys(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to resolve encryption keys: %w", err)
+	}
+
+	if len(keys) == 0 || keys[0] == "" {
+		return nil, fmt.Errorf("key provider returned no current key: %w", encryption.ErrEmptySecret)
+	}
+
+	return keys, nil
+}
@@ -0,0 +1,114 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+
+	"github.com/grafana/grafana/pkg/services/encryption"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_Service_Managed(t *testing.T) {
+	ctx := context.Background()
+
+	svc := SetupTestService(t)
+	setAlgorithm(t, svc, encryption.AesGcm)
+
+	t.Run("without key provider should fail", func(t *testing.T) {
+		_, err := svc.EncryptManaged(ctx, []byte("grafana"))
+		require.ErrorIs(t, err, errNoKeyProvider)
+
+		_, err = svc.DecryptManaged(ctx, []byte("grafana"))
+		require.ErrorIs(t, err, errNoKeyProvider)
+	})
+
+	keys := &fakeKeyProvider{keys: []string{"2021"}}
+	svc.SetKeyProvider(keys)
+	t.Cleanup(func() { svc.SetKeyProvider(nil) })
+
+	t.Run("payloads should be encrypted with the current key", func(t *testing.T) {
+		encrypted, err := svc.EncryptManaged(ctx, []byte("grafana"))
+		require.NoError(t, err)
+
+		decrypted, err := svc.Decrypt(ctx, encrypted, "2021")
+		require.NoError(t, err)
+		assert.Equal(t, []byte("grafana"), decrypted)
+
+		decrypted, err = svc.DecryptManaged(ctx, encrypted)
+		require.NoError(t, err)
+		assert.Equal(t, []byte("grafana"), decrypted)
+	})
+
+	t.Run("payloads of previous keys should be decrypted after rotation", func(t *testing.T) {
+		keys.set("2021")
+		previous, err := svc.EncryptManaged(ctx, []byte("grafana"))
+		require.NoError(t, err)
+
+		keys.set("2022", "2021")
+		current, err := svc.EncryptManaged(ctx, []byte("loki"))
+		require.NoError(t, err)
+
+		_, err = svc.Decrypt(ctx, current, "2021")
+		require.ErrorIs(t, err, encryption.ErrAuthenticationFailed)
+
+		decrypted, err := svc.DecryptManaged(ctx, previous)
+		require.NoError(t, err)
+		assert.Equal(t, []byte("grafana"), decrypted)
+
+		decrypted, err = svc.DecryptManaged(ctx, current)
+		require.NoError(t, err)
+		assert.Equal(t, []byte("loki"), decrypted)
+
+		keys.set("2022")
+		_, err = svc.DecryptManaged(ctx, previous)
+		require.ErrorIs(t, err, encryption.ErrAuthenticationFailed)
+	})
+
+	t.Run("failing key provider should fail", func(t *testing.T) {
+		keys.fail(errors.New("vault unreachable"))
+		t.Cleanup(func() { keys.fail(nil) })
+
+		_, err := svc.EncryptManaged(ctx, []byte("grafana"))
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "vault unreachable")
+	})
+
+	t.Run("no current key should fail", func(t *testing.T) {
+		for _, k := range [][]string{nil, {""}} {
+			keys.set(k...)
+
+			_, err := svc.EncryptManaged(ctx, []byte("grafana"))
+			require.ErrorIs(t, err, encryption.ErrEmptySecret)
+		}
+	})
+}
+
+type fakeKeyProvider struct {
+	mtx  sync.Mutex
+	keys []string
+	err  error
+}
+
+func (p *fakeKeyProvider) Keys(context.Context) ([]string, error) {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+
+	return p.keys, p.err
+}
+
+func (p *fakeKeyProvider) set(keys ...string) {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+
+	p.keys = keys
+}
+
+func (p *fakeKeyProvider) fail(err error) {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+
+	p.err = err
+}
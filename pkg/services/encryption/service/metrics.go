@@ -0,0 +1,115 @@
+package service
+
+import (
+	"errors"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	metricsNamespace = "grafana"
+	metricsSubsystem = "encryption"
+
+	operationEncrypt = "encrypt"
+	operationDecrypt = "decrypt"
+)
+
+// metrics are the Prometheus metrics of the service. A nil *metrics is
+// valid and records nothing, which is the default until RegisterMetrics.
+type metrics struct {
+	duration         *prometheus.HistogramVec
+	rejectedPayloads *prometheus.CounterVec
+}
+
+func newMetrics() *metrics {
+	return &metrics{
+		duration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: metricsNamespace,
+			Subsystem: metricsSubsystem,
+			Name:      "duration_seconds",
+			Help:      "Duration of the cipher operations, by operation and algorithm.",
+			// From in-memory ciphers, in the order of microseconds,
+			// to network-backed ones, in the order of seconds.
+			Buckets: []float64{.00001, .0001, .001, .01, .05, .1, .25, .5, 1, 2.5, 5, 10},
+		}, []string{"operation", "algorithm"}),
+		rejectedPayloads: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Subsystem: metricsSubsystem,
+			Name:      "rejected_payloads_total",
+			Help:      "Number of payloads rejected for exceeding the maximum size, by operation.",
+		}, []string{"operation"}),
+	}
+}
+
+// observeDuration records the time elapsed since the given start
+// for the given operation of the given algorithm.
+func (m *metrics) observeDuration(operation, algorithm string, start time.Time) {
+	if m == nil {
+		return
+	}
+
+	m.duration.WithLabelValues(operation, algorithm).Observe(time.Since(start).Seconds())
+}
+
+// countRejectedPayload counts a payload rejected
+// for its size by the given operation.
+func (m *metrics) countRejectedPayload(operation string) {
+	if m == nil {
+		return
+	}
+
+	m.rejectedPayloads.WithLabelValues(operation).Inc()
+}
+
+// RegisterMetrics registers the Prometheus metrics of the service with the
+// given registry, and starts recording them. When the metrics are already
+// registered (e.g. by another instance), the existing ones are reused.
+// A nil registry leaves the metrics disabled.
+//
+// It must be called before the service is used, as
+// the metrics aren't guarded against concurrent access.
+func (s *Service) RegisterMetrics(reg prometheus.Registerer) error {
+	if reg == nil {
+		return nil
+	}
+
+	m := newMetrics()
+
+	duration, err := register(reg, m.duration)
+	if err != nil {
+		return err
+	}
+
+	rejectedPayloads, err := register(reg, m.rejectedPayloads)
+	if err != nil {
+		return err
+	}
+
+	var ok bool
+	if m.duration, ok = duration.(*prometheus.HistogramVec); !ok {
+		return errors.New("encryption duration metric already registered with another type")
+	}
+	if m.rejectedPayloads, ok = rejectedPayloads.(*prometheus.CounterVec); !ok {
+		return errors.New("encryption rejected payloads metric already registered with another type")
+	}
+
+	s.metrics = m
+	return nil
+}
+
+// register registers the given collector with the given registry, and
+// returns it, or the existing one when it's already registered.
+func register(reg prometheus.Registerer, c prometheus.Collector) (prometheus.Collector, error) {
+	err := reg.Register(c)
+	if err == nil {
+		return c, nil
+	}
+
+	var alreadyRegistered prometheus.AlreadyRegisteredError
+	if !errors.As(err, &alreadyRegistered) {
+		return nil, err
+	}
+
+	return alreadyRegistered.ExistingCollector, nil
+}
@@ -0,0 +1,89 @@
+package service
+
+import (
+	"context"
+	"testing"
+
+	"github.com/grafana/grafana/pkg/services/encryption"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_Service_RegisterMetrics(t *testing.T) {
+	ctx := context.Background()
+
+	t.Run("without registry should record nothing", func(t *testing.T) {
+		svc := SetupTestService(t)
+		require.NoError(t, svc.RegisterMetrics(nil))
+		assert.Nil(t, svc.metrics)
+
+		encrypted, err := svc.Encrypt(ctx, []byte("grafana"), "1234")
+		require.NoError(t, err)
+
+		_, err = svc.Decrypt(ctx, encrypted, "1234")
+		require.NoError(t, err)
+	})
+
+	t.Run("with registry should record the cipher operations", func(t *testing.T) {
+		svc := SetupTestService(t)
+		setAlgorithm(t, svc, encryption.AesGcm)
+
+		reg := prometheus.NewRegistry()
+		require.NoError(t, svc.RegisterMetrics(reg))
+
+		encrypted, err := svc.Encrypt(ctx, []byte("grafana"), "1234")
+		require.NoError(t, err)
+
+		for i := 0; i < 2; i++ {
+			_, err = svc.Decrypt(ctx, encrypted, "1234")
+			require.NoError(t, err)
+		}
+
+		_, err = svc.Decrypt(ctx, encrypted, "4321")
+		require.Error(t, err)
+
+		assert.Equal(t, map[string]uint64{
+			"encrypt/" + encryption.AesGcm: 1,
+			"decrypt/" + encryption.AesGcm: 3,
+		}, histogramCounts(t, reg))
+	})
+
+	t.Run("registering twice should reuse the metrics", func(t *testing.T) {
+		reg := prometheus.NewRegistry()
+
+		first := SetupTestService(t)
+		require.NoError(t, first.RegisterMetrics(reg))
+
+		second := SetupTestService(t)
+		require.NoError(t, second.RegisterMetrics(reg))
+
+		assert.Same(t, first.metrics.duration, second.metrics.duration)
+	})
+}
+
+// histogramCounts returns the number of observations of the duration
+// histogram gathered from the given registry, by operation/algorithm.
+func histogramCounts(t *testing.T, reg *prometheus.Registry) map[string]uint64 {
+	t.Helper()
+
+	families, err := reg.Gather()
+	require.NoError(t, err)
+
+	counts := make(map[string]uint64)
+	for _, family := range families {
+		if family.GetName() != "grafana_encryption_duration_seconds" {
+			continue
+		}
+
+		for _, m := range family.GetMetric() {
+			labels := make(map[string]string)
+			for _, label := range m.GetLabel() {
+				labels[label.GetName()] = label.GetValue()
+			}
+			counts[labels["operation"]+"/"+labels["algorithm"]] = m.GetHistogram().GetSampleCount()
+		}
+	}
+
+	return counts
+}
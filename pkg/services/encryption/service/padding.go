@@ -0,0 +1,80 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+)
+
+// Ciphertexts are only as long as their plaintexts plus a fixed overhead, so
+// they reveal the length of the secrets they protect, which may be enough to
+// tell them apart, e.g. "true" from "false". Padding the plaintexts to the
+// next multiple of a bucket size before encryption hides the length within
+// the bucket, at the cost of the space the padding takes.
+//
+// The padding is the one of ISO/IEC 7816-4: a 0x80 byte followed by as many
+// zero bytes as needed, so it's always at least one byte long. The length of
+// the padding is thus recorded in the plaintext itself, which is encrypted
+// along with it, while the payload header only signals that the plaintext was
+// padded (see payloadFlagPadded), as recording the length in the clear would
+// reveal what the padding hides.
+const (
+	paddingMarker byte = 0x80
+
+	// maxPaddingBucketSize bounds the bucket sizes, as the padding is meant
+	// for short secrets, e.g. passwords or tokens, rather than large payloads.
+	maxPaddingBucketSize = 64 * 1024
+)
+
+var errInvalidPadding = errors.New("invalid padding")
+
+// EncryptWithPadding encrypts the given payload, as Encrypt does, but padded
+// to the next multiple of the given bucket size, so payloads of different
+// lengths within the same bucket produce ciphertexts of the same length.
+// The padding is stripped by Decrypt, as it's recorded in the payload.
+func (s *Service) EncryptWithPadding(ctx context.Context, payload []byte, secret string, bucketSize int) ([]byte, error) {
+	if err := checkPaddingBucketSize(bucketSize); err != nil {
+		s.log.Error("Encryption failed", logContext(ctx, "error", err)...)
+		return nil, err
+	}
+
+	return s.encrypt(ctx, nil, payload, nil, secret, s.CurrentAlgorithm(), bucketSize)
+}
+
+func checkPaddingBucketSize(bucketSize int) error {
+	if bucketSize <= 0 || bucketSize > maxPaddingBucketSize {
+		return fmt.Errorf("padding bucket size must be between 1 and %d bytes, got %d", maxPaddingBucketSize, bucketSize)
+	}
+	return nil
+}
+
+// pad returns a copy of the given payload padded to the
+// next multiple of the given bucket size, see unpad.
+func pad(payload []byte, bucketSize int) ([]byte, error) {
+	if err := checkPaddingBucketSize(bucketSize); err != nil {
+		return nil, err
+	}
+
+	n := (len(payload)/bucketSize + 1) * bucketSize
+	padded := make([]byte, n)
+	copy(padded, payload)
+	padded[len(payload)] = paddingMarker
+
+	return padded, nil
+}
+
+// unpad returns the given padded payload without its padding, as a
+// subslice of it. Its length is only checked against maxPaddingBucketSize,
+// as the bucket size doesn't need to be known to strip the padding.
+func unpad(padded []byte) ([]byte, error) {
+	i := len(padded) - 1
+	for i >= 0 && padded[i] == 0 && len(padded)-i < maxPaddingBucketSize {
+		i--
+	}
+
+	if i < 0 || padded[i] != paddingMarker {
+		return nil, errInvalidPadding
+	}
+
+	return padded[:i], nil
+}
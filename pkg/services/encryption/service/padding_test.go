@@ -0,0 +1,136 @@
+package service
+
+import (
+	"bytes"
+	"context"
+	"testing"
+
+	"github.com/grafana/grafana/pkg/services/encryption"
+	"github.com/grafana/grafana/pkg/setting"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_Service_Padding(t *testing.T) {
+	ctx := context.Background()
+
+	svc := SetupTestService(t)
+	settings := svc.settingsProvider.(*setting.OSSImpl)
+	section := settings.Cfg.Raw.Section(securitySection)
+
+	for _, algorithm := range []string{encryption.AesCfb, encryption.AesGcm, encryption.XChaCha20Poly1305} {
+		t.Run(algorithm+" payloads within a bucket should be of the same length", func(t *testing.T) {
+			setAlgorithm(t, svc, algorithm)
+
+			var lengths []int
+			for _, plaintext := range [][]byte{{}, []byte("true"), []byte("false"), bytes.Repeat([]byte("a"), 31)} {
+				encrypted, err := svc.EncryptWithPadding(ctx, plaintext, "1234", 32)
+				require.NoError(t, err)
+				lengths = append(lengths, len(encrypted))
+
+				header, _, err := decodePayloadHeader(encrypted)
+				require.NoError(t, err)
+				assert.True(t, header.padded)
+
+				decrypted, err := svc.Decrypt(ctx, encrypted, "1234")
+				require.NoError(t, err)
+				assert.Equal(t, plaintext, decrypted)
+			}
+			for _, length := range lengths {
+				assert.Equal(t, lengths[0], length)
+			}
+
+			// The padding is always at least one byte long, so
+			// a full bucket spills over into the next one.
+			encrypted, err := svc.EncryptWithPadding(ctx, bytes.Repeat([]byte("a"), 32), "1234", 32)
+			require.NoError(t, err)
+			assert.Equal(t, lengths[0]+32, len(encrypted))
+
+			decrypted, err := svc.Decrypt(ctx, encrypted, "1234")
+			require.NoError(t, err)
+			assert.Equal(t, bytes.Repeat([]byte("a"), 32), decrypted)
+		})
+	}
+
+	t.Run("unpadded payloads should not be flagged", func(t *testing.T) {
+		encrypted, err := svc.Encrypt(ctx, []byte("grafana"), "1234")
+		require.NoError(t, err)
+
+		header, _, err := decodePayloadHeader(encrypted)
+		require.NoError(t, err)
+		assert.False(t, header.padded)
+	})
+
+	t.Run("invalid bucket sizes should be rejected", func(t *testing.T) {
+		for _, bucketSize := range []int{0, -1, maxPaddingBucketSize + 1} {
+			_, err := svc.EncryptWithPadding(ctx, []byte("grafana"), "1234", bucketSize)
+			require.Error(t, err)
+			assert.Contains(t, err.Error(), "padding bucket size must be between 1 and 65536 bytes")
+		}
+	})
+
+	t.Run("profiles should pad their payloads", func(t *testing.T) {
+		profile := settings.Cfg.Raw.Section(profileSectionPrefix + "short")
+		_, err := profile.NewKey(profileAlgorithmKey, encryption.AesGcm)
+		require.NoError(t, err)
+		_, err = profile.NewKey(profilePaddingKey, "16")
+		require.NoError(t, err)
+		t.Cleanup(func() { settings.Cfg.Raw.DeleteSection(profileSectionPrefix + "short") })
+		require.NoError(t, svc.Reload(settings.Section(securitySection)))
+
+		short, err := svc.EncryptProfile(ctx, "short", []byte("true"), "1234")
+		require.NoError(t, err)
+
+		long, err := svc.EncryptProfile(ctx, "short", []byte("false"), "1234")
+		require.NoError(t, err)
+		assert.Equal(t, len(short), len(long))
+
+		decrypted, err := svc.Decrypt(ctx, long, "1234")
+		require.NoError(t, err)
+		assert.Equal(t, []byte("false"), decrypted)
+
+		profile.Key(profilePaddingKey).SetValue("-16")
+		err = svc.Reload(settings.Section(securitySection))
+		require.EqualError(t, err, "invalid encryption profile 'short': padding bucket size must be between 1 and 65536 bytes, got -16")
+	})
+
+	t.Run("compressed payloads should be padded once compressed", func(t *testing.T) {
+		section.Key(compressPayloadsKey).SetValue("true")
+		t.Cleanup(func() { section.DeleteKey(compressPayloadsKey) })
+
+		plaintext := bytes.Repeat([]byte("grafana"), 100)
+		encrypted, err := svc.EncryptWithPadding(ctx, plaintext, "1234", 64)
+		require.NoError(t, err)
+
+		header, _, err := decodePayloadHeader(encrypted)
+		require.NoError(t, err)
+		assert.True(t, header.compressed)
+		assert.True(t, header.padded)
+
+		decrypted, err := svc.Decrypt(ctx, encrypted, "1234")
+		require.NoError(t, err)
+		assert.Equal(t, plaintext, decrypted)
+	})
+}
+
+func Test_Unpad(t *testing.T) {
+	padded, err := pad([]byte("grafana"), 16)
+	require.NoError(t, err)
+	require.Len(t, padded, 16)
+
+	unpadded, err := unpad(padded)
+	require.NoError(t, err)
+	assert.Equal(t, []byte("grafana"), unpadded)
+
+	for name, padded := range map[string][]byte{
+		"empty":          {},
+		"no marker":      make([]byte, 16),
+		"trailing bytes": append([]byte("grafana\x80"), 0x01),
+		"too long":       append([]byte{paddingMarker}, make([]byte, maxPaddingBucketSize)...),
+	} {
+		t.Run(name+" padding should be rejected", func(t *testing.T) {
+			_, err := unpad(padded)
+			require.ErrorIs(t, err, errInvalidPadding)
+		})
+	}
+}
@@ -0,0 +1,358 @@
+package service
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"fmt"
+
+	"github.com/grafana/grafana/pkg/services/encryption"
+	"github.com/grafana/grafana/pkg/setting"
+)
+
+// Payloads produced by Encrypt are prefixed with a header that identifies
+// how they were encrypted, so Decrypt can process them back. The header
+// format is versioned, and all versions start with the delimiter:
+//
+//	v0: *<base64(algorithm)>*<ciphertext>
+//	v1: *<version><base64(algorithm)>*<length><header><ciphertext>
+//
+// The version is implicit for v0, which is the original format and the one
+// still used whenever there's nothing to record apart from the algorithm.
+// Later versions have an explicit version byte right after the delimiter,
+// always lower than payloadMaxVersion, so it can never be mistaken for the
+// base64-encoded algorithm that follows the delimiter in v0 payloads.
+//
+// In v1, the algorithm is followed by a header of up to 255 bytes whose first
+// byte is a set of flags, each one signaling the presence of a feature and,
+// when it needs any, of its parameters after the flags. Readers must reject
+// any flag they don't know, but must skip any remaining header bytes they
+// don't know how to interpret, so new fields can be added as new flags.
+// A new version is only needed for incompatible changes to the format.
+//
+// The algorithm is encoded with the standard base64 alphabet, unless the
+// URL-safe one is configured (see prefixEncodingKey), e.g. for payloads
+// shared with systems that expect it. Both are always accepted on decoding,
+// so payloads written by those systems are readable either way.
+//
+// Payloads not starting with the delimiter are assumed to be legacy AesCfb
+// ciphertexts, while those starting with it but lacking a valid header are
+// rejected as malformed.
+//
+// The framing of all the versions is replicated by encryption.ValidatePayload,
+// so any change here must be reflected there.
+const (
+	encryptionAlgorithmDelimiter = '*'
+
+	// maxEncryptionAlgorithmLength bounds the length of the algorithm
+	// names accepted within the payloads' prefix, so a crafted payload
+	// cannot make the decoding allocate arbitrarily large buffers.
+	maxEncryptionAlgorithmLength = 64
+
+	// maxEncodedAlgorithmLength is the length of the longest algorithm
+	// names once encoded, i.e. base64.RawStdEncoding.EncodedLen(64).
+	maxEncodedAlgorithmLength = (maxEncryptionAlgorithmLength*8 + 5) / 6
+
+	payloadVersion0 byte = 0x00
+	payloadVersion1 byte = 0x01
+
+	// payloadMaxVersion is the upper bound (exclusive) of the version bytes,
+	// which keeps them out of the base64 alphabet and away from the delimiter.
+	payloadMaxVersion byte = 0x20
+
+	// payloadFlagCompressed signals that the
+	// plaintext was deflated before encryption.
+	payloadFlagCompressed byte = 1 << 0
+
+	// payloadFlagKDF signals that the secret was derived
+	// with the KDF whose parameters follow the flags.
+	payloadFlagKDF byte = 1 << 1
+
+	// payloadFlagKeyVersion signals that the secret was mixed with
+	// the key of the version whose id follows the KDF parameters.
+	payloadFlagKeyVersion byte = 1 << 2
+
+	// payloadFlagKeyCommitment signals that the ciphertext is committed
+	// to the secret, whose commitment follows the key version id.
+	payloadFlagKeyCommitment byte = 1 << 3
+
+	// payloadFlagPadded signals that the plaintext was padded
+	// to a bucket size before encryption, see pad.
+	payloadFlagPadded byte = 1 << 4
+
+	payloadKnownFlags = payloadFlagCompressed | payloadFlagKDF | payloadFlagKeyVersion | payloadFlagKeyCommitment | payloadFlagPadded
+)
+
+// prefixEncodingKey sets the base64 alphabet the algorithm
+// is encoded with in the payloads' prefix, see prefixEncodings.
+const prefixEncodingKey = "prefix_encoding"
+
+// prefixEncodings are the supported values of prefixEncodingKey,
+// mapped to whether they're the URL-safe alphabet.
+var prefixEncodings = map[string]bool{
+	"std": false,
+	"url": true,
+}
+
+type payloadHeader struct {
+	algorithm  string
+	compressed bool
+	kdf        *kdfParams
+	keyVersion string
+	commitment *keyCommitment
+	padded     bool
+
+	// urlSafe encodes the algorithm with the
+	// URL-safe base64 alphabet instead of the standard one.
+	urlSafe bool
+}
+
+func (h payloadHeader) algorithmEncoding() *base64.Encoding {
+	if h.urlSafe {
+		return base64.RawURLEncoding
+	}
+	return base64.RawStdEncoding
+}
+
+func (h payloadHeader) flags() byte {
+	var flags byte
+	if h.compressed {
+		flags |= payloadFlagCompressed
+	}
+	if h.kdf != nil {
+		flags |= payloadFlagKDF
+	}
+	if h.keyVersion != "" {
+		flags |= payloadFlagKeyVersion
+	}
+	if h.commitment != nil {
+		flags |= payloadFlagKeyCommitment
+	}
+	if h.padded {
+		flags |= payloadFlagPadded
+	}
+	return flags
+}
+
+// encodePayloadHeader returns the shortest prefix able to represent the given header.
+func encodePayloadHeader(h payloadHeader) []byte {
+	return appendPayloadHeader(make([]byte, 0, payloadHeaderLen(h)), h)
+}
+
+// payloadHeaderLen returns the length of the prefix
+// encodePayloadHeader returns for the given header.
+func payloadHeaderLen(h payloadHeader) int {
+	n := h.algorithmEncoding().EncodedLen(len(h.algorithm)) + 2
+	if h.flags() == 0 {
+		return n
+	}
+
+	// Version, length of the fields and flags.
+	n += 3
+	if h.kdf != nil {
+		n += h.kdf.encodedLen()
+	}
+	if h.keyVersion != "" {
+		n += 1 + len(h.keyVersion)
+	}
+	if h.commitment != nil {
+		n += keyCommitmentLen
+	}
+	return n
+}
+
+// appendPayloadHeader appends the prefix encodePayloadHeader returns for the
+// given header to the given buffer, writing it in place when it has enough
+// capacity, so the prefix and the ciphertext can share a single allocation.
+func appendPayloadHeader(dst []byte, h payloadHeader) []byte {
+	flags := h.flags()
+
+	dst = append(dst, encryptionAlgorithmDelimiter)
+	if flags != 0 {
+		dst = append(dst, payloadVersion1)
+	}
+
+	off := len(dst)
+	dst = append(dst, make([]byte, h.algorithmEncoding().EncodedLen(len(h.algorithm)))...)
+	h.algorithmEncoding().Encode(dst[off:], []byte(h.algorithm))
+	dst = append(dst, encryptionAlgorithmDelimiter)
+
+	if flags == 0 {
+		return dst
+	}
+
+	off = len(dst)
+	dst = append(dst, 0, flags)
+	if h.kdf != nil {
+		dst = h.kdf.appendTo(dst)
+	}
+	if h.keyVersion != "" {
+		dst = appendKeyVersion(dst, h.keyVersion)
+	}
+	if h.commitment != nil {
+		dst = h.commitment.appendTo(dst)
+	}
+	dst[off] = byte(len(dst) - off - 1)
+
+	return dst
+}
+
+// encodeEncryptionAlgorithm returns the prefix that identifies the given
+// algorithm on a ciphertext: *<base64(algorithm)>*
+func encodeEncryptionAlgorithm(algorithm string) []byte {
+	return encodePayloadHeader(payloadHeader{algorithm: algorithm})
+}
+
+func deriveEncryptionAlgorithm(payload []byte) (string, []byte, error) {
+	header, payload, err := decodePayloadHeader(payload)
+	if err != nil {
+		return "", nil, err
+	}
+
+	return header.algorithm, payload, nil
+}
+
+// decodePayloadHeader parses the header of the given payload, in any of the
+// supported versions, and returns it together with the remaining ciphertext.
+func decodePayloadHeader(payload []byte) (payloadHeader, []byte, error) {
+	if len(payload) == 0 {
+		return payloadHeader{}, nil, fmt.Errorf("unable to derive encryption algorithm")
+	}
+
+	if payload[0] != encryptionAlgorithmDelimiter {
+		return payloadHeader{algorithm: encryption.AesCfb}, payload, nil // backwards compatibility
+	}
+
+	version, payload := payloadVersion(payload[1:])
+
+	switch version {
+	case payloadVersion0:
+		algorithm, urlSafe, payload, err := decodePayloadAlgorithm(payload)
+		if err != nil {
+			return payloadHeader{}, nil, err
+		}
+		return payloadHeader{algorithm: algorithm, urlSafe: urlSafe}, payload, nil
+	case payloadVersion1:
+		return decodePayloadHeaderV1(payload)
+	default:
+		return payloadHeader{}, nil, fmt.Errorf("unsupported payload version: %d", version)
+	}
+}
+
+// payloadVersion returns the version of the given payload, with the leading
+// delimiter already stripped, and the payload following the version byte.
+func payloadVersion(payload []byte) (byte, []byte) {
+	if len(payload) == 0 || payload[0] == payloadVersion0 || payload[0] >= payloadMaxVersion {
+		return payloadVersion0, payload
+	}
+
+	return payload[0], payload[1:]
+}
+
+// decodePayloadAlgorithm decodes the <base64(algorithm)>* part of the header,
+// and returns the algorithm, whether it's encoded with the URL-safe alphabet,
+// and the remaining payload. Names made of characters whose encoding is the
+// same in both alphabets are reported as encoded with the standard one.
+func decodePayloadAlgorithm(payload []byte) (string, bool, []byte, error) {
+	// Legacy AesCfb payloads start with their salt, which is alphanumeric,
+	// so any payload starting with the delimiter must have a valid header.
+	// The delimiter is only looked for where it can be, so neither the search
+	// nor the decoding depend on the size of a crafted payload.
+	window := payload
+	if len(window) > maxEncodedAlgorithmLength+1 {
+		window = window[:maxEncodedAlgorithmLength+1]
+	}
+
+	algorithmDelimiterIdx := bytes.IndexByte(window, encryptionAlgorithmDelimiter)
+	if algorithmDelimiterIdx == -1 {
+		if len(window) < len(payload) {
+			return "", false, nil, errAlgorithmTooLong
+		}
+		return "", false, nil, errors.New("malformed algorithm header")
+	}
+
+	algorithmB64 := payload[:algorithmDelimiterIdx]
+	payload = payload[algorithmDelimiterIdx+1:]
+
+	// The decoded name is at most maxEncryptionAlgorithmLength bytes long,
+	// as the encoded one is at most maxEncodedAlgorithmLength bytes long.
+	var algorithm [maxEncryptionAlgorithmLength]byte
+
+	urlSafe := false
+	n, err := base64.RawStdEncoding.Decode(algorithm[:], algorithmB64)
+	if err != nil {
+		urlSafe = true
+		if n, err = base64.RawURLEncoding.Decode(algorithm[:], algorithmB64); err != nil {
+			return "", false, nil, err
+		}
+	}
+
+	return string(algorithm[:n]), urlSafe, payload, nil
+}
+
+// errAlgorithmTooLong is returned for the payloads whose prefix is
+// too long to be the encoding of a valid algorithm name.
+var errAlgorithmTooLong = fmt.Errorf("encryption algorithm name exceeds the maximum length of %d bytes", maxEncryptionAlgorithmLength)
+
+// urlSafePrefix returns whether the algorithm must be encoded with the
+// URL-safe alphabet in the payloads' prefix, according to the given section.
+func urlSafePrefix(section setting.Section) (bool, error) {
+	encoding := section.KeyValue(prefixEncodingKey).MustString("std")
+
+	urlSafe, ok := prefixEncodings[encoding]
+	if !ok {
+		return false, fmt.Errorf("unsupported %s '%s', must be either 'std' or 'url'", prefixEncodingKey, encoding)
+	}
+
+	return urlSafe, nil
+}
+
+func decodePayloadHeaderV1(payload []byte) (payloadHeader, []byte, error) {
+	algorithm, urlSafe, payload, err := decodePayloadAlgorithm(payload)
+	if err != nil {
+		return payloadHeader{}, nil, fmt.Errorf("malformed payload header: %w", err)
+	}
+
+	if len(payload) < 2 || payload[0] == 0 || len(payload) < int(payload[0])+1 {
+		return payloadHeader{}, nil, errors.New("malformed payload header")
+	}
+
+	fields := payload[1 : int(payload[0])+1]
+	payload = payload[int(payload[0])+1:]
+
+	flags := fields[0]
+	if flags&^payloadKnownFlags != 0 {
+		return payloadHeader{}, nil, fmt.Errorf("unsupported payload header flags: %08b", flags)
+	}
+
+	header := payloadHeader{algorithm: algorithm, urlSafe: urlSafe}
+	header.compressed = flags&payloadFlagCompressed != 0
+	header.padded = flags&payloadFlagPadded != 0
+
+	// Any field following the known ones is skipped.
+	fields = fields[1:]
+	if flags&payloadFlagKDF != 0 {
+		var kdf kdfParams
+		kdf, fields, err = decodeKDFParams(fields)
+		if err != nil {
+			return payloadHeader{}, nil, err
+		}
+		header.kdf = &kdf
+	}
+
+	if flags&payloadFlagKeyVersion != 0 {
+		header.keyVersion, fields, err = decodeKeyVersion(fields)
+		if err != nil {
+			return payloadHeader{}, nil, err
+		}
+	}
+
+	if flags&payloadFlagKeyCommitment != 0 {
+		header.commitment, _, err = decodeKeyCommitment(fields)
+		if err != nil {
+			return payloadHeader{}, nil, err
+		}
+	}
+
+	return header, payload, nil
+}
@@ -0,0 +1,351 @@
+package service
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/grafana/grafana/pkg/services/encryption"
+	"github.com/grafana/grafana/pkg/services/encryption/provider"
+	"github.com/grafana/grafana/pkg/setting"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_deriveEncryptionAlgorithm(t *testing.T) {
+	t.Run("with valid prefix should return the algorithm", func(t *testing.T) {
+		algorithm, payload, err := deriveEncryptionAlgorithm([]byte("*YWVzLWdjbQ*grafana"))
+		require.NoError(t, err)
+		assert.Equal(t, encryption.AesGcm, algorithm)
+		assert.Equal(t, []byte("grafana"), payload)
+	})
+
+	t.Run("with url-safe prefix should return the algorithm", func(t *testing.T) {
+		for _, prefix := range []string{"*YWNtZS9rbXN+djE*", "*YWNtZS9rbXN-djE*"} {
+			algorithm, payload, err := deriveEncryptionAlgorithm([]byte(prefix + "grafana"))
+			require.NoError(t, err)
+			assert.Equal(t, "acme/kms~v1", algorithm)
+			assert.Equal(t, []byte("grafana"), payload)
+		}
+	})
+
+	t.Run("with longest allowed algorithm should work", func(t *testing.T) {
+		name := strings.Repeat("a", maxEncryptionAlgorithmLength)
+		payload := append(encodeEncryptionAlgorithm(name), []byte("grafana")...)
+
+		algorithm, _, err := deriveEncryptionAlgorithm(payload)
+		require.NoError(t, err)
+		assert.Equal(t, name, algorithm)
+	})
+
+	t.Run("with oversized prefix should fail without allocating it", func(t *testing.T) {
+		payload := append(encodeEncryptionAlgorithm(strings.Repeat("a", 1<<20)), []byte("grafana")...)
+
+		allocs := testing.AllocsPerRun(10, func() {
+			_, _, err := deriveEncryptionAlgorithm(payload)
+			require.Error(t, err)
+		})
+		assert.LessOrEqual(t, allocs, float64(2))
+	})
+
+	t.Run("with multi-megabyte prefix should fail without allocating it", func(t *testing.T) {
+		prefix := bytes.Repeat([]byte("YWVz"), 4<<20)
+		for _, payload := range [][]byte{
+			append(append([]byte("*"), prefix...), '*'),
+			append([]byte("*"), prefix...),
+			append([]byte("*\x01"), prefix...),
+		} {
+			// The search for the delimiter is bounded, so it's reported as
+			// too long rather than as missing its delimiter or malformed.
+			_, _, err := deriveEncryptionAlgorithm(payload)
+			require.ErrorIs(t, err, errAlgorithmTooLong)
+
+			if raceEnabled {
+				continue
+			}
+
+			allocs := testing.AllocsPerRun(100, func() {
+				_, _, _ = deriveEncryptionAlgorithm(payload)
+			})
+			assert.LessOrEqual(t, allocs, float64(2))
+		}
+	})
+
+	t.Run("without prefix should fall back to aes-cfb", func(t *testing.T) {
+		algorithm, payload, err := deriveEncryptionAlgorithm([]byte("grafana"))
+		require.NoError(t, err)
+		assert.Equal(t, encryption.AesCfb, algorithm)
+		assert.Equal(t, []byte("grafana"), payload)
+	})
+
+	t.Run("with leading delimiter but no second one should fail", func(t *testing.T) {
+		for _, payload := range []string{"*", "*YWVzLWdjbQ", "*grafana"} {
+			_, _, err := deriveEncryptionAlgorithm([]byte(payload))
+			require.Error(t, err, payload)
+			assert.Equal(t, "malformed algorithm header", err.Error())
+		}
+	})
+
+	t.Run("with non-base64 prefix should fail", func(t *testing.T) {
+		_, _, err := deriveEncryptionAlgorithm([]byte("*not base64!*grafana"))
+		require.Error(t, err)
+	})
+
+	t.Run("with truncated prefixes should never panic", func(t *testing.T) {
+		payload := append(encodeEncryptionAlgorithm(encryption.AesGcm), []byte("grafana")...)
+		for i := 0; i <= len(payload); i++ {
+			assert.NotPanics(t, func() {
+				_, _, _ = deriveEncryptionAlgorithm(payload[:i])
+			})
+		}
+	})
+}
+
+func Test_decodePayloadHeader(t *testing.T) {
+	t.Run("header without flags should be encoded in the original format", func(t *testing.T) {
+		prefix := encodePayloadHeader(payloadHeader{algorithm: encryption.AesGcm})
+		assert.Equal(t, []byte("*YWVzLWdjbQ*"), prefix)
+	})
+
+	t.Run("header with flags should round-trip", func(t *testing.T) {
+		prefix := encodePayloadHeader(payloadHeader{algorithm: encryption.AesGcm, compressed: true})
+		assert.Equal(t, []byte("*\x01YWVzLWdjbQ*\x01\x01"), prefix)
+
+		header, payload, err := decodePayloadHeader(append(prefix, []byte("grafana")...))
+		require.NoError(t, err)
+		assert.Equal(t, payloadHeader{algorithm: encryption.AesGcm, compressed: true}, header)
+		assert.Equal(t, []byte("grafana"), payload)
+	})
+
+	t.Run("header should be appended in place without allocating", func(t *testing.T) {
+		kdf := &kdfParams{id: kdfIDArgon2id, time: 1, memory: 1024, threads: 1, salt: []byte("0123456789abcdef")}
+		commitment := &keyCommitment{salt: []byte("0123456789abcdef"), value: make([]byte, 32)}
+		for _, h := range []payloadHeader{
+			{algorithm: encryption.AesGcm},
+			{algorithm: encryption.AesGcm, compressed: true},
+			{algorithm: encryption.AesGcm, kdf: kdf, keyVersion: "v1"},
+			{algorithm: encryption.AesGcm, keyVersion: "v1", commitment: commitment},
+			{algorithm: "acme/kms~v1", urlSafe: true},
+			{algorithm: "acme/kms~v1", compressed: true, urlSafe: true},
+		} {
+			buf := make([]byte, 0, payloadHeaderLen(h))
+
+			prefix := appendPayloadHeader(buf, h)
+			assert.Len(t, prefix, payloadHeaderLen(h))
+
+			if !raceEnabled {
+				allocs := testing.AllocsPerRun(10, func() {
+					_ = appendPayloadHeader(buf, h)
+				})
+				assert.Zero(t, allocs)
+			}
+
+			decoded, _, err := decodePayloadHeader(prefix)
+			require.NoError(t, err)
+			assert.Equal(t, h, decoded)
+		}
+	})
+
+	t.Run("header with unknown fields should skip them", func(t *testing.T) {
+		header, payload, err := decodePayloadHeader([]byte("*\x01YWVzLWdjbQ*\x03\x01ABgrafana"))
+		require.NoError(t, err)
+		assert.Equal(t, payloadHeader{algorithm: encryption.AesGcm, compressed: true}, header)
+		assert.Equal(t, []byte("grafana"), payload)
+	})
+
+	t.Run("header with unknown flags should fail", func(t *testing.T) {
+		_, _, err := decodePayloadHeader([]byte("*\x01YWVzLWdjbQ*\x01\x80grafana"))
+		require.Error(t, err)
+	})
+
+	t.Run("malformed versioned headers should fail", func(t *testing.T) {
+		for _, payload := range []string{
+			"*\x01YWVzLWdjbQ",
+			"*\x01YWVzLWdjbQ*",
+			"*\x01YWVzLWdjbQ*\x00grafana",
+			"*\x01YWVzLWdjbQ*\x10\x01",
+		} {
+			_, _, err := decodePayloadHeader([]byte(payload))
+			require.Error(t, err, payload)
+		}
+	})
+}
+
+func Test_Service_PrefixEncoding(t *testing.T) {
+	ctx := context.Background()
+
+	svc := SetupTestService(t)
+	settings := svc.settingsProvider.(*setting.OSSImpl)
+	section := settings.Cfg.Raw.Section(securitySection)
+
+	aesGcm := provider.Provider{}
+	require.NoError(t, svc.RegisterCipher("acme/kms~v1", aesGcm.ProvideCiphers()[encryption.AesGcm], aesGcm.ProvideDeciphers()[encryption.AesGcm]))
+
+	for encoding, prefix := range map[string]string{"": "*YWNtZS9rbXN+djE*", "std": "*YWNtZS9rbXN+djE*", "url": "*YWNtZS9rbXN-djE*"} {
+		t.Run(fmt.Sprintf("with %q encoding should encode the algorithm accordingly", encoding), func(t *testing.T) {
+			section.Key(prefixEncodingKey).SetValue(encoding)
+			t.Cleanup(func() { section.DeleteKey(prefixEncodingKey) })
+
+			encrypted, err := svc.EncryptWithAlgorithm(ctx, []byte("grafana"), "1234", "acme/kms~v1")
+			require.NoError(t, err)
+			assert.True(t, strings.HasPrefix(string(encrypted), prefix), string(encrypted))
+
+			decrypted, err := svc.Decrypt(ctx, encrypted, "1234")
+			require.NoError(t, err)
+			assert.Equal(t, []byte("grafana"), decrypted)
+		})
+	}
+
+	t.Run("payloads should be decrypted regardless of the configured encoding", func(t *testing.T) {
+		encrypted, err := svc.EncryptWithAlgorithm(ctx, []byte("grafana"), "1234", "acme/kms~v1")
+		require.NoError(t, err)
+
+		section.Key(prefixEncodingKey).SetValue("url")
+		t.Cleanup(func() { section.DeleteKey(prefixEncodingKey) })
+
+		decrypted, err := svc.Decrypt(ctx, encrypted, "1234")
+		require.NoError(t, err)
+		assert.Equal(t, []byte("grafana"), decrypted)
+	})
+
+	t.Run("unsupported encoding should fail", func(t *testing.T) {
+		section.Key(prefixEncodingKey).SetValue("hex")
+		t.Cleanup(func() { section.DeleteKey(prefixEncodingKey) })
+
+		require.Error(t, svc.Validate(settings.Section(securitySection)))
+
+		_, err := svc.Encrypt(ctx, []byte("grafana"), "1234")
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "unsupported prefix_encoding 'hex'")
+	})
+}
+
+func Test_payloadVersions(t *testing.T) {
+	ctx := context.Background()
+
+	svc := SetupTestService(t)
+	setAlgorithm(t, svc, encryption.AesGcm)
+
+	v0, err := svc.Encrypt(ctx, []byte("grafana"), "1234")
+	require.NoError(t, err)
+
+	prefix := encodeEncryptionAlgorithm(encryption.AesGcm)
+	require.Equal(t, prefix, v0[:len(prefix)])
+	body := v0[len(prefix):]
+
+	t.Run("v0 payload should decrypt", func(t *testing.T) {
+		decrypted, err := svc.Decrypt(ctx, v0, "1234")
+		require.NoError(t, err)
+		assert.Equal(t, []byte("grafana"), decrypted)
+	})
+
+	t.Run("v1 payload with extra header fields should decrypt", func(t *testing.T) {
+		v1 := []byte{encryptionAlgorithmDelimiter, payloadVersion1}
+		v1 = append(v1, prefix[1:]...)
+		v1 = append(v1, 4, 0, 'x', 'y', 'z')
+		v1 = append(v1, body...)
+
+		decrypted, err := svc.Decrypt(ctx, v1, "1234")
+		require.NoError(t, err)
+		assert.Equal(t, []byte("grafana"), decrypted)
+
+		algorithm, err := encryption.ValidatePayload(v1)
+		require.NoError(t, err)
+		assert.Equal(t, encryption.AesGcm, algorithm)
+	})
+
+	t.Run("payload with unsupported version should fail", func(t *testing.T) {
+		for _, version := range []byte{0x02, payloadMaxVersion - 1} {
+			payload := []byte{encryptionAlgorithmDelimiter, version}
+			payload = append(payload, prefix[1:]...)
+			payload = append(payload, body...)
+
+			_, err := svc.Decrypt(ctx, payload, "1234")
+			require.Error(t, err)
+			assert.Equal(t, fmt.Sprintf("unsupported payload version: %d", version), err.Error())
+
+			_, err = encryption.ValidatePayload(payload)
+			require.Error(t, err)
+		}
+	})
+}
+
+func Test_ValidatePayload(t *testing.T) {
+	ctx := context.Background()
+
+	svc := SetupTestService(t)
+	settings := svc.settingsProvider.(*setting.OSSImpl)
+	section := settings.Cfg.Raw.Section(securitySection)
+
+	// The encryption package replicates the header parsing,
+	// so both must agree on the payloads produced by Encrypt.
+	for _, algorithm := range []string{encryption.AesCfb, encryption.AesGcm, encryption.AesCbcHmac, encryption.ChaCha20Poly1305, encryption.XChaCha20Poly1305, encryption.AesSiv} {
+		for _, compress := range []string{"false", "true"} {
+			setAlgorithm(t, svc, algorithm)
+			section.Key(compressPayloadsKey).SetValue(compress)
+
+			encrypted, err := svc.Encrypt(ctx, []byte(strings.Repeat("grafana", 10)), "1234")
+			require.NoError(t, err)
+
+			validated, err := encryption.ValidatePayload(encrypted)
+			require.NoError(t, err)
+			assert.Equal(t, algorithm, validated)
+		}
+	}
+
+	t.Run("payloads with all the header options should be valid", func(t *testing.T) {
+		setAlgorithm(t, svc, encryption.AesGcm)
+		keys := map[string]string{
+			kdfKey:                     kdfArgon2id,
+			kdfArgon2idMemoryKey:       "1024",
+			keyVersionsKey:             "v1",
+			keyVersionKeyPrefix + "v1": "key",
+			currentKeyVersionKey:       "v1",
+			keyCommitmentKey:           "true",
+			compressPayloadsKey:        "true",
+		}
+		for key, value := range keys {
+			section.Key(key).SetValue(value)
+		}
+		t.Cleanup(func() {
+			for key := range keys {
+				section.DeleteKey(key)
+			}
+		})
+
+		encrypted, err := svc.EncryptWithPadding(ctx, []byte(strings.Repeat("grafana", 10)), "1234", 64)
+		require.NoError(t, err)
+
+		header, _, err := decodePayloadHeader(encrypted)
+		require.NoError(t, err)
+		require.True(t, header.compressed && header.padded)
+		require.NotNil(t, header.kdf)
+		require.NotEmpty(t, header.keyVersion)
+		require.NotNil(t, header.commitment)
+
+		validated, err := encryption.ValidatePayload(encrypted)
+		require.NoError(t, err)
+		assert.Equal(t, encryption.AesGcm, validated)
+	})
+}
+
+func Test_CiphertextLen(t *testing.T) {
+	ctx := context.Background()
+
+	svc := SetupTestService(t)
+
+	// The encryption package replicates the payload format,
+	// so its estimates must match the payloads produced by Encrypt.
+	for _, algorithm := range []string{encryption.AesCfb, encryption.AesGcm, encryption.AesCbcHmac, encryption.ChaCha20Poly1305, encryption.XChaCha20Poly1305, encryption.AesSiv} {
+		for _, plaintextLen := range []int{0, 1, 15, 16, 17, 100, 1024} {
+			encrypted, err := svc.EncryptWithAlgorithm(ctx, make([]byte, plaintextLen), "1234", algorithm)
+			require.NoError(t, err)
+
+			estimated, err := encryption.CiphertextLen(algorithm, plaintextLen)
+			require.NoError(t, err)
+			assert.Equal(t, len(encrypted), estimated, "%s with %d bytes", algorithm, plaintextLen)
+		}
+	}
+}
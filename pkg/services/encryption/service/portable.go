@@ -0,0 +1,371 @@
+package service
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/pbkdf2"
+
+	"github.com/grafana/grafana/pkg/services/encryption"
+)
+
+// The portable payloads produced by EncryptPortable are meant to be handed
+// over to parties outside Grafana, so unlike the internal payloads (see
+// encodePayloadHeader), they're self-describing and only made of standard
+// primitives, with no dependency on the registered ciphers' own framing.
+// The format is stable: any incompatible change must bump the version, and
+// DecryptPortable must keep reading all the previous ones. All the integers
+// are unsigned and big-endian:
+//
+//	offset  length  field
+//	0       4       magic, "GFEP"
+//	4       1       version, 0x01
+//	5       1       AEAD: 0x01 AES-256-GCM, 0x02 ChaCha20-Poly1305,
+//	                0x03 XChaCha20-Poly1305
+//	6       1       KDF: 0x01 PBKDF2-HMAC-SHA256, 0x02 Argon2id
+//	7       n       KDF parameters:
+//	                PBKDF2: uint32 iterations (n = 4)
+//	                Argon2id: uint32 time, uint32 memory in KiB,
+//	                uint8 threads (n = 9)
+//	7+n     1       salt length (s)
+//	8+n     s       salt
+//	8+n+s   1       nonce length (l), which must be the AEAD's nonce size
+//	9+n+s   l       nonce
+//	9+n+s+l         ciphertext, followed by the 16-byte authentication tag
+//
+// The 32-byte key is derived with the KDF from the UTF-8 bytes of the secret
+// and the salt. Everything up to, and including, the nonce is authenticated
+// as the AEAD's associated data, so no field can be altered undetected.
+const (
+	portableVersion1 byte = 0x01
+
+	portableAEADAesGcm            byte = 0x01
+	portableAEADChaCha20Poly1305  byte = 0x02
+	portableAEADXChaCha20Poly1305 byte = 0x03
+
+	portableKDFPBKDF2   byte = 0x01
+	portableKDFArgon2id byte = 0x02
+
+	// portablePBKDF2Iterations is the iteration count the payloads are
+	// written with, same as encryption.KeyToBytes's.
+	portablePBKDF2Iterations = 10000
+
+	// Bounds of the PBKDF2 iteration count read from payloads, so a
+	// crafted payload can neither weaken the key derivation nor make
+	// the decryption take arbitrary CPU time.
+	minPortablePBKDF2Iterations = 1000
+	maxPortablePBKDF2Iterations = 10000000
+
+	portableSaltLength = 16
+	portableKeyLength  = 32
+)
+
+var portableMagic = []byte("GFEP")
+
+// portableAEADs maps the algorithms that can be used in portable
+// payloads to their id, the portable algorithms for short.
+var portableAEADs = map[string]byte{
+	encryption.AesGcm:            portableAEADAesGcm,
+	encryption.ChaCha20Poly1305:  portableAEADChaCha20Poly1305,
+	encryption.XChaCha20Poly1305: portableAEADXChaCha20Poly1305,
+}
+
+// errMalformedPortablePayload is returned for the
+// payloads that don't follow the portable format.
+var errMalformedPortablePayload = errors.New("malformed portable payload")
+
+// portableParams are the parameters a portable payload is sealed with.
+type portableParams struct {
+	aead byte
+	kdf  byte
+
+	// iterations is the PBKDF2 iteration count.
+	iterations uint32
+
+	// time, memory and threads are the Argon2id parameters.
+	time    uint32
+	memory  uint32
+	threads uint8
+
+	salt  []byte
+	nonce []byte
+}
+
+// EncryptPortable encrypts the given payload into the portable format (see
+// portableVersion1), for parties that don't run Grafana, e.g. holding a
+// secret provisioned for them. It uses the configured algorithm when it's one
+// of the portable ones, AES-256-GCM otherwise, and the configured KDF, so
+// PBKDF2-HMAC-SHA256 unless Argon2id is. The configured settings that only
+// apply to the internal payloads (e.g. compression) are ignored.
+func (s *Service) EncryptPortable(ctx context.Context, payload []byte, secret string) ([]byte, error) {
+	var err error
+	defer func() {
+		if err != nil {
+			s.log.Error("Portable encryption failed", logContext(ctx, "error", err)...)
+		}
+	}()
+
+	if err = ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	if err = s.checkEncryptionSecret(secret); err != nil {
+		return nil, err
+	}
+
+	if err = s.checkPayloadSize(operationEncrypt, len(payload)); err != nil {
+		return nil, err
+	}
+
+	var params portableParams
+	params, err = s.newPortableParams(s.random)
+	if err != nil {
+		return nil, err
+	}
+
+	var encrypted []byte
+	encrypted, err = sealPortable(params, payload, secret)
+	return encrypted, err
+}
+
+// DecryptPortable decrypts the given payload, in any version of the portable
+// format (see EncryptPortable), with the given secret. The parameters are
+// read from the payload, so decryption doesn't depend on the configuration.
+func (s *Service) DecryptPortable(ctx context.Context, payload []byte, secret string) ([]byte, error) {
+	var err error
+	defer func() {
+		if err != nil {
+			s.log.Error("Portable decryption failed", logContext(ctx, "error", err)...)
+		}
+	}()
+
+	if err = ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	if secret == "" {
+		err = encryption.ErrEmptySecret
+		return nil, err
+	}
+
+	var decrypted []byte
+	decrypted, err = openPortable(payload, secret, s.fipsMode)
+	return decrypted, err
+}
+
+// newPortableParams returns the parameters for a new portable payload,
+// according to the configuration, with the salt and nonce read from random.
+func (s *Service) newPortableParams(random io.Reader) (portableParams, error) {
+	params := portableParams{
+		aead:       portableAEADs[s.portableAlgorithm()],
+		kdf:        portableKDFPBKDF2,
+		iterations: portablePBKDF2Iterations,
+	}
+
+	kdf, err := newKDFParams(s.securitySettings(), s.random)
+	if err != nil {
+		return portableParams{}, err
+	}
+	if kdf != nil {
+		params.kdf = portableKDFArgon2id
+		params.time, params.memory, params.threads = kdf.time, kdf.memory, kdf.threads
+	}
+
+	nonceSize, _ := portableNonceSize(params.aead)
+	params.salt = make([]byte, portableSaltLength)
+	params.nonce = make([]byte, nonceSize)
+	if _, err := io.ReadFull(random, params.salt); err != nil {
+		return portableParams{}, err
+	}
+	if _, err := io.ReadFull(random, params.nonce); err != nil {
+		return portableParams{}, err
+	}
+
+	return params, nil
+}
+
+// sealPortable encrypts the given payload into the portable format, with the
+// given parameters, which are expected to be valid.
+func sealPortable(params portableParams, payload []byte, secret string) ([]byte, error) {
+	key := params.deriveKey(secret)
+	defer encryption.Wipe(key)
+
+	aead, err := newPortableAEAD(params.aead, key)
+	if err != nil {
+		return nil, err
+	}
+
+	header := params.appendTo(nil)
+	return aead.Seal(header, params.nonce, payload, header), nil
+}
+
+// openPortable decrypts the given portable payload, rejecting the algorithms
+// that aren't FIPS approved when fipsMode is set.
+func openPortable(payload []byte, secret string, fipsMode bool) ([]byte, error) {
+	params, ciphertext, err := decodePortableParams(payload)
+	if err != nil {
+		return nil, err
+	}
+
+	if fipsMode && params.aead != portableAEADAesGcm {
+		return nil, errors.New("portable payload encrypted with an AEAD that is not FIPS approved")
+	}
+
+	key := params.deriveKey(secret)
+	defer encryption.Wipe(key)
+
+	aead, err := newPortableAEAD(params.aead, key)
+	if err != nil {
+		return nil, err
+	}
+
+	decrypted, err := aead.Open(nil, params.nonce, ciphertext, payload[:len(payload)-len(ciphertext)])
+	if err != nil {
+		return nil, encryption.ErrAuthenticationFailed
+	}
+
+	return decrypted, nil
+}
+
+func (p portableParams) deriveKey(secret string) []byte {
+	if p.kdf == portableKDFArgon2id {
+		return argon2.IDKey([]byte(secret), p.salt, p.time, p.memory, p.threads, portableKeyLength)
+	}
+	return pbkdf2.Key([]byte(secret), p.salt, int(p.iterations), portableKeyLength, sha256.New)
+}
+
+// appendTo appends the encoded parameters, i.e. everything
+// preceding the ciphertext, to the given buffer.
+func (p portableParams) appendTo(b []byte) []byte {
+	b = append(b, portableMagic...)
+	b = append(b, portableVersion1, p.aead, p.kdf)
+
+	if p.kdf == portableKDFArgon2id {
+		b = appendUint32(b, p.time)
+		b = appendUint32(b, p.memory)
+		b = append(b, p.threads)
+	} else {
+		b = appendUint32(b, p.iterations)
+	}
+
+	b = append(b, byte(len(p.salt)))
+	b = append(b, p.salt...)
+	b = append(b, byte(len(p.nonce)))
+	return append(b, p.nonce...)
+}
+
+func appendUint32(b []byte, v uint32) []byte {
+	var buf [4]byte
+	binary.BigEndian.PutUint32(buf[:], v)
+	return append(b, buf[:]...)
+}
+
+// decodePortableParams decodes the parameters of the given
+// portable payload, and returns them with the ciphertext.
+func decodePortableParams(payload []byte) (portableParams, []byte, error) {
+	if !bytes.HasPrefix(payload, portableMagic) {
+		return portableParams{}, nil, errMalformedPortablePayload
+	}
+	payload = payload[len(portableMagic):]
+
+	if len(payload) < 3 {
+		return portableParams{}, nil, errMalformedPortablePayload
+	}
+
+	if payload[0] != portableVersion1 {
+		return portableParams{}, nil, fmt.Errorf("unsupported portable payload version: %d", payload[0])
+	}
+
+	p := portableParams{aead: payload[1], kdf: payload[2]}
+	payload = payload[3:]
+
+	nonceSize, ok := portableNonceSize(p.aead)
+	if !ok {
+		return portableParams{}, nil, fmt.Errorf("unsupported portable payload AEAD: %d", p.aead)
+	}
+
+	switch p.kdf {
+	case portableKDFPBKDF2:
+		if len(payload) < 4 {
+			return portableParams{}, nil, errMalformedPortablePayload
+		}
+		p.iterations, payload = binary.BigEndian.Uint32(payload), payload[4:]
+
+		if p.iterations < minPortablePBKDF2Iterations || p.iterations > maxPortablePBKDF2Iterations {
+			return portableParams{}, nil, errors.New("key derivation parameters out of bounds")
+		}
+	case portableKDFArgon2id:
+		if len(payload) < 9 {
+			return portableParams{}, nil, errMalformedPortablePayload
+		}
+		p.time, p.memory, p.threads = binary.BigEndian.Uint32(payload), binary.BigEndian.Uint32(payload[4:]), payload[8]
+		payload = payload[9:]
+
+		if p.time < 1 || p.time > maxArgon2idTime || p.memory < 1 || p.memory > maxArgon2idMemory || p.threads < 1 {
+			return portableParams{}, nil, errors.New("key derivation parameters out of bounds")
+		}
+	default:
+		return portableParams{}, nil, fmt.Errorf("unsupported portable payload key derivation function: %d", p.kdf)
+	}
+
+	if len(payload) < 1 || payload[0] == 0 || len(payload) < 1+int(payload[0]) {
+		return portableParams{}, nil, errMalformedPortablePayload
+	}
+	p.salt, payload = payload[1:1+int(payload[0])], payload[1+int(payload[0]):]
+
+	if len(payload) < 1 || int(payload[0]) != nonceSize || len(payload) < 1+nonceSize {
+		return portableParams{}, nil, errMalformedPortablePayload
+	}
+	p.nonce, payload = payload[1:1+nonceSize], payload[1+nonceSize:]
+
+	return p, payload, nil
+}
+
+// portableAlgorithm returns the configured algorithm when it's one of the
+// portable ones, and allowed in FIPS mode if enabled, AesGcm otherwise.
+func (s *Service) portableAlgorithm() string {
+	algorithm := s.CurrentAlgorithm()
+	if _, ok := portableAEADs[algorithm]; !ok || (s.fipsMode && !fipsApprovedAlgorithms[algorithm]) {
+		return encryption.AesGcm
+	}
+	return algorithm
+}
+
+// portableNonceSize returns the nonce size of the given AEAD,
+// and whether it's one of the supported ones.
+func portableNonceSize(aead byte) (int, bool) {
+	switch aead {
+	case portableAEADAesGcm, portableAEADChaCha20Poly1305:
+		return chacha20poly1305.NonceSize, true
+	case portableAEADXChaCha20Poly1305:
+		return chacha20poly1305.NonceSizeX, true
+	default:
+		return 0, false
+	}
+}
+
+func newPortableAEAD(aead byte, key []byte) (cipher.AEAD, error) {
+	switch aead {
+	case portableAEADAesGcm:
+		block, err := aes.NewCipher(key)
+		if err != nil {
+			return nil, err
+		}
+		return cipher.NewGCM(block)
+	case portableAEADChaCha20Poly1305:
+		return chacha20poly1305.New(key)
+	case portableAEADXChaCha20Poly1305:
+		return chacha20poly1305.NewX(key)
+	default:
+		return nil, fmt.Errorf("unsupported portable payload AEAD: %d", aead)
+	}
+}
@@ -0,0 +1,182 @@
+package service
+
+import (
+	"bytes"
+	"context"
+	"flag"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/grafana/grafana/pkg/services/encryption"
+	"github.com/grafana/grafana/pkg/setting"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var update = flag.Bool("update", false, "update golden files")
+
+func Test_Service_Portable(t *testing.T) {
+	ctx := context.Background()
+
+	svc := SetupTestService(t)
+	section := svc.settingsProvider.(*setting.OSSImpl).Cfg.Raw.Section(securitySection)
+
+	for algorithm := range portableAEADs {
+		t.Run(algorithm+" encrypt and decrypt should work", func(t *testing.T) {
+			setAlgorithm(t, svc, algorithm)
+
+			encrypted, err := svc.EncryptPortable(ctx, []byte("grafana"), "1234")
+			require.NoError(t, err)
+			assert.Equal(t, portableAEADs[algorithm], encrypted[5])
+
+			decrypted, err := svc.DecryptPortable(ctx, encrypted, "1234")
+			require.NoError(t, err)
+			assert.Equal(t, []byte("grafana"), decrypted)
+		})
+	}
+
+	t.Run("non-portable algorithms should fall back to aes-gcm", func(t *testing.T) {
+		setAlgorithm(t, svc, encryption.AesCbcHmac)
+
+		encrypted, err := svc.EncryptPortable(ctx, []byte("grafana"), "1234")
+		require.NoError(t, err)
+		assert.Equal(t, portableAEADAesGcm, encrypted[5])
+	})
+
+	t.Run("configured argon2id should be used", func(t *testing.T) {
+		section.Key(kdfKey).SetValue(kdfArgon2id)
+		section.Key(kdfArgon2idMemoryKey).SetValue("64")
+		t.Cleanup(func() {
+			section.DeleteKey(kdfKey)
+			section.DeleteKey(kdfArgon2idMemoryKey)
+		})
+
+		encrypted, err := svc.EncryptPortable(ctx, []byte("grafana"), "1234")
+		require.NoError(t, err)
+		assert.Equal(t, portableKDFArgon2id, encrypted[6])
+
+		decrypted, err := svc.DecryptPortable(ctx, encrypted, "1234")
+		require.NoError(t, err)
+		assert.Equal(t, []byte("grafana"), decrypted)
+	})
+
+	t.Run("tampered payloads should fail", func(t *testing.T) {
+		encrypted, err := svc.EncryptPortable(ctx, []byte("grafana"), "1234")
+		require.NoError(t, err)
+
+		for _, i := range []int{8, 12, len(encrypted) - 1} {
+			tampered := append([]byte{}, encrypted...)
+			tampered[i] ^= 0x01
+
+			_, err := svc.DecryptPortable(ctx, tampered, "1234")
+			require.ErrorIs(t, err, encryption.ErrAuthenticationFailed, "byte %d", i)
+		}
+	})
+
+	t.Run("wrong secret should fail", func(t *testing.T) {
+		encrypted, err := svc.EncryptPortable(ctx, []byte("grafana"), "1234")
+		require.NoError(t, err)
+
+		_, err = svc.DecryptPortable(ctx, encrypted, "4321")
+		require.ErrorIs(t, err, encryption.ErrAuthenticationFailed)
+	})
+
+	t.Run("malformed payloads should be rejected", func(t *testing.T) {
+		encrypted, err := svc.EncryptPortable(ctx, []byte("grafana"), "1234")
+		require.NoError(t, err)
+
+		internal, err := svc.Encrypt(ctx, []byte("grafana"), "1234")
+		require.NoError(t, err)
+
+		for _, payload := range [][]byte{nil, internal, encrypted[:4], encrypted[:12], encrypted[:30]} {
+			_, err := svc.DecryptPortable(ctx, payload, "1234")
+			require.ErrorIs(t, err, errMalformedPortablePayload)
+		}
+
+		unsupported := append([]byte{}, encrypted...)
+		unsupported[4] = 0x02
+		_, err = svc.DecryptPortable(ctx, unsupported, "1234")
+		require.EqualError(t, err, "unsupported portable payload version: 2")
+
+		weakened := append([]byte{}, encrypted...)
+		copy(weakened[7:11], []byte{0, 0, 0, 1})
+		_, err = svc.DecryptPortable(ctx, weakened, "1234")
+		require.EqualError(t, err, "key derivation parameters out of bounds")
+	})
+
+	t.Run("empty secret should be rejected", func(t *testing.T) {
+		_, err := svc.EncryptPortable(ctx, []byte("grafana"), "")
+		require.ErrorIs(t, err, encryption.ErrEmptySecret)
+
+		_, err = svc.DecryptPortable(ctx, []byte("grafana"), "")
+		require.ErrorIs(t, err, encryption.ErrEmptySecret)
+	})
+}
+
+func Test_Portable_Golden(t *testing.T) {
+	svc := SetupTestService(t)
+	section := svc.settingsProvider.(*setting.OSSImpl).Cfg.Raw.Section(securitySection)
+
+	testCases := []struct {
+		golden   string
+		settings map[string]string
+	}{
+		{
+			golden:   "portable_v1_aes-gcm_pbkdf2.golden",
+			settings: map[string]string{encryptionAlgorithmKey: encryption.AesGcm},
+		},
+		{
+			golden: "portable_v1_xchacha20-poly1305_argon2id.golden",
+			settings: map[string]string{
+				encryptionAlgorithmKey: encryption.XChaCha20Poly1305,
+				kdfKey:                 kdfArgon2id,
+				kdfArgon2idTimeKey:     "1",
+				kdfArgon2idMemoryKey:   "64",
+				kdfArgon2idThreadsKey:  "1",
+			},
+		},
+	}
+
+	// The salt and nonce are read from a deterministic source,
+	// so the payloads are the same on every run.
+	random := make([]byte, 64)
+	for i := range random {
+		random[i] = byte(i)
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.golden, func(t *testing.T) {
+			for key, value := range tc.settings {
+				section.Key(key).SetValue(value)
+			}
+			t.Cleanup(func() {
+				for key := range tc.settings {
+					section.DeleteKey(key)
+				}
+			})
+			setAlgorithm(t, svc, tc.settings[encryptionAlgorithmKey])
+
+			params, err := svc.newPortableParams(bytes.NewReader(random))
+			require.NoError(t, err)
+
+			encrypted, err := sealPortable(params, []byte("grafana portable payload"), "portable secret")
+			require.NoError(t, err)
+
+			goldenFile := filepath.Join("testdata", tc.golden)
+			if *update {
+				require.NoError(t, os.WriteFile(goldenFile, encrypted, 0600))
+			}
+
+			// Safe to disable, this is a test.
+			// nolint:gosec
+			want, err := os.ReadFile(goldenFile)
+			require.NoError(t, err)
+			assert.Equal(t, want, encrypted, "not matched with golden file")
+
+			decrypted, err := svc.DecryptPortable(context.Background(), want, "portable secret")
+			require.NoError(t, err)
+			assert.Equal(t, []byte("grafana portable payload"), decrypted)
+		})
+	}
+}
@@ -0,0 +1,106 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Profiles let callers encrypt with another algorithm than the configured one,
+// chosen by purpose rather than by name, e.g. a strong one for the long-lived
+// secrets stored at rest, and a fast one for the short-lived tokens in transit.
+// Each profile is configured in a section of its own, optionally along with
+// the bucket size in bytes its payloads are padded to (see EncryptWithPadding):
+//
+//	[security.encryption.profiles.atrest]
+//	algorithm = aes-gcm
+//	padding = 32
+//
+//	[security.encryption.profiles.transit]
+//	algorithm = chacha20poly1305
+//
+// The payloads are prefixed with their algorithm as usual, so they're
+// decrypted by Decrypt regardless of the profile they were encrypted with.
+const (
+	profileSectionPrefix = securitySection + ".profiles."
+	profileAlgorithmKey  = "algorithm"
+	profilePaddingKey    = "padding"
+)
+
+type encryptionProfile struct {
+	algorithm string
+
+	// padding is the bucket size the payloads
+	// are padded to, or zero to not pad them.
+	padding int
+}
+
+// EncryptProfile encrypts the given payload, as Encrypt does, but with the
+// algorithm of the given profile rather than the configured one, and padded
+// as configured for the profile, if at all.
+func (s *Service) EncryptProfile(ctx context.Context, profile string, payload []byte, secret string) ([]byte, error) {
+	s.mtx.RLock()
+	p, ok := s.profiles[profile]
+	s.mtx.RUnlock()
+
+	if !ok {
+		err := fmt.Errorf("unknown encryption profile '%s'", profile)
+		s.log.Error("Encryption failed", logContext(ctx, "profile", profile, "error", err)...)
+		return nil, err
+	}
+
+	return s.encrypt(ctx, nil, payload, nil, secret, p.algorithm, p.padding)
+}
+
+// loadProfiles returns the configured profiles by name, once
+// checked, so a misconfigured profile is caught on startup or reload rather
+// than when encrypting. The profiles are read from the current settings, as
+// the profile sections would otherwise inherit the algorithm of the encryption
+// section, which would hide the missing ones.
+func (s *Service) loadProfiles() (map[string]encryptionProfile, error) {
+	var (
+		settings = s.settingsProvider.Current()
+		names    []string
+	)
+	for section := range settings {
+		if strings.HasPrefix(section, profileSectionPrefix) {
+			names = append(names, section)
+		}
+	}
+	sort.Strings(names)
+
+	profiles := make(map[string]encryptionProfile, len(names))
+	for _, section := range names {
+		profile := strings.TrimPrefix(section, profileSectionPrefix)
+
+		algorithm := settings[section][profileAlgorithmKey]
+		if algorithm == "" {
+			return nil, fmt.Errorf("no algorithm configured for encryption profile '%s'", profile)
+		}
+		algorithm = s.resolveAlgorithm(algorithm)
+
+		if err := s.checkEncryptionAlgorithm(algorithm); err != nil {
+			return nil, fmt.Errorf("invalid encryption profile '%s': %w", profile, err)
+		}
+
+		var padding int
+		if value := settings[section][profilePaddingKey]; value != "" {
+			var err error
+			if padding, err = strconv.Atoi(value); err != nil {
+				return nil, fmt.Errorf("invalid encryption profile '%s': %w", profile, err)
+			}
+		}
+
+		if padding != 0 {
+			if err := checkPaddingBucketSize(padding); err != nil {
+				return nil, fmt.Errorf("invalid encryption profile '%s': %w", profile, err)
+			}
+		}
+
+		profiles[profile] = encryptionProfile{algorithm: algorithm, padding: padding}
+	}
+
+	return profiles, nil
+}
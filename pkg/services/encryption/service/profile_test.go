@@ -0,0 +1,70 @@
+package service
+
+import (
+	"context"
+	"testing"
+
+	"github.com/grafana/grafana/pkg/infra/usagestats"
+	"github.com/grafana/grafana/pkg/services/encryption"
+	"github.com/grafana/grafana/pkg/services/encryption/provider"
+	"github.com/grafana/grafana/pkg/setting"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_Service_EncryptProfile(t *testing.T) {
+	ctx := context.Background()
+
+	svc := SetupTestService(t)
+	settings := svc.settingsProvider.(*setting.OSSImpl)
+
+	// NewKey rather than Key, as the latter would return the
+	// key inherited from the encryption section, if any.
+	setProfile := func(t *testing.T, settings *setting.OSSImpl, profile, algorithm string) {
+		t.Helper()
+		_, err := settings.Cfg.Raw.Section(profileSectionPrefix+profile).NewKey(profileAlgorithmKey, algorithm)
+		require.NoError(t, err)
+	}
+
+	setProfile(t, settings, "atrest", encryption.AesGcm)
+	setProfile(t, settings, "transit", encryption.ChaCha20Poly1305)
+	require.NoError(t, svc.Reload(settings.Section(securitySection)))
+
+	t.Run("profiles should encrypt with their algorithm", func(t *testing.T) {
+		atRest, err := svc.EncryptProfile(ctx, "atrest", []byte("grafana"), "1234")
+		require.NoError(t, err)
+
+		transit, err := svc.EncryptProfile(ctx, "transit", []byte("grafana"), "1234")
+		require.NoError(t, err)
+
+		for payload, algorithm := range map[string]string{string(atRest): encryption.AesGcm, string(transit): encryption.ChaCha20Poly1305} {
+			header, _, err := decodePayloadHeader([]byte(payload))
+			require.NoError(t, err)
+			assert.Equal(t, algorithm, header.algorithm)
+
+			decrypted, decryptedWith, err := svc.DecryptWithAlgorithm(ctx, []byte(payload), "1234")
+			require.NoError(t, err)
+			assert.Equal(t, []byte("grafana"), decrypted)
+			assert.Equal(t, algorithm, decryptedWith)
+		}
+	})
+
+	t.Run("unknown profiles should fail", func(t *testing.T) {
+		_, err := svc.EncryptProfile(ctx, "unknown", []byte("grafana"), "1234")
+		require.EqualError(t, err, "unknown encryption profile 'unknown'")
+	})
+
+	t.Run("profiles should be checked on startup", func(t *testing.T) {
+		settings := &setting.OSSImpl{Cfg: setting.NewCfg()}
+		settings.Cfg.Raw.Section(securitySection).Key(skipSelfTestKey).SetValue("true")
+		setProfile(t, settings, "transit", "unknown")
+
+		_, err := ProvideEncryptionService(provider.Provider{}, &usagestats.UsageStatsMock{T: t}, settings)
+		require.EqualError(t, err, "invalid encryption profile 'transit': no cipher registered for encryption algorithm configured 'unknown'")
+
+		settings.Cfg.Raw.Section(profileSectionPrefix + "transit").DeleteKey(profileAlgorithmKey)
+
+		_, err = ProvideEncryptionService(provider.Provider{}, &usagestats.UsageStatsMock{T: t}, settings)
+		require.EqualError(t, err, "no algorithm configured for encryption profile 'transit'")
+	})
+}
@@ -0,0 +1,8 @@
+//go:build race
+// +build race
+
+package service
+
+// raceEnabled reports whether the tests are run with the race detector,
+// whose instrumentation allocates on its own, so allocations aren't checked.
+const raceEnabled = true
@@ -0,0 +1,103 @@
+package service
+
+import (
+	"context"
+	"crypto/rand"
+	"errors"
+	"testing"
+
+	"github.com/grafana/grafana/pkg/infra/usagestats"
+	"github.com/grafana/grafana/pkg/services/encryption"
+	"github.com/grafana/grafana/pkg/services/encryption/provider"
+	"github.com/grafana/grafana/pkg/setting"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_Service_RandSource(t *testing.T) {
+	ctx := context.Background()
+	errRandom := errors.New("entropy source unavailable")
+
+	newService := func(t *testing.T, random encryption.RandSource) *Service {
+		t.Helper()
+
+		settings := &setting.OSSImpl{Cfg: setting.NewCfg()}
+		// The self-test would fail first with a failing source.
+		settings.Cfg.Raw.Section(securitySection).Key(skipSelfTestKey).SetValue("true")
+
+		svc, err := ProvideEncryptionServiceWithRandSource(provider.Provider{}, &usagestats.UsageStatsMock{T: t}, settings, random)
+		require.NoError(t, err)
+		return svc
+	}
+
+	t.Run("failing source should fail the encryption", func(t *testing.T) {
+		svc := newService(t, &failingRandSource{err: errRandom})
+
+		for _, algorithm := range svc.SupportedAlgorithms() {
+			// AES-SIV is deterministic, so it doesn't draw any randomness.
+			if algorithm == encryption.AesSiv {
+				continue
+			}
+
+			encrypted, err := svc.EncryptWithAlgorithm(ctx, []byte("grafana"), "1234", algorithm)
+			require.ErrorIs(t, err, errRandom, algorithm)
+			assert.Nil(t, encrypted, algorithm)
+		}
+	})
+
+	t.Run("failing source should fail the salts of the service", func(t *testing.T) {
+		svc := newService(t, &failingRandSource{err: errRandom})
+		section := svc.settingsProvider.(*setting.OSSImpl).Cfg.Raw.Section(securitySection)
+		setAlgorithm(t, svc, encryption.AesGcm)
+		section.Key(keyCommitmentKey).SetValue("true")
+
+		_, err := svc.Encrypt(ctx, []byte("grafana"), "1234")
+		require.ErrorIs(t, err, errRandom)
+
+		// AES-SIV stays deterministic, even with key commitment.
+		_, err = svc.EncryptWithAlgorithm(ctx, []byte("grafana"), "1234", encryption.AesSiv)
+		require.NoError(t, err)
+
+		_, err = svc.EncryptPortable(ctx, []byte("grafana"), "1234")
+		require.ErrorIs(t, err, errRandom)
+	})
+
+	t.Run("working source should be drawn from", func(t *testing.T) {
+		random := &failingRandSource{}
+		svc := newService(t, random)
+
+		encrypted, err := svc.Encrypt(ctx, []byte("grafana"), "1234")
+		require.NoError(t, err)
+		assert.NotZero(t, random.reads)
+
+		decrypted, err := svc.Decrypt(ctx, encrypted, "1234")
+		require.NoError(t, err)
+		assert.Equal(t, []byte("grafana"), decrypted)
+	})
+
+	t.Run("providers without random sources should be rejected", func(t *testing.T) {
+		settings := &setting.OSSImpl{Cfg: setting.NewCfg()}
+
+		_, err := ProvideEncryptionServiceWithRandSource(fakeProvider{}, &usagestats.UsageStatsMock{T: t}, settings, rand.Reader)
+		require.EqualError(t, err, "encryption provider doesn't support random sources")
+
+		_, err = ProvideEncryptionServiceWithRandSource(provider.Provider{}, &usagestats.UsageStatsMock{T: t}, settings, nil)
+		require.EqualError(t, err, "random source cannot be nil")
+	})
+}
+
+// failingRandSource is a source of randomness that fails with the given
+// error, if any, and reads from crypto/rand.Reader otherwise. Reads are
+// counted either way.
+type failingRandSource struct {
+	err   error
+	reads int
+}
+
+func (r *failingRandSource) Read(p []byte) (int, error) {
+	r.reads++
+	if r.err != nil {
+		return 0, r.err
+	}
+	return rand.Read(p)
+}
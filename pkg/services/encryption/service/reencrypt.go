@@ -0,0 +1,177 @@
+package service
+
+import (
+	"context"
+	"crypto/sha256"
+	"sync"
+
+	"github.com/grafana/grafana/pkg/services/encryption"
+)
+
+// Re-encryption passes (e.g. rotating the secret, or upgrading payloads to
+// the configured algorithm) may be run by several replicas at the same time,
+// or interrupted and run again. ReEncryptIfNeeded makes re-encrypting a
+// payload idempotent, and ReEncryptGuard makes sure each payload is processed
+// only once within a replica. Neither can coordinate replicas though, which is
+// up to the database: the rows should be locked while being re-encrypted (e.g.
+// SELECT ... FOR UPDATE), or updated conditionally on still holding the
+// payload that was read (e.g. UPDATE ... WHERE value = <old payload>), so a
+// row re-encrypted by another replica in the meantime is left alone.
+
+// ReEncryptIfNeeded re-encrypts the given payload, as ReEncrypt does, unless
+// it's already re-encrypted, in which case it's returned as it is, along with
+// false. A payload is re-encrypted when it's encrypted with the configured
+// algorithm, and the current key version if any, as well as with newSecret.
+//
+// Only the algorithms bound to the secret (see encryption.IsSecretBound) tell
+// which secret a payload is encrypted with, by trying to decrypt it with
+// newSecret. The others either decrypt into garbage with any secret, or ignore
+// it altogether, e.g. VaultTransit, so when the secret changes, their payloads
+// are always re-encrypted, and must never go through the same pass twice.
+func (s *Service) ReEncryptIfNeeded(ctx context.Context, payload []byte, oldSecret, newSecret string) ([]byte, bool, error) {
+	done, err := s.isReEncrypted(ctx, payload, oldSecret, newSecret)
+	if err != nil {
+		s.log.Error("Re-encryption failed", logContext(ctx, "error", err)...)
+		return nil, false, err
+	}
+
+	if done {
+		return payload, false, nil
+	}
+
+	reEncrypted, err := s.ReEncrypt(ctx, payload, oldSecret, newSecret)
+	if err != nil {
+		return nil, false, err
+	}
+
+	return reEncrypted, true, nil
+}
+
+func (s *Service) isReEncrypted(ctx context.Context, payload []byte, oldSecret, newSecret string) (bool, error) {
+	if err := ctx.Err(); err != nil {
+		return false, err
+	}
+
+	header, toDecrypt, err := s.decodePayloadHeader(payload)
+	if err != nil {
+		return false, err
+	}
+
+	if header.algorithm != s.CurrentAlgorithm() {
+		return false, nil
+	}
+
+	keys, err := newKeyRegistry(s.securitySettings())
+	if err != nil {
+		return false, err
+	}
+
+	var currentKeyVersion string
+	if keys != nil {
+		currentKeyVersion = keys.current
+	}
+
+	if header.keyVersion != currentKeyVersion {
+		return false, nil
+	}
+
+	if oldSecret == newSecret {
+		return true, nil
+	}
+
+	if !encryption.IsSecretBound(header.algorithm) || newSecret == "" {
+		return false, nil
+	}
+
+	decipher, ok := s.decipher(header.algorithm)
+	if !ok {
+		return false, nil
+	}
+
+	// Failing to decrypt is the expected outcome for the
+	// payloads still to be re-encrypted, so it's not logged.
+	decrypted, err := s.decryptPayload(ctx, decipher, header, toDecrypt, nil, newSecret)
+	encryption.Wipe(decrypted)
+	if ctxErr := ctx.Err(); ctxErr != nil {
+		return false, ctxErr
+	}
+
+	return err == nil, nil
+}
+
+// ReEncryptGuard runs a re-encryption pass, making sure each payload is
+// processed only once, however many times it's submitted, e.g. by several
+// workers reading overlapping batches. It must be used for a single pass, i.e.
+// with the same secrets, and is safe for concurrent use. See ReEncryptIfNeeded
+// for coordinating several replicas.
+type ReEncryptGuard struct {
+	s *Service
+
+	oldSecret string
+	newSecret string
+
+	mtx sync.Mutex
+	// claimed has the payloads being processed or processed already,
+	// as well as their re-encrypted versions, by hash.
+	claimed map[[sha256.Size]byte]struct{}
+}
+
+// NewReEncryptGuard returns a guard re-encrypting the
+// payloads from oldSecret to newSecret.
+func (s *Service) NewReEncryptGuard(oldSecret, newSecret string) *ReEncryptGuard {
+	return &ReEncryptGuard{
+		s:         s,
+		oldSecret: oldSecret,
+		newSecret: newSecret,
+		claimed:   make(map[[sha256.Size]byte]struct{}),
+	}
+}
+
+// ReEncrypt re-encrypts the given payload, as ReEncryptIfNeeded does, and
+// hands the result over to store, e.g. to write it back to the database. It
+// returns whether store was called, which isn't the case for the payloads
+// already re-encrypted, nor for those already submitted to the guard, even
+// concurrently. When re-encrypting or storing fails, the payload is released,
+// so it can be submitted again.
+func (g *ReEncryptGuard) ReEncrypt(ctx context.Context, payload []byte, store func(reEncrypted []byte) error) (bool, error) {
+	id := sha256.Sum256(payload)
+	if !g.claim(id) {
+		return false, nil
+	}
+
+	reEncrypted, changed, err := g.s.ReEncryptIfNeeded(ctx, payload, g.oldSecret, g.newSecret)
+	if err == nil && changed {
+		err = store(reEncrypted)
+	}
+	if err != nil {
+		g.release(id)
+		return false, err
+	}
+
+	if changed {
+		g.claim(sha256.Sum256(reEncrypted))
+	}
+
+	return changed, nil
+}
+
+// claim marks the payload of the given hash as processed,
+// and returns false if it was already.
+func (g *ReEncryptGuard) claim(id [sha256.Size]byte) bool {
+	g.mtx.Lock()
+	defer g.mtx.Unlock()
+
+	if _, ok := g.claimed[id]; ok {
+		return false
+	}
+
+	g.claimed[id] = struct{}{}
+	return true
+}
+
+func (g *ReEncryptGuard) release(id [sha256.Size]byte) {
+	g.mtx.Lock()
+	defer g.mtx.Unlock()
+
+	delete(g.claimed, id)
+}
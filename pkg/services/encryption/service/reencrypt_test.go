@@ -0,0 +1,182 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/grafana/grafana/pkg/services/encryption"
+	"github.com/grafana/grafana/pkg/setting"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_Service_ReEncryptIfNeeded(t *testing.T) {
+	ctx := context.Background()
+
+	svc := SetupTestService(t)
+	section := svc.settingsProvider.(*setting.OSSImpl).Cfg.Raw.Section(securitySection)
+	setAlgorithm(t, svc, encryption.AesGcm)
+
+	t.Run("payloads of other algorithms should be re-encrypted", func(t *testing.T) {
+		legacy, err := svc.EncryptWithAlgorithm(ctx, []byte("grafana"), "1234", encryption.AesCfb)
+		require.NoError(t, err)
+
+		reEncrypted, changed, err := svc.ReEncryptIfNeeded(ctx, legacy, "1234", "1234")
+		require.NoError(t, err)
+		assert.True(t, changed)
+
+		algorithm, _, err := deriveEncryptionAlgorithm(reEncrypted)
+		require.NoError(t, err)
+		assert.Equal(t, encryption.AesGcm, algorithm)
+
+		t.Run("and skipped once upgraded", func(t *testing.T) {
+			skipped, changed, err := svc.ReEncryptIfNeeded(ctx, reEncrypted, "1234", "1234")
+			require.NoError(t, err)
+			assert.False(t, changed)
+			assert.Equal(t, reEncrypted, skipped)
+		})
+	})
+
+	t.Run("payloads of the old secret should be re-encrypted", func(t *testing.T) {
+		encrypted, err := svc.Encrypt(ctx, []byte("grafana"), "old")
+		require.NoError(t, err)
+
+		reEncrypted, changed, err := svc.ReEncryptIfNeeded(ctx, encrypted, "old", "new")
+		require.NoError(t, err)
+		assert.True(t, changed)
+
+		decrypted, err := svc.Decrypt(ctx, reEncrypted, "new")
+		require.NoError(t, err)
+		assert.Equal(t, []byte("grafana"), decrypted)
+
+		t.Run("and skipped once rotated", func(t *testing.T) {
+			skipped, changed, err := svc.ReEncryptIfNeeded(ctx, reEncrypted, "old", "new")
+			require.NoError(t, err)
+			assert.False(t, changed)
+			assert.Equal(t, reEncrypted, skipped)
+		})
+	})
+
+	t.Run("payloads of previous key versions should be re-encrypted", func(t *testing.T) {
+		section.Key(keyVersionsKey).SetValue("v1, v2")
+		section.Key(keyVersionKeyPrefix + "v1").SetValue("key1")
+		section.Key(keyVersionKeyPrefix + "v2").SetValue("key2")
+		section.Key(currentKeyVersionKey).SetValue("v1")
+		t.Cleanup(func() {
+			for _, k := range []string{keyVersionsKey, keyVersionKeyPrefix + "v1", keyVersionKeyPrefix + "v2", currentKeyVersionKey} {
+				section.DeleteKey(k)
+			}
+		})
+
+		encrypted, err := svc.Encrypt(ctx, []byte("grafana"), "1234")
+		require.NoError(t, err)
+
+		_, changed, err := svc.ReEncryptIfNeeded(ctx, encrypted, "1234", "1234")
+		require.NoError(t, err)
+		assert.False(t, changed)
+
+		section.Key(currentKeyVersionKey).SetValue("v2")
+		reEncrypted, changed, err := svc.ReEncryptIfNeeded(ctx, encrypted, "1234", "1234")
+		require.NoError(t, err)
+		assert.True(t, changed)
+
+		header, _, err := decodePayloadHeader(reEncrypted)
+		require.NoError(t, err)
+		assert.Equal(t, "v2", header.keyVersion)
+	})
+
+	t.Run("payloads of algorithms ignoring the secret should always be re-encrypted", func(t *testing.T) {
+		svc := SetupTestService(t)
+		// fakeCipher decrypts with any secret, as VaultTransit does.
+		require.NoError(t, svc.RegisterCipher(encryption.VaultTransit, fakeCipher{}, fakeDecipher{}))
+		setAlgorithm(t, svc, encryption.VaultTransit)
+
+		encrypted, err := svc.Encrypt(ctx, []byte("grafana"), "old")
+		require.NoError(t, err)
+
+		_, err = svc.Decrypt(ctx, encrypted, "new")
+		require.NoError(t, err)
+
+		_, changed, err := svc.ReEncryptIfNeeded(ctx, encrypted, "old", "new")
+		require.NoError(t, err)
+		assert.True(t, changed)
+	})
+
+	t.Run("undecryptable payloads should fail", func(t *testing.T) {
+		encrypted, err := svc.Encrypt(ctx, []byte("grafana"), "other")
+		require.NoError(t, err)
+
+		_, _, err = svc.ReEncryptIfNeeded(ctx, encrypted, "old", "new")
+		require.ErrorIs(t, err, encryption.ErrAuthenticationFailed)
+	})
+}
+
+func Test_ReEncryptGuard(t *testing.T) {
+	ctx := context.Background()
+
+	svc := SetupTestService(t)
+	setAlgorithm(t, svc, encryption.AesGcm)
+
+	encrypted, err := svc.Encrypt(ctx, []byte("grafana"), "old")
+	require.NoError(t, err)
+
+	t.Run("payloads should be stored only once", func(t *testing.T) {
+		guard := svc.NewReEncryptGuard("old", "new")
+
+		var (
+			stored int32
+			wg     sync.WaitGroup
+		)
+		for i := 0; i < 10; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				_, err := guard.ReEncrypt(ctx, encrypted, func([]byte) error {
+					atomic.AddInt32(&stored, 1)
+					return nil
+				})
+				assert.NoError(t, err)
+			}()
+		}
+		wg.Wait()
+
+		assert.EqualValues(t, 1, stored)
+	})
+
+	t.Run("re-encrypted payloads should be skipped", func(t *testing.T) {
+		guard := svc.NewReEncryptGuard("old", "new")
+
+		var reEncrypted []byte
+		changed, err := guard.ReEncrypt(ctx, encrypted, func(p []byte) error {
+			reEncrypted = p
+			return nil
+		})
+		require.NoError(t, err)
+		require.True(t, changed)
+
+		for _, g := range []*ReEncryptGuard{guard, svc.NewReEncryptGuard("old", "new")} {
+			changed, err = g.ReEncrypt(ctx, reEncrypted, func([]byte) error {
+				require.Fail(t, "re-encrypted payload should not be stored")
+				return nil
+			})
+			require.NoError(t, err)
+			assert.False(t, changed)
+		}
+	})
+
+	t.Run("failed payloads should be released", func(t *testing.T) {
+		guard := svc.NewReEncryptGuard("old", "new")
+
+		_, err := guard.ReEncrypt(ctx, encrypted, func([]byte) error {
+			return errors.New("database is locked")
+		})
+		require.Error(t, err)
+
+		changed, err := guard.ReEncrypt(ctx, encrypted, func([]byte) error { return nil })
+		require.NoError(t, err)
+		assert.True(t, changed)
+	})
+}
@@ -0,0 +1,97 @@
+package service
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/grafana/grafana/pkg/services/encryption"
+)
+
+// RewrapDEK moves the given payload, encrypted with an algorithm whose data
+// key is wrapped by the secret (see encryption.Rewrapper), e.g. with
+// encryption.EnvelopeLocal, from oldSecret to newSecret by only rewrapping its
+// data key (DEK), which is much cheaper than re-encrypting it (see ReEncrypt)
+// for large payloads. The header is kept as it is, so the payload keeps its
+// key version and KDF parameters, if any, and its key commitment, if any, is
+// renewed for newSecret. It fails with encryption.ErrAuthenticationFailed if
+// oldSecret is wrong, and for any payload of an algorithm that cannot rewrap.
+func (s *Service) RewrapDEK(ctx context.Context, payload []byte, oldSecret, newSecret string) ([]byte, error) {
+	var (
+		err    error
+		header payloadHeader
+	)
+	defer func() {
+		if err != nil {
+			s.log.Error("Data key rewrap failed", logContext(ctx, "algorithm", header.algorithm, "error", err)...)
+		}
+	}()
+
+	if err = ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	if oldSecret == "" {
+		err = encryption.ErrEmptySecret
+		return nil, err
+	}
+
+	if err = s.checkEncryptionSecret(newSecret); err != nil {
+		return nil, err
+	}
+
+	var toRewrap []byte
+	header, toRewrap, err = s.decodePayloadHeader(payload)
+	if err != nil {
+		return nil, err
+	}
+
+	var rewrapped []byte
+	rewrapped, header, err = s.rewrap(ctx, header, toRewrap, oldSecret, newSecret)
+	if err != nil {
+		return nil, err
+	}
+
+	out := make([]byte, 0, payloadHeaderLen(header)+len(rewrapped))
+	out = appendPayloadHeader(out, header)
+	return append(out, rewrapped...), nil
+}
+
+// rewrap rewraps the data key of the given payload, once its header has been
+// decoded, and returns it along with the header to prefix it with.
+func (s *Service) rewrap(ctx context.Context, header payloadHeader, payload []byte, oldSecret, newSecret string) ([]byte, payloadHeader, error) {
+	decipher, ok := s.decipher(header.algorithm)
+	if !ok {
+		return nil, header, fmt.Errorf("no decipher available for algorithm '%s': %w", header.algorithm, encryption.ErrUnknownAlgorithm)
+	}
+
+	rewrapper, ok := decipher.(encryption.Rewrapper)
+	if !ok {
+		return nil, header, fmt.Errorf("data keys of algorithm '%s' cannot be rewrapped", header.algorithm)
+	}
+
+	oldSecret, err := s.payloadSecret(header, oldSecret)
+	if err != nil {
+		return nil, header, err
+	}
+
+	newSecret, err = s.payloadSecret(header, newSecret)
+	if err != nil {
+		return nil, header, err
+	}
+
+	if err := s.verifyKeyCommitment(header, oldSecret); err != nil {
+		return nil, header, err
+	}
+
+	if header.commitment != nil {
+		if header.commitment, err = newKeyCommitment(s.random, newSecret); err != nil {
+			return nil, header, err
+		}
+	}
+
+	ctx, cancel := s.withOperationTimeout(ctx, decipher)
+	defer cancel()
+
+	rewrapped, err := rewrapper.Rewrap(ctx, payload, oldSecret, newSecret)
+	return rewrapped, header, err
+}
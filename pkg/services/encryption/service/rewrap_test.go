@@ -0,0 +1,106 @@
+package service
+
+import (
+	"context"
+	"testing"
+
+	"github.com/grafana/grafana/pkg/services/encryption"
+	"github.com/grafana/grafana/pkg/setting"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_Service_EnvelopeLocal(t *testing.T) {
+	ctx := context.Background()
+
+	svc := SetupTestService(t)
+	section := svc.settingsProvider.(*setting.OSSImpl).Cfg.Raw.Section(securitySection)
+	setAlgorithm(t, svc, encryption.EnvelopeLocal)
+
+	t.Run("encrypt and decrypt should work", func(t *testing.T) {
+		encrypted, err := svc.Encrypt(ctx, []byte("grafana"), "1234")
+		require.NoError(t, err)
+
+		decrypted, algorithm, err := svc.DecryptWithAlgorithm(ctx, encrypted, "1234")
+		require.NoError(t, err)
+		assert.Equal(t, []byte("grafana"), decrypted)
+		assert.Equal(t, encryption.EnvelopeLocal, algorithm)
+
+		_, err = svc.Decrypt(ctx, encrypted, "4321")
+		require.ErrorIs(t, err, encryption.ErrAuthenticationFailed)
+	})
+
+	t.Run("rewrap should move the payload to the new secret", func(t *testing.T) {
+		encrypted, err := svc.EncryptWithAAD(ctx, []byte("grafana"), []byte("password"), "1234")
+		require.NoError(t, err)
+
+		rewrapped, err := svc.RewrapDEK(ctx, encrypted, "1234", "4321")
+		require.NoError(t, err)
+		require.Len(t, rewrapped, len(encrypted))
+
+		// Only the wrapped data key differs, not the sealed payload.
+		sealedLen := len("grafana") + 12 + 16
+		assert.Equal(t, encrypted[len(encrypted)-sealedLen:], rewrapped[len(rewrapped)-sealedLen:])
+
+		decrypted, err := svc.DecryptWithAAD(ctx, rewrapped, []byte("password"), "4321")
+		require.NoError(t, err)
+		assert.Equal(t, []byte("grafana"), decrypted)
+
+		_, err = svc.DecryptWithAAD(ctx, rewrapped, []byte("password"), "1234")
+		require.ErrorIs(t, err, encryption.ErrAuthenticationFailed)
+	})
+
+	t.Run("rewrap should keep the header", func(t *testing.T) {
+		section.Key(keyCommitmentKey).SetValue("true")
+		section.Key(kdfKey).SetValue(kdfArgon2id)
+		section.Key(kdfArgon2idMemoryKey).SetValue("64")
+		section.Key(keyVersionsKey).SetValue("v1")
+		section.Key(keyVersionKeyPrefix + "v1").SetValue("first key")
+		section.Key(currentKeyVersionKey).SetValue("v1")
+		t.Cleanup(func() {
+			for _, key := range []string{keyCommitmentKey, kdfKey, kdfArgon2idMemoryKey, keyVersionsKey, keyVersionKeyPrefix + "v1", currentKeyVersionKey} {
+				section.DeleteKey(key)
+			}
+		})
+
+		encrypted, err := svc.Encrypt(ctx, []byte("grafana"), "1234")
+		require.NoError(t, err)
+
+		rewrapped, err := svc.RewrapDEK(ctx, encrypted, "1234", "4321")
+		require.NoError(t, err)
+
+		header, _, err := decodePayloadHeader(encrypted)
+		require.NoError(t, err)
+		rewrappedHeader, _, err := decodePayloadHeader(rewrapped)
+		require.NoError(t, err)
+		assert.Equal(t, header.keyVersion, rewrappedHeader.keyVersion)
+		assert.Equal(t, header.kdf, rewrappedHeader.kdf)
+		assert.NotEqual(t, header.commitment, rewrappedHeader.commitment)
+
+		decrypted, err := svc.Decrypt(ctx, rewrapped, "4321")
+		require.NoError(t, err)
+		assert.Equal(t, []byte("grafana"), decrypted)
+
+		_, err = svc.Decrypt(ctx, rewrapped, "1234")
+		require.ErrorIs(t, err, encryption.ErrAuthenticationFailed)
+	})
+
+	t.Run("rewrap with wrong secret should fail", func(t *testing.T) {
+		encrypted, err := svc.Encrypt(ctx, []byte("grafana"), "1234")
+		require.NoError(t, err)
+
+		_, err = svc.RewrapDEK(ctx, encrypted, "4321", "5678")
+		require.ErrorIs(t, err, encryption.ErrAuthenticationFailed)
+
+		_, err = svc.RewrapDEK(ctx, encrypted, "1234", "")
+		require.ErrorIs(t, err, encryption.ErrEmptySecret)
+	})
+
+	t.Run("rewrap of other algorithms should fail", func(t *testing.T) {
+		encrypted, err := svc.EncryptWithAlgorithm(ctx, []byte("grafana"), "1234", encryption.AesGcm)
+		require.NoError(t, err)
+
+		_, err = svc.RewrapDEK(ctx, encrypted, "1234", "4321")
+		require.EqualError(t, err, "data keys of algorithm 'aes-gcm' cannot be rewrapped")
+	})
+}
@@ -0,0 +1,137 @@
+package service
+
+import (
+	"context"
+	"crypto/cipher"
+	"fmt"
+
+	"github.com/grafana/grafana/pkg/services/encryption"
+)
+
+// Seal and Open follow the semantics of crypto/cipher.AEAD, for the code
+// written against it: they operate on the raw AEAD, with the nonce given by
+// the caller, so unlike Encrypt and Decrypt, there's no header (see
+// encodePayloadHeader), salt or nonce stored in front of the ciphertext. The
+// caller is responsible for never reusing a nonce with the same secret, and
+// for storing the nonce and additional data needed to open the ciphertext.
+//
+// The AEAD is given explicitly rather than taken from the configured
+// algorithm, as nothing in the ciphertext records it: changing the configured
+// algorithm must not make the sealed ciphertexts impossible to open. It's one
+// of the raw AEADs, i.e. AES-256-GCM, ChaCha20-Poly1305 or XChaCha20-Poly1305,
+// and must be allowed in FIPS mode if enabled. Its 32-byte key is derived from
+// the secret with encryption.KeyToBytes, with the algorithm name as the salt,
+// as there's nowhere to store a random one, so the ciphertexts are
+// interoperable with any implementation of the AEAD given the same key.
+
+// Seal encrypts and authenticates the given plaintext, authenticates the
+// given additional data, and returns the ciphertext followed by the tag, as
+// cipher.AEAD's Seal does, with the given algorithm. The nonce must be
+// NonceSize bytes long.
+func (s *Service) Seal(ctx context.Context, nonce, plaintext, additionalData []byte, secret, algorithm string) ([]byte, error) {
+	var err error
+	defer func() {
+		if err != nil {
+			s.log.Error("Seal failed", logContext(ctx, "algorithm", algorithm, "error", err)...)
+		}
+	}()
+
+	if err = ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	if err = s.checkEncryptionSecret(secret); err != nil {
+		return nil, err
+	}
+
+	if err = s.checkPayloadSize(operationEncrypt, len(plaintext)); err != nil {
+		return nil, err
+	}
+
+	var aead cipher.AEAD
+	aead, err = s.newSealAEAD(algorithm, nonce, secret)
+	if err != nil {
+		return nil, err
+	}
+
+	return aead.Seal(nil, nonce, plaintext, additionalData), nil
+}
+
+// Open authenticates the given ciphertext and additional data and, if they're
+// authentic, decrypts the ciphertext, as cipher.AEAD's Open does, with the
+// algorithm it was sealed with. It fails with encryption.ErrAuthenticationFailed
+// otherwise, e.g. if the secret is wrong.
+func (s *Service) Open(ctx context.Context, nonce, ciphertext, additionalData []byte, secret, algorithm string) ([]byte, error) {
+	var err error
+	defer func() {
+		if err != nil {
+			s.log.Error("Open failed", logContext(ctx, "algorithm", algorithm, "error", err)...)
+		}
+	}()
+
+	if err = ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	if secret == "" {
+		err = encryption.ErrEmptySecret
+		return nil, err
+	}
+
+	var aead cipher.AEAD
+	aead, err = s.newSealAEAD(algorithm, nonce, secret)
+	if err != nil {
+		return nil, err
+	}
+
+	var decrypted []byte
+	if decrypted, err = aead.Open(nil, nonce, ciphertext, additionalData); err != nil {
+		err = encryption.ErrAuthenticationFailed
+		return nil, err
+	}
+
+	return decrypted, nil
+}
+
+// NonceSize returns the size of the nonces Seal and Open must be given for
+// the given algorithm, or 0 if it cannot be used to seal.
+func (s *Service) NonceSize(algorithm string) int {
+	aead, ok := portableAEADs[algorithm]
+	if !ok {
+		return 0
+	}
+
+	nonceSize, _ := portableNonceSize(aead)
+	return nonceSize
+}
+
+// newSealAEAD returns the AEAD of the given algorithm keyed for the given
+// secret, once the algorithm has been checked to be one of the raw AEADs, and
+// the given nonce to be of the right size, as cipher.AEAD would panic otherwise.
+func (s *Service) newSealAEAD(algorithm string, nonce []byte, secret string) (cipher.AEAD, error) {
+	aeadID, ok := portableAEADs[algorithm]
+	if !ok {
+		return nil, fmt.Errorf("encryption algorithm '%s' cannot be used to seal: %w", algorithm, encryption.ErrUnknownAlgorithm)
+	}
+
+	if s.fipsMode && !fipsApprovedAlgorithms[algorithm] {
+		return nil, fmt.Errorf("encryption algorithm '%s' is not FIPS approved", algorithm)
+	}
+
+	key, err := encryption.KeyToBytes(secret, algorithm)
+	if err != nil {
+		return nil, err
+	}
+	defer encryption.Wipe(key)
+
+	aead, err := newPortableAEAD(aeadID, key)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(nonce) != aead.NonceSize() {
+		return nil, fmt.Errorf("nonce must be %d bytes long for algorithm '%s', got %d", aead.NonceSize(), algorithm, len(nonce))
+	}
+
+	return aead, nil
+}
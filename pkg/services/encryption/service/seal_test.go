@@ -0,0 +1,139 @@
+package service
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"testing"
+
+	"github.com/grafana/grafana/pkg/services/encryption"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+func Test_Service_SealOpen(t *testing.T) {
+	ctx := context.Background()
+
+	svc := SetupTestService(t)
+
+	// newAEAD builds the AEAD of the given algorithm the way
+	// any other implementation would, given the documented key.
+	newAEAD := func(t *testing.T, algorithm, secret string) cipher.AEAD {
+		t.Helper()
+
+		key, err := encryption.KeyToBytes(secret, algorithm)
+		require.NoError(t, err)
+
+		var aead cipher.AEAD
+		switch algorithm {
+		case encryption.AesGcm:
+			block, err := aes.NewCipher(key)
+			require.NoError(t, err)
+			aead, err = cipher.NewGCM(block)
+			require.NoError(t, err)
+		case encryption.ChaCha20Poly1305:
+			aead, err = chacha20poly1305.New(key)
+			require.NoError(t, err)
+		case encryption.XChaCha20Poly1305:
+			aead, err = chacha20poly1305.NewX(key)
+			require.NoError(t, err)
+		}
+		return aead
+	}
+
+	for _, algorithm := range []string{encryption.AesGcm, encryption.ChaCha20Poly1305, encryption.XChaCha20Poly1305} {
+		t.Run(algorithm+" should interoperate with the raw AEAD", func(t *testing.T) {
+			aead := newAEAD(t, algorithm, "1234")
+			require.Equal(t, aead.NonceSize(), svc.NonceSize(algorithm))
+			nonce := bytes.Repeat([]byte{0x2a}, svc.NonceSize(algorithm))
+
+			sealed, err := svc.Seal(ctx, nonce, []byte("grafana"), []byte("datasource 1"), "1234", algorithm)
+			require.NoError(t, err)
+			assert.Equal(t, aead.Seal(nil, nonce, []byte("grafana"), []byte("datasource 1")), sealed)
+
+			opened, err := aead.Open(nil, nonce, sealed, []byte("datasource 1"))
+			require.NoError(t, err)
+			assert.Equal(t, []byte("grafana"), opened)
+
+			opened, err = svc.Open(ctx, nonce, aead.Seal(nil, nonce, []byte("raw"), nil), nil, "1234", algorithm)
+			require.NoError(t, err)
+			assert.Equal(t, []byte("raw"), opened)
+		})
+	}
+
+	t.Run("changing the configured algorithm should not break opening", func(t *testing.T) {
+		setAlgorithm(t, svc, encryption.AesGcm)
+
+		nonce := make([]byte, svc.NonceSize(encryption.ChaCha20Poly1305))
+		sealed, err := svc.Seal(ctx, nonce, []byte("grafana"), nil, "1234", encryption.ChaCha20Poly1305)
+		require.NoError(t, err)
+
+		setAlgorithm(t, svc, encryption.XChaCha20Poly1305)
+
+		opened, err := svc.Open(ctx, nonce, sealed, nil, "1234", encryption.ChaCha20Poly1305)
+		require.NoError(t, err)
+		assert.Equal(t, []byte("grafana"), opened)
+	})
+
+	t.Run("non-raw algorithms should be rejected", func(t *testing.T) {
+		assert.Zero(t, svc.NonceSize(encryption.AesCbcHmac))
+
+		nonce := make([]byte, svc.NonceSize(encryption.AesGcm))
+		_, err := svc.Seal(ctx, nonce, []byte("grafana"), nil, "1234", encryption.AesCbcHmac)
+		require.ErrorIs(t, err, encryption.ErrUnknownAlgorithm)
+
+		_, err = svc.Open(ctx, nonce, []byte("grafana"), nil, "1234", encryption.AesCbcHmac)
+		require.ErrorIs(t, err, encryption.ErrUnknownAlgorithm)
+	})
+
+	t.Run("non-approved algorithms should be rejected in FIPS mode", func(t *testing.T) {
+		svc := SetupTestService(t)
+		svc.fipsMode = true
+
+		nonce := make([]byte, svc.NonceSize(encryption.ChaCha20Poly1305))
+		_, err := svc.Seal(ctx, nonce, []byte("grafana"), nil, "1234", encryption.ChaCha20Poly1305)
+		require.EqualError(t, err, "encryption algorithm 'chacha20poly1305' is not FIPS approved")
+
+		_, err = svc.Seal(ctx, nonce, []byte("grafana"), nil, "1234", encryption.AesGcm)
+		require.NoError(t, err)
+	})
+
+	t.Run("tampered ciphertexts should fail", func(t *testing.T) {
+		nonce := make([]byte, svc.NonceSize(encryption.AesGcm))
+		sealed, err := svc.Seal(ctx, nonce, []byte("grafana"), []byte("datasource 1"), "1234", encryption.AesGcm)
+		require.NoError(t, err)
+
+		_, err = svc.Open(ctx, nonce, sealed, []byte("datasource 2"), "1234", encryption.AesGcm)
+		require.ErrorIs(t, err, encryption.ErrAuthenticationFailed)
+
+		_, err = svc.Open(ctx, nonce, sealed, []byte("datasource 1"), "4321", encryption.AesGcm)
+		require.ErrorIs(t, err, encryption.ErrAuthenticationFailed)
+
+		otherNonce := append([]byte{0x01}, nonce[1:]...)
+		_, err = svc.Open(ctx, otherNonce, sealed, []byte("datasource 1"), "1234", encryption.AesGcm)
+		require.ErrorIs(t, err, encryption.ErrAuthenticationFailed)
+
+		_, err = svc.Open(ctx, nonce, sealed, []byte("datasource 1"), "1234", encryption.ChaCha20Poly1305)
+		require.ErrorIs(t, err, encryption.ErrAuthenticationFailed)
+	})
+
+	t.Run("nonces of the wrong size should be rejected", func(t *testing.T) {
+		_, err := svc.Seal(ctx, make([]byte, 8), []byte("grafana"), nil, "1234", encryption.AesGcm)
+		require.EqualError(t, err, "nonce must be 12 bytes long for algorithm 'aes-gcm', got 8")
+
+		_, err = svc.Open(ctx, nil, []byte("grafana"), nil, "1234", encryption.AesGcm)
+		require.EqualError(t, err, "nonce must be 12 bytes long for algorithm 'aes-gcm', got 0")
+	})
+
+	t.Run("empty secret should be rejected", func(t *testing.T) {
+		nonce := make([]byte, svc.NonceSize(encryption.AesGcm))
+
+		_, err := svc.Seal(ctx, nonce, []byte("grafana"), nil, "", encryption.AesGcm)
+		require.ErrorIs(t, err, encryption.ErrEmptySecret)
+
+		_, err = svc.Open(ctx, nonce, []byte("grafana"), nil, "", encryption.AesGcm)
+		require.ErrorIs(t, err, encryption.ErrEmptySecret)
+	})
+}
@@ -0,0 +1,97 @@
+package service
+
+import (
+	"bytes"
+	"context"
+	_ "embed"
+	"encoding/json"
+	"errors"
+	"fmt"
+)
+
+// skipSelfTestKey skips the self-test run on startup (see selfTest), e.g.
+// to speed up development setups. It must not be enabled in production.
+const skipSelfTestKey = "skip_self_test"
+
+// selfTestVectors are the known-answer test vectors of the built-in
+// algorithms, i.e. the ciphertext produced by their cipher for the
+// given plaintext and secret, header excluded.
+//
+//go:embed selftest_vectors.json
+var selfTestVectors []byte
+
+type selfTestVector struct {
+	Algorithm  string `json:"algorithm"`
+	Secret     string `json:"secret"`
+	Plaintext  string `json:"plaintext"`
+	Ciphertext []byte `json:"ciphertext"`
+
+	// Deterministic algorithms must encrypt the plaintext into the
+	// ciphertext, while the others can only be checked for round-trip.
+	Deterministic bool `json:"deterministic"`
+}
+
+// selfTest runs the known-answer tests of the registered algorithms: their
+// decipher must decrypt the vector ciphertext into the vector plaintext, and
+// their cipher must produce the vector ciphertext when deterministic, or a
+// ciphertext their decipher decrypts back into the plaintext otherwise. This
+// catches broken builds and tampered binaries before anything is encrypted.
+//
+// Algorithms without vectors, i.e. the ones backed by external key management
+// services and the ones registered by plugins, aren't tested, since that would
+// require calling the external services on startup.
+func (s *Service) selfTest(ctx context.Context) error {
+	var vectors []selfTestVector
+	if err := json.Unmarshal(selfTestVectors, &vectors); err != nil {
+		return fmt.Errorf("failed to load encryption self-test vectors: %w", err)
+	}
+
+	for _, v := range vectors {
+		if err := s.runSelfTest(ctx, v); err != nil {
+			return fmt.Errorf("encryption self-test failed for algorithm '%s': %w", v.Algorithm, err)
+		}
+	}
+
+	return nil
+}
+
+func (s *Service) runSelfTest(ctx context.Context, v selfTestVector) error {
+	s.mtx.RLock()
+	cipher, hasCipher := s.ciphers[v.Algorithm]
+	decipher, hasDecipher := s.deciphers[v.Algorithm]
+	s.mtx.RUnlock()
+
+	if !hasCipher || !hasDecipher {
+		return nil
+	}
+
+	decrypted, err := decipher.Decrypt(ctx, v.Ciphertext, v.Secret)
+	if err != nil {
+		return fmt.Errorf("failed to decrypt known answer: %w", err)
+	}
+	if string(decrypted) != v.Plaintext {
+		return errors.New("decrypted known answer doesn't match")
+	}
+
+	encrypted, err := cipher.Encrypt(ctx, []byte(v.Plaintext), v.Secret)
+	if err != nil {
+		return fmt.Errorf("failed to encrypt known answer: %w", err)
+	}
+
+	if v.Deterministic {
+		if !bytes.Equal(encrypted, v.Ciphertext) {
+			return errors.New("encrypted known answer doesn't match")
+		}
+		return nil
+	}
+
+	decrypted, err = decipher.Decrypt(ctx, encrypted, v.Secret)
+	if err != nil {
+		return fmt.Errorf("failed to decrypt round-trip: %w", err)
+	}
+	if string(decrypted) != v.Plaintext {
+		return errors.New("decrypted round-trip doesn't match")
+	}
+
+	return nil
+}
@@ -0,0 +1,101 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+
+	"github.com/grafana/grafana/pkg/infra/usagestats"
+	"github.com/grafana/grafana/pkg/services/encryption"
+	"github.com/grafana/grafana/pkg/services/encryption/provider"
+	"github.com/grafana/grafana/pkg/setting"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_Service_SelfTest(t *testing.T) {
+	newService := func(t *testing.T, encProvider encryption.Provider, skip bool) (*Service, error) {
+		t.Helper()
+
+		settings := &setting.OSSImpl{Cfg: setting.NewCfg()}
+		if skip {
+			settings.Cfg.Raw.Section(securitySection).Key(skipSelfTestKey).SetValue("true")
+		}
+
+		return ProvideEncryptionService(encProvider, &usagestats.UsageStatsMock{T: t}, settings)
+	}
+
+	builtIn := provider.Provider{}
+
+	t.Run("built-in algorithms should pass", func(t *testing.T) {
+		svc, err := newService(t, builtIn, false)
+		require.NoError(t, err)
+		require.NoError(t, svc.selfTest(context.Background()))
+	})
+
+	t.Run("every built-in algorithm should have vectors", func(t *testing.T) {
+		var vectors []selfTestVector
+		require.NoError(t, json.Unmarshal(selfTestVectors, &vectors))
+
+		tested := make(map[string]bool)
+		for _, v := range vectors {
+			tested[v.Algorithm] = true
+		}
+
+		for algorithm := range builtIn.ProvideCiphers() {
+			assert.True(t, tested[algorithm], algorithm)
+		}
+	})
+
+	t.Run("broken decipher should fail the construction", func(t *testing.T) {
+		svc, err := newService(t, tamperedProvider{Provider: builtIn, algorithm: encryption.AesGcm}, false)
+		assert.Nil(t, svc)
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "self-test failed for algorithm 'aes-gcm'")
+	})
+
+	t.Run("broken deterministic cipher should fail the construction", func(t *testing.T) {
+		svc, err := newService(t, randomizedSivProvider{Provider: builtIn}, false)
+		assert.Nil(t, svc)
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "encrypted known answer doesn't match")
+	})
+
+	t.Run("skipped self-test should not fail the construction", func(t *testing.T) {
+		svc, err := newService(t, tamperedProvider{Provider: builtIn, algorithm: encryption.AesGcm}, true)
+		require.NoError(t, err)
+		assert.NotNil(t, svc)
+	})
+}
+
+// tamperedProvider replaces the cipher and decipher of the
+// given algorithm by fakes, which are consistent with each
+// other, so only the known-answer tests can catch them.
+type tamperedProvider struct {
+	encryption.Provider
+	algorithm string
+}
+
+func (p tamperedProvider) ProvideCiphers() map[string]encryption.Cipher {
+	ciphers := p.Provider.ProvideCiphers()
+	ciphers[p.algorithm] = fakeCipher{}
+	return ciphers
+}
+
+func (p tamperedProvider) ProvideDeciphers() map[string]encryption.Decipher {
+	deciphers := p.Provider.ProvideDeciphers()
+	deciphers[p.algorithm] = fakeDecipher{}
+	return deciphers
+}
+
+// randomizedSivProvider replaces the aes-siv cipher by the
+// aes-gcm one, which is randomized, keeping the aes-siv decipher.
+type randomizedSivProvider struct {
+	encryption.Provider
+}
+
+func (p randomizedSivProvider) ProvideCiphers() map[string]encryption.Cipher {
+	ciphers := p.Provider.ProvideCiphers()
+	ciphers[encryption.AesSiv] = ciphers[encryption.AesGcm]
+	return ciphers
+}
@@ -3,24 +3,89 @@ package service
 import (
 	"bytes"
 	"context"
+	"crypto/rand"
 	"encoding/base64"
 	"errors"
 	"fmt"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/grafana/grafana/pkg/infra/log"
+	"github.com/grafana/grafana/pkg/infra/tracing"
 	"github.com/grafana/grafana/pkg/infra/usagestats"
 	"github.com/grafana/grafana/pkg/services/encryption"
 	"github.com/grafana/grafana/pkg/setting"
+	"github.com/grafana/grafana/pkg/util"
+	"golang.org/x/sync/errgroup"
 )
 
 const (
-	encryptionAlgorithmDelimiter = '*'
-
 	securitySection            = "security.encryption"
 	encryptionAlgorithmKey     = "algorithm"
 	defaultEncryptionAlgorithm = encryption.AesCfb
+
+	// compressPayloadsKey enables the compression
+	// of the payloads before encrypting them.
+	compressPayloadsKey = "compress_payloads"
+
+	// jsonDataWorkersKey sets the max amount of values
+	// encrypted concurrently by EncryptJsonData.
+	jsonDataWorkersKey = "json_data_workers"
+
+	// disallowDowngradeKey rejects configuration changes from an
+	// authenticated algorithm to an unauthenticated one.
+	disallowDowngradeKey = "disallow_downgrade"
+
+	// allowLegacyUnprefixedKey enables the decryption of payloads
+	// without algorithm prefix, assumed to be legacy AesCfb ones.
+	allowLegacyUnprefixedKey = "allow_legacy_unprefixed"
+
+	// fipsModeKey restricts the algorithms available to the FIPS approved
+	// ones. It's only read on startup, so changing it requires a restart.
+	fipsModeKey = "fips_mode"
+
+	// minSecretLengthKey sets the minimum length of the secrets payloads
+	// are encrypted with. It's not enforced on decryption, so payloads
+	// encrypted before raising it can still be decrypted.
+	minSecretLengthKey = "min_secret_length"
+
+	// maxPayloadBytesKey sets the maximum size of the payloads, or streams,
+	// that can be encrypted, so a faulty integration cannot exhaust the memory
+	// by encrypting huge values. It's unlimited (zero) by default.
+	maxPayloadBytesKey = "max_payload_bytes"
+
+	// verifyOnEncryptKey makes every encryption decrypt its own output and
+	// compare it with the plaintext before returning it, so a faulty cipher
+	// (or hardware) is caught before anything is stored. It doubles the cost
+	// of the encryptions, so it's disabled by default.
+	verifyOnEncryptKey = "verify_on_encrypt"
 )
 
+// errLegacyUnprefixed is returned when decrypting a payload without
+// algorithm prefix while allowLegacyUnprefixedKey is disabled.
+var errLegacyUnprefixed = errors.New("payload has no algorithm prefix and legacy unprefixed payloads are not allowed")
+
+// fipsApprovedAlgorithms are the algorithms built on FIPS 140-2
+// approved primitives, the only ones available in FIPS mode.
+var fipsApprovedAlgorithms = map[string]bool{
+	encryption.AesGcm:     true,
+	encryption.AesCbcHmac: true,
+}
+
+// validKeySizes are the encryption key sizes, in bytes, the ciphers can
+// report (see encryption.KeySizer), i.e. those of AES-128, AES-192 and
+// AES-256, the latter also being the one of ChaCha20-Poly1305.
+var validKeySizes = map[int]bool{
+	16: true,
+	24: true,
+	32: true,
+}
+
+var _ encryption.Internal = (*Service)(nil)
+
 // Service must not be used for encryption.
 // Use secrets.Service implementing envelope encryption instead.
 type Service struct {
@@ -29,41 +94,275 @@ type Service struct {
 	settingsProvider setting.Provider
 	usageMetrics     usagestats.Service
 
+	// mtx guards the ciphers and deciphers, which can be registered at
+	// runtime, as well as the applied algorithm, which changes on reload.
+	// Lookups take the read lock, so they don't contend with each other.
+	mtx       sync.RWMutex
 	ciphers   map[string]encryption.Cipher
 	deciphers map[string]encryption.Decipher
+
+	// fallbackDeciphers are tried when the deciphers fail,
+	// see SetFallbackDeciphers. Guarded by mtx too.
+	fallbackDeciphers map[string]encryption.Decipher
+
+	// keyProvider resolves the secrets of the managed
+	// operations, see SetKeyProvider. Guarded by mtx too.
+	keyProvider encryption.KeyProvider
+
+	decryptionsCounter *usageCounter
+
+	// decryptionFailuresCounter counts the failures by
+	// algorithm and reason, see countDecryptionFailure.
+	decryptionFailuresCounter *usageCounter
+
+	// legacyFallbacksCounter counts the payloads taken for legacy
+	// AesCfb ones, or that would be, see countLegacyFallback.
+	legacyFallbacksCounter *usageCounter
+
+	// metrics are nil, and so disabled, unless registered.
+	metrics *metrics
+
+	// keyCache is nil, and so disabled, unless configured.
+	keyCache *keyCache
+
+	// decryptCache is nil, and so disabled, unless configured.
+	decryptCache *decryptCache
+
+	// registration is what's registered for settings reloads
+	// and usage stats on behalf of the service, see Close.
+	registration *registration
+
+	// appliedAlgorithm is the algorithm configured
+	// as of the initialization or the last reload.
+	appliedAlgorithm string
+
+	// aliases are the alternative names of the algorithms, by
+	// lowercase name, see RegisterAlias. Guarded by mtx too.
+	aliases map[string]string
+
+	// profiles are the profiles by name, as of the
+	// initialization or the last reload, see EncryptProfile.
+	profiles map[string]encryptionProfile
+
+	// fipsMode restricts the ciphers and deciphers
+	// to the fipsApprovedAlgorithms.
+	fipsMode bool
+
+	// random is the source the service draws its own randomness from,
+	// e.g. the KDF and key commitment salts, and passes to the ciphers,
+	// see ProvideEncryptionServiceWithRandSource.
+	random encryption.RandSource
 }
 
 func ProvideEncryptionService(
 	provider encryption.Provider,
 	usageMetrics usagestats.Service,
 	settingsProvider setting.Provider,
+) (*Service, error) {
+	return ProvideEncryptionServiceWithLogger(provider, usageMetrics, settingsProvider, log.New("encryption"))
+}
+
+// ProvideEncryptionServiceWithLogger works like ProvideEncryptionService,
+// but the service logs through the given logger, including while it's being
+// initialized, e.g. to route the logs of an embedded service with extra fields.
+func ProvideEncryptionServiceWithLogger(
+	provider encryption.Provider,
+	usageMetrics usagestats.Service,
+	settingsProvider setting.Provider,
+	logger log.Logger,
+) (*Service, error) {
+	return provideEncryptionService(provider, usageMetrics, settingsProvider, logger, rand.Reader)
+}
+
+// ProvideEncryptionServiceWithRandSource works like ProvideEncryptionService,
+// but all the randomness drawn to encrypt comes from the given source rather
+// than crypto/rand.Reader, e.g. an HSM-backed or audited one. The provider must
+// be an encryption.RandomizedProvider, so its ciphers draw from the source too.
+func ProvideEncryptionServiceWithRandSource(
+	provider encryption.Provider,
+	usageMetrics usagestats.Service,
+	settingsProvider setting.Provider,
+	random encryption.RandSource,
+) (*Service, error) {
+	if random == nil {
+		return nil, errors.New("random source cannot be nil")
+	}
+
+	randomized, ok := provider.(encryption.RandomizedProvider)
+	if !ok {
+		return nil, errors.New("encryption provider doesn't support random sources")
+	}
+
+	return provideEncryptionService(randomized.WithRandSource(random), usageMetrics, settingsProvider, log.New("encryption"), random)
+}
+
+func provideEncryptionService(
+	provider encryption.Provider,
+	usageMetrics usagestats.Service,
+	settingsProvider setting.Provider,
+	logger log.Logger,
+	random encryption.RandSource,
 ) (*Service, error) {
 	s := &Service{
-		log: log.New("encryption"),
+		log:    logger,
+		random: random,
 
 		ciphers:   provider.ProvideCiphers(),
 		deciphers: provider.ProvideDeciphers(),
 
 		usageMetrics:     usageMetrics,
 		settingsProvider: settingsProvider,
+
+		decryptionsCounter:        newUsageCounter(),
+		decryptionFailuresCounter: newUsageCounter(),
+		legacyFallbacksCounter:    newUsageCounter(),
+	}
+
+	if err := checkProvidedCiphers(s.ciphers, s.deciphers); err != nil {
+		s.log.Error("Inconsistent encryption provider", "error", err)
+		return nil, err
+	}
+
+	if s.fipsMode = s.securitySettings().KeyValue(fipsModeKey).MustBool(false); s.fipsMode {
+		for algorithm := range s.ciphers {
+			if !fipsApprovedAlgorithms[algorithm] {
+				delete(s.ciphers, algorithm)
+				delete(s.deciphers, algorithm)
+			}
+		}
+	}
+
+	if err := s.configureCiphers(); err != nil {
+		s.log.Error("Failed to configure encryption ciphers", "error", err)
+		return nil, err
+	}
+
+	if !s.securitySettings().KeyValue(skipSelfTestKey).MustBool(false) {
+		if err := s.selfTest(context.Background()); err != nil {
+			s.log.Error("Encryption self-test failed", "error", err)
+			return nil, err
+		}
 	}
 
-	algorithm := s.settingsProvider.
-		KeyValue(securitySection, encryptionAlgorithmKey).
-		MustString(defaultEncryptionAlgorithm)
+	algorithm := s.configuredAlgorithm(s.securitySettings())
 
 	if err := s.checkEncryptionAlgorithm(algorithm); err != nil {
 		return nil, err
 	}
 
-	settingsProvider.RegisterReloadHandler(securitySection, s)
+	// Applied right away, as the warmup encrypts with it.
+	s.appliedAlgorithm = algorithm
+
+	profiles, err := s.loadProfiles()
+	if err != nil {
+		s.log.Error("Wrong security encryption profiles configuration", "error", err)
+		return nil, err
+	}
+
+	if _, err := newKDFParams(s.securitySettings(), s.random); err != nil {
+		return nil, err
+	}
+
+	if _, err := newKeyRegistry(s.securitySettings()); err != nil {
+		return nil, err
+	}
+
+	if s.securitySettings().KeyValue(warmupKey).MustBool(false) {
+		if err := s.Warmup(context.Background()); err != nil {
+			s.log.Error("Encryption warmup failed", "error", err)
+			return nil, err
+		}
+	}
+
+	s.keyCache, err = newKeyCache(s.securitySettings().KeyValue(kdfCacheSizeKey).MustInt(0), s.random)
+	if err != nil {
+		return nil, err
+	}
+
+	s.decryptCache, err = newDecryptCache(
+		s.securitySettings().KeyValue(decryptCacheSizeKey).MustInt(0),
+		s.securitySettings().KeyValue(decryptCacheTTLKey).MustDuration(defaultDecryptCacheTTL),
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	s.profiles = profiles
+
+	s.registration = &registration{s: s}
+
+	settingsProvider.RegisterReloadHandler(securitySection, s.registration)
 
 	s.registerUsageMetrics()
 
 	return s, nil
 }
 
+// checkProvidedCiphers checks that every provided cipher has a matching
+// decipher and the other way around, so a faulty provider is caught on
+// startup rather than when decrypting.
+func checkProvidedCiphers(ciphers map[string]encryption.Cipher, deciphers map[string]encryption.Decipher) error {
+	var mismatches []string
+
+	for algorithm := range ciphers {
+		if _, ok := deciphers[algorithm]; !ok {
+			mismatches = append(mismatches, fmt.Sprintf("no decipher for '%s'", algorithm))
+		}
+	}
+
+	for algorithm := range deciphers {
+		if _, ok := ciphers[algorithm]; !ok {
+			mismatches = append(mismatches, fmt.Sprintf("no cipher for '%s'", algorithm))
+		}
+	}
+
+	if len(mismatches) == 0 {
+		return nil
+	}
+
+	sort.Strings(mismatches)
+	return fmt.Errorf("encryption provider ciphers and deciphers don't match: %s", strings.Join(mismatches, ", "))
+}
+
+// configureCiphers configures the ciphers and deciphers that
+// are encryption.Configurable with their own settings section.
+func (s *Service) configureCiphers() error {
+	s.mtx.RLock()
+	defer s.mtx.RUnlock()
+
+	for algorithm, c := range s.ciphers {
+		if err := s.configure(algorithm, c); err != nil {
+			return err
+		}
+	}
+
+	for algorithm, d := range s.deciphers {
+		if err := s.configure(algorithm, d); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// configure configures the given cipher or decipher of the given
+// algorithm, if it's encryption.Configurable, and is a no-op otherwise.
+func (s *Service) configure(algorithm string, c interface{}) error {
+	configurable, ok := c.(encryption.Configurable)
+	if !ok {
+		return nil
+	}
+
+	if err := configurable.Configure(s.settingsProvider.Section(securitySection + "." + algorithm)); err != nil {
+		return fmt.Errorf("failed to configure encryption algorithm '%s': %w", algorithm, err)
+	}
+
+	return nil
+}
+
 func (s *Service) checkEncryptionAlgorithm(algorithm string) error {
+	algorithm = s.resolveAlgorithm(algorithm)
+
 	var err error
 	defer func() {
 		if err != nil {
@@ -71,173 +370,1319 @@ func (s *Service) checkEncryptionAlgorithm(algorithm string) error {
 		}
 	}()
 
-	if _, ok := s.ciphers[algorithm]; !ok {
-		err = errors.New("no cipher registered for encryption algorithm configured")
+	if s.fipsMode && !fipsApprovedAlgorithms[algorithm] {
+		err = errors.New("encryption algorithm configured is not FIPS approved")
+		return err
+	}
+
+	cipher, ok := s.cipher(algorithm)
+	if !ok {
+		err = fmt.Errorf("no cipher registered for encryption algorithm configured '%s'", algorithm)
+		return err
+	}
+
+	if sizer, ok := cipher.(encryption.KeySizer); ok && !validKeySizes[sizer.KeySize()] {
+		err = fmt.Errorf("cipher registered for encryption algorithm configured requires an unsupported key size of %d bytes", sizer.KeySize())
 		return err
 	}
 
-	if _, ok := s.deciphers[algorithm]; !ok {
-		err = errors.New("no cipher registered for encryption algorithm configured")
+	if _, ok := s.decipher(algorithm); !ok {
+		err = fmt.Errorf("no decipher registered for encryption algorithm configured '%s'", algorithm)
 		return err
 	}
 
 	return nil
 }
 
-func (s *Service) registerUsageMetrics() {
-	s.usageMetrics.RegisterMetricsFunc(func(context.Context) (map[string]interface{}, error) {
-		algorithm := s.settingsProvider.
-			KeyValue(securitySection, encryptionAlgorithmKey).
-			MustString(defaultEncryptionAlgorithm)
-
-		return map[string]interface{}{
-			fmt.Sprintf("stats.encryption.%s.count", algorithm): 1,
-		}, nil
-	})
+// CurrentAlgorithm returns the encryption algorithm used by Encrypt, as
+// applied on initialization or by the last successful reload, under its
+// canonical name when configured under an alias (see RegisterAlias). An
+// algorithm rejected on reload is thus never used, even though configured.
+func (s *Service) CurrentAlgorithm() string {
+	s.mtx.RLock()
+	defer s.mtx.RUnlock()
+
+	return s.appliedAlgorithm
 }
 
-func (s *Service) Decrypt(ctx context.Context, payload []byte, secret string) ([]byte, error) {
-	var err error
-	defer func() {
-		if err != nil {
-			s.log.Error("Decryption failed", "error", err)
+// configuredAlgorithm returns the encryption algorithm configured in the
+// given section, or the default one, under its canonical name.
+func (s *Service) configuredAlgorithm(section setting.Section) string {
+	return s.resolveAlgorithm(section.KeyValue(encryptionAlgorithmKey).
+		MustString(defaultEncryptionAlgorithm))
+}
+
+// SupportedAlgorithms returns the sorted names of the algorithms that can be
+// used both for encryption and decryption, including the ones registered at
+// runtime with RegisterCipher.
+func (s *Service) SupportedAlgorithms() []string {
+	s.mtx.RLock()
+	defer s.mtx.RUnlock()
+
+	algorithms := make([]string, 0, len(s.ciphers))
+	for algorithm := range s.ciphers {
+		if _, ok := s.deciphers[algorithm]; ok {
+			algorithms = append(algorithms, algorithm)
 		}
-	}()
+	}
+	sort.Strings(algorithms)
 
-	var (
-		algorithm string
-		toDecrypt []byte
-	)
-	algorithm, toDecrypt, err = deriveEncryptionAlgorithm(payload)
-	if err != nil {
-		return nil, err
+	return algorithms
+}
+
+// RegisterCipher registers the given cipher and decipher for the given
+// algorithm, making it available for encryption and decryption and
+// selectable through settings from then on. Algorithms already
+// registered cannot be overridden.
+func (s *Service) RegisterCipher(algorithm string, c encryption.Cipher, d encryption.Decipher) error {
+	if algorithm == "" {
+		return errors.New("encryption algorithm name cannot be empty")
 	}
 
-	decipher, ok := s.deciphers[algorithm]
-	if !ok {
-		err = fmt.Errorf("no decipher available for algorithm '%s'", algorithm)
-		return nil, err
+	if c == nil || d == nil {
+		return fmt.Errorf("both cipher and decipher are required for encryption algorithm '%s'", algorithm)
 	}
 
-	var decrypted []byte
-	decrypted, err = decipher.Decrypt(ctx, toDecrypt, secret)
+	if s.fipsMode && !fipsApprovedAlgorithms[algorithm] {
+		return fmt.Errorf("encryption algorithm '%s' is not FIPS approved", algorithm)
+	}
 
-	return decrypted, err
+	if err := s.configure(algorithm, c); err != nil {
+		return err
+	}
+
+	if err := s.configure(algorithm, d); err != nil {
+		return err
+	}
+
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	_, hasCipher := s.ciphers[algorithm]
+	_, hasDecipher := s.deciphers[algorithm]
+	if hasCipher || hasDecipher {
+		return fmt.Errorf("encryption algorithm '%s' already registered", algorithm)
+	}
+
+	// Names only differing by case would make the
+	// case-insensitive resolution ambiguous, see resolveAlgorithm.
+	for registered := range s.ciphers {
+		if strings.EqualFold(registered, algorithm) {
+			return fmt.Errorf("encryption algorithm '%s' conflicts with the registered '%s'", algorithm, registered)
+		}
+	}
+
+	if s.ciphers == nil {
+		s.ciphers = make(map[string]encryption.Cipher)
+	}
+
+	if s.deciphers == nil {
+		s.deciphers = make(map[string]encryption.Decipher)
+	}
+
+	s.ciphers[algorithm] = c
+	s.deciphers[algorithm] = d
+
+	return nil
+}
+
+func (s *Service) cipher(algorithm string) (encryption.Cipher, bool) {
+	s.mtx.RLock()
+	defer s.mtx.RUnlock()
+
+	c, ok := s.ciphers[algorithm]
+	return c, ok
+}
+
+func (s *Service) decipher(algorithm string) (encryption.Decipher, bool) {
+	s.mtx.RLock()
+	defer s.mtx.RUnlock()
+
+	d, ok := s.deciphers[algorithm]
+	return d, ok
+}
+
+func (s *Service) registerUsageMetrics() {
+	s.usageMetrics.RegisterSendReportCallback(s.registration.resetUsageStats)
+	s.usageMetrics.RegisterMetricsFunc(s.registration.usageStats)
+}
+
+func (s *Service) resetUsageStats() {
+	s.decryptionsCounter.reset()
+	s.decryptionFailuresCounter.reset()
+	s.legacyFallbacksCounter.reset()
 }
 
-func deriveEncryptionAlgorithm(payload []byte) (string, []byte, error) {
-	if len(payload) == 0 {
-		return "", nil, fmt.Errorf("unable to derive encryption algorithm")
+func (s *Service) usageStats(context.Context) (map[string]interface{}, error) {
+	algorithm := s.CurrentAlgorithm()
+
+	metrics := map[string]interface{}{
+		fmt.Sprintf("stats.encryption.%s.count", algorithm): 1,
 	}
 
-	if payload[0] != encryptionAlgorithmDelimiter {
-		return encryption.AesCfb, payload, nil // backwards compatibility
+	for decryptionAlgorithm, count := range s.decryptionsCounter.snapshot() {
+		metrics[fmt.Sprintf("stats.encryption.decrypt.%s.count", decryptionAlgorithm)] = count
 	}
 
-	payload = payload[1:]
-	algorithmDelimiterIdx := bytes.Index(payload, []byte{encryptionAlgorithmDelimiter})
-	if algorithmDelimiterIdx == -1 {
-		return encryption.AesCfb, payload, nil // backwards compatibility
+	var failures int64
+	for failure, count := range s.decryptionFailuresCounter.snapshot() {
+		metrics[fmt.Sprintf("stats.encryption.decrypt.failure.%s.count", failure)] = count
+		failures += count
 	}
+	metrics["stats.encryption.decrypt.failure.count"] = failures
 
-	algorithmB64 := payload[:algorithmDelimiterIdx]
-	payload = payload[algorithmDelimiterIdx+1:]
+	var fallbacks int64
+	for fallback, count := range s.legacyFallbacksCounter.snapshot() {
+		metrics[fmt.Sprintf("stats.encryption.legacy_fallback.%s.count", fallback)] = count
+		fallbacks += count
+	}
+	metrics["stats.encryption.legacy_fallback.count"] = fallbacks
+
+	return metrics, nil
+}
+
+// Decrypt decrypts the given payload with the decipher of the algorithm
+// recorded in its header. Regarding sensitive data held in memory: the keys
+// derived from the secret by the registered deciphers and any intermediate
+// plaintext (e.g. before decompression) are wiped before returning. The given
+// payload is left untouched, and the returned plaintext is owned by the
+// caller, who is responsible for wiping it (see encryption.Wipe). When the
+// cache of decrypted values is enabled (see decryptCacheSizeKey), a copy of
+// the plaintext is kept until it expires, and served to the next calls.
+func (s *Service) Decrypt(ctx context.Context, payload []byte, secret string) ([]byte, error) {
+	decrypted, _, err := s.decrypt(ctx, payload, nil, secret)
+	return decrypted, err
+}
 
-	algorithm := make([]byte, base64.RawStdEncoding.DecodedLen(len(algorithmB64)))
+// DecryptWithAlgorithm decrypts the given payload, as Decrypt does, and also
+// returns the algorithm it was encrypted with, as resolved from its header
+// (i.e. encryption.AesCfb for legacy unprefixed payloads), so callers can
+// tell whether it needs to be re-encrypted without decoding it twice. The
+// algorithm is also returned when the decryption fails, as long as the header
+// could be decoded, and is empty otherwise.
+func (s *Service) DecryptWithAlgorithm(ctx context.Context, payload []byte, secret string) ([]byte, string, error) {
+	return s.decrypt(ctx, payload, nil, secret)
+}
 
-	_, err := base64.RawStdEncoding.Decode(algorithm, algorithmB64)
+// CanDecrypt reports whether the service has a decipher for the algorithm the
+// given payload was encrypted with, and returns that algorithm, as resolved
+// from its header, e.g. to find, before an upgrade, the stored payloads that
+// couldn't be decrypted anymore. It neither decrypts the payload nor needs
+// the secret, so it cannot tell whether the payload would actually decrypt.
+// Legacy unprefixed payloads are reported as encryption.AesCfb ones, which
+// cannot be decrypted when allowLegacyUnprefixedKey is disabled. Payloads
+// whose header cannot be decoded are reported without algorithm.
+func (s *Service) CanDecrypt(payload []byte) (bool, string) {
+	algorithm, _, err := deriveEncryptionAlgorithm(payload)
 	if err != nil {
-		return "", nil, err
+		return false, ""
 	}
 
-	return string(algorithm), payload, nil
+	if payload[0] != encryptionAlgorithmDelimiter && !s.legacyUnprefixedAllowed() {
+		return false, algorithm
+	}
+
+	_, ok := s.decipher(algorithm)
+	return ok, algorithm
 }
 
-func (s *Service) Encrypt(ctx context.Context, payload []byte, secret string) ([]byte, error) {
+// DecryptLegacy decrypts the given payload as one produced by the Grafana
+// versions that didn't prefix payloads with their algorithm, that is, always
+// with the encryption.AesCfb decipher and without decoding any header, even
+// when the payload starts with the algorithm delimiter. It's meant for data
+// known to predate the prefix, where Decrypt could misinterpret the payload.
+// Being explicit, it's not subject to allowLegacyUnprefixedKey.
+func (s *Service) DecryptLegacy(ctx context.Context, payload []byte, secret string) ([]byte, error) {
 	var err error
 	defer func() {
 		if err != nil {
-			s.log.Error("Encryption failed", "error", err)
+			s.log.Error("Legacy decryption failed", logContext(ctx, "algorithm", encryption.AesCfb, "error", err)...)
+			s.countDecryptionFailure(encryption.AesCfb, err)
 		}
 	}()
 
-	algorithm := s.settingsProvider.
-		KeyValue(securitySection, encryptionAlgorithmKey).
-		MustString(defaultEncryptionAlgorithm)
+	if err = ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	if secret == "" {
+		err = encryption.ErrEmptySecret
+		return nil, err
+	}
 
-	cipher, ok := s.ciphers[algorithm]
+	decipher, ok := s.decipher(encryption.AesCfb)
 	if !ok {
-		err = fmt.Errorf("no cipher available for algorithm '%s'", algorithm)
+		err = fmt.Errorf("no decipher available for algorithm '%s': %w", encryption.AesCfb, encryption.ErrUnknownAlgorithm)
 		return nil, err
 	}
 
-	var encrypted []byte
-	encrypted, err = cipher.Encrypt(ctx, payload, secret)
+	var decrypted []byte
+	decrypted, err = s.decryptPayload(ctx, decipher, payloadHeader{algorithm: encryption.AesCfb}, payload, nil, secret)
 
-	prefix := make([]byte, base64.RawStdEncoding.EncodedLen(len([]byte(algorithm)))+2)
-	base64.RawStdEncoding.Encode(prefix[1:], []byte(algorithm))
-	prefix[0] = encryptionAlgorithmDelimiter
-	prefix[len(prefix)-1] = encryptionAlgorithmDelimiter
+	return decrypted, err
+}
 
-	ciphertext := make([]byte, len(prefix)+len(encrypted))
-	copy(ciphertext, prefix)
-	copy(ciphertext[len(prefix):], encrypted)
+// DecryptString decrypts the given base64-encoded payload,
+// as returned by EncryptToString.
+func (s *Service) DecryptString(ctx context.Context, payload string, secret string) ([]byte, error) {
+	decoded, err := base64.StdEncoding.DecodeString(payload)
+	if err != nil {
+		err = fmt.Errorf("malformed base64-encoded payload: %w", err)
+		s.log.Error("Decryption failed", logContext(ctx, "error", err)...)
+		return nil, err
+	}
 
-	return ciphertext, nil
+	return s.Decrypt(ctx, decoded, secret)
 }
 
-func (s *Service) EncryptJsonData(ctx context.Context, kv map[string]string, secret string) (map[string][]byte, error) {
-	encrypted := make(map[string][]byte)
-	for key, value := range kv {
-		encryptedData, err := s.Encrypt(ctx, []byte(value), secret)
+// DecryptWithSecrets decrypts the given payload, as Decrypt does, trying each
+// of the given secrets in order until one succeeds, e.g. the new and the old
+// ones while rotating secrets. When none does, the error lists why each one
+// failed and wraps the error of the last one.
+//
+// Algorithms bound to the secret (see encryption.IsSecretBound) reliably
+// detect a wrong secret, so the right one is always found. Unauthenticated
+// ones (i.e. AesCfb) don't, and most of the time decrypt the payload into
+// garbage with the first secret, so the order of the secrets only matters for
+// them, and the result cannot be trusted. VaultTransit doesn't use the secret
+// at all, so the first one succeeds, which tells nothing about the secret.
+func (s *Service) DecryptWithSecrets(ctx context.Context, payload []byte, secrets []string) ([]byte, error) {
+	var (
+		err       error
+		header    payloadHeader
+		toDecrypt []byte
+	)
+	defer func() {
 		if err != nil {
-			return nil, err
+			s.log.Error("Decryption failed", logContext(ctx, "algorithm", header.algorithm, "error", err)...)
+			s.countDecryptionFailure(header.algorithm, err)
 		}
+	}()
 
-		encrypted[key] = encryptedData
+	if len(secrets) == 0 {
+		err = encryption.ErrEmptySecret
+		return nil, err
 	}
-	return encrypted, nil
-}
 
-func (s *Service) DecryptJsonData(ctx context.Context, sjd map[string][]byte, secret string) (map[string]string, error) {
-	decrypted := make(map[string]string)
-	for key, data := range sjd {
-		decryptedData, err := s.Decrypt(ctx, data, secret)
-		if err != nil {
-			return nil, err
-		}
+	if err = ctx.Err(); err != nil {
+		return nil, err
+	}
 
-		decrypted[key] = string(decryptedData)
+	header, toDecrypt, err = s.decodePayloadHeader(payload)
+	if err != nil {
+		return nil, err
 	}
-	return decrypted, nil
-}
 
-func (s *Service) GetDecryptedValue(ctx context.Context, sjd map[string][]byte, key, fallback, secret string) string {
-	if value, ok := sjd[key]; ok {
-		decryptedData, err := s.Decrypt(ctx, value, secret)
-		if err != nil {
-			return fallback
-		}
+	decipher, ok := s.decipher(header.algorithm)
+	if !ok {
+		err = fmt.Errorf("no decipher available for algorithm '%s': %w", header.algorithm, encryption.ErrUnknownAlgorithm)
+		return nil, err
+	}
 
-		return string(decryptedData)
+	// Failed attempts aren't logged, as they're expected.
+	failures := make([]string, 0, len(secrets))
+	for i, secret := range secrets {
+		var decrypted []byte
+		if secret == "" {
+			err = encryption.ErrEmptySecret
+		} else if decrypted, err = s.decryptPayload(ctx, decipher, header, toDecrypt, nil, secret); err == nil {
+			return decrypted, nil
+		}
+		failures = append(failures, fmt.Sprintf("secret %d: %s", i, err))
 	}
 
-	return fallback
+	err = fmt.Errorf("failed to decrypt with any of the given secrets (%s): %w", strings.Join(failures, "; "), err)
+	return nil, err
 }
 
-func (s *Service) Validate(section setting.Section) error {
-	s.log.Debug("Validating encryption config")
-
-	algorithm := section.KeyValue(encryptionAlgorithmKey).
-		MustString(defaultEncryptionAlgorithm)
-
-	if err := s.checkEncryptionAlgorithm(algorithm); err != nil {
-		return err
+// DecryptWithAAD decrypts the given payload, as Decrypt does, verifying that
+// it was encrypted with the given associated data (see EncryptWithAAD).
+func (s *Service) DecryptWithAAD(ctx context.Context, payload, aad []byte, secret string) ([]byte, error) {
+	if aad == nil {
+		aad = []byte{}
 	}
 
-	return nil
+	decrypted, _, err := s.decrypt(ctx, payload, aad, secret)
+	return decrypted, err
 }
 
-func (s *Service) Reload(_ setting.Section) error {
+// decrypt decrypts the given payload, verifying the given
+// associated data unless it's nil.
+func (s *Service) decrypt(ctx context.Context, payload, aad []byte, secret string) ([]byte, string, error) {
+	var (
+		err       error
+		header    payloadHeader
+		toDecrypt []byte
+	)
+	defer func() {
+		if err != nil {
+			s.log.Error("Decryption failed", logContext(ctx, "algorithm", header.algorithm, "error", err)...)
+			s.countDecryptionFailure(header.algorithm, err)
+		}
+	}()
+
+	if err = ctx.Err(); err != nil {
+		return nil, "", err
+	}
+
+	if secret == "" {
+		err = encryption.ErrEmptySecret
+		return nil, "", err
+	}
+
+	header, toDecrypt, err = s.decodePayloadHeader(payload)
+	if err != nil {
+		return nil, "", err
+	}
+
+	decipher, ok := s.decipher(header.algorithm)
+	if !ok {
+		err = fmt.Errorf("no decipher available for algorithm '%s': %w", header.algorithm, encryption.ErrUnknownAlgorithm)
+		return nil, header.algorithm, err
+	}
+
+	// Hits still count as decryptions, so the usage
+	// stats don't depend on the hit ratio of the cache.
+	if cached, _, ok := s.decryptCache.get(payload, aad, secret); ok {
+		s.decryptionsCounter.inc(header.algorithm)
+		return cached, header.algorithm, nil
+	}
+
+	var decrypted []byte
+	decrypted, err = s.decryptPayload(ctx, decipher, header, toDecrypt, aad, secret)
+	if err == nil {
+		s.decryptCache.put(payload, aad, secret, header.algorithm, decrypted)
+	}
+
+	return decrypted, header.algorithm, err
+}
+
+// decryptPayload decrypts the given payload, once its header has been
+// decoded, and reverts any transformation recorded in the header.
+func (s *Service) decryptPayload(ctx context.Context, decipher encryption.Decipher, header payloadHeader, payload, aad []byte, secret string) ([]byte, error) {
+	if aad != nil {
+		if _, ok := decipher.(encryption.AEADDecipher); !ok {
+			return nil, fmt.Errorf("no associated data support for algorithm '%s': %w", header.algorithm, encryption.ErrAADNotSupported)
+		}
+	}
+
+	s.decryptionsCounter.inc(header.algorithm)
+
+	secret, err := s.payloadSecret(header, secret)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := s.verifyKeyCommitment(header, secret); err != nil {
+		return nil, err
+	}
+
+	decrypted, err := s.openPayload(ctx, decipher, header.algorithm, payload, aad, secret)
+	if err != nil && ctx.Err() == nil {
+		// The fallback error isn't of interest, as the
+		// fallback deciphers are only a last resort.
+		if fallback, ok := s.fallbackDecipher(header.algorithm); ok {
+			if fallbackDecrypted, fallbackErr := s.openPayload(ctx, fallback, header.algorithm, payload, aad, secret); fallbackErr == nil {
+				decrypted, err = fallbackDecrypted, nil
+			}
+		}
+	}
+	if err != nil {
+		// The algorithm is worth naming, as it may have been
+		// resolved by the legacy fallback rather than a prefix.
+		return nil, fmt.Errorf("decrypt with %q failed: %w", header.algorithm, err)
+	}
+
+	if header.padded {
+		if decrypted, err = unpad(decrypted); err != nil {
+			return nil, fmt.Errorf("decrypt with %q failed: %w", header.algorithm, err)
+		}
+	}
+
+	if header.compressed {
+		defer encryption.Wipe(decrypted)
+		return decompress(decrypted)
+	}
+
+	return decrypted, nil
+}
+
+// payloadSecret returns the secret the cipher of the payload with the given
+// header received, i.e. the given secret mixed with the key of the recorded
+// version, if any, then stretched with the recorded KDF, if any.
+func (s *Service) payloadSecret(header payloadHeader, secret string) (string, error) {
+	if header.keyVersion != "" {
+		keys, err := newKeyRegistry(s.securitySettings())
+		if err != nil {
+			return "", err
+		}
+
+		if secret, err = keys.secret(header.keyVersion, secret); err != nil {
+			return "", err
+		}
+	}
+
+	if header.kdf != nil {
+		secret = s.keyCache.derive(header.kdf, secret)
+	}
+
+	return secret, nil
+}
+
+// openPayload decrypts the given payload, once its header has been decoded,
+// with the given decipher, verifying the associated data unless it's nil.
+func (s *Service) openPayload(ctx context.Context, decipher encryption.Decipher, algorithm string, payload, aad []byte, secret string) ([]byte, error) {
+	ctx, cancel := s.withOperationTimeout(ctx, decipher)
+	defer cancel()
+
+	if aad == nil {
+		defer s.metrics.observeDuration(operationDecrypt, algorithm, time.Now())
+		return decipher.Decrypt(ctx, payload, secret)
+	}
+
+	aeadDecipher, ok := decipher.(encryption.AEADDecipher)
+	if !ok {
+		return nil, fmt.Errorf("no associated data support for algorithm '%s': %w", algorithm, encryption.ErrAADNotSupported)
+	}
+
+	defer s.metrics.observeDuration(operationDecrypt, algorithm, time.Now())
+	return aeadDecipher.DecryptWithAAD(ctx, payload, aad, secret)
+}
+
+// DecryptSlice decrypts all the given payloads, returning the plaintexts in
+// the same order. The headers of all the payloads are decoded upfront, and
+// the decipher of each algorithm is looked up only once for the whole batch.
+// Note that keys are still derived per payload, as each one has its own salt.
+//
+// Payloads are processed in order and the first failure aborts the whole
+// batch, returning an error that includes the index of the failing payload.
+func (s *Service) DecryptSlice(ctx context.Context, payloads [][]byte, secret string) ([][]byte, error) {
+	var (
+		err error
+
+		// algorithm is the one of the payload being processed.
+		algorithm string
+	)
+	defer func() {
+		if err != nil {
+			s.log.Error("Batch decryption failed", "error", err)
+			s.countDecryptionFailure(algorithm, err)
+		}
+	}()
+
+	if secret == "" {
+		err = encryption.ErrEmptySecret
+		return nil, err
+	}
+
+	headers := make([]payloadHeader, len(payloads))
+	toDecrypt := make([][]byte, len(payloads))
+	deciphers := make(map[string]encryption.Decipher)
+
+	s.mtx.RLock()
+	for i, payload := range payloads {
+		algorithm = ""
+		headers[i], toDecrypt[i], err = s.decodePayloadHeader(payload)
+		if err != nil {
+			s.mtx.RUnlock()
+			err = fmt.Errorf("failed to decrypt payload at index %d: %w", i, err)
+			return nil, err
+		}
+
+		algorithm = headers[i].algorithm
+		if _, ok := deciphers[algorithm]; ok {
+			continue
+		}
+
+		decipher, ok := s.deciphers[algorithm]
+		if !ok {
+			s.mtx.RUnlock()
+			err = fmt.Errorf("failed to decrypt payload at index %d: no decipher available for algorithm '%s': %w", i, algorithm, encryption.ErrUnknownAlgorithm)
+			return nil, err
+		}
+		deciphers[algorithm] = decipher
+	}
+	s.mtx.RUnlock()
+
+	decrypted := make([][]byte, len(payloads))
+	for i := range payloads {
+		if err = ctx.Err(); err != nil {
+			return nil, err
+		}
+
+		algorithm = headers[i].algorithm
+		decrypted[i], err = s.decryptPayload(ctx, deciphers[algorithm], headers[i], toDecrypt[i], nil, secret)
+		if err != nil {
+			err = fmt.Errorf("failed to decrypt payload at index %d: %w", i, err)
+			return nil, err
+		}
+	}
+
+	return decrypted, nil
+}
+
+func (s *Service) Encrypt(ctx context.Context, payload []byte, secret string) ([]byte, error) {
+	return s.encrypt(ctx, nil, payload, nil, secret, s.CurrentAlgorithm(), 0)
+}
+
+// EncryptToString encrypts the given payload, as Encrypt does, and returns
+// the result encoded with standard base64, so it can be embedded in text-only
+// formats (e.g. YAML). It's decrypted with DecryptString, or with Decrypt once
+// decoded, as the format of the payload is the same.
+func (s *Service) EncryptToString(ctx context.Context, payload []byte, secret string) (string, error) {
+	encrypted, err := s.Encrypt(ctx, payload, secret)
+	if err != nil {
+		return "", err
+	}
+
+	return base64.StdEncoding.EncodeToString(encrypted), nil
+}
+
+// EncryptWithAlgorithm encrypts the given payload, as Encrypt does, but with
+// the given algorithm instead of the configured one. The algorithm is recorded
+// in the payload as usual, so it's decrypted with Decrypt. It fails with
+// encryption.ErrUnknownAlgorithm if there's no cipher for the algorithm.
+func (s *Service) EncryptWithAlgorithm(ctx context.Context, payload []byte, secret, algorithm string) ([]byte, error) {
+	return s.encrypt(ctx, nil, payload, nil, secret, algorithm, 0)
+}
+
+// EncryptTo encrypts the given payload, as Encrypt does, and appends the
+// resulting payload to dst, returning the extended slice. It follows the
+// append convention, so dst is reallocated when its capacity isn't enough
+// to hold the result, and callers can reuse a buffer by passing dst[:0].
+// On error, nil is returned and the contents of dst are left untouched.
+func (s *Service) EncryptTo(ctx context.Context, dst, payload []byte, secret string) ([]byte, error) {
+	return s.encrypt(ctx, dst, payload, nil, secret, s.CurrentAlgorithm(), 0)
+}
+
+// EncryptWithAAD encrypts the given payload, as Encrypt does, authenticating
+// the given associated data along with it. The associated data isn't stored
+// in the resulting payload, so the same one must be given to DecryptWithAAD.
+// It fails with encryption.ErrAADNotSupported if the configured algorithm
+// cannot authenticate associated data.
+func (s *Service) EncryptWithAAD(ctx context.Context, payload, aad []byte, secret string) ([]byte, error) {
+	if aad == nil {
+		aad = []byte{}
+	}
+
+	return s.encrypt(ctx, nil, payload, aad, secret, s.CurrentAlgorithm(), 0)
+}
+
+// encrypt encrypts the given payload with the given algorithm, authenticating
+// the given associated data unless it's nil, and appends the result to dst.
+// The payload is padded to the given bucket size first, unless it's zero.
+func (s *Service) encrypt(ctx context.Context, dst, payload, aad []byte, secret, algorithm string, bucketSize int) ([]byte, error) {
+	var err error
+	defer func() {
+		if err != nil {
+			s.log.Error("Encryption failed", logContext(ctx, "algorithm", algorithm, "error", err)...)
+		}
+	}()
+
+	if err = ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	if err = s.checkEncryptionSecret(secret); err != nil {
+		return nil, err
+	}
+
+	if err = s.checkPayloadSize(operationEncrypt, len(payload)); err != nil {
+		return nil, err
+	}
+
+	cipher, ok := s.cipher(algorithm)
+	if !ok {
+		err = fmt.Errorf("no cipher available for algorithm '%s': %w", algorithm, encryption.ErrUnknownAlgorithm)
+		return nil, err
+	}
+
+	var aeadCipher encryption.AEADCipher
+	if aad != nil {
+		if aeadCipher, ok = cipher.(encryption.AEADCipher); !ok {
+			err = fmt.Errorf("no associated data support for algorithm '%s': %w", algorithm, encryption.ErrAADNotSupported)
+			return nil, err
+		}
+	}
+
+	var header payloadHeader
+	header, secret, err = s.newPayloadHeader(cipher, algorithm, secret)
+	if err != nil {
+		return nil, err
+	}
+
+	if s.compressionEnabled() {
+		var compressed []byte
+		compressed, err = compress(payload)
+		if err != nil {
+			return nil, err
+		}
+
+		// Compression is only worth it when it actually saves
+		// some space, otherwise the payload is kept as it is.
+		if len(compressed) < len(payload) {
+			payload = compressed
+			header.compressed = true
+		}
+		defer encryption.Wipe(compressed)
+	}
+
+	// Padding comes last, as compressing
+	// the padding would defeat its purpose.
+	if bucketSize > 0 {
+		var padded []byte
+		if padded, err = pad(payload, bucketSize); err != nil {
+			return nil, err
+		}
+
+		payload = padded
+		header.padded = true
+		defer encryption.Wipe(padded)
+	}
+
+	var encrypted []byte
+	opCtx, cancel := s.withOperationTimeout(ctx, cipher)
+	start := time.Now()
+	if aeadCipher != nil {
+		encrypted, err = aeadCipher.EncryptWithAAD(opCtx, payload, aad, secret)
+	} else {
+		encrypted, err = cipher.Encrypt(opCtx, payload, secret)
+	}
+	s.metrics.observeDuration(operationEncrypt, algorithm, start)
+	cancel()
+	if err != nil {
+		return nil, err
+	}
+
+	if s.verifyOnEncryptEnabled() {
+		if err = s.verifyRoundTrip(ctx, algorithm, encrypted, payload, aad, secret); err != nil {
+			return nil, err
+		}
+	}
+
+	// Growing dst upfront keeps the header and the ciphertext in a single
+	// allocation, if any, instead of letting append grow it twice.
+	if n := payloadHeaderLen(header) + len(encrypted); cap(dst)-len(dst) < n {
+		grown := make([]byte, len(dst), len(dst)+n)
+		copy(grown, dst)
+		dst = grown
+	}
+
+	dst = appendPayloadHeader(dst, header)
+	dst = append(dst, encrypted...)
+
+	return dst, nil
+}
+
+// newPayloadHeader returns the header of a new payload of the given algorithm,
+// with the options configured for it, and the secret to give its cipher, i.e.
+// the given secret mixed with the key of the current version, if any, then
+// stretched with the configured KDF, if any, see payloadSecret.
+func (s *Service) newPayloadHeader(cipher encryption.Cipher, algorithm, secret string) (payloadHeader, string, error) {
+	header := payloadHeader{algorithm: algorithm}
+
+	var err error
+	header.urlSafe, err = urlSafePrefix(s.securitySettings())
+	if err != nil {
+		return payloadHeader{}, "", err
+	}
+
+	keys, err := newKeyRegistry(s.securitySettings())
+	if err != nil {
+		return payloadHeader{}, "", err
+	}
+
+	if keys != nil {
+		header.keyVersion = keys.current
+		if secret, err = keys.secret(header.keyVersion, secret); err != nil {
+			return payloadHeader{}, "", err
+		}
+	}
+
+	// The random salt of the KDF would defeat the determinism of AesSiv.
+	if algorithm != encryption.AesSiv {
+		header.kdf, err = newKDFParams(s.securitySettings(), s.keyCache.saltSource(s.random))
+		if err != nil {
+			return payloadHeader{}, "", err
+		}
+	}
+
+	if header.kdf != nil {
+		secret = s.keyCache.derive(header.kdf, secret)
+	}
+
+	// Only AEAD ciphers are committed, as the others don't authenticate the
+	// payloads in the first place, but AesSiv, as for the KDF above.
+	if committed(cipher, algorithm) && s.keyCommitmentEnabled() {
+		header.commitment, err = newKeyCommitment(s.random, secret)
+		if err != nil {
+			return payloadHeader{}, "", err
+		}
+	}
+
+	return header, secret, nil
+}
+
+// logContext returns the given key/value pairs to log, plus the id of the
+// trace of the given context, if any, so log lines can be correlated with
+// the request that originated them.
+func logContext(ctx context.Context, kv ...interface{}) []interface{} {
+	if traceID := tracing.TraceIDFromContext(ctx, false); traceID != "" {
+		kv = append(kv, "traceID", traceID)
+	}
+	return kv
+}
+
+// ReEncrypt decrypts the given payload with oldSecret and encrypts it back
+// with newSecret. The currently configured algorithm is used for encryption,
+// so payloads encrypted with any other algorithm get upgraded on the way.
+func (s *Service) ReEncrypt(ctx context.Context, payload []byte, oldSecret, newSecret string) ([]byte, error) {
+	decrypted, err := s.Decrypt(ctx, payload, oldSecret)
+	if err != nil {
+		return nil, err
+	}
+
+	return s.Encrypt(ctx, decrypted, newSecret)
+}
+
+// ReEncryptJsonData re-encrypts each value of the given secure JSON data, as
+// ReEncrypt does, keeping the same keys. It's all or nothing: if any value
+// cannot be re-encrypted, the error identifies its key and no data is returned.
+func (s *Service) ReEncryptJsonData(ctx context.Context, sjd map[string][]byte, oldSecret, newSecret string) (map[string][]byte, error) {
+	reEncrypted := make(map[string][]byte, len(sjd))
+	for _, key := range sortedPayloadKeys(sjd) {
+		decrypted, err := s.Decrypt(ctx, sjd[key], oldSecret)
+		if err != nil {
+			return nil, fmt.Errorf("failed to re-encrypt value of key '%s': %w", key, err)
+		}
+
+		encrypted, err := s.Encrypt(ctx, decrypted, newSecret)
+		encryption.Wipe(decrypted)
+		if err != nil {
+			return nil, fmt.Errorf("failed to re-encrypt value of key '%s': %w", key, err)
+		}
+
+		reEncrypted[key] = encrypted
+	}
+
+	return reEncrypted, nil
+}
+
+// healthCheckPayload is the plaintext encrypted and decrypted back by HealthCheck.
+var healthCheckPayload = []byte("grafana encryption health check")
+
+// HealthCheck verifies that payloads can actually be encrypted with the
+// currently configured algorithm and decrypted back, so any failure of the
+// cipher in use (e.g. an unreachable key management service) is caught. A
+// throwaway random secret is used.
+func (s *Service) HealthCheck(ctx context.Context) error {
+	secret, err := util.GetRandomString(32)
+	if err != nil {
+		return fmt.Errorf("encryption health check failed to generate a secret: %w", err)
+	}
+
+	algorithm := s.CurrentAlgorithm()
+
+	encrypted, err := s.Encrypt(ctx, healthCheckPayload, secret)
+	if err != nil {
+		return fmt.Errorf("encryption health check failed to encrypt with '%s': %w", algorithm, err)
+	}
+
+	decrypted, err := s.Decrypt(ctx, encrypted, secret)
+	if err != nil {
+		return fmt.Errorf("encryption health check failed to decrypt with '%s': %w", algorithm, err)
+	}
+
+	if !bytes.Equal(decrypted, healthCheckPayload) {
+		return fmt.Errorf("encryption health check failed: payload decrypted with '%s' doesn't match the original one", algorithm)
+	}
+
+	return nil
+}
+
+// EncryptJsonData encrypts the values of the given map concurrently, using
+// up to the configured amount of workers (by default, one per CPU). On the
+// first failure, the remaining encryptions are cancelled and the error, which
+// names the failed key, is returned. Empty values are encrypted like any
+// other, so their keys are kept; see EncryptJsonDataSkipEmpty to leave them
+// out instead.
+func (s *Service) EncryptJsonData(ctx context.Context, kv map[string]string, secret string) (map[string][]byte, error) {
+	return s.encryptJsonData(ctx, kv, secret, s.CurrentAlgorithm(), false)
+}
+
+// EncryptJsonDataSkipEmpty encrypts the values of the given map, as
+// EncryptJsonData does, but leaves the keys with an empty value out of the
+// result entirely, e.g. for the optional secrets that are left unset, so
+// they aren't mistaken for configured secrets once encrypted.
+func (s *Service) EncryptJsonDataSkipEmpty(ctx context.Context, kv map[string]string, secret string) (map[string][]byte, error) {
+	nonEmpty := make(map[string]string, len(kv))
+	for key, value := range kv {
+		if value != "" {
+			nonEmpty[key] = value
+		}
+	}
+
+	return s.encryptJsonData(ctx, nonEmpty, secret, s.CurrentAlgorithm(), false)
+}
+
+// EncryptJsonDataBound encrypts the values of the given map, as EncryptJsonData
+// does, authenticating the key of every value as its associated data, so the
+// encrypted values cannot be moved from one key to another, even within the
+// same map. They must be decrypted with DecryptJsonDataBound, or one by one with
+// DecryptWithAAD and their key. It fails with encryption.ErrAADNotSupported if
+// the configured algorithm cannot authenticate associated data.
+func (s *Service) EncryptJsonDataBound(ctx context.Context, kv map[string]string, secret string) (map[string][]byte, error) {
+	return s.encryptJsonData(ctx, kv, secret, s.CurrentAlgorithm(), true)
+}
+
+// EncryptJsonDataWithAlgorithm encrypts the values of the given map, as
+// EncryptJsonData does, but with the given algorithm instead of the configured
+// one, e.g. for the provisioned values that must be readable by a third party.
+// They're decrypted with DecryptJsonData as usual. It fails right away with
+// encryption.ErrUnknownAlgorithm if there's no cipher for the algorithm.
+func (s *Service) EncryptJsonDataWithAlgorithm(ctx context.Context, kv map[string]string, secret, algorithm string) (map[string][]byte, error) {
+	if _, ok := s.cipher(algorithm); !ok {
+		err := fmt.Errorf("no cipher available for algorithm '%s': %w", algorithm, encryption.ErrUnknownAlgorithm)
+		s.log.Error("Encryption failed", logContext(ctx, "algorithm", algorithm, "error", err)...)
+		return nil, err
+	}
+
+	return s.encryptJsonData(ctx, kv, secret, algorithm, false)
+}
+
+// encryptJsonData encrypts the values of the given map with the given
+// algorithm, authenticating their key as associated data when bound.
+// The values are dispatched in the order of their keys, and the error
+// returned is the one of the first key in that order that actually failed,
+// i.e. not just cancelled because of another failure, wrapped with its key.
+func (s *Service) encryptJsonData(ctx context.Context, kv map[string]string, secret, algorithm string, bound bool) (map[string][]byte, error) {
+	var mtx sync.Mutex
+	encrypted := make(map[string][]byte, len(kv))
+
+	keys := sortedKeys(kv)
+	errs := make([]error, len(keys))
+
+	g, groupCtx := errgroup.WithContext(ctx)
+	g.SetLimit(s.jsonDataWorkers())
+	for i, key := range keys {
+		i, key, value := i, key, kv[key]
+		g.Go(func() error {
+			var aad []byte
+			if bound {
+				aad = append([]byte{}, key...)
+			}
+
+			encryptedData, err := s.encrypt(groupCtx, nil, []byte(value), aad, secret, algorithm, 0)
+			if err != nil {
+				errs[i] = fmt.Errorf("failed to encrypt value of key '%s': %w", key, err)
+				return errs[i]
+			}
+
+			mtx.Lock()
+			encrypted[key] = encryptedData
+			mtx.Unlock()
+			return nil
+		})
+	}
+
+	if err := g.Wait(); err != nil {
+		for _, keyErr := range errs {
+			if keyErr != nil && (ctx.Err() != nil || !errors.Is(keyErr, context.Canceled)) {
+				return nil, keyErr
+			}
+		}
+		return nil, err
+	}
+
+	return encrypted, nil
+}
+
+// sortedKeys returns the keys of the given map in order, so
+// the errors of the operations on its values are deterministic.
+func sortedKeys(kv map[string]string) []string {
+	keys := make([]string, 0, len(kv))
+	for key := range kv {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// sortedPayloadKeys returns the keys of the given map in order, as sortedKeys does.
+func sortedPayloadKeys(sjd map[string][]byte) []string {
+	keys := make([]string, 0, len(sjd))
+	for key := range sjd {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// decodePayloadHeader decodes the header of the given payload, as the
+// function of the same name does, but rejects the legacy unprefixed
+// payloads unless they're allowed by the configuration, as well as
+// those encrypted with algorithms not FIPS approved in FIPS mode.
+// The payloads taken for legacy ones are counted, see countLegacyFallback.
+func (s *Service) decodePayloadHeader(payload []byte) (payloadHeader, []byte, error) {
+	if len(payload) > 0 && payload[0] != encryptionAlgorithmDelimiter && !s.legacyUnprefixedAllowed() {
+		return payloadHeader{}, nil, errLegacyUnprefixed
+	}
+
+	header, toDecrypt, err := decodePayloadHeader(payload)
+	if err != nil {
+		s.countLegacyFallback(legacyFallbackMalformedPrefix)
+		return payloadHeader{}, nil, malformedPayloadError{err: err}
+	}
+
+	if len(payload) > 0 && payload[0] != encryptionAlgorithmDelimiter {
+		s.countLegacyFallback(legacyFallbackUnprefixed)
+	}
+	payload = toDecrypt
+
+	if s.fipsMode && !fipsApprovedAlgorithms[header.algorithm] {
+		return payloadHeader{}, nil, fmt.Errorf("payload encrypted with algorithm '%s', which is not FIPS approved", header.algorithm)
+	}
+
+	return header, payload, nil
+}
+
+// checkEncryptionSecret checks that the given secret isn't empty,
+// nor shorter than the configured minimum length, if any.
+func (s *Service) checkEncryptionSecret(secret string) error {
+	if secret == "" {
+		return encryption.ErrEmptySecret
+	}
+
+	if minLength := s.securitySettings().KeyValue(minSecretLengthKey).MustInt(0); len(secret) < minLength {
+		return fmt.Errorf("encryption secret must be at least %d characters long", minLength)
+	}
+
+	return nil
+}
+
+// checkPayloadSize checks that the given amount of bytes doesn't exceed
+// the configured maximum, if any, counting the rejection otherwise.
+func (s *Service) checkPayloadSize(operation string, size int) error {
+	maxSize := s.securitySettings().KeyValue(maxPayloadBytesKey).MustInt(0)
+	if maxSize <= 0 || size <= maxSize {
+		return nil
+	}
+
+	s.metrics.countRejectedPayload(operation)
+	return fmt.Errorf("payload of %d bytes exceeds the maximum of %d bytes: %w", size, maxSize, encryption.ErrPayloadTooLarge)
+}
+
+func (s *Service) legacyUnprefixedAllowed() bool {
+	return s.securitySettings().
+		KeyValue(allowLegacyUnprefixedKey).
+		MustBool(true)
+}
+
+func (s *Service) verifyOnEncryptEnabled() bool {
+	return s.securitySettings().
+		KeyValue(verifyOnEncryptKey).
+		MustBool(false)
+}
+
+// verifyRoundTrip checks that the given ciphertext, as returned by the cipher
+// of the given algorithm, decrypts back into the given plaintext.
+func (s *Service) verifyRoundTrip(ctx context.Context, algorithm string, ciphertext, plaintext, aad []byte, secret string) error {
+	decipher, ok := s.decipher(algorithm)
+	if !ok {
+		return fmt.Errorf("no decipher available to verify the encryption with algorithm '%s': %w", algorithm, encryption.ErrUnknownAlgorithm)
+	}
+
+	ctx, cancel := s.withOperationTimeout(ctx, decipher)
+	defer cancel()
+
+	var (
+		decrypted []byte
+		err       error
+	)
+	if aad != nil {
+		aeadDecipher, ok := decipher.(encryption.AEADDecipher)
+		if !ok {
+			return fmt.Errorf("no associated data support for algorithm '%s': %w", algorithm, encryption.ErrAADNotSupported)
+		}
+		decrypted, err = aeadDecipher.DecryptWithAAD(ctx, ciphertext, aad, secret)
+	} else {
+		decrypted, err = decipher.Decrypt(ctx, ciphertext, secret)
+	}
+	defer encryption.Wipe(decrypted)
+
+	if err != nil {
+		return fmt.Errorf("encryption round-trip verification failed for algorithm '%s': %w", algorithm, err)
+	}
+
+	if !bytes.Equal(decrypted, plaintext) {
+		return fmt.Errorf("encryption round-trip verification failed for algorithm '%s': decrypted payload doesn't match", algorithm)
+	}
+
+	return nil
+}
+
+func (s *Service) compressionEnabled() bool {
+	return s.securitySettings().
+		KeyValue(compressPayloadsKey).
+		MustBool(false)
+}
+
+func (s *Service) jsonDataWorkers() int {
+	workers := s.securitySettings().
+		KeyValue(jsonDataWorkersKey).
+		MustInt(runtime.NumCPU())
+
+	if workers < 1 {
+		return 1
+	}
+
+	return workers
+}
+
+func (s *Service) DecryptJsonData(ctx context.Context, sjd map[string][]byte, secret string) (map[string]string, error) {
+	if decrypted, ok, err := s.decryptJsonDataWithSharedKey(ctx, sjd, secret); ok {
+		return decrypted, err
+	}
+
+	return s.DecryptJsonDataFunc(ctx, sjd, secret, nil)
+}
+
+// DecryptJsonDataFunc decrypts the values of the given map, as DecryptJsonData
+// does, in key order, but calls onErr with the key and the error of every value
+// that fails to decrypt, e.g. to log or count the failures. The value is left
+// out of the result and the decryption goes on when onErr returns true, while
+// it's aborted when onErr returns false, or is nil, as with DecryptJsonData.
+func (s *Service) DecryptJsonDataFunc(ctx context.Context, sjd map[string][]byte, secret string, onErr func(key string, err error) bool) (map[string]string, error) {
+	decrypted := make(map[string]string)
+	for _, key := range sortedPayloadKeys(sjd) {
+		decryptedData, err := s.Decrypt(ctx, sjd[key], secret)
+		if err != nil {
+			if onErr != nil && onErr(key, err) {
+				continue
+			}
+			return nil, fmt.Errorf("failed to decrypt value of key '%s': %w", key, err)
+		}
+
+		decrypted[key] = string(decryptedData)
+		encryption.Wipe(decryptedData)
+	}
+	return decrypted, nil
+}
+
+// DecryptJsonDataBound decrypts the values of the given map, as DecryptJsonData
+// does, verifying they were encrypted for their key (see EncryptJsonDataBound).
+func (s *Service) DecryptJsonDataBound(ctx context.Context, sjd map[string][]byte, secret string) (map[string]string, error) {
+	decrypted := make(map[string]string)
+	for _, key := range sortedPayloadKeys(sjd) {
+		decryptedData, err := s.DecryptWithAAD(ctx, sjd[key], []byte(key), secret)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decrypt value of key '%s': %w", key, err)
+		}
+
+		decrypted[key] = string(decryptedData)
+		encryption.Wipe(decryptedData)
+	}
+	return decrypted, nil
+}
+
+// DecryptJsonDataPartial works like DecryptJsonData, but it doesn't abort on
+// failures. Instead, it returns all the values that could be decrypted plus
+// the errors for the ones that couldn't, both keyed by field name. The map
+// of errors is nil when all the values were decrypted successfully.
+func (s *Service) DecryptJsonDataPartial(ctx context.Context, sjd map[string][]byte, secret string) (map[string]string, map[string]error) {
+	var errs map[string]error
+	// The decryption is never aborted, so there's no error to handle.
+	decrypted, _ := s.DecryptJsonDataFunc(ctx, sjd, secret, func(key string, err error) bool {
+		if errs == nil {
+			errs = make(map[string]error)
+		}
+		errs[key] = err
+		return true
+	})
+	return decrypted, errs
+}
+
+func (s *Service) GetDecryptedValue(ctx context.Context, sjd map[string][]byte, key, fallback, secret string) string {
+	if value, ok := sjd[key]; ok {
+		decryptedData, err := s.Decrypt(ctx, value, secret)
+		if err != nil {
+			return fallback
+		}
+		defer encryption.Wipe(decryptedData)
+
+		return string(decryptedData)
+	}
+
+	return fallback
+}
+
+// GetDecryptedValues works like GetDecryptedValue for each of the given keys,
+// substituting the fallback of each key, if any, when it's missing or cannot
+// be decrypted. The returned map has an entry for each of the given keys,
+// which is empty when there's no value nor fallback for it. The decipher of
+// each algorithm is looked up only once for all the values.
+func (s *Service) GetDecryptedValues(ctx context.Context, sjd map[string][]byte, keys []string, fallbacks map[string]string, secret string) map[string]string {
+	values := make(map[string]string, len(keys))
+	deciphers := make(map[string]encryption.Decipher)
+
+	for _, key := range keys {
+		values[key] = fallbacks[key]
+
+		payload, ok := sjd[key]
+		if !ok {
+			continue
+		}
+
+		decrypted, err := s.decryptValue(ctx, deciphers, payload, secret)
+		if err != nil {
+			s.log.Error("Decryption failed", logContext(ctx, "key", key, "error", err)...)
+			continue
+		}
+
+		values[key] = string(decrypted)
+		encryption.Wipe(decrypted)
+	}
+
+	return values
+}
+
+// decryptValue decrypts the given payload, as decrypt does, looking up
+// the decipher in the given map first, and adding it when it's missing.
+func (s *Service) decryptValue(ctx context.Context, deciphers map[string]encryption.Decipher, payload []byte, secret string) (decrypted []byte, err error) {
+	var header payloadHeader
+	defer func() {
+		if err != nil {
+			s.countDecryptionFailure(header.algorithm, err)
+		}
+	}()
+
+	if err = ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	if secret == "" {
+		return nil, encryption.ErrEmptySecret
+	}
+
+	var toDecrypt []byte
+	header, toDecrypt, err = s.decodePayloadHeader(payload)
+	if err != nil {
+		return nil, err
+	}
+
+	decipher, ok := deciphers[header.algorithm]
+	if !ok {
+		if decipher, ok = s.decipher(header.algorithm); !ok {
+			return nil, fmt.Errorf("no decipher available for algorithm '%s': %w", header.algorithm, encryption.ErrUnknownAlgorithm)
+		}
+		deciphers[header.algorithm] = decipher
+	}
+
+	return s.decryptPayload(ctx, decipher, header, toDecrypt, nil, secret)
+}
+
+// GetDecryptedBytes works like GetDecryptedValue, but it returns the plaintext
+// as a byte slice that is owned by the caller, so it can be wiped (see
+// encryption.Wipe) as soon as it's no longer needed. The fallback is
+// returned as is when the value cannot be decrypted.
+func (s *Service) GetDecryptedBytes(ctx context.Context, sjd map[string][]byte, key string, fallback []byte, secret string) []byte {
+	if value, ok := sjd[key]; ok {
+		decryptedData, err := s.Decrypt(ctx, value, secret)
+		if err != nil {
+			return fallback
+		}
+
+		return decryptedData
+	}
+
+	return fallback
+}
+
+func (s *Service) Validate(section setting.Section) error {
+	s.log.Debug("Validating encryption config")
+
+	section = readOnlySection{section}
+
+	algorithm := s.configuredAlgorithm(section)
+
+	if err := s.checkEncryptionAlgorithm(algorithm); err != nil {
+		return err
+	}
+
+	if _, err := newKDFParams(section, s.random); err != nil {
+		return err
+	}
+
+	if _, err := newKeyRegistry(section); err != nil {
+		return err
+	}
+
+	if _, err := urlSafePrefix(section); err != nil {
+		return err
+	}
+
+	if _, err := operationTimeout(section); err != nil {
+		return err
+	}
+
+	return s.checkAlgorithmDowngrade(section, algorithm)
+}
+
+func (s *Service) Reload(section setting.Section) error {
+	s.log.Debug("Reloading encryption config")
+
+	section = readOnlySection{section}
+
+	algorithm := s.configuredAlgorithm(section)
+
+	if err := s.checkEncryptionAlgorithm(algorithm); err != nil {
+		return err
+	}
+
+	if err := s.checkAlgorithmDowngrade(section, algorithm); err != nil {
+		return err
+	}
+
+	if err := s.configureCiphers(); err != nil {
+		s.log.Error("Failed to configure encryption ciphers", "error", err)
+		return err
+	}
+
+	profiles, err := s.loadProfiles()
+	if err != nil {
+		s.log.Error("Wrong security encryption profiles configuration", "error", err)
+		return err
+	}
+
+	s.mtx.Lock()
+	s.appliedAlgorithm = algorithm
+	s.profiles = profiles
+	s.mtx.Unlock()
+
+	// The key versions may have changed, so the
+	// cached values may no longer be decryptable.
+	s.decryptCache.clear()
+
+	return nil
+}
+
+// checkAlgorithmDowngrade checks whether changing the applied algorithm to the
+// given one implies losing integrity protection, in which case it's rejected
+// if downgrades are disallowed by the given section, or just reported if not.
+func (s *Service) checkAlgorithmDowngrade(section setting.Section, algorithm string) error {
+	s.mtx.RLock()
+	applied := s.appliedAlgorithm
+	s.mtx.RUnlock()
+
+	if !encryption.IsAuthenticated(applied) || encryption.IsAuthenticated(algorithm) {
+		return nil
+	}
+
+	if section.KeyValue(disallowDowngradeKey).MustBool(false) {
+		s.log.Error("Rejected downgrade of encryption algorithm to an unauthenticated one", "from", applied, "to", algorithm)
+		return fmt.Errorf("downgrade of encryption algorithm from '%s' to unauthenticated '%s' is not allowed", applied, algorithm)
+	}
+
+	s.log.Warn("Encryption algorithm downgraded to an unauthenticated one, newly encrypted secrets won't have integrity protection", "from", applied, "to", algorithm)
 	return nil
 }
@@ -1,13 +1,25 @@
 package service
 
 import (
+	"bytes"
 	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
 	"testing"
 
+	"github.com/grafana/grafana/pkg/infra/log/logtest"
+	"github.com/grafana/grafana/pkg/infra/tracing"
 	"github.com/grafana/grafana/pkg/infra/usagestats"
 	"github.com/grafana/grafana/pkg/services/encryption"
 	"github.com/grafana/grafana/pkg/services/encryption/provider"
 	"github.com/grafana/grafana/pkg/setting"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 )
@@ -30,7 +42,7 @@ func Test_Service(t *testing.T) {
 	})
 
 	t.Run("encrypt and decrypt with aes-cfb should work", func(t *testing.T) {
-		settings.Cfg.Raw.Section(securitySection).Key(encryptionAlgorithmKey).SetValue(encryption.AesCfb)
+		setAlgorithm(t, svc, encryption.AesCfb)
 
 		encrypted, err := svc.Encrypt(ctx, []byte("grafana"), "1234")
 		require.NoError(t, err)
@@ -53,24 +65,1787 @@ func Test_Service(t *testing.T) {
 		assert.Equal(t, []byte("grafana"), decrypted)
 	})
 
-	t.Run("encrypt with aes-gcm should fail", func(t *testing.T) {
-		settings.Cfg.Raw.Section(securitySection).Key(encryptionAlgorithmKey).SetValue(encryption.AesGcm)
+	t.Run("encrypt and decrypt with aes-gcm should work", func(t *testing.T) {
+		setAlgorithm(t, svc, encryption.AesGcm)
+
+		encrypted, err := svc.Encrypt(ctx, []byte("grafana"), "1234")
+		require.NoError(t, err)
+
+		algorithm, _, err := deriveEncryptionAlgorithm(encrypted)
+		require.NoError(t, err)
+		assert.Equal(t, encryption.AesGcm, algorithm)
+
+		decrypted, err := svc.Decrypt(ctx, encrypted, "1234")
+		require.NoError(t, err)
+		assert.Equal(t, []byte("grafana"), decrypted)
+	})
+
+	t.Run("decrypt tampered aes-gcm ciphertext should fail", func(t *testing.T) {
+		setAlgorithm(t, svc, encryption.AesGcm)
+
+		encrypted, err := svc.Encrypt(ctx, []byte("grafana"), "1234")
+		require.NoError(t, err)
+
+		encrypted[len(encrypted)-1] ^= 0x01
+
+		_, err = svc.Decrypt(ctx, encrypted, "1234")
+		require.ErrorIs(t, err, encryption.ErrAuthenticationFailed)
+	})
+
+	t.Run("encrypt and decrypt with chacha20poly1305 should work", func(t *testing.T) {
+		setAlgorithm(t, svc, encryption.ChaCha20Poly1305)
+
+		encrypted, err := svc.Encrypt(ctx, []byte("grafana"), "1234")
+		require.NoError(t, err)
+
+		algorithm, _, err := deriveEncryptionAlgorithm(encrypted)
+		require.NoError(t, err)
+		assert.Equal(t, encryption.ChaCha20Poly1305, algorithm)
+
+		decrypted, err := svc.Decrypt(ctx, encrypted, "1234")
+		require.NoError(t, err)
+		assert.Equal(t, []byte("grafana"), decrypted)
+	})
+
+	t.Run("encrypt with aes-siv should be deterministic", func(t *testing.T) {
+		setAlgorithm(t, svc, encryption.AesSiv)
+
+		first, err := svc.Encrypt(ctx, []byte("grafana"), "1234")
+		require.NoError(t, err)
+
+		second, err := svc.Encrypt(ctx, []byte("grafana"), "1234")
+		require.NoError(t, err)
+		assert.Equal(t, first, second)
+
+		other, err := svc.Encrypt(ctx, []byte("grafana"), "4321")
+		require.NoError(t, err)
+		assert.NotEqual(t, first, other)
+
+		decrypted, err := svc.Decrypt(ctx, first, "1234")
+		require.NoError(t, err)
+		assert.Equal(t, []byte("grafana"), decrypted)
+	})
+
+	t.Run("encrypt and decrypt with aes-cbc-hmac should work", func(t *testing.T) {
+		setAlgorithm(t, svc, encryption.AesCbcHmac)
+
+		encrypted, err := svc.Encrypt(ctx, []byte("grafana"), "1234")
+		require.NoError(t, err)
+
+		algorithm, _, err := deriveEncryptionAlgorithm(encrypted)
+		require.NoError(t, err)
+		assert.Equal(t, encryption.AesCbcHmac, algorithm)
+
+		decrypted, err := svc.Decrypt(ctx, encrypted, "1234")
+		require.NoError(t, err)
+		assert.Equal(t, []byte("grafana"), decrypted)
+	})
+
+	t.Run("decrypt with unknown algorithm should return typed error", func(t *testing.T) {
+		ciphertext := append(encodeEncryptionAlgorithm("unknown"), []byte("grafana")...)
+
+		_, err := svc.Decrypt(ctx, ciphertext, "1234")
+		require.ErrorIs(t, err, encryption.ErrUnknownAlgorithm)
+	})
+
+	t.Run("encrypt with unknown algorithm should return typed error", func(t *testing.T) {
+		_, err := svc.EncryptWithAlgorithm(ctx, []byte("grafana"), "1234", "unknown")
+		require.ErrorIs(t, err, encryption.ErrUnknownAlgorithm)
+	})
+
+	t.Run("decrypting legacy ciphertext should work", func(t *testing.T) {
+		// Raw slice of bytes that corresponds to the following ciphertext:
+		// - 'grafana' as payload
+		// - '1234' as secret
+		// - no encryption algorithm metadata
+		ciphertext := []byte{73, 71, 50, 57, 121, 110, 90, 109, 115, 23, 237, 13, 130, 188, 151, 118, 98, 103, 80, 209, 79, 143, 22, 122, 44, 40, 102, 41, 136, 16, 27}
+
+		decrypted, err := svc.Decrypt(context.Background(), ciphertext, "1234")
+		require.NoError(t, err)
+		assert.Equal(t, []byte("grafana"), decrypted)
+	})
+
+	t.Run("encrypting the same payload twice should use different salts", func(t *testing.T) {
+		for _, algorithm := range []string{encryption.AesCfb, encryption.AesGcm, encryption.AesCbcHmac, encryption.ChaCha20Poly1305, encryption.XChaCha20Poly1305} {
+			setAlgorithm(t, svc, algorithm)
+
+			first, err := svc.Encrypt(ctx, []byte("grafana"), "1234")
+			require.NoError(t, err)
+
+			second, err := svc.Encrypt(ctx, []byte("grafana"), "1234")
+			require.NoError(t, err)
+
+			assert.NotEqual(t, first, second, algorithm)
+
+			_, firstBody, err := decodePayloadHeader(first)
+			require.NoError(t, err)
+
+			_, secondBody, err := decodePayloadHeader(second)
+			require.NoError(t, err)
+
+			assert.NotEqual(t, firstBody[:encryption.SaltLength], secondBody[:encryption.SaltLength], algorithm)
+
+			for _, encrypted := range [][]byte{first, second} {
+				decrypted, err := svc.Decrypt(ctx, encrypted, "1234")
+				require.NoError(t, err)
+				assert.Equal(t, []byte("grafana"), decrypted, algorithm)
+			}
+		}
+	})
+}
+
+func Test_Service_CancelledContext(t *testing.T) {
+	svc := SetupTestService(t)
+
+	encrypted, err := svc.Encrypt(context.Background(), []byte("grafana"), "1234")
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	t.Run("encrypt should return the context error", func(t *testing.T) {
+		_, err := svc.Encrypt(ctx, []byte("grafana"), "1234")
+		require.ErrorIs(t, err, context.Canceled)
+	})
+
+	t.Run("decrypt should return the context error", func(t *testing.T) {
+		_, err := svc.Decrypt(ctx, encrypted, "1234")
+		require.ErrorIs(t, err, context.Canceled)
+	})
+}
+
+func Test_Service_Secret(t *testing.T) {
+	ctx := context.Background()
+
+	svc := SetupTestService(t)
+	settings := svc.settingsProvider.(*setting.OSSImpl)
+	section := settings.Cfg.Raw.Section(securitySection)
+	setAlgorithm(t, svc, encryption.AesGcm)
+
+	encrypted, err := svc.Encrypt(ctx, []byte("grafana"), "1234")
+	require.NoError(t, err)
+
+	t.Run("empty secret should be rejected", func(t *testing.T) {
+		_, err := svc.Encrypt(ctx, []byte("grafana"), "")
+		require.ErrorIs(t, err, encryption.ErrEmptySecret)
+
+		_, err = svc.Decrypt(ctx, encrypted, "")
+		require.ErrorIs(t, err, encryption.ErrEmptySecret)
+
+		_, err = svc.DecryptSlice(ctx, [][]byte{encrypted}, "")
+		require.ErrorIs(t, err, encryption.ErrEmptySecret)
+
+		err = svc.EncryptStream(ctx, &strings.Builder{}, strings.NewReader("grafana"), "")
+		require.ErrorIs(t, err, encryption.ErrEmptySecret)
+
+		_, err = svc.DecryptReader(ctx, strings.NewReader(string(encrypted)), "")
+		require.ErrorIs(t, err, encryption.ErrEmptySecret)
+
+		assert.Equal(t, "fallback", svc.GetDecryptedValue(ctx, map[string][]byte{"password": encrypted}, "password", "fallback", ""))
+	})
+
+	t.Run("short secret should be rejected when a minimum length is configured", func(t *testing.T) {
+		section.Key(minSecretLengthKey).SetValue("8")
+		t.Cleanup(func() { section.DeleteKey(minSecretLengthKey) })
+
+		_, err := svc.Encrypt(ctx, []byte("grafana"), "1234")
+		require.Error(t, err)
+		assert.Equal(t, "encryption secret must be at least 8 characters long", err.Error())
+
+		_, err = svc.Encrypt(ctx, []byte("grafana"), "12345678")
+		require.NoError(t, err)
+
+		// Payloads encrypted before configuring it can still be decrypted.
+		decrypted, err := svc.Decrypt(ctx, encrypted, "1234")
+		require.NoError(t, err)
+		assert.Equal(t, []byte("grafana"), decrypted)
+	})
+}
+
+func Test_Service_MaxPayloadBytes(t *testing.T) {
+	ctx := context.Background()
+
+	svc := SetupTestService(t)
+	section := svc.settingsProvider.(*setting.OSSImpl).Cfg.Raw.Section(securitySection)
+
+	reg := prometheus.NewRegistry()
+	require.NoError(t, svc.RegisterMetrics(reg))
+	rejected := svc.metrics.rejectedPayloads.WithLabelValues(operationEncrypt)
+
+	t.Run("payloads should be unlimited by default", func(t *testing.T) {
+		_, err := svc.Encrypt(ctx, make([]byte, 1<<20), "1234")
+		require.NoError(t, err)
+	})
+
+	t.Run("payloads up to the maximum should be encrypted", func(t *testing.T) {
+		section.Key(maxPayloadBytesKey).SetValue("16")
+		t.Cleanup(func() { section.DeleteKey(maxPayloadBytesKey) })
+
+		encrypted, err := svc.Encrypt(ctx, make([]byte, 16), "1234")
+		require.NoError(t, err)
+
+		decrypted, err := svc.Decrypt(ctx, encrypted, "1234")
+		require.NoError(t, err)
+		assert.Len(t, decrypted, 16)
+
+		var out bytes.Buffer
+		require.NoError(t, svc.EncryptStream(ctx, &out, bytes.NewReader(make([]byte, 16)), "1234"))
+		assert.Zero(t, testutil.ToFloat64(rejected))
+	})
+
+	t.Run("payloads over the maximum should be rejected", func(t *testing.T) {
+		section.Key(maxPayloadBytesKey).SetValue("16")
+		t.Cleanup(func() { section.DeleteKey(maxPayloadBytesKey) })
+
+		_, err := svc.Encrypt(ctx, make([]byte, 17), "1234")
+		require.ErrorIs(t, err, encryption.ErrPayloadTooLarge)
+
+		_, err = svc.EncryptJsonData(ctx, map[string]string{"password": strings.Repeat("x", 17)}, "1234")
+		require.ErrorIs(t, err, encryption.ErrPayloadTooLarge)
+
+		var out bytes.Buffer
+		err = svc.EncryptStream(ctx, &out, bytes.NewReader(make([]byte, 17)), "1234")
+		require.ErrorIs(t, err, encryption.ErrPayloadTooLarge)
+
+		assert.Equal(t, float64(3), testutil.ToFloat64(rejected))
+	})
+
+	t.Run("decryption should not be limited", func(t *testing.T) {
+		encrypted, err := svc.Encrypt(ctx, make([]byte, 17), "1234")
+		require.NoError(t, err)
+
+		section.Key(maxPayloadBytesKey).SetValue("16")
+		t.Cleanup(func() { section.DeleteKey(maxPayloadBytesKey) })
+
+		_, err = svc.Decrypt(ctx, encrypted, "1234")
+		require.NoError(t, err)
+	})
+}
+
+func Test_Service_VerifyOnEncrypt(t *testing.T) {
+	ctx := context.Background()
+
+	svc := SetupTestService(t)
+	section := svc.settingsProvider.(*setting.OSSImpl).Cfg.Raw.Section(securitySection)
+
+	// The cipher reverses the payloads, but the decipher doesn't
+	// reverse them back, so they never round-trip but for palindromes.
+	require.NoError(t, svc.RegisterCipher("broken", fakeCipher{}, brokenDecipher{}))
+
+	t.Run("broken cipher should go unnoticed by default", func(t *testing.T) {
+		encrypted, err := svc.EncryptWithAlgorithm(ctx, []byte("grafana"), "1234", "broken")
+		require.NoError(t, err)
+		assert.NotEmpty(t, encrypted)
+	})
+
+	section.Key(verifyOnEncryptKey).SetValue("true")
+
+	t.Run("broken cipher should be caught", func(t *testing.T) {
+		dst := []byte("prefix")
+		encrypted, err := svc.encrypt(ctx, dst, []byte("grafana"), nil, "1234", "broken", 0)
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "encryption round-trip verification failed for algorithm 'broken'")
+		assert.Nil(t, encrypted)
+		assert.Equal(t, []byte("prefix"), dst)
+
+		_, err = svc.EncryptJsonDataWithAlgorithm(ctx, map[string]string{"password": "grafana"}, "1234", "broken")
+		require.Error(t, err)
+	})
+
+	t.Run("sound ciphers should pass", func(t *testing.T) {
+		section.Key(compressPayloadsKey).SetValue("true")
+		t.Cleanup(func() { section.DeleteKey(compressPayloadsKey) })
+
+		for _, algorithm := range []string{encryption.AesCfb, encryption.AesGcm, encryption.ChaCha20Poly1305} {
+			encrypted, err := svc.EncryptWithAlgorithm(ctx, []byte(strings.Repeat("grafana", 10)), "1234", algorithm)
+			require.NoError(t, err, algorithm)
+
+			decrypted, err := svc.Decrypt(ctx, encrypted, "1234")
+			require.NoError(t, err)
+			assert.Equal(t, []byte(strings.Repeat("grafana", 10)), decrypted)
+		}
+
+		aad := []byte("aad")
+		encrypted, err := svc.encrypt(ctx, nil, []byte("grafana"), aad, "1234", encryption.AesGcm, 0)
+		require.NoError(t, err)
+
+		decrypted, err := svc.DecryptWithAAD(ctx, encrypted, aad, "1234")
+		require.NoError(t, err)
+		assert.Equal(t, []byte("grafana"), decrypted)
+	})
+}
+
+func Test_Service_CurrentAlgorithm(t *testing.T) {
+	svc := SetupTestService(t)
+
+	t.Run("without configuration should return the default algorithm", func(t *testing.T) {
+		assert.Equal(t, defaultEncryptionAlgorithm, svc.CurrentAlgorithm())
+	})
+
+	t.Run("with configuration should return the configured algorithm", func(t *testing.T) {
+		setAlgorithm(t, svc, encryption.AesGcm)
+		assert.Equal(t, encryption.AesGcm, svc.CurrentAlgorithm())
+	})
+}
+
+func Test_Service_SupportedAlgorithms(t *testing.T) {
+	svc := SetupTestService(t)
+
+	t.Run("should return the algorithms registered by the provider", func(t *testing.T) {
+		p := provider.ProvideEncryptionProvider(svc.settingsProvider)
+
+		var expected []string
+		for algorithm := range p.ProvideCiphers() {
+			expected = append(expected, algorithm)
+		}
+
+		algorithms := svc.SupportedAlgorithms()
+		assert.ElementsMatch(t, expected, algorithms)
+		assert.IsIncreasing(t, algorithms)
+	})
+
+	t.Run("should include the algorithms registered at runtime", func(t *testing.T) {
+		require.NoError(t, svc.RegisterCipher("fake", fakeCipher{}, fakeDecipher{}))
+		assert.Contains(t, svc.SupportedAlgorithms(), "fake")
+	})
+}
+
+func Test_Service_Must(t *testing.T) {
+	ctx := context.Background()
+
+	svc := SetupTestService(t)
+
+	t.Run("round-trip should work", func(t *testing.T) {
+		encrypted := svc.MustEncrypt(ctx, []byte("grafana"), "1234")
+		assert.Equal(t, []byte("grafana"), svc.MustDecrypt(ctx, encrypted, "1234"))
+	})
+
+	t.Run("failures should panic", func(t *testing.T) {
+		cancelledCtx, cancel := context.WithCancel(ctx)
+		cancel()
+
+		assert.Panics(t, func() { svc.MustEncrypt(cancelledCtx, []byte("grafana"), "1234") })
+		assert.Panics(t, func() { svc.MustDecrypt(ctx, encodeEncryptionAlgorithm("unknown"), "1234") })
+	})
+}
+
+func Test_Service_EncryptTo(t *testing.T) {
+	ctx := context.Background()
+
+	svc := SetupTestService(t)
+
+	t.Run("should append to the given buffer", func(t *testing.T) {
+		buf, err := svc.EncryptTo(ctx, []byte("prefix"), []byte("grafana"), "1234")
+		require.NoError(t, err)
+		require.True(t, strings.HasPrefix(string(buf), "prefix"))
+
+		decrypted, err := svc.Decrypt(ctx, buf[len("prefix"):], "1234")
+		require.NoError(t, err)
+		assert.Equal(t, []byte("grafana"), decrypted)
+	})
+
+	t.Run("should reuse the buffer when it's large enough", func(t *testing.T) {
+		buf := make([]byte, 0, 1024)
+
+		for i := 0; i < 3; i++ {
+			encrypted, err := svc.EncryptTo(ctx, buf[:0], []byte("grafana"), "1234")
+			require.NoError(t, err)
+			assert.Equal(t, &buf[:1][0], &encrypted[0])
+
+			decrypted, err := svc.Decrypt(ctx, encrypted, "1234")
+			require.NoError(t, err)
+			assert.Equal(t, []byte("grafana"), decrypted)
+		}
+	})
+
+	t.Run("failure should leave the buffer untouched", func(t *testing.T) {
+		cancelledCtx, cancel := context.WithCancel(ctx)
+		cancel()
+
+		buf := []byte("prefix")
+		encrypted, err := svc.EncryptTo(cancelledCtx, buf, []byte("grafana"), "1234")
+		require.Error(t, err)
+		assert.Nil(t, encrypted)
+		assert.Equal(t, []byte("prefix"), buf)
+	})
+}
+
+func Test_Service_EncryptToString(t *testing.T) {
+	ctx := context.Background()
+
+	svc := SetupTestService(t)
+
+	for _, algorithm := range []string{encryption.AesCfb, encryption.AesGcm} {
+		setAlgorithm(t, svc, algorithm)
+
+		encrypted, err := svc.EncryptToString(ctx, []byte("grafana"), "1234")
+		require.NoError(t, err)
+
+		decrypted, err := svc.DecryptString(ctx, encrypted, "1234")
+		require.NoError(t, err)
+		assert.Equal(t, []byte("grafana"), decrypted)
+
+		// The armored payload is a regular one once decoded.
+		decoded, err := base64.StdEncoding.DecodeString(encrypted)
+		require.NoError(t, err)
+
+		decrypted, err = svc.Decrypt(ctx, decoded, "1234")
+		require.NoError(t, err)
+		assert.Equal(t, []byte("grafana"), decrypted)
+	}
+
+	t.Run("invalid base64 should fail", func(t *testing.T) {
+		// The latter lacks the padding.
+		for _, payload := range []string{"not base64!", "KllXVnpMV2RqYlEqZ3JhZmFuYQ"} {
+			_, err := svc.DecryptString(ctx, payload, "1234")
+			require.Error(t, err, payload)
+			assert.Contains(t, err.Error(), "malformed base64-encoded payload")
+		}
+	})
+}
+
+func Test_Service_EncryptWithAlgorithm(t *testing.T) {
+	ctx := context.Background()
+
+	svc := SetupTestService(t)
+	require.Equal(t, encryption.AesCfb, svc.CurrentAlgorithm())
+
+	t.Run("non-default algorithm should be decrypted through Decrypt", func(t *testing.T) {
+		for _, algorithm := range []string{encryption.AesGcm, encryption.ChaCha20Poly1305} {
+			encrypted, err := svc.EncryptWithAlgorithm(ctx, []byte("grafana"), "1234", algorithm)
+			require.NoError(t, err)
+
+			derived, _, err := deriveEncryptionAlgorithm(encrypted)
+			require.NoError(t, err)
+			assert.Equal(t, algorithm, derived)
+
+			decrypted, err := svc.Decrypt(ctx, encrypted, "1234")
+			require.NoError(t, err)
+			assert.Equal(t, []byte("grafana"), decrypted)
+		}
+
+		// Encrypt keeps using the configured algorithm.
+		encrypted, err := svc.Encrypt(ctx, []byte("grafana"), "1234")
+		require.NoError(t, err)
+
+		derived, _, err := deriveEncryptionAlgorithm(encrypted)
+		require.NoError(t, err)
+		assert.Equal(t, encryption.AesCfb, derived)
+	})
+
+	t.Run("unknown algorithm should fail", func(t *testing.T) {
+		_, err := svc.EncryptWithAlgorithm(ctx, []byte("grafana"), "1234", "unknown")
+		require.ErrorIs(t, err, encryption.ErrUnknownAlgorithm)
+	})
+}
+
+func Test_Service_DecryptWithAlgorithm(t *testing.T) {
+	ctx := context.Background()
+
+	svc := SetupTestService(t)
+
+	t.Run("prefixed payloads should report their algorithm", func(t *testing.T) {
+		for _, algorithm := range []string{encryption.AesCfb, encryption.AesGcm, encryption.ChaCha20Poly1305} {
+			encrypted, err := svc.EncryptWithAlgorithm(ctx, []byte("grafana"), "1234", algorithm)
+			require.NoError(t, err)
+
+			decrypted, decryptedWith, err := svc.DecryptWithAlgorithm(ctx, encrypted, "1234")
+			require.NoError(t, err)
+			assert.Equal(t, []byte("grafana"), decrypted)
+			assert.Equal(t, algorithm, decryptedWith)
+		}
+	})
+
+	t.Run("legacy payloads should report aes-cfb", func(t *testing.T) {
+		// Same legacy ciphertext as in Test_Service, 'grafana' with '1234'.
+		ciphertext := []byte{73, 71, 50, 57, 121, 110, 90, 109, 115, 23, 237, 13, 130, 188, 151, 118, 98, 103, 80, 209, 79, 143, 22, 122, 44, 40, 102, 41, 136, 16, 27}
+
+		decrypted, algorithm, err := svc.DecryptWithAlgorithm(ctx, ciphertext, "1234")
+		require.NoError(t, err)
+		assert.Equal(t, []byte("grafana"), decrypted)
+		assert.Equal(t, encryption.AesCfb, algorithm)
+	})
+
+	t.Run("failed decryption should still report the algorithm", func(t *testing.T) {
+		encrypted, err := svc.EncryptWithAlgorithm(ctx, []byte("grafana"), "1234", encryption.AesGcm)
+		require.NoError(t, err)
+
+		_, algorithm, err := svc.DecryptWithAlgorithm(ctx, encrypted, "4321")
+		require.Error(t, err)
+		assert.Equal(t, encryption.AesGcm, algorithm)
+	})
+
+	t.Run("malformed header should report no algorithm", func(t *testing.T) {
+		_, algorithm, err := svc.DecryptWithAlgorithm(ctx, []byte("*grafana"), "1234")
+		require.Error(t, err)
+		assert.Empty(t, algorithm)
+	})
+}
+
+func Test_Service_DecryptErrors(t *testing.T) {
+	ctx := context.Background()
+
+	svc := SetupTestService(t)
+
+	t.Run("decipher errors should name the algorithm", func(t *testing.T) {
+		errBroken := errors.New("broken decipher")
+		require.NoError(t, svc.RegisterCipher("broken", fakeCipher{}, failingDecipher{err: errBroken}))
+
+		encrypted, err := svc.EncryptWithAlgorithm(ctx, []byte("grafana"), "1234", "broken")
+		require.NoError(t, err)
+
+		_, err = svc.Decrypt(ctx, encrypted, "1234")
+		require.ErrorIs(t, err, errBroken)
+		assert.EqualError(t, err, `decrypt with "broken" failed: broken decipher`)
+	})
+
+	t.Run("authentication failures should name the algorithm", func(t *testing.T) {
+		encrypted, err := svc.EncryptWithAlgorithm(ctx, []byte("grafana"), "1234", encryption.AesGcm)
+		require.NoError(t, err)
+
+		_, err = svc.Decrypt(ctx, encrypted, "4321")
+		require.ErrorIs(t, err, encryption.ErrAuthenticationFailed)
+		assert.EqualError(t, err, `decrypt with "aes-gcm" failed: message authentication failed`)
+	})
+
+	t.Run("legacy payloads should name aes-cfb", func(t *testing.T) {
+		_, err := svc.Decrypt(ctx, []byte("grafana"), "1234")
+		assert.EqualError(t, err, `decrypt with "aes-cfb" failed: unable to compute salt`)
+	})
+}
+
+func Test_Service_CanDecrypt(t *testing.T) {
+	ctx := context.Background()
+
+	svc := SetupTestService(t)
+	section := svc.settingsProvider.(*setting.OSSImpl).Cfg.Raw.Section(securitySection)
+
+	gcm, err := svc.EncryptWithAlgorithm(ctx, []byte("grafana"), "1234", encryption.AesGcm)
+	require.NoError(t, err)
+
+	cfb, err := svc.EncryptWithAlgorithm(ctx, []byte("grafana"), "1234", encryption.AesCfb)
+	require.NoError(t, err)
+	legacy := cfb[len(encodeEncryptionAlgorithm(encryption.AesCfb)):]
+
+	testCases := []struct {
+		desc      string
+		payload   []byte
+		ok        bool
+		algorithm string
+	}{
+		{desc: "known algorithm", payload: gcm, ok: true, algorithm: encryption.AesGcm},
+		{desc: "unknown algorithm", payload: []byte("*dW5rbm93bg*grafana"), algorithm: "unknown"},
+		{desc: "legacy payload", payload: legacy, ok: true, algorithm: encryption.AesCfb},
+		{desc: "malformed header", payload: []byte("*grafana")},
+		{desc: "empty payload", payload: nil},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			ok, algorithm := svc.CanDecrypt(tc.payload)
+			assert.Equal(t, tc.ok, ok)
+			assert.Equal(t, tc.algorithm, algorithm)
+		})
+	}
+
+	t.Run("disallowed legacy payload", func(t *testing.T) {
+		section.Key(allowLegacyUnprefixedKey).SetValue("false")
+		t.Cleanup(func() { section.DeleteKey(allowLegacyUnprefixedKey) })
+
+		ok, algorithm := svc.CanDecrypt(legacy)
+		assert.False(t, ok)
+		assert.Equal(t, encryption.AesCfb, algorithm)
+
+		ok, _ = svc.CanDecrypt(cfb)
+		assert.True(t, ok)
+	})
+}
+
+func Test_Service_DecryptLegacy(t *testing.T) {
+	ctx := context.Background()
+
+	svc := SetupTestService(t)
+
+	// legacyEncrypt encrypts the given payload as the Grafana versions
+	// without algorithm prefix did, but with the given salt, so the
+	// payload can start with the algorithm delimiter.
+	legacyEncrypt := func(t *testing.T, payload []byte, secret, salt string) []byte {
+		t.Helper()
+
+		key, err := encryption.KeyToBytes(secret, salt)
+		require.NoError(t, err)
+
+		block, err := aes.NewCipher(key)
+		require.NoError(t, err)
+
+		ciphertext := make([]byte, encryption.SaltLength+aes.BlockSize+len(payload))
+		copy(ciphertext, salt)
+		iv := ciphertext[encryption.SaltLength : encryption.SaltLength+aes.BlockSize]
+		cipher.NewCFBEncrypter(block, iv).XORKeyStream(ciphertext[encryption.SaltLength+aes.BlockSize:], payload)
+		return ciphertext
+	}
+
+	t.Run("legacy payloads should be decrypted", func(t *testing.T) {
+		legacy := legacyEncrypt(t, []byte("grafana"), "1234", "abcdefgh")
+
+		decrypted, err := svc.DecryptLegacy(ctx, legacy, "1234")
+		require.NoError(t, err)
+		assert.Equal(t, []byte("grafana"), decrypted)
+	})
+
+	t.Run("legacy payloads starting with the delimiter should be decrypted", func(t *testing.T) {
+		legacy := legacyEncrypt(t, []byte("grafana"), "1234", "*YWVzLWd")
+		require.Equal(t, byte('*'), legacy[0])
+
+		decrypted, err := svc.DecryptLegacy(ctx, legacy, "1234")
+		require.NoError(t, err)
+		assert.Equal(t, []byte("grafana"), decrypted)
+
+		decrypted, err = svc.Decrypt(ctx, legacy, "1234")
+		if err == nil {
+			assert.NotEqual(t, []byte("grafana"), decrypted)
+		}
+	})
+
+	t.Run("prefixed payloads should not be decoded", func(t *testing.T) {
+		encrypted, err := svc.EncryptWithAlgorithm(ctx, []byte("grafana"), "1234", encryption.AesCfb)
+		require.NoError(t, err)
+
+		decrypted, err := svc.DecryptLegacy(ctx, encrypted, "1234")
+		require.NoError(t, err)
+		assert.NotEqual(t, []byte("grafana"), decrypted)
+	})
+
+	t.Run("empty secret should fail", func(t *testing.T) {
+		_, err := svc.DecryptLegacy(ctx, legacyEncrypt(t, []byte("grafana"), "1234", "abcdefgh"), "")
+		require.ErrorIs(t, err, encryption.ErrEmptySecret)
+	})
+}
+
+func Test_Service_AllowLegacyUnprefixed(t *testing.T) {
+	ctx := context.Background()
+
+	svc := SetupTestService(t)
+	settings := svc.settingsProvider.(*setting.OSSImpl)
+	section := settings.Cfg.Raw.Section(securitySection)
+	setAlgorithm(t, svc, encryption.AesCfb)
+
+	prefixed, err := svc.Encrypt(ctx, []byte("grafana"), "1234")
+	require.NoError(t, err)
+
+	prefix := encodeEncryptionAlgorithm(encryption.AesCfb)
+	require.Equal(t, prefix, prefixed[:len(prefix)])
+	legacy := prefixed[len(prefix):]
+
+	t.Run("legacy payloads should be decrypted by default", func(t *testing.T) {
+		for _, payload := range [][]byte{legacy, prefixed} {
+			decrypted, err := svc.Decrypt(ctx, payload, "1234")
+			require.NoError(t, err)
+			assert.Equal(t, []byte("grafana"), decrypted)
+		}
+
+		decrypted, err := svc.DecryptSlice(ctx, [][]byte{legacy, prefixed}, "1234")
+		require.NoError(t, err)
+		assert.Equal(t, [][]byte{[]byte("grafana"), []byte("grafana")}, decrypted)
+	})
+
+	t.Run("legacy payloads should be rejected when disallowed", func(t *testing.T) {
+		section.Key(allowLegacyUnprefixedKey).SetValue("false")
+		t.Cleanup(func() { section.DeleteKey(allowLegacyUnprefixedKey) })
+
+		_, err := svc.Decrypt(ctx, legacy, "1234")
+		require.ErrorIs(t, err, errLegacyUnprefixed)
+
+		_, err = svc.DecryptSlice(ctx, [][]byte{prefixed, legacy}, "1234")
+		require.ErrorIs(t, err, errLegacyUnprefixed)
+
+		decrypted, err := svc.Decrypt(ctx, prefixed, "1234")
+		require.NoError(t, err)
+		assert.Equal(t, []byte("grafana"), decrypted)
+	})
+}
+
+func Test_Service_FIPSMode(t *testing.T) {
+	ctx := context.Background()
+
+	newService := func(t *testing.T, algorithm string, fipsMode bool) (*Service, error) {
+		settings := &setting.OSSImpl{Cfg: setting.NewCfg()}
+		section := settings.Cfg.Raw.Section(securitySection)
+		section.Key(encryptionAlgorithmKey).SetValue(algorithm)
+		section.Key(fipsModeKey).SetValue(fmt.Sprint(fipsMode))
+
+		return ProvideEncryptionService(provider.ProvideEncryptionProvider(settings), &usagestats.UsageStatsMock{T: t}, settings)
+	}
+
+	t.Run("non-approved algorithm should be rejected", func(t *testing.T) {
+		svc, err := newService(t, encryption.ChaCha20Poly1305, true)
+		require.Error(t, err)
+		assert.Nil(t, svc)
+		assert.Equal(t, "encryption algorithm configured is not FIPS approved", err.Error())
+	})
+
+	t.Run("approved algorithm should be accepted", func(t *testing.T) {
+		svc, err := newService(t, encryption.AesGcm, true)
+		require.NoError(t, err)
+
+		assert.Equal(t, []string{encryption.AesCbcHmac, encryption.AesGcm}, svc.SupportedAlgorithms())
+
+		encrypted, err := svc.Encrypt(ctx, []byte("grafana"), "1234")
+		require.NoError(t, err)
+
+		decrypted, err := svc.Decrypt(ctx, encrypted, "1234")
+		require.NoError(t, err)
+		assert.Equal(t, []byte("grafana"), decrypted)
+
+		err = svc.RegisterCipher("custom", fakeCipher{}, fakeDecipher{})
+		require.Error(t, err)
+	})
+
+	t.Run("payloads of non-approved algorithms should not be decrypted", func(t *testing.T) {
+		nonFIPS, err := newService(t, encryption.ChaCha20Poly1305, false)
+		require.NoError(t, err)
+
+		encrypted, err := nonFIPS.Encrypt(ctx, []byte("grafana"), "1234")
+		require.NoError(t, err)
+
+		fips, err := newService(t, encryption.AesGcm, true)
+		require.NoError(t, err)
+
+		_, err = fips.Decrypt(ctx, encrypted, "1234")
+		require.Error(t, err)
+		assert.Equal(t, "payload encrypted with algorithm 'chacha20poly1305', which is not FIPS approved", err.Error())
+
+		_, err = fips.Decrypt(ctx, []byte("legacy"), "1234")
+		require.Error(t, err)
+	})
+
+	t.Run("reload to a non-approved algorithm should fail", func(t *testing.T) {
+		svc, err := newService(t, encryption.AesGcm, true)
+		require.NoError(t, err)
+
+		cfg := setting.NewCfg()
+		cfg.Raw.Section(securitySection).Key(encryptionAlgorithmKey).SetValue(encryption.AesCfb)
+
+		require.Error(t, svc.Reload((&setting.OSSImpl{Cfg: cfg}).Section(securitySection)))
+		assert.Equal(t, encryption.AesGcm, svc.CurrentAlgorithm())
+	})
+}
+
+func Test_DecryptWith(t *testing.T) {
+	ctx := context.Background()
+
+	svc := SetupTestService(t)
+	settings := svc.settingsProvider.(*setting.OSSImpl)
+	section := settings.Cfg.Raw.Section(securitySection)
+	deciphers := provider.ProvideEncryptionProvider(settings).ProvideDeciphers()
+
+	for _, algorithm := range svc.SupportedAlgorithms() {
+		setAlgorithm(t, svc, algorithm)
+		section.Key(compressPayloadsKey).SetValue("true")
+
+		encrypted, err := svc.Encrypt(ctx, []byte(strings.Repeat("grafana", 10)), "1234")
+		require.NoError(t, err)
+
+		decrypted, err := DecryptWith(ctx, deciphers, encrypted, "1234")
+		require.NoError(t, err, algorithm)
+		assert.Equal(t, []byte(strings.Repeat("grafana", 10)), decrypted)
+	}
+
+	t.Run("legacy payload should be decrypted", func(t *testing.T) {
+		// 'grafana' encrypted with '1234' as secret and no algorithm metadata.
+		legacy := []byte{73, 71, 50, 57, 121, 110, 90, 109, 115, 23, 237, 13, 130, 188, 151, 118, 98, 103, 80, 209, 79, 143, 22, 122, 44, 40, 102, 41, 136, 16, 27}
+
+		decrypted, err := DecryptWith(ctx, deciphers, legacy, "1234")
+		require.NoError(t, err)
+		assert.Equal(t, []byte("grafana"), decrypted)
+	})
+
+	t.Run("unknown algorithm should fail", func(t *testing.T) {
+		_, err := DecryptWith(ctx, deciphers, []byte("*dW5rbm93bg*grafana"), "1234")
+		require.ErrorIs(t, err, encryption.ErrUnknownAlgorithm)
+	})
+
+	t.Run("deciphers without the default algorithm should work", func(t *testing.T) {
+		encrypted, err := svc.EncryptWithAlgorithm(ctx, []byte("grafana"), "1234", encryption.AesGcm)
+		require.NoError(t, err)
+
+		only := map[string]encryption.Decipher{encryption.AesGcm: deciphers[encryption.AesGcm]}
+		decrypted, err := DecryptWith(ctx, only, encrypted, "1234")
+		require.NoError(t, err)
+		assert.Equal(t, []byte("grafana"), decrypted)
+	})
+}
+
+func Test_Service_DecryptWithSecrets(t *testing.T) {
+	ctx := context.Background()
+
+	svc := SetupTestService(t)
+	setAlgorithm(t, svc, encryption.AesGcm)
+
+	underOld, err := svc.Encrypt(ctx, []byte("old"), "old secret")
+	require.NoError(t, err)
+
+	underNew, err := svc.Encrypt(ctx, []byte("new"), "new secret")
+	require.NoError(t, err)
+
+	secrets := []string{"new secret", "old secret"}
+
+	t.Run("payloads under any of the secrets should be decrypted", func(t *testing.T) {
+		decrypted, err := svc.DecryptWithSecrets(ctx, underNew, secrets)
+		require.NoError(t, err)
+		assert.Equal(t, []byte("new"), decrypted)
+
+		decrypted, err = svc.DecryptWithSecrets(ctx, underOld, secrets)
+		require.NoError(t, err)
+		assert.Equal(t, []byte("old"), decrypted)
+	})
+
+	t.Run("payloads under none of the secrets should fail", func(t *testing.T) {
+		_, err := svc.DecryptWithSecrets(ctx, underOld, []string{"new secret", "", "other secret"})
+		require.ErrorIs(t, err, encryption.ErrAuthenticationFailed)
+		assert.Equal(t, `failed to decrypt with any of the given secrets (secret 0: decrypt with "aes-gcm" failed: message authentication failed; secret 1: encryption secret cannot be empty; secret 2: decrypt with "aes-gcm" failed: message authentication failed): decrypt with "aes-gcm" failed: message authentication failed`, err.Error())
+	})
+
+	t.Run("without secrets should fail", func(t *testing.T) {
+		_, err := svc.DecryptWithSecrets(ctx, underOld, nil)
+		require.ErrorIs(t, err, encryption.ErrEmptySecret)
+	})
+
+	t.Run("malformed payloads should fail", func(t *testing.T) {
+		_, err := svc.DecryptWithSecrets(ctx, []byte("*dW5rbm93bg*grafana"), secrets)
+		require.ErrorIs(t, err, encryption.ErrUnknownAlgorithm)
+	})
+}
+
+func Test_Service_ReEncrypt(t *testing.T) {
+	ctx := context.Background()
+
+	svc := SetupTestService(t)
+
+	t.Run("re-encrypt should rotate the secret and upgrade the algorithm", func(t *testing.T) {
+		setAlgorithm(t, svc, encryption.AesCfb)
+
+		encrypted, err := svc.Encrypt(ctx, []byte("grafana"), "old")
+		require.NoError(t, err)
+
+		setAlgorithm(t, svc, encryption.AesGcm)
+
+		reEncrypted, err := svc.ReEncrypt(ctx, encrypted, "old", "new")
+		require.NoError(t, err)
+
+		algorithm, _, err := deriveEncryptionAlgorithm(reEncrypted)
+		require.NoError(t, err)
+		assert.Equal(t, encryption.AesGcm, algorithm)
+
+		decrypted, err := svc.Decrypt(ctx, reEncrypted, "new")
+		require.NoError(t, err)
+		assert.Equal(t, []byte("grafana"), decrypted)
+
+		_, err = svc.Decrypt(ctx, reEncrypted, "old")
+		require.Error(t, err)
+	})
+
+	t.Run("re-encrypt with wrong old secret should fail", func(t *testing.T) {
+		setAlgorithm(t, svc, encryption.AesGcm)
+
+		encrypted, err := svc.Encrypt(ctx, []byte("grafana"), "old")
+		require.NoError(t, err)
+
+		_, err = svc.ReEncrypt(ctx, encrypted, "wrong", "new")
+		require.ErrorIs(t, err, encryption.ErrAuthenticationFailed)
+	})
+}
+
+func Test_Service_ReEncryptJsonData(t *testing.T) {
+	ctx := context.Background()
+
+	svc := SetupTestService(t)
+
+	setAlgorithm(t, svc, encryption.AesCfb)
+	sjd, err := svc.EncryptJsonData(ctx, map[string]string{
+		"password":    "grafana",
+		"certificate": "cert",
+		"token":       "token",
+	}, "old")
+	require.NoError(t, err)
+
+	setAlgorithm(t, svc, encryption.AesGcm)
+
+	t.Run("should rotate the secret of all the values", func(t *testing.T) {
+		reEncrypted, err := svc.ReEncryptJsonData(ctx, sjd, "old", "new")
+		require.NoError(t, err)
+		require.Len(t, reEncrypted, 3)
+
+		for _, payload := range reEncrypted {
+			algorithm, _, err := deriveEncryptionAlgorithm(payload)
+			require.NoError(t, err)
+			assert.Equal(t, encryption.AesGcm, algorithm)
+		}
+
+		decrypted, err := svc.DecryptJsonData(ctx, reEncrypted, "new")
+		require.NoError(t, err)
+		assert.Equal(t, map[string]string{
+			"password":    "grafana",
+			"certificate": "cert",
+			"token":       "token",
+		}, decrypted)
+	})
+
+	t.Run("should fail without partial output", func(t *testing.T) {
+		withCorrupt := map[string][]byte{"password": sjd["password"], "token": []byte("*YWVzLWdjbQ*corrupt")}
+
+		reEncrypted, err := svc.ReEncryptJsonData(ctx, withCorrupt, "old", "new")
+		require.Error(t, err)
+		assert.Nil(t, reEncrypted)
+		assert.Contains(t, err.Error(), "key 'token'")
+	})
+
+	t.Run("with empty data should return empty data", func(t *testing.T) {
+		reEncrypted, err := svc.ReEncryptJsonData(ctx, map[string][]byte{}, "old", "new")
+		require.NoError(t, err)
+		assert.Empty(t, reEncrypted)
+	})
+}
+
+func Test_Service_EncryptJsonData(t *testing.T) {
+	ctx := context.Background()
+
+	svc := SetupTestService(t)
+	settings := svc.settingsProvider.(*setting.OSSImpl)
+	setAlgorithm(t, svc, encryption.AesGcm)
+
+	kv := make(map[string]string)
+	for i := 0; i < 50; i++ {
+		kv[fmt.Sprintf("key%d", i)] = fmt.Sprintf("value%d", i)
+	}
+
+	for _, workers := range []string{"1", "4", ""} {
+		t.Run(fmt.Sprintf("with %q workers should encrypt all the values", workers), func(t *testing.T) {
+			settings.Cfg.Raw.Section(securitySection).Key(jsonDataWorkersKey).SetValue(workers)
+
+			encrypted, err := svc.EncryptJsonData(ctx, kv, "1234")
+			require.NoError(t, err)
+			require.Len(t, encrypted, len(kv))
+
+			decrypted, err := svc.DecryptJsonData(ctx, encrypted, "1234")
+			require.NoError(t, err)
+			assert.Equal(t, kv, decrypted)
+		})
+	}
+
+	t.Run("with cancelled context should fail", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(ctx)
+		cancel()
+
+		_, err := svc.EncryptJsonData(ctx, kv, "1234")
+		require.ErrorIs(t, err, context.Canceled)
+	})
+
+	t.Run("with failing encryption should return the error", func(t *testing.T) {
+		encrypted, err := svc.EncryptJsonDataWithAlgorithm(ctx, kv, "1234", "unknown")
+		require.ErrorIs(t, err, encryption.ErrUnknownAlgorithm)
+		assert.Nil(t, encrypted)
+	})
+
+	t.Run("with failing encryption should name the failed key", func(t *testing.T) {
+		require.NoError(t, svc.RegisterCipher("failing-value", failingValueCipher{value: "value17"}, fakeDecipher{}))
+		setAlgorithm(t, svc, "failing-value")
+
+		for _, workers := range []string{"1", "4", ""} {
+			settings.Cfg.Raw.Section(securitySection).Key(jsonDataWorkersKey).SetValue(workers)
+
+			for i := 0; i < 10; i++ {
+				_, err := svc.EncryptJsonData(ctx, kv, "1234")
+				require.ErrorIs(t, err, errFailingValue)
+				assert.EqualError(t, err, "failed to encrypt value of key 'key17': failing value", "with %q workers", workers)
+			}
+		}
+	})
+
+	t.Run("with several failing values should name the first key in order", func(t *testing.T) {
+		setAlgorithm(t, svc, "failing-value")
+		settings.Cfg.Raw.Section(securitySection).Key(jsonDataWorkersKey).SetValue("1")
+
+		failing := map[string]string{"b": "value17", "a": "value17", "c": "value17"}
+		for i := 0; i < 10; i++ {
+			_, err := svc.EncryptJsonData(ctx, failing, "1234")
+			assert.EqualError(t, err, "failed to encrypt value of key 'a': failing value")
+		}
+	})
+}
+
+func Test_Service_DecryptJsonDataErrors(t *testing.T) {
+	ctx := context.Background()
+
+	svc := SetupTestService(t)
+
+	for _, algorithm := range []string{encryption.AesGcm, encryption.AesSiv} {
+		t.Run(algorithm+" should name the first failed key in order", func(t *testing.T) {
+			sjd, err := svc.EncryptJsonDataWithAlgorithm(ctx, map[string]string{"a": "1", "b": "2", "c": "3", "d": "4"}, "1234", algorithm)
+			require.NoError(t, err)
+
+			sjd["d"][len(sjd["d"])-1] ^= 0x01
+			sjd["b"][len(sjd["b"])-1] ^= 0x01
+
+			for i := 0; i < 10; i++ {
+				_, err := svc.DecryptJsonData(ctx, sjd, "1234")
+				require.ErrorIs(t, err, encryption.ErrAuthenticationFailed)
+				assert.Contains(t, err.Error(), "failed to decrypt value of key 'b'")
+			}
+		})
+	}
+}
+
+func Test_Service_DecryptJsonDataFunc(t *testing.T) {
+	ctx := context.Background()
+
+	svc := SetupTestService(t)
+
+	sjd, err := svc.EncryptJsonDataWithAlgorithm(ctx, map[string]string{"a": "1", "b": "2", "c": "3", "d": "4"}, "1234", encryption.AesGcm)
+	require.NoError(t, err)
+	sjd["b"][len(sjd["b"])-1] ^= 0x01
+	sjd["d"][len(sjd["d"])-1] ^= 0x01
+
+	t.Run("continue policy should decrypt the healthy values", func(t *testing.T) {
+		var failed []string
+		decrypted, err := svc.DecryptJsonDataFunc(ctx, sjd, "1234", func(key string, err error) bool {
+			assert.ErrorIs(t, err, encryption.ErrAuthenticationFailed)
+			failed = append(failed, key)
+			return true
+		})
+		require.NoError(t, err)
+		assert.Equal(t, map[string]string{"a": "1", "c": "3"}, decrypted)
+		assert.Equal(t, []string{"b", "d"}, failed)
+	})
+
+	t.Run("abort policy should stop at the first failure", func(t *testing.T) {
+		var failed []string
+		decrypted, err := svc.DecryptJsonDataFunc(ctx, sjd, "1234", func(key string, err error) bool {
+			failed = append(failed, key)
+			return false
+		})
+		require.ErrorIs(t, err, encryption.ErrAuthenticationFailed)
+		assert.Contains(t, err.Error(), "failed to decrypt value of key 'b'")
+		assert.Nil(t, decrypted)
+		assert.Equal(t, []string{"b"}, failed)
+	})
+
+	t.Run("nil callback should abort", func(t *testing.T) {
+		_, err := svc.DecryptJsonDataFunc(ctx, sjd, "1234", nil)
+		require.ErrorIs(t, err, encryption.ErrAuthenticationFailed)
+	})
+}
+
+func Test_Service_EncryptJsonDataSkipEmpty(t *testing.T) {
+	ctx := context.Background()
+
+	svc := SetupTestService(t)
+	kv := map[string]string{"password": "grafana", "basicAuthPassword": "", "tlsClientKey": "1234", "tlsCACert": ""}
+
+	t.Run("empty values should be left out", func(t *testing.T) {
+		encrypted, err := svc.EncryptJsonDataSkipEmpty(ctx, kv, "1234")
+		require.NoError(t, err)
+		require.Len(t, encrypted, 2)
+		assert.NotContains(t, encrypted, "basicAuthPassword")
+		assert.NotContains(t, encrypted, "tlsCACert")
+
+		decrypted, err := svc.DecryptJsonData(ctx, encrypted, "1234")
+		require.NoError(t, err)
+		assert.Equal(t, map[string]string{"password": "grafana", "tlsClientKey": "1234"}, decrypted)
+	})
+
+	t.Run("empty values should still be encrypted by EncryptJsonData", func(t *testing.T) {
+		encrypted, err := svc.EncryptJsonData(ctx, kv, "1234")
+		require.NoError(t, err)
+		require.Len(t, encrypted, len(kv))
+
+		decrypted, err := svc.DecryptJsonData(ctx, encrypted, "1234")
+		require.NoError(t, err)
+		assert.Equal(t, kv, decrypted)
+	})
+
+	t.Run("only empty values should result in an empty map", func(t *testing.T) {
+		encrypted, err := svc.EncryptJsonDataSkipEmpty(ctx, map[string]string{"password": ""}, "1234")
+		require.NoError(t, err)
+		assert.Empty(t, encrypted)
+	})
+}
+
+func Test_Service_EncryptJsonDataWithAlgorithm(t *testing.T) {
+	ctx := context.Background()
+
+	svc := SetupTestService(t)
+	kv := map[string]string{"password": "grafana", "basicAuthPassword": "1234"}
+
+	t.Run("values should be encrypted with the given algorithm", func(t *testing.T) {
+		require.NotEqual(t, encryption.ChaCha20Poly1305, svc.CurrentAlgorithm())
+
+		encrypted, err := svc.EncryptJsonDataWithAlgorithm(ctx, kv, "1234", encryption.ChaCha20Poly1305)
+		require.NoError(t, err)
+		require.Len(t, encrypted, len(kv))
+
+		for _, payload := range encrypted {
+			algorithm, _, err := deriveEncryptionAlgorithm(payload)
+			require.NoError(t, err)
+			assert.Equal(t, encryption.ChaCha20Poly1305, algorithm)
+		}
+
+		decrypted, err := svc.DecryptJsonData(ctx, encrypted, "1234")
+		require.NoError(t, err)
+		assert.Equal(t, kv, decrypted)
+	})
+
+	t.Run("unknown algorithm should fail", func(t *testing.T) {
+		encrypted, err := svc.EncryptJsonDataWithAlgorithm(ctx, kv, "1234", "unknown")
+		require.ErrorIs(t, err, encryption.ErrUnknownAlgorithm)
+		assert.Nil(t, encrypted)
+
+		_, err = svc.EncryptJsonDataWithAlgorithm(ctx, map[string]string{}, "1234", "unknown")
+		require.ErrorIs(t, err, encryption.ErrUnknownAlgorithm)
+	})
+}
+
+func Test_Service_EncryptJsonDataBound(t *testing.T) {
+	ctx := context.Background()
+
+	svc := SetupTestService(t)
+	setAlgorithm(t, svc, encryption.AesGcm)
+
+	kv := map[string]string{"password": "grafana", "basicAuthPassword": "1234", "": "empty key"}
+
+	t.Run("bound values should be decrypted", func(t *testing.T) {
+		encrypted, err := svc.EncryptJsonDataBound(ctx, kv, "1234")
+		require.NoError(t, err)
+
+		decrypted, err := svc.DecryptJsonDataBound(ctx, encrypted, "1234")
+		require.NoError(t, err)
+		assert.Equal(t, kv, decrypted)
+
+		value, err := svc.DecryptWithAAD(ctx, encrypted["password"], []byte("password"), "1234")
+		require.NoError(t, err)
+		assert.Equal(t, []byte("grafana"), value)
+	})
+
+	t.Run("swapped values should fail", func(t *testing.T) {
+		encrypted, err := svc.EncryptJsonDataBound(ctx, kv, "1234")
+		require.NoError(t, err)
+
+		encrypted["password"], encrypted["basicAuthPassword"] = encrypted["basicAuthPassword"], encrypted["password"]
+
+		for _, key := range []string{"password", "basicAuthPassword"} {
+			_, err := svc.DecryptJsonDataBound(ctx, map[string][]byte{key: encrypted[key]}, "1234")
+			require.ErrorIs(t, err, encryption.ErrAuthenticationFailed, key)
+		}
+	})
+
+	t.Run("unbound values should fail", func(t *testing.T) {
+		encrypted, err := svc.EncryptJsonData(ctx, kv, "1234")
+		require.NoError(t, err)
+
+		_, err = svc.DecryptJsonDataBound(ctx, encrypted, "1234")
+		require.ErrorIs(t, err, encryption.ErrAuthenticationFailed)
+	})
+
+	t.Run("algorithm without associated data support should fail", func(t *testing.T) {
+		setAlgorithm(t, svc, encryption.AesCfb)
+
+		_, err := svc.EncryptJsonDataBound(ctx, kv, "1234")
+		require.ErrorIs(t, err, encryption.ErrAADNotSupported)
+	})
+}
+
+func Test_Service_AAD(t *testing.T) {
+	ctx := context.Background()
+
+	svc := SetupTestService(t)
+	settings := svc.settingsProvider.(*setting.OSSImpl)
+	section := settings.Cfg.Raw.Section(securitySection)
+
+	for _, algorithm := range []string{encryption.AesGcm, encryption.AesCbcHmac, encryption.ChaCha20Poly1305, encryption.AesSiv} {
+		for _, compress := range []string{"false", "true"} {
+			t.Run(fmt.Sprintf("with %s and compression %s should bind the associated data", algorithm, compress), func(t *testing.T) {
+				setAlgorithm(t, svc, algorithm)
+				section.Key(compressPayloadsKey).SetValue(compress)
+
+				payload := []byte(strings.Repeat("grafana", 10))
+
+				encrypted, err := svc.EncryptWithAAD(ctx, payload, []byte("datasource:1"), "1234")
+				require.NoError(t, err)
+
+				decrypted, err := svc.DecryptWithAAD(ctx, encrypted, []byte("datasource:1"), "1234")
+				require.NoError(t, err)
+				assert.Equal(t, payload, decrypted)
+
+				_, err = svc.DecryptWithAAD(ctx, encrypted, []byte("datasource:2"), "1234")
+				require.ErrorIs(t, err, encryption.ErrAuthenticationFailed)
+
+				_, err = svc.DecryptWithAAD(ctx, encrypted, nil, "1234")
+				require.ErrorIs(t, err, encryption.ErrAuthenticationFailed)
+
+				_, err = svc.Decrypt(ctx, encrypted, "1234")
+				require.ErrorIs(t, err, encryption.ErrAuthenticationFailed)
+			})
+		}
+	}
+
+	t.Run("with unauthenticated algorithm should fail", func(t *testing.T) {
+		setAlgorithm(t, svc, encryption.AesCfb)
+
+		_, err := svc.EncryptWithAAD(ctx, []byte("grafana"), []byte("datasource:1"), "1234")
+		require.ErrorIs(t, err, encryption.ErrAADNotSupported)
+
+		_, err = svc.EncryptWithAAD(ctx, []byte("grafana"), nil, "1234")
+		require.ErrorIs(t, err, encryption.ErrAADNotSupported)
+
+		encrypted, err := svc.Encrypt(ctx, []byte("grafana"), "1234")
+		require.NoError(t, err)
+
+		_, err = svc.DecryptWithAAD(ctx, encrypted, []byte("datasource:1"), "1234")
+		require.ErrorIs(t, err, encryption.ErrAADNotSupported)
+	})
+
+	t.Run("with algorithm without associated data support should fail", func(t *testing.T) {
+		require.NoError(t, svc.RegisterCipher("fake", fakeCipher{}, fakeDecipher{}))
+		setAlgorithm(t, svc, "fake")
+
+		_, err := svc.EncryptWithAAD(ctx, []byte("grafana"), []byte("datasource:1"), "1234")
+		require.ErrorIs(t, err, encryption.ErrAADNotSupported)
+	})
+}
+
+func Test_Service_HealthCheck(t *testing.T) {
+	ctx := context.Background()
+
+	svc := SetupTestService(t)
+
+	require.NoError(t, svc.RegisterCipher("broken", fakeCipher{}, echoDecipher{}))
+
+	t.Run("with healthy algorithm should succeed", func(t *testing.T) {
+		for _, algorithm := range []string{encryption.AesCfb, encryption.AesGcm, encryption.AesCbcHmac, encryption.ChaCha20Poly1305} {
+			setAlgorithm(t, svc, algorithm)
+			require.NoError(t, svc.HealthCheck(ctx), algorithm)
+		}
+	})
+
+	t.Run("with unavailable algorithm should fail", func(t *testing.T) {
+		// As if the cipher of the applied algorithm was gone,
+		// which a reload cannot lead to, as it'd be rejected.
+		svc.mtx.Lock()
+		applied := svc.appliedAlgorithm
+		svc.appliedAlgorithm = "unknown"
+		svc.mtx.Unlock()
+		t.Cleanup(func() {
+			svc.mtx.Lock()
+			svc.appliedAlgorithm = applied
+			svc.mtx.Unlock()
+		})
+
+		err := svc.HealthCheck(ctx)
+		require.ErrorIs(t, err, encryption.ErrUnknownAlgorithm)
+		assert.Contains(t, err.Error(), "failed to encrypt with 'unknown'")
+	})
+
+	t.Run("with mismatching round-trip should fail", func(t *testing.T) {
+		setAlgorithm(t, svc, "broken")
+
+		err := svc.HealthCheck(ctx)
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "doesn't match")
+	})
+
+	t.Run("with cancelled context should fail", func(t *testing.T) {
+		setAlgorithm(t, svc, encryption.AesGcm)
+
+		ctx, cancel := context.WithCancel(ctx)
+		cancel()
+
+		require.ErrorIs(t, svc.HealthCheck(ctx), context.Canceled)
+	})
+}
+
+func Test_Service_RegisterCipher(t *testing.T) {
+	ctx := context.Background()
+
+	svc := SetupTestService(t)
+	settings := svc.settingsProvider.(*setting.OSSImpl)
+
+	t.Run("registering a cipher should make it available", func(t *testing.T) {
+		err := svc.RegisterCipher("fake", fakeCipher{}, fakeDecipher{})
+		require.NoError(t, err)
+
+		section := settings.Section(securitySection)
+		setAlgorithm(t, svc, "fake")
+		require.NoError(t, svc.Validate(section))
+
+		encrypted, err := svc.Encrypt(ctx, []byte("grafana"), "1234")
+		require.NoError(t, err)
+
+		algorithm, toDecrypt, err := deriveEncryptionAlgorithm(encrypted)
+		require.NoError(t, err)
+		assert.Equal(t, "fake", algorithm)
+		assert.Equal(t, []byte("anafarg"), toDecrypt)
 
-		_, err := svc.Encrypt(ctx, []byte("grafana"), "1234")
+		decrypted, err := svc.Decrypt(ctx, encrypted, "1234")
+		require.NoError(t, err)
+		assert.Equal(t, []byte("grafana"), decrypted)
+	})
+
+	t.Run("registering an already registered algorithm should fail", func(t *testing.T) {
+		err := svc.RegisterCipher(encryption.AesGcm, fakeCipher{}, fakeDecipher{})
+		require.Error(t, err)
+
+		err = svc.RegisterCipher("fake", fakeCipher{}, fakeDecipher{})
 		require.Error(t, err)
 	})
 
-	t.Run("decrypting legacy ciphertext should work", func(t *testing.T) {
-		// Raw slice of bytes that corresponds to the following ciphertext:
-		// - 'grafana' as payload
-		// - '1234' as secret
-		// - no encryption algorithm metadata
-		ciphertext := []byte{73, 71, 50, 57, 121, 110, 90, 109, 115, 23, 237, 13, 130, 188, 151, 118, 98, 103, 80, 209, 79, 143, 22, 122, 44, 40, 102, 41, 136, 16, 27}
+	t.Run("registering an algorithm without name should fail", func(t *testing.T) {
+		err := svc.RegisterCipher("", fakeCipher{}, fakeDecipher{})
+		require.Error(t, err)
+	})
 
-		decrypted, err := svc.Decrypt(context.Background(), ciphertext, "1234")
+	t.Run("configuring a cipher with an unsupported key size should fail", func(t *testing.T) {
+		err := svc.RegisterCipher("fake-key-size", keySizedCipher{size: 20}, fakeDecipher{})
+		require.NoError(t, err)
+
+		cfg := setting.NewCfg()
+		cfg.Raw.Section(securitySection).Key(encryptionAlgorithmKey).SetValue("fake-key-size")
+
+		err = svc.Validate((&setting.OSSImpl{Cfg: cfg}).Section(securitySection))
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "unsupported key size of 20 bytes")
+	})
+
+	t.Run("registering an algorithm without cipher or decipher should fail", func(t *testing.T) {
+		err := svc.RegisterCipher("other", nil, fakeDecipher{})
+		require.Error(t, err)
+
+		err = svc.RegisterCipher("other", fakeCipher{}, nil)
+		require.Error(t, err)
+	})
+}
+
+func Test_Service_CheckEncryptionAlgorithm(t *testing.T) {
+	svc := SetupTestService(t)
+
+	// Half-registered algorithms can only come from a faulty
+	// provider, so they're set up directly on the service.
+	svc.ciphers["only-cipher"] = fakeCipher{}
+	svc.deciphers["only-decipher"] = fakeDecipher{}
+
+	t.Run("missing cipher should be reported", func(t *testing.T) {
+		err := svc.checkEncryptionAlgorithm("only-decipher")
+		require.Error(t, err)
+		assert.Equal(t, "no cipher registered for encryption algorithm configured 'only-decipher'", err.Error())
+	})
+
+	t.Run("missing decipher should be reported", func(t *testing.T) {
+		err := svc.checkEncryptionAlgorithm("only-cipher")
+		require.Error(t, err)
+		assert.Equal(t, "no decipher registered for encryption algorithm configured 'only-cipher'", err.Error())
+	})
+
+	t.Run("complete algorithm should pass", func(t *testing.T) {
+		require.NoError(t, svc.checkEncryptionAlgorithm(encryption.AesGcm))
+	})
+}
+
+func Test_Service_AuthenticatedAlgorithms(t *testing.T) {
+	ctx := context.Background()
+
+	svc := SetupTestService(t)
+
+	for _, algorithm := range svc.SupportedAlgorithms() {
+		encrypted, err := svc.EncryptWithAlgorithm(ctx, []byte("grafana"), "1234", algorithm)
+		require.NoError(t, err)
+
+		tampered := append([]byte{}, encrypted...)
+		tampered[len(tampered)-1] ^= 0x01
+
+		decrypted, err := svc.Decrypt(ctx, tampered, "1234")
+		if encryption.IsAuthenticated(algorithm) {
+			require.ErrorIs(t, err, encryption.ErrAuthenticationFailed, algorithm)
+		} else {
+			require.NoError(t, err, algorithm)
+			assert.NotEqual(t, []byte("grafana"), decrypted, algorithm)
+		}
+	}
+}
+
+func Test_Service_ConcurrentRegistration(t *testing.T) {
+	// Meant to be run with -race, so any unsynchronized
+	// access to the ciphers and deciphers is reported.
+	ctx := context.Background()
+
+	svc := SetupTestService(t)
+
+	const workers = 4
+	const registrations = 20
+
+	var wg sync.WaitGroup
+	wg.Add(workers + 1)
+
+	go func() {
+		defer wg.Done()
+		for i := 0; i < registrations; i++ {
+			assert.NoError(t, svc.RegisterCipher(fmt.Sprintf("fake-%d", i), fakeCipher{}, fakeDecipher{}))
+		}
+	}()
+
+	for w := 0; w < workers; w++ {
+		go func() {
+			defer wg.Done()
+			for i := 0; i < registrations; i++ {
+				encrypted, err := svc.Encrypt(ctx, []byte("grafana"), "1234")
+				if !assert.NoError(t, err) {
+					return
+				}
+
+				decrypted, err := svc.DecryptSlice(ctx, [][]byte{encrypted}, "1234")
+				if !assert.NoError(t, err) {
+					return
+				}
+				assert.Equal(t, []byte("grafana"), decrypted[0])
+
+				_ = svc.Validate(svc.settingsProvider.Section(securitySection))
+			}
+		}()
+	}
+
+	wg.Wait()
+
+	for i := 0; i < registrations; i++ {
+		_, ok := svc.cipher(fmt.Sprintf("fake-%d", i))
+		assert.True(t, ok)
+	}
+}
+
+func Test_Service_DecryptJsonDataPartial(t *testing.T) {
+	ctx := context.Background()
+
+	svc := SetupTestService(t)
+	setAlgorithm(t, svc, encryption.AesGcm)
+
+	encrypted, err := svc.EncryptJsonData(ctx, map[string]string{
+		"password": "grafana",
+		"token":    "secret",
+		"broken":   "corrupted",
+	}, "1234")
+	require.NoError(t, err)
+
+	t.Run("without failures should decrypt all the values", func(t *testing.T) {
+		decrypted, errs := svc.DecryptJsonDataPartial(ctx, encrypted, "1234")
+		assert.Nil(t, errs)
+		assert.Equal(t, map[string]string{
+			"password": "grafana",
+			"token":    "secret",
+			"broken":   "corrupted",
+		}, decrypted)
+	})
+
+	t.Run("with failures should decrypt the healthy values", func(t *testing.T) {
+		encrypted["broken"][len(encrypted["broken"])-1] ^= 0x01
+		encrypted["unknown"] = append(encodeEncryptionAlgorithm("unknown"), []byte("grafana")...)
+
+		decrypted, errs := svc.DecryptJsonDataPartial(ctx, encrypted, "1234")
+		assert.Equal(t, map[string]string{
+			"password": "grafana",
+			"token":    "secret",
+		}, decrypted)
+
+		require.Len(t, errs, 2)
+		assert.ErrorIs(t, errs["broken"], encryption.ErrAuthenticationFailed)
+		assert.ErrorIs(t, errs["unknown"], encryption.ErrUnknownAlgorithm)
+
+		_, err := svc.DecryptJsonData(ctx, encrypted, "1234")
+		require.Error(t, err)
+	})
+}
+
+func Test_Service_GetDecryptedBytes(t *testing.T) {
+	ctx := context.Background()
+
+	svc := SetupTestService(t)
+	setAlgorithm(t, svc, encryption.AesGcm)
+
+	encrypted, err := svc.EncryptJsonData(ctx, map[string]string{"password": "grafana"}, "1234")
+	require.NoError(t, err)
+
+	t.Run("with present key should return a wipeable plaintext", func(t *testing.T) {
+		decrypted := svc.GetDecryptedBytes(ctx, encrypted, "password", nil, "1234")
+		assert.Equal(t, []byte("grafana"), decrypted)
+
+		encryption.Wipe(decrypted)
+		assert.Equal(t, make([]byte, len("grafana")), decrypted)
+
+		assert.Equal(t, []byte("grafana"), svc.GetDecryptedBytes(ctx, encrypted, "password", nil, "1234"))
+	})
+
+	t.Run("with absent key or wrong secret should return the fallback", func(t *testing.T) {
+		assert.Equal(t, []byte("fallback"), svc.GetDecryptedBytes(ctx, encrypted, "token", []byte("fallback"), "1234"))
+		assert.Equal(t, []byte("fallback"), svc.GetDecryptedBytes(ctx, encrypted, "password", []byte("fallback"), "4321"))
+	})
+}
+
+func Test_Service_GetDecryptedValues(t *testing.T) {
+	ctx := context.Background()
+
+	svc := SetupTestService(t)
+	setAlgorithm(t, svc, encryption.AesGcm)
+
+	encrypted, err := svc.EncryptJsonData(ctx, map[string]string{
+		"password":    "grafana",
+		"certificate": "cert",
+		"token":       "token",
+	}, "1234")
+	require.NoError(t, err)
+
+	// Values encrypted with other algorithms must be decrypted as well.
+	setAlgorithm(t, svc, encryption.AesCfb)
+	encrypted["basicAuthPassword"], err = svc.Encrypt(ctx, []byte("basic"), "1234")
+	require.NoError(t, err)
+
+	encrypted["token"][len(encrypted["token"])-1] ^= 1
+
+	values := svc.GetDecryptedValues(ctx, encrypted,
+		[]string{"password", "certificate", "token", "basicAuthPassword", "apiKey", "clientSecret"},
+		map[string]string{"token": "fallback token", "apiKey": "fallback key"},
+		"1234",
+	)
+
+	assert.Equal(t, map[string]string{
+		"password":          "grafana",
+		"certificate":       "cert",
+		"token":             "fallback token",
+		"basicAuthPassword": "basic",
+		"apiKey":            "fallback key",
+		"clientSecret":      "",
+	}, values)
+
+	t.Run("with wrong secret should return the fallbacks", func(t *testing.T) {
+		values := svc.GetDecryptedValues(ctx, encrypted, []string{"password", "certificate"}, map[string]string{"password": "fallback"}, "4321")
+		assert.Equal(t, map[string]string{"password": "fallback", "certificate": ""}, values)
+	})
+}
+
+func Test_Service_DecryptSlice(t *testing.T) {
+	ctx := context.Background()
+
+	svc := SetupTestService(t)
+
+	var (
+		payloads   [][]byte
+		expected   [][]byte
+		algorithms = []string{encryption.AesCfb, encryption.AesGcm, encryption.ChaCha20Poly1305}
+	)
+	for i := 0; i < 9; i++ {
+		setAlgorithm(t, svc, algorithms[i%len(algorithms)])
+
+		plaintext := []byte(fmt.Sprintf("grafana%d", i))
+		encrypted, err := svc.Encrypt(ctx, plaintext, "1234")
+		require.NoError(t, err)
+
+		payloads = append(payloads, encrypted)
+		expected = append(expected, plaintext)
+	}
+
+	t.Run("decrypt slice with mixed algorithms should work", func(t *testing.T) {
+		decrypted, err := svc.DecryptSlice(ctx, payloads, "1234")
+		require.NoError(t, err)
+		assert.Equal(t, expected, decrypted)
+	})
+
+	t.Run("decrypt slice with a corrupt payload should report its index", func(t *testing.T) {
+		corrupt := make([][]byte, len(payloads))
+		copy(corrupt, payloads)
+		corrupt[4] = append([]byte{}, payloads[4]...)
+		corrupt[4][len(corrupt[4])-1] ^= 0x01
+
+		decrypted, err := svc.DecryptSlice(ctx, corrupt, "1234")
+		require.ErrorIs(t, err, encryption.ErrAuthenticationFailed)
+		assert.Contains(t, err.Error(), "index 4")
+		assert.Nil(t, decrypted)
+	})
+
+	t.Run("decrypt slice with an unknown algorithm should report its index", func(t *testing.T) {
+		unknown := append([][]byte{}, payloads...)
+		unknown = append(unknown, append(encodeEncryptionAlgorithm("unknown"), []byte("grafana")...))
+
+		_, err := svc.DecryptSlice(ctx, unknown, "1234")
+		require.ErrorIs(t, err, encryption.ErrUnknownAlgorithm)
+		assert.Contains(t, err.Error(), fmt.Sprintf("index %d", len(payloads)))
+	})
+}
+
+func Benchmark_Service_DecryptSlice(b *testing.B) {
+	ctx := context.Background()
+
+	svc := SetupTestService(b)
+
+	payloads := make([][]byte, 100)
+	for i := range payloads {
+		encrypted, err := svc.Encrypt(ctx, []byte("grafana"), "1234")
+		require.NoError(b, err)
+		payloads[i] = encrypted
+	}
+
+	b.Run("naive loop", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			for _, payload := range payloads {
+				if _, err := svc.Decrypt(ctx, payload, "1234"); err != nil {
+					b.Fatal(err)
+				}
+			}
+		}
+	})
+
+	b.Run("decrypt slice", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			if _, err := svc.DecryptSlice(ctx, payloads, "1234"); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+func Test_Service_Reload(t *testing.T) {
+	section := func(kv map[string]string) setting.Section {
+		cfg := setting.NewCfg()
+		for key, value := range kv {
+			cfg.Raw.Section(securitySection).Key(key).SetValue(value)
+		}
+		return (&setting.OSSImpl{Cfg: cfg}).Section(securitySection)
+	}
+
+	setup := func(t *testing.T, algorithm string) *Service {
+		t.Helper()
+
+		settings := &setting.OSSImpl{Cfg: setting.NewCfg()}
+		settings.Cfg.Raw.Section(securitySection).Key(encryptionAlgorithmKey).SetValue(algorithm)
+
+		svc, err := ProvideEncryptionService(provider.ProvideEncryptionProvider(settings), &usagestats.UsageStatsMock{T: t}, settings)
+		require.NoError(t, err)
+		return svc
+	}
+
+	testCases := []struct {
+		desc      string
+		from      string
+		to        map[string]string
+		expectErr bool
+	}{
+		{
+			desc: "upgrade should be allowed",
+			from: encryption.AesCfb,
+			to:   map[string]string{encryptionAlgorithmKey: encryption.AesGcm, disallowDowngradeKey: "true"},
+		},
+		{
+			desc: "lateral move should be allowed",
+			from: encryption.AesGcm,
+			to:   map[string]string{encryptionAlgorithmKey: encryption.ChaCha20Poly1305, disallowDowngradeKey: "true"},
+		},
+		{
+			desc: "downgrade should be allowed by default",
+			from: encryption.AesGcm,
+			to:   map[string]string{encryptionAlgorithmKey: encryption.AesCfb},
+		},
+		{
+			desc:      "downgrade should be rejected when disallowed",
+			from:      encryption.AesGcm,
+			to:        map[string]string{encryptionAlgorithmKey: encryption.AesCfb, disallowDowngradeKey: "true"},
+			expectErr: true,
+		},
+		{
+			desc:      "unknown algorithm should be rejected",
+			from:      encryption.AesGcm,
+			to:        map[string]string{encryptionAlgorithmKey: "unknown"},
+			expectErr: true,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			svc := setup(t, tc.from)
+
+			validateErr := svc.Validate(section(tc.to))
+			reloadErr := svc.Reload(section(tc.to))
+			if tc.expectErr {
+				require.Error(t, validateErr)
+				require.Error(t, reloadErr)
+				assert.Equal(t, tc.from, svc.appliedAlgorithm)
+
+				// The rejected algorithm is configured,
+				// but Encrypt keeps using the applied one.
+				settings := svc.settingsProvider.(*setting.OSSImpl)
+				for key, value := range tc.to {
+					settings.Cfg.Raw.Section(securitySection).Key(key).SetValue(value)
+				}
+
+				encrypted, err := svc.Encrypt(context.Background(), []byte("grafana"), "1234")
+				require.NoError(t, err)
+
+				header, _, err := decodePayloadHeader(encrypted)
+				require.NoError(t, err)
+				assert.Equal(t, tc.from, header.algorithm)
+				return
+			}
+
+			require.NoError(t, validateErr)
+			require.NoError(t, reloadErr)
+			assert.Equal(t, tc.to[encryptionAlgorithmKey], svc.appliedAlgorithm)
+		})
+	}
+}
+
+func Test_Service_ConfigurableCipher(t *testing.T) {
+	ctx := context.Background()
+
+	svc := SetupTestService(t)
+	settings := svc.settingsProvider.(*setting.OSSImpl)
+	settings.Cfg.Raw.Section(securitySection + ".fake-configurable").Key("prefix").SetValue("v1:")
+
+	prefixed := &prefixCipher{}
+	require.NoError(t, svc.RegisterCipher("fake-configurable", prefixed, prefixed))
+	setAlgorithm(t, svc, "fake-configurable")
+
+	t.Run("registering a configurable cipher should configure it", func(t *testing.T) {
+		encrypted, err := svc.Encrypt(ctx, []byte("grafana"), "1234")
+		require.NoError(t, err)
+
+		_, toDecrypt, err := deriveEncryptionAlgorithm(encrypted)
+		require.NoError(t, err)
+		assert.Equal(t, []byte("v1:grafana"), toDecrypt)
+	})
+
+	t.Run("reloading should reconfigure it", func(t *testing.T) {
+		settings.Cfg.Raw.Section(securitySection + ".fake-configurable").Key("prefix").SetValue("v2:")
+		require.NoError(t, svc.Reload(settings.Section(securitySection)))
+
+		encrypted, err := svc.Encrypt(ctx, []byte("grafana"), "1234")
+		require.NoError(t, err)
+
+		_, toDecrypt, err := deriveEncryptionAlgorithm(encrypted)
+		require.NoError(t, err)
+		assert.Equal(t, []byte("v2:grafana"), toDecrypt)
+
+		decrypted, err := svc.Decrypt(ctx, encrypted, "1234")
 		require.NoError(t, err)
 		assert.Equal(t, []byte("grafana"), decrypted)
 	})
+
+	t.Run("invalid configuration should fail the reload", func(t *testing.T) {
+		settings.Cfg.Raw.Section(securitySection + ".fake-configurable").Key("prefix").SetValue("")
+
+		err := svc.Reload(settings.Section(securitySection))
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "fake-configurable")
+	})
+
+	t.Run("invalid configuration should fail the registration", func(t *testing.T) {
+		err := svc.RegisterCipher("fake-unconfigured", &prefixCipher{}, &prefixCipher{})
+		require.Error(t, err)
+
+		assert.NotContains(t, svc.SupportedAlgorithms(), "fake-unconfigured")
+	})
 }
 
 func Test_Service_MissingProvider(t *testing.T) {
@@ -83,6 +1858,99 @@ func Test_Service_MissingProvider(t *testing.T) {
 	assert.Error(t, err)
 }
 
+func Test_Service_MismatchedProvider(t *testing.T) {
+	encProvider := mismatchedProvider{Provider: provider.Provider{}}
+	usageStats := &usagestats.UsageStatsMock{}
+	settings := &setting.OSSImpl{Cfg: setting.NewCfg()}
+
+	service, err := ProvideEncryptionService(encProvider, usageStats, settings)
+	assert.Nil(t, service)
+	require.Error(t, err)
+	assert.Equal(t, "encryption provider ciphers and deciphers don't match: no cipher for 'only-decipher', no decipher for 'aes-gcm'", err.Error())
+}
+
+func Test_Service_FailureLogs(t *testing.T) {
+	svc := SetupTestService(t)
+	setAlgorithm(t, svc, encryption.AesGcm)
+
+	logs := &logtest.Fake{}
+	svc.log = logs
+
+	ctx, span := tracing.InitializeTracerForTest().Start(context.Background(), "test")
+	defer span.End()
+	traceID := tracing.TraceIDFromContext(ctx, false)
+	require.NotEmpty(t, traceID)
+
+	t.Run("failed decryption should log the algorithm and the trace id", func(t *testing.T) {
+		encrypted, err := svc.Encrypt(ctx, []byte("grafana"), "1234")
+		require.NoError(t, err)
+
+		_, err = svc.Decrypt(ctx, encrypted, "4321")
+		require.Error(t, err)
+
+		assert.Equal(t, "Decryption failed", logs.ErrorLogs.Message)
+		assert.Equal(t, []interface{}{"algorithm", encryption.AesGcm, "error", err, "traceID", traceID}, logs.ErrorLogs.Ctx)
+	})
+
+	t.Run("failed encryption should log the algorithm and the trace id", func(t *testing.T) {
+		_, err := svc.EncryptWithAlgorithm(ctx, []byte("grafana"), "1234", "unknown")
+		require.Error(t, err)
+
+		assert.Equal(t, "Encryption failed", logs.ErrorLogs.Message)
+		assert.Equal(t, []interface{}{"algorithm", "unknown", "error", err, "traceID", traceID}, logs.ErrorLogs.Ctx)
+	})
+
+	t.Run("failures without trace should not log a trace id", func(t *testing.T) {
+		_, err := svc.Decrypt(context.Background(), []byte("*dW5rbm93bg*grafana"), "1234")
+		require.Error(t, err)
+
+		assert.Equal(t, []interface{}{"algorithm", "unknown", "error", err}, logs.ErrorLogs.Ctx)
+	})
+}
+
+func Test_ProvideEncryptionServiceWithLogger(t *testing.T) {
+	ctx := context.Background()
+	usageStats := &usagestats.UsageStatsMock{T: t}
+
+	t.Run("failures should be logged through the given logger", func(t *testing.T) {
+		settings := &setting.OSSImpl{Cfg: setting.NewCfg()}
+		settings.Cfg.Raw.Section(securitySection).Key(encryptionAlgorithmKey).SetValue(encryption.AesGcm)
+		logs := &logtest.Fake{}
+
+		svc, err := ProvideEncryptionServiceWithLogger(provider.ProvideEncryptionProvider(settings), usageStats, settings, logs)
+		require.NoError(t, err)
+
+		_, err = svc.Decrypt(ctx, svc.MustEncrypt(ctx, []byte("grafana"), "1234"), "4321")
+		require.Error(t, err)
+
+		assert.Equal(t, 1, logs.ErrorLogs.Calls)
+		assert.Equal(t, "Decryption failed", logs.ErrorLogs.Message)
+	})
+
+	t.Run("initialization failures should be logged through the given logger", func(t *testing.T) {
+		settings := &setting.OSSImpl{Cfg: setting.NewCfg()}
+		logs := &logtest.Fake{}
+
+		_, err := ProvideEncryptionServiceWithLogger(mismatchedProvider{Provider: provider.Provider{}}, usageStats, settings, logs)
+		require.Error(t, err)
+
+		assert.Equal(t, "Inconsistent encryption provider", logs.ErrorLogs.Message)
+	})
+}
+
+// mismatchedProvider drops the aes-gcm decipher and
+// adds a decipher without cipher to the given provider.
+type mismatchedProvider struct {
+	encryption.Provider
+}
+
+func (p mismatchedProvider) ProvideDeciphers() map[string]encryption.Decipher {
+	deciphers := p.Provider.ProvideDeciphers()
+	delete(deciphers, encryption.AesGcm)
+	deciphers["only-decipher"] = fakeDecipher{}
+	return deciphers
+}
+
 type fakeProvider struct{}
 
 func (p fakeProvider) ProvideCiphers() map[string]encryption.Cipher {
@@ -92,3 +1960,132 @@ func (p fakeProvider) ProvideCiphers() map[string]encryption.Cipher {
 func (p fakeProvider) ProvideDeciphers() map[string]encryption.Decipher {
 	return nil
 }
+
+// fakeCipher reverses the payload,
+// so it's easy to assert on it.
+type fakeCipher struct{}
+
+func (c fakeCipher) Encrypt(_ context.Context, payload []byte, _ string) ([]byte, error) {
+	return reverse(payload), nil
+}
+
+var errFailingValue = errors.New("failing value")
+
+// failingValueCipher is a fakeCipher failing
+// with errFailingValue on the given value.
+type failingValueCipher struct {
+	fakeCipher
+	value string
+}
+
+func (c failingValueCipher) Encrypt(ctx context.Context, payload []byte, secret string) ([]byte, error) {
+	if string(payload) == c.value {
+		return nil, errFailingValue
+	}
+	return c.fakeCipher.Encrypt(ctx, payload, secret)
+}
+
+// failingDecipher fails every decryption with the given error.
+type failingDecipher struct {
+	err error
+}
+
+func (d failingDecipher) Decrypt(context.Context, []byte, string) ([]byte, error) {
+	return nil, d.err
+}
+
+// keySizedCipher is a fakeCipher reporting the given key size.
+type keySizedCipher struct {
+	fakeCipher
+	size int
+}
+
+func (c keySizedCipher) KeySize() int {
+	return c.size
+}
+
+// prefixCipher prepends the configured prefix
+// to the payload, so it's easy to assert on it.
+type prefixCipher struct {
+	mtx    sync.RWMutex
+	prefix string
+}
+
+func (c *prefixCipher) Configure(section setting.Section) error {
+	prefix := section.KeyValue("prefix").MustString("")
+	if prefix == "" {
+		return errors.New("prefix is required")
+	}
+
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	c.prefix = prefix
+	return nil
+}
+
+func (c *prefixCipher) Encrypt(_ context.Context, payload []byte, _ string) ([]byte, error) {
+	c.mtx.RLock()
+	defer c.mtx.RUnlock()
+	return append([]byte(c.prefix), payload...), nil
+}
+
+func (c *prefixCipher) Decrypt(_ context.Context, payload []byte, _ string) ([]byte, error) {
+	c.mtx.RLock()
+	defer c.mtx.RUnlock()
+	return bytes.TrimPrefix(payload, []byte(c.prefix)), nil
+}
+
+// brokenDecipher returns the payloads as they are.
+type brokenDecipher struct{}
+
+func (d brokenDecipher) Decrypt(_ context.Context, payload []byte, _ string) ([]byte, error) {
+	return payload, nil
+}
+
+type fakeDecipher struct{}
+
+func (d fakeDecipher) Decrypt(_ context.Context, payload []byte, _ string) ([]byte, error) {
+	return reverse(payload), nil
+}
+
+// echoDecipher returns the payload as it is, so it
+// doesn't match the output of fakeCipher.
+type echoDecipher struct{}
+
+func (d echoDecipher) Decrypt(_ context.Context, payload []byte, _ string) ([]byte, error) {
+	return payload, nil
+}
+
+func reverse(payload []byte) []byte {
+	reversed := make([]byte, len(payload))
+	for i, b := range payload {
+		reversed[len(payload)-1-i] = b
+	}
+	return reversed
+}
+
+// setAlgorithm configures the given algorithm and applies it as a reload
+// would, as Encrypt only uses the applied one, and restores the previous
+// one on cleanup.
+func setAlgorithm(tb testing.TB, svc *Service, algorithm string) {
+	tb.Helper()
+
+	section := svc.settingsProvider.(*setting.OSSImpl).Cfg.Raw.Section(securitySection)
+	configured, previous := section.HasKey(encryptionAlgorithmKey), section.Key(encryptionAlgorithmKey).Value()
+	applied := svc.CurrentAlgorithm()
+
+	section.Key(encryptionAlgorithmKey).SetValue(algorithm)
+	require.NoError(tb, svc.Reload(svc.settingsProvider.Section(securitySection)))
+
+	tb.Cleanup(func() {
+		if configured {
+			section.Key(encryptionAlgorithmKey).SetValue(previous)
+		} else {
+			section.DeleteKey(encryptionAlgorithmKey)
+		}
+
+		svc.mtx.Lock()
+		svc.appliedAlgorithm = applied
+		svc.mtx.Unlock()
+	})
+}
@@ -0,0 +1,63 @@
+package service
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/grafana/grafana/pkg/setting"
+)
+
+// securitySettings returns the settings of the security section, as read on
+// every operation, see readOnlySection.
+func (s *Service) securitySettings() setting.Section {
+	return readOnlySection{s.settingsProvider.Section(securitySection)}
+}
+
+// readOnlySection reads the settings of the given section as it does, but
+// without writing the defaults back into the keys that aren't set, as the
+// ini-backed implementation does, so the settings can be read concurrently
+// by the operations, while the keys aren't safe for concurrent writes.
+type readOnlySection struct {
+	setting.Section
+}
+
+func (s readOnlySection) KeyValue(key string) setting.KeyValue {
+	return readOnlyKeyValue{s.Section.KeyValue(key)}
+}
+
+// readOnlyKeyValue parses the values as the ini keys do, so the
+// settings are interpreted the same way, however they're read.
+type readOnlyKeyValue struct {
+	setting.KeyValue
+}
+
+func (k readOnlyKeyValue) MustString(defaultVal string) string {
+	if val := k.Value(); len(val) > 0 {
+		return val
+	}
+	return defaultVal
+}
+
+func (k readOnlyKeyValue) MustBool(defaultVal bool) bool {
+	switch k.Value() {
+	case "1", "t", "T", "true", "TRUE", "True", "YES", "yes", "Yes", "y", "ON", "on", "On":
+		return true
+	case "0", "f", "F", "false", "FALSE", "False", "NO", "no", "No", "n", "OFF", "off", "Off":
+		return false
+	}
+	return defaultVal
+}
+
+func (k readOnlyKeyValue) MustDuration(defaultVal time.Duration) time.Duration {
+	if val, err := time.ParseDuration(k.Value()); err == nil {
+		return val
+	}
+	return defaultVal
+}
+
+func (k readOnlyKeyValue) MustInt(defaultVal int) int {
+	if val, err := strconv.ParseInt(k.Value(), 0, 64); err == nil {
+		return int(val)
+	}
+	return defaultVal
+}
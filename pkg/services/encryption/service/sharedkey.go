@@ -0,0 +1,105 @@
+package service
+
+import (
+	"context"
+	"crypto/subtle"
+	"fmt"
+
+	"github.com/grafana/grafana/pkg/services/encryption"
+)
+
+// decryptJsonDataWithSharedKey decrypts the values of the given map, as
+// DecryptJsonData does, deriving the key only once for all of them. That's
+// only possible when they're all encrypted with the same algorithm, whose
+// decipher derives the key from the secret alone (see encryption.KeyedDecipher),
+// and none of them has been stretched with a slow KDF, as that uses a salt of
+// its own per payload. Otherwise, or when any header cannot be decoded, it
+// returns false without decrypting anything, so the values are decrypted one
+// by one instead, which also reports the malformed payloads.
+func (s *Service) decryptJsonDataWithSharedKey(ctx context.Context, sjd map[string][]byte, secret string) (map[string]string, bool, error) {
+	if len(sjd) < 2 || secret == "" {
+		return nil, false, nil
+	}
+
+	var (
+		algorithm string
+		headers   = make(map[string]payloadHeader, len(sjd))
+		payloads  = make(map[string][]byte, len(sjd))
+	)
+	for key, data := range sjd {
+		header, toDecrypt, err := s.decodePayloadHeader(data)
+		if err != nil || header.kdf != nil || (algorithm != "" && header.algorithm != algorithm) {
+			return nil, false, nil
+		}
+
+		algorithm = header.algorithm
+		headers[key], payloads[key] = header, toDecrypt
+	}
+
+	decipher, ok := s.decipher(algorithm)
+	if !ok {
+		return nil, false, nil
+	}
+
+	keyed, ok := decipher.(encryption.KeyedDecipher)
+	if !ok {
+		return nil, false, nil
+	}
+
+	shared := &sharedKeyDecipher{KeyedDecipher: keyed}
+	defer shared.wipe()
+
+	decrypted := make(map[string]string, len(sjd))
+	for _, key := range sortedPayloadKeys(sjd) {
+		header := headers[key]
+		var (
+			decryptedData []byte
+			err           error
+		)
+		if err = ctx.Err(); err == nil {
+			decryptedData, err = s.decryptPayload(ctx, shared, header, payloads[key], nil, secret)
+		}
+		if err != nil {
+			s.log.Error("Decryption failed", logContext(ctx, "algorithm", algorithm, "error", err)...)
+			s.countDecryptionFailure(algorithm, err)
+			return nil, true, fmt.Errorf("failed to decrypt value of key '%s': %w", key, err)
+		}
+
+		decrypted[key] = string(decryptedData)
+		encryption.Wipe(decryptedData)
+	}
+
+	return decrypted, true, nil
+}
+
+// sharedKeyDecipher decrypts with the key derived from the first secret it's
+// called with, which it keeps until wiped. Other secrets, e.g. resolved from
+// different key versions, are handed over to the wrapped decipher as usual.
+// Unlike the deciphers, it's not safe for concurrent use.
+type sharedKeyDecipher struct {
+	encryption.KeyedDecipher
+
+	secret string
+	key    []byte
+}
+
+func (d *sharedKeyDecipher) Decrypt(ctx context.Context, payload []byte, secret string) ([]byte, error) {
+	if d.key == nil {
+		key, err := d.DeriveKey(secret)
+		if err != nil {
+			return nil, err
+		}
+		d.secret, d.key = secret, key
+	}
+
+	if subtle.ConstantTimeCompare([]byte(secret), []byte(d.secret)) != 1 {
+		return d.KeyedDecipher.Decrypt(ctx, payload, secret)
+	}
+
+	return d.DecryptWithKey(ctx, payload, d.key)
+}
+
+func (d *sharedKeyDecipher) wipe() {
+	encryption.Wipe(d.key)
+	d.key = nil
+}
@@ -0,0 +1,116 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"sync/atomic"
+	"testing"
+
+	"github.com/grafana/grafana/pkg/services/encryption"
+	"github.com/grafana/grafana/pkg/services/encryption/provider"
+	"github.com/grafana/grafana/pkg/setting"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_Service_DecryptJsonDataWithSharedKey(t *testing.T) {
+	ctx := context.Background()
+
+	svc := SetupTestService(t)
+	section := svc.settingsProvider.(*setting.OSSImpl).Cfg.Raw.Section(securitySection)
+
+	aesSiv := provider.Provider{}
+	counting := &countingKeyedDecipher{KeyedDecipher: aesSiv.ProvideDeciphers()[encryption.AesSiv].(encryption.KeyedDecipher)}
+	require.NoError(t, svc.RegisterCipher("counting-siv", aesSiv.ProvideCiphers()[encryption.AesSiv], counting))
+
+	kv := make(map[string]string, 20)
+	for i := 0; i < 20; i++ {
+		kv[fmt.Sprintf("field%d", i)] = fmt.Sprintf("value%d", i)
+	}
+
+	t.Run("key should be derived once for the whole map", func(t *testing.T) {
+		encrypted, err := svc.EncryptJsonDataWithAlgorithm(ctx, kv, "1234", "counting-siv")
+		require.NoError(t, err)
+
+		counting.reset()
+		decrypted, err := svc.DecryptJsonData(ctx, encrypted, "1234")
+		require.NoError(t, err)
+		assert.Equal(t, kv, decrypted)
+		assert.Equal(t, int32(1), atomic.LoadInt32(&counting.derivations))
+		assert.Zero(t, atomic.LoadInt32(&counting.decryptions))
+	})
+
+	t.Run("wrong secret should fail", func(t *testing.T) {
+		encrypted, err := svc.EncryptJsonDataWithAlgorithm(ctx, kv, "1234", "counting-siv")
+		require.NoError(t, err)
+
+		_, err = svc.DecryptJsonData(ctx, encrypted, "4321")
+		require.ErrorIs(t, err, encryption.ErrAuthenticationFailed)
+	})
+
+	t.Run("mixed algorithms should be decrypted per value", func(t *testing.T) {
+		encrypted, err := svc.EncryptJsonDataWithAlgorithm(ctx, kv, "1234", "counting-siv")
+		require.NoError(t, err)
+
+		encrypted["field0"], err = svc.EncryptWithAlgorithm(ctx, []byte("value0"), "1234", encryption.AesGcm)
+		require.NoError(t, err)
+
+		counting.reset()
+		decrypted, err := svc.DecryptJsonData(ctx, encrypted, "1234")
+		require.NoError(t, err)
+		assert.Equal(t, kv, decrypted)
+		assert.Zero(t, atomic.LoadInt32(&counting.derivations))
+		assert.Equal(t, int32(len(kv)-1), atomic.LoadInt32(&counting.decryptions))
+	})
+
+	t.Run("payloads with a per-payload salt should be decrypted per value", func(t *testing.T) {
+		section.Key(kdfKey).SetValue(kdfArgon2id)
+		section.Key(kdfArgon2idMemoryKey).SetValue("1024")
+		t.Cleanup(func() {
+			section.DeleteKey(kdfKey)
+			section.DeleteKey(kdfArgon2idMemoryKey)
+		})
+
+		encrypted, err := svc.EncryptJsonDataWithAlgorithm(ctx, kv, "1234", "counting-siv")
+		require.NoError(t, err)
+
+		counting.reset()
+		decrypted, err := svc.DecryptJsonData(ctx, encrypted, "1234")
+		require.NoError(t, err)
+		assert.Equal(t, kv, decrypted)
+		assert.Zero(t, atomic.LoadInt32(&counting.derivations))
+		assert.Equal(t, int32(len(kv)), atomic.LoadInt32(&counting.decryptions))
+	})
+
+	t.Run("malformed payloads should still be reported", func(t *testing.T) {
+		encrypted, err := svc.EncryptJsonDataWithAlgorithm(ctx, kv, "1234", "counting-siv")
+		require.NoError(t, err)
+		encrypted["field0"] = []byte("*unknown")
+
+		_, err = svc.DecryptJsonData(ctx, encrypted, "1234")
+		require.Error(t, err)
+	})
+}
+
+// countingKeyedDecipher counts the keys derived for
+// the whole map, and the payloads decrypted one by one.
+type countingKeyedDecipher struct {
+	encryption.KeyedDecipher
+	derivations int32
+	decryptions int32
+}
+
+func (d *countingKeyedDecipher) Decrypt(ctx context.Context, payload []byte, secret string) ([]byte, error) {
+	atomic.AddInt32(&d.decryptions, 1)
+	return d.KeyedDecipher.Decrypt(ctx, payload, secret)
+}
+
+func (d *countingKeyedDecipher) DeriveKey(secret string) ([]byte, error) {
+	atomic.AddInt32(&d.derivations, 1)
+	return d.KeyedDecipher.DeriveKey(secret)
+}
+
+func (d *countingKeyedDecipher) reset() {
+	atomic.StoreInt32(&d.derivations, 0)
+	atomic.StoreInt32(&d.decryptions, 0)
+}
@@ -0,0 +1,431 @@
+package service
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/grafana/grafana/pkg/infra/log"
+	"github.com/grafana/grafana/pkg/services/encryption"
+)
+
+// Streams are encrypted in chunks, so they can be processed without
+// holding the whole payload in memory. The format is:
+//
+//	<header>                      same header as Encrypt
+//	<stream id>                   random, streamIDLen bytes
+//	<frame>...<frame>             one or more frames
+//
+// Where each frame is:
+//
+//	<uint32 length><ciphertext>   big-endian length of the ciphertext
+//
+// And the ciphertext of each frame is the output of the algorithm's cipher
+// for a chunk plaintext with the following layout:
+//
+//	<uint64 sequence><byte final><data>
+//
+// The sequence starts at zero and increases by one per frame, and the final
+// flag is only set on the last frame. When the algorithm is authenticated,
+// both are covered by the authentication tag of each frame, so reordered,
+// dropped or truncated frames are detected on decryption. The stream id is
+// the associated data of each frame, so frames can't be spliced either from
+// another stream encrypted with the same secret.
+//
+// The header records the same options as that of Encrypt, i.e. the key
+// version, KDF and key commitment, except for compression and padding,
+// which are never applied to streams.
+const (
+	streamIDLen          = 16
+	streamChunkSize      = 256 * 1024
+	streamChunkHeaderLen = 8 + 1
+	streamFrameHeaderLen = 4
+
+	// streamMaxFrameLen bounds the frame length accepted on decryption,
+	// leaving room for the overhead (salt, nonce, tag...) of the cipher.
+	streamMaxFrameLen = streamChunkSize + streamChunkHeaderLen + 4096
+)
+
+var errStreamTruncated = errors.New("encrypted stream is truncated")
+
+// EncryptStream encrypts the content read from in and writes it into out,
+// using the currently configured algorithm. See the format description above.
+func (s *Service) EncryptStream(ctx context.Context, out io.Writer, in io.Reader, secret string) error {
+	var err error
+	defer func() {
+		if err != nil {
+			s.log.Error("Stream encryption failed", "error", err)
+		}
+	}()
+
+	if err = s.checkEncryptionSecret(secret); err != nil {
+		return err
+	}
+
+	algorithm := s.CurrentAlgorithm()
+
+	cipher, ok := s.cipher(algorithm)
+	if !ok {
+		err = fmt.Errorf("no cipher available for algorithm '%s': %w", algorithm, encryption.ErrUnknownAlgorithm)
+		return err
+	}
+
+	var header payloadHeader
+	header, secret, err = s.newPayloadHeader(cipher, algorithm, secret)
+	if err != nil {
+		return err
+	}
+
+	streamID := make([]byte, streamIDLen)
+	if _, err = io.ReadFull(s.random, streamID); err != nil {
+		return err
+	}
+
+	if _, err = out.Write(encodePayloadHeader(header)); err != nil {
+		return err
+	}
+
+	if _, err = out.Write(streamID); err != nil {
+		return err
+	}
+
+	// The ciphers without associated data support, e.g. AesCfb,
+	// don't authenticate the frames in the first place.
+	aeadCipher, _ := cipher.(encryption.AEADCipher)
+
+	chunk := make([]byte, streamChunkHeaderLen+streamChunkSize)
+	frameHeader := make([]byte, streamFrameHeaderLen)
+
+	// Reading one byte ahead is what makes possible to flag
+	// the last chunk without an additional empty frame.
+	r := bufio.NewReader(in)
+	var size int
+	for seq := uint64(0); ; seq++ {
+		if err = ctx.Err(); err != nil {
+			return err
+		}
+
+		var n int
+		n, err = io.ReadFull(r, chunk[streamChunkHeaderLen:])
+		if err != nil && !errors.Is(err, io.EOF) && !errors.Is(err, io.ErrUnexpectedEOF) {
+			return err
+		}
+
+		final := err != nil
+		if !final {
+			if _, err = r.Peek(1); err != nil {
+				if !errors.Is(err, io.EOF) {
+					return err
+				}
+				final = true
+			}
+		}
+		err = nil
+
+		// The size is checked before encrypting the chunk, so nothing
+		// beyond the maximum is written, and the stream is left truncated.
+		size += n
+		if err = s.checkPayloadSize(operationEncrypt, size); err != nil {
+			return err
+		}
+
+		binary.BigEndian.PutUint64(chunk[:8], seq)
+		chunk[8] = 0
+		if final {
+			chunk[8] = 1
+		}
+
+		var encrypted []byte
+		opCtx, cancel := s.withOperationTimeout(ctx, cipher)
+		if aeadCipher != nil {
+			encrypted, err = aeadCipher.EncryptWithAAD(opCtx, chunk[:streamChunkHeaderLen+n], streamID, secret)
+		} else {
+			encrypted, err = cipher.Encrypt(opCtx, chunk[:streamChunkHeaderLen+n], secret)
+		}
+		cancel()
+		if err != nil {
+			return err
+		}
+
+		binary.BigEndian.PutUint32(frameHeader, uint32(len(encrypted)))
+		if _, err = out.Write(frameHeader); err != nil {
+			return err
+		}
+
+		if _, err = out.Write(encrypted); err != nil {
+			return err
+		}
+
+		if final {
+			return nil
+		}
+	}
+}
+
+// DecryptStream decrypts the content read from in, which must have been
+// produced by EncryptStream, and writes the plaintext into out. Each chunk
+// is written once it has been decrypted, so out may have received part of
+// the plaintext when an error is returned.
+func (s *Service) DecryptStream(ctx context.Context, out io.Writer, in io.Reader, secret string) error {
+	var err error
+	defer func() {
+		if err != nil {
+			s.log.Error("Stream decryption failed", "error", err)
+		}
+	}()
+
+	var d *streamDecrypter
+	d, err = s.newStreamDecrypter(ctx, in, secret)
+	if err != nil {
+		return err
+	}
+
+	for {
+		var chunk []byte
+		chunk, err = d.next()
+		if err != nil {
+			if errors.Is(err, io.EOF) {
+				err = nil
+			}
+			return err
+		}
+
+		if _, err = out.Write(chunk); err != nil {
+			return err
+		}
+	}
+}
+
+// DecryptReader returns a reader of the plaintext of the content read from r,
+// which must have been produced by EncryptStream. The content is decrypted on
+// demand, one chunk at a time, so it's never held in memory as a whole. The
+// header is read upfront, so an unknown algorithm is reported right away.
+//
+// For authenticated algorithms, each chunk is only returned once verified,
+// and a truncated stream surfaces as an error instead of io.EOF. The given
+// context is checked before reading each chunk, as with DecryptStream.
+func (s *Service) DecryptReader(ctx context.Context, r io.Reader, secret string) (io.Reader, error) {
+	d, err := s.newStreamDecrypter(ctx, r, secret)
+	if err != nil {
+		s.log.Error("Stream decryption failed", "error", err)
+		return nil, err
+	}
+
+	return &decryptReader{d: d, log: s.log}, nil
+}
+
+// streamDecrypter decrypts the frames of a stream one by one, see the
+// format description above.
+type streamDecrypter struct {
+	s        *Service
+	ctx      context.Context
+	r        *bufio.Reader
+	decipher encryption.Decipher
+	secret   string
+	streamID []byte
+
+	// aeadDecipher is the decipher, when it supports associated
+	// data, to authenticate the stream id of each frame with.
+	aeadDecipher encryption.AEADDecipher
+
+	seq  uint64
+	done bool
+
+	frameHeader [streamFrameHeaderLen]byte
+}
+
+// newStreamDecrypter reads the header and the stream id from the given
+// reader, and looks up the decipher of the algorithm the header identifies.
+func (s *Service) newStreamDecrypter(ctx context.Context, in io.Reader, secret string) (*streamDecrypter, error) {
+	if secret == "" {
+		return nil, encryption.ErrEmptySecret
+	}
+
+	r := bufio.NewReader(in)
+
+	header, err := readPayloadHeader(r)
+	if err != nil {
+		return nil, err
+	}
+
+	if header.compressed || header.padded {
+		return nil, errors.New("encrypted stream has unsupported header flags")
+	}
+
+	decipher, ok := s.decipher(header.algorithm)
+	if !ok {
+		return nil, fmt.Errorf("no decipher available for algorithm '%s': %w", header.algorithm, encryption.ErrUnknownAlgorithm)
+	}
+
+	if secret, err = s.payloadSecret(header, secret); err != nil {
+		return nil, err
+	}
+
+	if err = s.verifyKeyCommitment(header, secret); err != nil {
+		return nil, err
+	}
+
+	streamID := make([]byte, streamIDLen)
+	if _, err = io.ReadFull(r, streamID); err != nil {
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			err = errStreamTruncated
+		}
+		return nil, err
+	}
+
+	d := &streamDecrypter{s: s, ctx: ctx, r: r, decipher: decipher, secret: secret, streamID: streamID}
+	d.aeadDecipher, _ = decipher.(encryption.AEADDecipher)
+	return d, nil
+}
+
+// next returns the data of the next chunk, or io.EOF once
+// the final frame has been decrypted and nothing follows it.
+func (d *streamDecrypter) next() ([]byte, error) {
+	if d.done {
+		return nil, io.EOF
+	}
+
+	if err := d.ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	if _, err := io.ReadFull(d.r, d.frameHeader[:]); err != nil {
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			err = errStreamTruncated
+		}
+		return nil, err
+	}
+
+	frameLen := binary.BigEndian.Uint32(d.frameHeader[:])
+	if frameLen > streamMaxFrameLen {
+		return nil, fmt.Errorf("encrypted stream frame too large: %d bytes", frameLen)
+	}
+
+	frame := make([]byte, frameLen)
+	if _, err := io.ReadFull(d.r, frame); err != nil {
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			err = errStreamTruncated
+		}
+		return nil, err
+	}
+
+	ctx, cancel := d.s.withOperationTimeout(d.ctx, d.decipher)
+	chunk, err := d.open(ctx, frame)
+	cancel()
+	if err != nil {
+		return nil, err
+	}
+
+	if len(chunk) < streamChunkHeaderLen || binary.BigEndian.Uint64(chunk[:8]) != d.seq {
+		return nil, errors.New("encrypted stream frame out of sequence")
+	}
+	d.seq++
+
+	if chunk[8] == 1 {
+		if _, err := d.r.Peek(1); !errors.Is(err, io.EOF) {
+			return nil, errors.New("unexpected data after the final frame of encrypted stream")
+		}
+		d.done = true
+	}
+
+	return chunk[streamChunkHeaderLen:], nil
+}
+
+// open decrypts the given frame, authenticating the stream id along with it
+// unless the algorithm has no associated data support, as EncryptStream does.
+func (d *streamDecrypter) open(ctx context.Context, frame []byte) ([]byte, error) {
+	if d.aeadDecipher != nil {
+		chunk, err := d.aeadDecipher.DecryptWithAAD(ctx, frame, d.streamID, d.secret)
+		if !errors.Is(err, encryption.ErrAADNotSupported) {
+			return chunk, err
+		}
+
+		// Some deciphers, e.g. the AES one, handle
+		// both AEAD and other algorithms.
+		d.aeadDecipher = nil
+	}
+
+	return d.decipher.Decrypt(ctx, frame, d.secret)
+}
+
+// decryptReader is the io.Reader returned by DecryptReader.
+type decryptReader struct {
+	d   *streamDecrypter
+	log log.Logger
+
+	chunk []byte
+	err   error
+}
+
+func (r *decryptReader) Read(p []byte) (int, error) {
+	for len(r.chunk) == 0 {
+		if r.err != nil {
+			return 0, r.err
+		}
+
+		r.chunk, r.err = r.d.next()
+		if r.err != nil && !errors.Is(r.err, io.EOF) {
+			r.log.Error("Stream decryption failed", "error", r.err)
+		}
+	}
+
+	n := copy(p, r.chunk)
+	r.chunk = r.chunk[n:]
+	return n, nil
+}
+
+// readPayloadHeader reads the header of a payload from the given reader,
+// see decodePayloadHeader, leaving the reader right after it.
+func readPayloadHeader(r *bufio.Reader) (payloadHeader, error) {
+	first, err := r.ReadByte()
+	if err != nil {
+		return payloadHeader{}, fmt.Errorf("unable to derive encryption algorithm")
+	}
+
+	if first != encryptionAlgorithmDelimiter {
+		return payloadHeader{}, errors.New("encrypted stream has no algorithm prefix")
+	}
+
+	prefix := []byte{first}
+
+	version := payloadVersion0
+	if b, err := r.Peek(1); err == nil {
+		if version, _ = payloadVersion(b); version != payloadVersion0 {
+			prefix = append(prefix, version)
+			_, _ = r.Discard(1)
+		}
+	}
+
+	// ReadSlice fails with bufio.ErrBufferFull when the delimiter is not
+	// found within the buffer size, which bounds the prefix length.
+	algorithmB64, err := r.ReadSlice(encryptionAlgorithmDelimiter)
+	if err != nil {
+		return payloadHeader{}, errors.New("encrypted stream has a malformed algorithm prefix")
+	}
+	prefix = append(prefix, algorithmB64...)
+
+	if version == payloadVersion1 {
+		n, err := r.ReadByte()
+		if err != nil {
+			return payloadHeader{}, errors.New("malformed payload header")
+		}
+
+		fields := make([]byte, n)
+		if _, err := io.ReadFull(r, fields); err != nil {
+			return payloadHeader{}, errors.New("malformed payload header")
+		}
+
+		prefix = append(prefix, n)
+		prefix = append(prefix, fields...)
+	}
+
+	header, _, err := decodePayloadHeader(prefix)
+	if err != nil {
+		return payloadHeader{}, err
+	}
+
+	return header, nil
+}
@@ -0,0 +1,282 @@
+package service
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/json"
+	"io"
+	"testing"
+
+	"github.com/grafana/grafana/pkg/services/encryption"
+	"github.com/grafana/grafana/pkg/setting"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_Service_Stream(t *testing.T) {
+	ctx := context.Background()
+
+	svc := SetupTestService(t)
+
+	payload := make([]byte, 10*1024*1024)
+	_, err := rand.Read(payload)
+	require.NoError(t, err)
+
+	for _, algorithm := range []string{encryption.AesCfb, encryption.AesGcm, encryption.ChaCha20Poly1305} {
+		t.Run(algorithm, func(t *testing.T) {
+			setAlgorithm(t, svc, algorithm)
+
+			encrypted := &bytes.Buffer{}
+			err := svc.EncryptStream(ctx, encrypted, bytes.NewReader(payload), "1234")
+			require.NoError(t, err)
+			assert.True(t, bytes.HasPrefix(encrypted.Bytes(), encodeEncryptionAlgorithm(algorithm)))
+
+			decrypted := &bytes.Buffer{}
+			err = svc.DecryptStream(ctx, decrypted, bytes.NewReader(encrypted.Bytes()), "1234")
+			require.NoError(t, err)
+			assert.True(t, bytes.Equal(payload, decrypted.Bytes()))
+		})
+	}
+
+	t.Run("empty stream round-trip should work", func(t *testing.T) {
+		setAlgorithm(t, svc, encryption.AesGcm)
+
+		encrypted := &bytes.Buffer{}
+		err := svc.EncryptStream(ctx, encrypted, bytes.NewReader(nil), "1234")
+		require.NoError(t, err)
+
+		decrypted := &bytes.Buffer{}
+		err = svc.DecryptStream(ctx, decrypted, bytes.NewReader(encrypted.Bytes()), "1234")
+		require.NoError(t, err)
+		assert.Empty(t, decrypted.Bytes())
+	})
+
+	t.Run("truncated stream should fail", func(t *testing.T) {
+		setAlgorithm(t, svc, encryption.AesGcm)
+
+		encrypted := &bytes.Buffer{}
+		err := svc.EncryptStream(ctx, encrypted, bytes.NewReader(payload[:3*streamChunkSize]), "1234")
+		require.NoError(t, err)
+
+		// Drop the last frame, so the remaining
+		// frames are still valid on their own.
+		frameLen := streamFrameHeaderLen + (encrypted.Len()-len(encodeEncryptionAlgorithm(encryption.AesGcm))-streamIDLen)/3
+		truncated := encrypted.Bytes()[:encrypted.Len()-frameLen]
+
+		err = svc.DecryptStream(ctx, &bytes.Buffer{}, bytes.NewReader(truncated), "1234")
+		require.ErrorIs(t, err, errStreamTruncated)
+
+		// Cut in the middle of a frame.
+		truncated = encrypted.Bytes()[:encrypted.Len()-10]
+
+		err = svc.DecryptStream(ctx, &bytes.Buffer{}, bytes.NewReader(truncated), "1234")
+		require.ErrorIs(t, err, errStreamTruncated)
+	})
+
+	t.Run("cancelled context should abort the stream", func(t *testing.T) {
+		setAlgorithm(t, svc, encryption.AesGcm)
+
+		encrypted := &bytes.Buffer{}
+		err := svc.EncryptStream(ctx, encrypted, bytes.NewReader(payload[:3*streamChunkSize]), "1234")
+		require.NoError(t, err)
+
+		cancelledCtx, cancel := context.WithCancel(ctx)
+		cancel()
+
+		err = svc.EncryptStream(cancelledCtx, &bytes.Buffer{}, bytes.NewReader(payload), "1234")
+		require.ErrorIs(t, err, context.Canceled)
+
+		err = svc.DecryptStream(cancelledCtx, &bytes.Buffer{}, bytes.NewReader(encrypted.Bytes()), "1234")
+		require.ErrorIs(t, err, context.Canceled)
+	})
+
+	t.Run("context cancelled mid-stream should abort the stream", func(t *testing.T) {
+		setAlgorithm(t, svc, encryption.AesGcm)
+
+		cancelledCtx, cancel := context.WithCancel(ctx)
+		defer cancel()
+
+		// The writer cancels the context on the first frame written,
+		// so the stream must stop before processing the next chunk.
+		out := &cancellingWriter{cancel: cancel}
+		err := svc.EncryptStream(cancelledCtx, out, bytes.NewReader(payload), "1234")
+		require.ErrorIs(t, err, context.Canceled)
+		assert.Less(t, out.n, len(payload))
+	})
+
+	t.Run("tampered stream should fail", func(t *testing.T) {
+		setAlgorithm(t, svc, encryption.AesGcm)
+
+		encrypted := &bytes.Buffer{}
+		err := svc.EncryptStream(ctx, encrypted, bytes.NewReader(payload[:streamChunkSize]), "1234")
+		require.NoError(t, err)
+
+		tampered := encrypted.Bytes()
+		tampered[len(tampered)-1] ^= 0x01
+
+		err = svc.DecryptStream(ctx, &bytes.Buffer{}, bytes.NewReader(tampered), "1234")
+		require.ErrorIs(t, err, encryption.ErrAuthenticationFailed)
+	})
+
+	t.Run("frames spliced from another stream should fail", func(t *testing.T) {
+		setAlgorithm(t, svc, encryption.AesGcm)
+
+		first, second := &bytes.Buffer{}, &bytes.Buffer{}
+		require.NoError(t, svc.EncryptStream(ctx, first, bytes.NewReader(payload[:streamChunkSize]), "1234"))
+		require.NoError(t, svc.EncryptStream(ctx, second, bytes.NewReader(payload[streamChunkSize:2*streamChunkSize]), "1234"))
+
+		// The header and the id of the first stream,
+		// followed by the frame of the second one.
+		prefixLen := len(encodeEncryptionAlgorithm(encryption.AesGcm)) + streamIDLen
+		spliced := append(append([]byte{}, first.Bytes()[:prefixLen]...), second.Bytes()[prefixLen:]...)
+
+		err := svc.DecryptStream(ctx, &bytes.Buffer{}, bytes.NewReader(spliced), "1234")
+		require.ErrorIs(t, err, encryption.ErrAuthenticationFailed)
+	})
+
+	t.Run("stream header should record the same options as Encrypt", func(t *testing.T) {
+		setAlgorithm(t, svc, encryption.AesGcm)
+		section := svc.settingsProvider.(*setting.OSSImpl).Cfg.Raw.Section(securitySection)
+		keys := map[string]string{
+			kdfKey:                     kdfArgon2id,
+			kdfArgon2idMemoryKey:       "1024",
+			keyVersionsKey:             "v1",
+			keyVersionKeyPrefix + "v1": "key",
+			currentKeyVersionKey:       "v1",
+			keyCommitmentKey:           "true",
+		}
+		for key, value := range keys {
+			section.Key(key).SetValue(value)
+		}
+		t.Cleanup(func() {
+			for key := range keys {
+				section.DeleteKey(key)
+			}
+		})
+
+		encrypted := &bytes.Buffer{}
+		require.NoError(t, svc.EncryptStream(ctx, encrypted, bytes.NewReader(payload[:streamChunkSize+1]), "1234"))
+
+		header, err := readPayloadHeader(bufio.NewReader(bytes.NewReader(encrypted.Bytes())))
+		require.NoError(t, err)
+		assert.Equal(t, encryption.AesGcm, header.algorithm)
+		assert.NotNil(t, header.kdf)
+		assert.Equal(t, "v1", header.keyVersion)
+		assert.NotNil(t, header.commitment)
+
+		decrypted := &bytes.Buffer{}
+		require.NoError(t, svc.DecryptStream(ctx, decrypted, bytes.NewReader(encrypted.Bytes()), "1234"))
+		assert.True(t, bytes.Equal(payload[:streamChunkSize+1], decrypted.Bytes()))
+
+		// The commitment rejects the wrong secrets before any frame.
+		_, err = svc.DecryptReader(ctx, bytes.NewReader(encrypted.Bytes()), "4321")
+		require.ErrorIs(t, err, encryption.ErrAuthenticationFailed)
+	})
+}
+
+func Test_Service_DecryptReader(t *testing.T) {
+	ctx := context.Background()
+
+	svc := SetupTestService(t)
+	setAlgorithm(t, svc, encryption.AesGcm)
+
+	payload := make([]byte, 3*streamChunkSize+100)
+	_, err := rand.Read(payload)
+	require.NoError(t, err)
+
+	encrypted := &bytes.Buffer{}
+	err = svc.EncryptStream(ctx, encrypted, bytes.NewReader(payload), "1234")
+	require.NoError(t, err)
+
+	t.Run("reading the whole stream should work", func(t *testing.T) {
+		r, err := svc.DecryptReader(ctx, bytes.NewReader(encrypted.Bytes()), "1234")
+		require.NoError(t, err)
+
+		decrypted, err := io.ReadAll(r)
+		require.NoError(t, err)
+		assert.True(t, bytes.Equal(payload, decrypted))
+	})
+
+	t.Run("reading in small pieces should work", func(t *testing.T) {
+		r, err := svc.DecryptReader(ctx, bytes.NewReader(encrypted.Bytes()), "1234")
+		require.NoError(t, err)
+
+		decrypted := &bytes.Buffer{}
+		_, err = io.CopyBuffer(decrypted, struct{ io.Reader }{r}, make([]byte, 1000))
+		require.NoError(t, err)
+		assert.True(t, bytes.Equal(payload, decrypted.Bytes()))
+	})
+
+	t.Run("stream should be decodable on the fly", func(t *testing.T) {
+		doc := map[string]string{"user": "grafana", "password": "secret"}
+
+		plain := &bytes.Buffer{}
+		require.NoError(t, json.NewEncoder(plain).Encode(doc))
+
+		encrypted := &bytes.Buffer{}
+		require.NoError(t, svc.EncryptStream(ctx, encrypted, plain, "1234"))
+
+		r, err := svc.DecryptReader(ctx, encrypted, "1234")
+		require.NoError(t, err)
+
+		var decoded map[string]string
+		require.NoError(t, json.NewDecoder(r).Decode(&decoded))
+		assert.Equal(t, doc, decoded)
+	})
+
+	t.Run("truncated stream should fail at the end", func(t *testing.T) {
+		frameLen := streamFrameHeaderLen + streamChunkHeaderLen + streamChunkSize + encryption.SaltLength + 12 + 16
+		prefixLen := len(encodeEncryptionAlgorithm(encryption.AesGcm)) + streamIDLen
+
+		for _, n := range []int{prefixLen, prefixLen + frameLen, prefixLen + 2*frameLen + 10, encrypted.Len() - 1} {
+			r, err := svc.DecryptReader(ctx, bytes.NewReader(encrypted.Bytes()[:n]), "1234")
+			require.NoError(t, err)
+
+			decrypted, err := io.ReadAll(r)
+			require.ErrorIs(t, err, errStreamTruncated)
+
+			// Only the chunks fully verified are returned.
+			assert.Zero(t, len(decrypted)%streamChunkSize)
+			assert.True(t, bytes.Equal(payload[:len(decrypted)], decrypted))
+
+			// The error keeps being returned.
+			_, err = r.Read(make([]byte, 1))
+			require.ErrorIs(t, err, errStreamTruncated)
+		}
+	})
+
+	t.Run("stream truncated before its id should fail right away", func(t *testing.T) {
+		_, err := svc.DecryptReader(ctx, bytes.NewReader(encrypted.Bytes()[:len(encodeEncryptionAlgorithm(encryption.AesGcm))+1]), "1234")
+		require.ErrorIs(t, err, errStreamTruncated)
+	})
+
+	t.Run("tampered stream should not return unauthenticated plaintext", func(t *testing.T) {
+		tampered := append([]byte{}, encrypted.Bytes()...)
+		tampered[len(tampered)-10] ^= 0x01
+
+		r, err := svc.DecryptReader(ctx, bytes.NewReader(tampered), "1234")
+		require.NoError(t, err)
+
+		decrypted, err := io.ReadAll(r)
+		require.ErrorIs(t, err, encryption.ErrAuthenticationFailed)
+		assert.Len(t, decrypted, 3*streamChunkSize)
+	})
+
+	t.Run("unknown algorithm should fail right away", func(t *testing.T) {
+		_, err := svc.DecryptReader(ctx, bytes.NewReader(encodeEncryptionAlgorithm("unknown")), "1234")
+		require.ErrorIs(t, err, encryption.ErrUnknownAlgorithm)
+	})
+}
+
+type cancellingWriter struct {
+	cancel context.CancelFunc
+	n      int
+}
+
+func (w *cancellingWriter) Write(p []byte) (int, error) {
+	w.n += len(p)
+	w.cancel()
+	return len(p), nil
+}
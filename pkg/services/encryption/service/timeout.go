@@ -0,0 +1,45 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/grafana/grafana/pkg/services/encryption"
+	"github.com/grafana/grafana/pkg/setting"
+)
+
+// operationTimeoutKey bounds each operation of the remote ciphers and
+// deciphers (see encryption.Remote), e.g. those of key management services,
+// whose calls could otherwise hang indefinitely when the caller's context has
+// no deadline. The deadlines of the callers always take precedence, and the
+// local ciphers are never bounded. Disabled by default.
+const operationTimeoutKey = "operation_timeout"
+
+// operationTimeout returns the operation timeout configured in the given
+// section, zero when disabled.
+func operationTimeout(section setting.Section) (time.Duration, error) {
+	timeout := section.KeyValue(operationTimeoutKey).MustDuration(0)
+	if timeout < 0 {
+		return 0, fmt.Errorf("%s cannot be negative", operationTimeoutKey)
+	}
+
+	return timeout, nil
+}
+
+// withOperationTimeout returns a child of the given context bounded by the
+// operation timeout, when it's configured, the given cipher or decipher is
+// remote and the context has no deadline yet, or the context as it is
+// otherwise. The returned function must be called once the operation is done.
+func (s *Service) withOperationTimeout(ctx context.Context, c interface{}) (context.Context, context.CancelFunc) {
+	if _, ok := ctx.Deadline(); ok || !encryption.IsRemote(c) {
+		return ctx, func() {}
+	}
+
+	timeout, err := operationTimeout(s.securitySettings())
+	if err != nil || timeout == 0 {
+		return ctx, func() {}
+	}
+
+	return context.WithTimeout(ctx, timeout)
+}
@@ -0,0 +1,114 @@
+package service
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/grafana/grafana/pkg/setting"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_Service_OperationTimeout(t *testing.T) {
+	ctx := context.Background()
+
+	svc := SetupTestService(t)
+	settings := svc.settingsProvider.(*setting.OSSImpl)
+	section := settings.Cfg.Raw.Section(securitySection)
+
+	remote := &sleepingCipher{delay: time.Second, remote: true}
+	local := &sleepingCipher{delay: 50 * time.Millisecond}
+	require.NoError(t, svc.RegisterCipher("sleeping-remote", remote, remote))
+	require.NoError(t, svc.RegisterCipher("sleeping-local", local, local))
+
+	encryptWith := func(t *testing.T, algorithm string) []byte {
+		t.Helper()
+
+		setAlgorithm(t, svc, algorithm)
+
+		encrypted, err := svc.Encrypt(ctx, []byte("grafana"), "1234")
+		require.NoError(t, err)
+		return encrypted
+	}
+
+	// The payloads are encrypted before setting the timeout.
+	remoteEncrypted := encryptWith(t, "sleeping-remote")
+	localEncrypted := encryptWith(t, "sleeping-local")
+
+	section.Key(operationTimeoutKey).SetValue("10ms")
+	t.Cleanup(func() { section.DeleteKey(operationTimeoutKey) })
+
+	t.Run("remote operations should time out", func(t *testing.T) {
+		setAlgorithm(t, svc, "sleeping-remote")
+
+		start := time.Now()
+		_, err := svc.Encrypt(ctx, []byte("grafana"), "1234")
+		require.ErrorIs(t, err, context.DeadlineExceeded)
+
+		_, err = svc.Decrypt(ctx, remoteEncrypted, "1234")
+		require.ErrorIs(t, err, context.DeadlineExceeded)
+		assert.Less(t, time.Since(start), remote.delay)
+	})
+
+	t.Run("local operations should not time out", func(t *testing.T) {
+		decrypted, err := svc.Decrypt(ctx, localEncrypted, "1234")
+		require.NoError(t, err)
+		assert.Equal(t, []byte("grafana"), decrypted)
+	})
+
+	t.Run("caller deadlines should take precedence", func(t *testing.T) {
+		deadlineCtx, cancel := context.WithTimeout(ctx, 5*time.Second)
+		defer cancel()
+
+		fast := &sleepingCipher{delay: 50 * time.Millisecond, remote: true}
+		require.NoError(t, svc.RegisterCipher("sleeping-remote-fast", fast, fast))
+
+		setAlgorithm(t, svc, "sleeping-remote-fast")
+
+		encrypted, err := svc.Encrypt(deadlineCtx, []byte("grafana"), "1234")
+		require.NoError(t, err)
+
+		decrypted, err := svc.Decrypt(deadlineCtx, encrypted, "1234")
+		require.NoError(t, err)
+		assert.Equal(t, []byte("grafana"), decrypted)
+	})
+
+	t.Run("negative timeouts should be rejected", func(t *testing.T) {
+		section.Key(operationTimeoutKey).SetValue("-1s")
+		t.Cleanup(func() { section.Key(operationTimeoutKey).SetValue("10ms") })
+
+		require.EqualError(t, svc.Validate(settings.Section(securitySection)), "operation_timeout cannot be negative")
+	})
+}
+
+// sleepingCipher is a fakeCipher taking the given delay, unless the
+// context is done before, to encrypt and decrypt.
+type sleepingCipher struct {
+	delay  time.Duration
+	remote bool
+}
+
+func (c *sleepingCipher) Encrypt(ctx context.Context, payload []byte, _ string) ([]byte, error) {
+	return c.sleep(ctx, payload)
+}
+
+func (c *sleepingCipher) Decrypt(ctx context.Context, payload []byte, _ string) ([]byte, error) {
+	return c.sleep(ctx, payload)
+}
+
+func (c *sleepingCipher) IsRemote() bool {
+	return c.remote
+}
+
+func (c *sleepingCipher) sleep(ctx context.Context, payload []byte) ([]byte, error) {
+	timer := time.NewTimer(c.delay)
+	defer timer.Stop()
+
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case <-timer.C:
+		return reverse(payload), nil
+	}
+}
@@ -0,0 +1,132 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+
+	"github.com/grafana/grafana/pkg/services/encryption"
+)
+
+// The reasons decryption failures are counted by. They're coarse on purpose,
+// so they're suitable for alerting: authentication failures usually mean a
+// wrong secret or a tampered payload, while the others usually mean corrupted
+// or foreign data.
+const (
+	failureUnknownAlgorithm     = "unknown_algorithm"
+	failureAuthenticationFailed = "authentication_failed"
+	failureMalformedHeader      = "malformed_header"
+	failureOther                = "other"
+
+	// failureUnknownAlgorithmName replaces the algorithm in the counters
+	// when it's unknown or couldn't be decoded, so a crafted payload
+	// cannot create arbitrarily many counters.
+	failureUnknownAlgorithmName = "unknown"
+)
+
+// malformedPayloadError wraps the errors of payloads whose header
+// cannot be decoded, so they can be told apart from the others.
+type malformedPayloadError struct {
+	err error
+}
+
+func (e malformedPayloadError) Error() string {
+	return e.err.Error()
+}
+
+func (e malformedPayloadError) Unwrap() error {
+	return e.err
+}
+
+// countDecryptionFailure counts a decryption of a payload of the given
+// algorithm, if known, that failed with the given error. Cancellations
+// aren't counted, as they don't tell anything about the payload.
+func (s *Service) countDecryptionFailure(algorithm string, err error) {
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return
+	}
+
+	var (
+		reason    string
+		malformed malformedPayloadError
+	)
+	switch {
+	case errors.Is(err, encryption.ErrUnknownAlgorithm):
+		reason, algorithm = failureUnknownAlgorithm, ""
+	case errors.Is(err, encryption.ErrAuthenticationFailed):
+		reason = failureAuthenticationFailed
+	case errors.As(err, &malformed):
+		reason, algorithm = failureMalformedHeader, ""
+	default:
+		reason = failureOther
+	}
+
+	if algorithm == "" {
+		algorithm = failureUnknownAlgorithmName
+	}
+
+	s.decryptionFailuresCounter.inc(algorithm + "." + reason)
+}
+
+// The kinds of payloads legacy fallbacks are counted by: those without the
+// algorithm prefix, decrypted as legacy AesCfb ones, and those starting with
+// the delimiter but without a valid header. The latter aren't decrypted, as
+// legacy payloads always start with their alphanumeric salt, but they're the
+// ones older versions used to take for legacy ones too, so both must be gone
+// before the legacy path can be removed.
+const (
+	legacyFallbackUnprefixed      = "unprefixed"
+	legacyFallbackMalformedPrefix = "malformed_prefix"
+)
+
+// countLegacyFallback counts a payload of the given kind decoded on decryption.
+func (s *Service) countLegacyFallback(kind string) {
+	s.legacyFallbacksCounter.inc(kind)
+}
+
+// usageCounter is a set of named counters safe for concurrent use.
+// Counters are created on first increment, so only the names that
+// have been observed are reported.
+type usageCounter struct {
+	mtx    sync.RWMutex
+	counts map[string]*int64
+}
+
+func newUsageCounter() *usageCounter {
+	return &usageCounter{counts: make(map[string]*int64)}
+}
+
+func (c *usageCounter) inc(name string) {
+	c.mtx.RLock()
+	count, ok := c.counts[name]
+	c.mtx.RUnlock()
+
+	if !ok {
+		c.mtx.Lock()
+		if count, ok = c.counts[name]; !ok {
+			count = new(int64)
+			c.counts[name] = count
+		}
+		c.mtx.Unlock()
+	}
+
+	atomic.AddInt64(count, 1)
+}
+
+func (c *usageCounter) snapshot() map[string]int64 {
+	c.mtx.RLock()
+	defer c.mtx.RUnlock()
+
+	snapshot := make(map[string]int64, len(c.counts))
+	for name, count := range c.counts {
+		snapshot[name] = atomic.LoadInt64(count)
+	}
+	return snapshot
+}
+
+func (c *usageCounter) reset() {
+	c.mtx.Lock()
+	c.counts = make(map[string]*int64)
+	c.mtx.Unlock()
+}
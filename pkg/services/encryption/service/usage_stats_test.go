@@ -0,0 +1,193 @@
+package service
+
+import (
+	"context"
+	"sync"
+	"testing"
+
+	"github.com/grafana/grafana/pkg/infra/usagestats"
+	"github.com/grafana/grafana/pkg/services/encryption"
+	"github.com/grafana/grafana/pkg/setting"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_Service_DecryptionsUsageStats(t *testing.T) {
+	ctx := context.Background()
+
+	svc := SetupTestService(t)
+	usageStats := svc.usageMetrics.(*usagestats.UsageStatsMock)
+
+	setAlgorithm(t, svc, encryption.AesCfb)
+	cfbEncrypted, err := svc.Encrypt(ctx, []byte("grafana"), "1234")
+	require.NoError(t, err)
+
+	setAlgorithm(t, svc, encryption.AesGcm)
+	gcmEncrypted, err := svc.Encrypt(ctx, []byte("grafana"), "1234")
+	require.NoError(t, err)
+
+	for _, payload := range [][]byte{cfbEncrypted, cfbEncrypted, gcmEncrypted} {
+		_, err := svc.Decrypt(ctx, payload, "1234")
+		require.NoError(t, err)
+	}
+
+	_, err = svc.Decrypt(ctx, append(encodeEncryptionAlgorithm("unknown"), []byte("grafana")...), "1234")
+	require.Error(t, err)
+
+	report, err := usageStats.GetUsageReport(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, int64(2), report.Metrics["stats.encryption.decrypt.aes-cfb.count"])
+	assert.Equal(t, int64(1), report.Metrics["stats.encryption.decrypt.aes-gcm.count"])
+	assert.NotContains(t, report.Metrics, "stats.encryption.decrypt.unknown.count")
+
+	svc.decryptionsCounter.reset()
+
+	report, err = usageStats.GetUsageReport(ctx)
+	require.NoError(t, err)
+	assert.NotContains(t, report.Metrics, "stats.encryption.decrypt.aes-cfb.count")
+	assert.NotContains(t, report.Metrics, "stats.encryption.decrypt.aes-gcm.count")
+}
+
+func Test_Service_DecryptionFailuresUsageStats(t *testing.T) {
+	ctx := context.Background()
+
+	svc := SetupTestService(t)
+	usageStats := svc.usageMetrics.(*usagestats.UsageStatsMock)
+
+	setAlgorithm(t, svc, encryption.AesGcm)
+	encrypted, err := svc.Encrypt(ctx, []byte("grafana"), "1234")
+	require.NoError(t, err)
+
+	report, err := usageStats.GetUsageReport(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, int64(0), report.Metrics["stats.encryption.decrypt.failure.count"])
+
+	_, err = svc.Decrypt(ctx, encrypted, "4321")
+	require.ErrorIs(t, err, encryption.ErrAuthenticationFailed)
+
+	_, err = svc.DecryptSlice(ctx, [][]byte{encrypted, encrypted}, "4321")
+	require.ErrorIs(t, err, encryption.ErrAuthenticationFailed)
+
+	_, err = svc.Decrypt(ctx, append(encodeEncryptionAlgorithm("unknown-algorithm"), []byte("grafana")...), "1234")
+	require.ErrorIs(t, err, encryption.ErrUnknownAlgorithm)
+
+	_, err = svc.Decrypt(ctx, []byte("*YWVzLWdjbQ"), "1234")
+	require.Error(t, err)
+
+	assert.Equal(t, "fallback", svc.GetDecryptedValue(ctx, map[string][]byte{"password": []byte("*\x01YWVzLWdjbQ*")}, "password", "fallback", "1234"))
+
+	cancelledCtx, cancel := context.WithCancel(ctx)
+	cancel()
+	_, err = svc.Decrypt(cancelledCtx, encrypted, "1234")
+	require.ErrorIs(t, err, context.Canceled)
+
+	report, err = usageStats.GetUsageReport(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, int64(5), report.Metrics["stats.encryption.decrypt.failure.count"])
+	assert.Equal(t, int64(2), report.Metrics["stats.encryption.decrypt.failure.aes-gcm.authentication_failed.count"])
+	assert.Equal(t, int64(1), report.Metrics["stats.encryption.decrypt.failure.unknown.unknown_algorithm.count"])
+	assert.Equal(t, int64(2), report.Metrics["stats.encryption.decrypt.failure.unknown.malformed_header.count"])
+
+	svc.decryptionFailuresCounter.reset()
+
+	report, err = usageStats.GetUsageReport(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, int64(0), report.Metrics["stats.encryption.decrypt.failure.count"])
+	assert.NotContains(t, report.Metrics, "stats.encryption.decrypt.failure.aes-gcm.authentication_failed.count")
+}
+
+func Test_usageCounter(t *testing.T) {
+	counter := newUsageCounter()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				counter.inc("a")
+				counter.inc("b")
+				_ = counter.snapshot()
+			}
+		}()
+	}
+	wg.Wait()
+
+	assert.Equal(t, map[string]int64{"a": 1000, "b": 1000}, counter.snapshot())
+
+	counter.reset()
+	assert.Empty(t, counter.snapshot())
+}
+
+func Test_Service_LegacyFallbacksUsageStats(t *testing.T) {
+	ctx := context.Background()
+
+	svc := SetupTestService(t)
+	settings := svc.settingsProvider.(*setting.OSSImpl)
+	usageStats := svc.usageMetrics.(*usagestats.UsageStatsMock)
+
+	setAlgorithm(t, svc, encryption.AesCfb)
+	cfbEncrypted, err := svc.Encrypt(ctx, []byte("grafana"), "1234")
+	require.NoError(t, err)
+
+	_, unprefixed, err := deriveEncryptionAlgorithm(cfbEncrypted)
+	require.NoError(t, err)
+
+	report, err := usageStats.GetUsageReport(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, int64(0), report.Metrics["stats.encryption.legacy_fallback.count"])
+
+	t.Run("prefixed payloads should not be counted", func(t *testing.T) {
+		_, err := svc.Decrypt(ctx, cfbEncrypted, "1234")
+		require.NoError(t, err)
+
+		report, err := usageStats.GetUsageReport(ctx)
+		require.NoError(t, err)
+		assert.Equal(t, int64(0), report.Metrics["stats.encryption.legacy_fallback.count"])
+	})
+
+	t.Run("unprefixed payloads should be counted", func(t *testing.T) {
+		decrypted, err := svc.Decrypt(ctx, unprefixed, "1234")
+		require.NoError(t, err)
+		assert.Equal(t, []byte("grafana"), decrypted)
+
+		_, err = svc.DecryptWithSecrets(ctx, unprefixed, []string{"1234"})
+		require.NoError(t, err)
+
+		report, err := usageStats.GetUsageReport(ctx)
+		require.NoError(t, err)
+		assert.Equal(t, int64(2), report.Metrics["stats.encryption.legacy_fallback.unprefixed.count"])
+		assert.Equal(t, int64(2), report.Metrics["stats.encryption.legacy_fallback.count"])
+	})
+
+	t.Run("malformed prefixes should be counted", func(t *testing.T) {
+		_, err := svc.Decrypt(ctx, []byte("*YWVzLWdjbQ"), "1234")
+		require.Error(t, err)
+
+		report, err := usageStats.GetUsageReport(ctx)
+		require.NoError(t, err)
+		assert.Equal(t, int64(1), report.Metrics["stats.encryption.legacy_fallback.malformed_prefix.count"])
+		assert.Equal(t, int64(2), report.Metrics["stats.encryption.legacy_fallback.unprefixed.count"])
+		assert.Equal(t, int64(3), report.Metrics["stats.encryption.legacy_fallback.count"])
+	})
+
+	t.Run("rejected unprefixed payloads should not be counted", func(t *testing.T) {
+		section := settings.Cfg.Raw.Section(securitySection)
+		section.Key(allowLegacyUnprefixedKey).SetValue("false")
+		t.Cleanup(func() { section.DeleteKey(allowLegacyUnprefixedKey) })
+
+		_, err := svc.Decrypt(ctx, unprefixed, "1234")
+		require.Error(t, err)
+
+		report, err := usageStats.GetUsageReport(ctx)
+		require.NoError(t, err)
+		assert.Equal(t, int64(2), report.Metrics["stats.encryption.legacy_fallback.unprefixed.count"])
+	})
+
+	svc.legacyFallbacksCounter.reset()
+
+	report, err = usageStats.GetUsageReport(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, int64(0), report.Metrics["stats.encryption.legacy_fallback.count"])
+	assert.NotContains(t, report.Metrics, "stats.encryption.legacy_fallback.unprefixed.count")
+}
@@ -0,0 +1,51 @@
+package service
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/grafana/grafana/pkg/services/encryption"
+)
+
+// warmupKey enables the warmup of the cipher and decipher of the configured
+// algorithm on startup (see Warmup), so the service fails to initialize when,
+// e.g., the credentials of a key management service are wrong.
+const warmupKey = "warmup"
+
+// Warmup checks that the cipher and decipher of the configured algorithm are
+// able to operate, when they implement encryption.Warmable, e.g. that the
+// key management service they call is reachable and authorizes them. Those
+// of the other algorithms aren't, as they may not be configured at all, if
+// only kept to decrypt older payloads. Each check is bounded by the operation
+// timeout when the context has no deadline (see operationTimeoutKey).
+func (s *Service) Warmup(ctx context.Context) error {
+	algorithm := s.CurrentAlgorithm()
+
+	var targets []interface{}
+	if cipher, ok := s.cipher(algorithm); ok {
+		targets = append(targets, cipher)
+	}
+	if decipher, ok := s.decipher(algorithm); ok {
+		targets = append(targets, decipher)
+	}
+
+	for _, target := range targets {
+		warmable, ok := target.(encryption.Warmable)
+		if !ok {
+			continue
+		}
+
+		if err := s.warmup(ctx, warmable); err != nil {
+			return fmt.Errorf("failed to warm up algorithm '%s': %w", algorithm, err)
+		}
+	}
+
+	return nil
+}
+
+func (s *Service) warmup(ctx context.Context, warmable encryption.Warmable) error {
+	ctx, cancel := s.withOperationTimeout(ctx, warmable)
+	defer cancel()
+
+	return warmable.Warmup(ctx)
+}
@@ -0,0 +1,100 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/grafana/grafana/pkg/infra/usagestats"
+	"github.com/grafana/grafana/pkg/services/encryption"
+	"github.com/grafana/grafana/pkg/services/encryption/provider"
+	"github.com/grafana/grafana/pkg/setting"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_Service_Warmup(t *testing.T) {
+	errUnauthorized := errors.New("unauthorized")
+
+	newService := func(t *testing.T, cipher *warmableCipher, warmup bool) (*Service, error) {
+		t.Helper()
+
+		settings := &setting.OSSImpl{Cfg: setting.NewCfg()}
+		section := settings.Cfg.Raw.Section(securitySection)
+		section.Key(skipSelfTestKey).SetValue("true")
+		section.Key(encryptionAlgorithmKey).SetValue("warmable")
+		if warmup {
+			section.Key(warmupKey).SetValue("true")
+		}
+
+		encProvider := warmableProvider{Provider: provider.Provider{}, cipher: cipher}
+		return ProvideEncryptionService(encProvider, &usagestats.UsageStatsMock{T: t}, settings)
+	}
+
+	t.Run("failing warmup should fail the initialization", func(t *testing.T) {
+		cipher := &warmableCipher{err: errUnauthorized}
+
+		_, err := newService(t, cipher, true)
+		require.ErrorIs(t, err, errUnauthorized)
+		assert.Equal(t, 1, cipher.warmups)
+	})
+
+	t.Run("successful warmup should warm up the cipher and decipher", func(t *testing.T) {
+		cipher := &warmableCipher{}
+
+		_, err := newService(t, cipher, true)
+		require.NoError(t, err)
+		assert.Equal(t, 2, cipher.warmups)
+	})
+
+	t.Run("disabled warmup should not warm up", func(t *testing.T) {
+		cipher := &warmableCipher{err: errUnauthorized}
+
+		svc, err := newService(t, cipher, false)
+		require.NoError(t, err)
+		assert.Equal(t, 0, cipher.warmups)
+
+		err = svc.Warmup(context.Background())
+		require.ErrorIs(t, err, errUnauthorized)
+		assert.EqualError(t, err, "failed to warm up algorithm 'warmable': unauthorized")
+	})
+
+	t.Run("ciphers that are not warmable should be skipped", func(t *testing.T) {
+		svc := SetupTestService(t)
+		require.NoError(t, svc.Warmup(context.Background()))
+	})
+}
+
+// warmableProvider adds a warmable algorithm, whose
+// cipher and decipher are the given warmableCipher.
+type warmableProvider struct {
+	encryption.Provider
+	cipher *warmableCipher
+}
+
+func (p warmableProvider) ProvideCiphers() map[string]encryption.Cipher {
+	ciphers := p.Provider.ProvideCiphers()
+	ciphers["warmable"] = p.cipher
+	return ciphers
+}
+
+func (p warmableProvider) ProvideDeciphers() map[string]encryption.Decipher {
+	deciphers := p.Provider.ProvideDeciphers()
+	deciphers["warmable"] = p.cipher
+	return deciphers
+}
+
+// warmableCipher is a fakeCipher whose warmups
+// are counted, and fail with the given error.
+type warmableCipher struct {
+	fakeCipher
+	fakeDecipher
+
+	err     error
+	warmups int
+}
+
+func (c *warmableCipher) Warmup(context.Context) error {
+	c.warmups++
+	return c.err
+}
@@ -76,6 +76,9 @@ type KeyValue interface {
 	// MustDuration returns the value's time.Duration
 	// representation. Otherwise returns the given default.
 	MustDuration(defaultVal time.Duration) time.Duration
+	// MustInt returns the value's integer representation
+	// Otherwise returns the given default.
+	MustInt(defaultVal int) int
 }
 
 // ReloadHandler defines the expected behaviour from a
@@ -157,6 +160,10 @@ func (k *keyValImpl) MustDuration(defaultVal time.Duration) time.Duration {
 	return k.key.MustDuration(defaultVal)
 }
 
+func (k *keyValImpl) MustInt(defaultVal int) int {
+	return k.key.MustInt(defaultVal)
+}
+
 type sectionImpl struct {
 	section *ini.Section
 }